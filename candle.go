@@ -0,0 +1,339 @@
+package igmarkets
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CandlePrice - open, high, low and close of one side of a candle
+type CandlePrice struct {
+	Open  float64 `json:"open"`
+	High  float64 `json:"high"`
+	Low   float64 `json:"low"`
+	Close float64 `json:"close"`
+}
+
+// Candle - OHLC bar of an epic between Start and End, built from the price
+// history (see PriceResponse.Candles) or from the stream (see OpenCandleStream)
+type Candle struct {
+	Epic       string      `json:"epic"`
+	Start      time.Time   `json:"start"`
+	End        time.Time   `json:"end"`
+	Bid        CandlePrice `json:"bid"`
+	Offer      CandlePrice `json:"offer"`
+	Mid        CandlePrice `json:"mid"`
+	LastTraded CandlePrice `json:"lastTraded"`
+	Volume     float64     `json:"volume"`
+	Ticks      int         `json:"ticks"`
+	Complete   bool        `json:"complete"`      // false for in-progress updates
+	Gap        bool        `json:"gap,omitempty"` // updates of the candle may have been missed
+}
+
+// midPrice - average of bid and offer
+func midPrice(bid, offer CandlePrice) CandlePrice {
+	return CandlePrice{
+		Open:  (bid.Open + offer.Open) / 2,
+		High:  (bid.High + offer.High) / 2,
+		Low:   (bid.Low + offer.Low) / 2,
+		Close: (bid.Close + offer.Close) / 2,
+	}
+}
+
+// CandleFromChartTick - running candle carried by a CHART tick of interval,
+// complete when the tick ends the candle
+func CandleFromChartTick(tick LightStreamChartTick, interval time.Duration) Candle {
+	var start time.Time
+	if tick.UTM != nil {
+		start = tick.UTM.Truncate(interval)
+	}
+
+	c := Candle{
+		Epic:       tick.EPIC,
+		Start:      start,
+		End:        start.Add(interval),
+		Bid:        CandlePrice{Open: tick.BID_OPEN, High: tick.BID_HIGH, Low: tick.BID_LOW, Close: tick.BID_CLOSE},
+		Offer:      CandlePrice{Open: tick.OFR_OPEN, High: tick.OFR_HIGH, Low: tick.OFR_LOW, Close: tick.OFR_CLOSE},
+		LastTraded: CandlePrice{Open: tick.LTP_OPEN, High: tick.LTP_HIGH, Low: tick.LTP_LOW, Close: tick.LTP_CLOSE},
+		Volume:     tick.TTV,
+		Ticks:      int(tick.CONS_TICK_COUNT),
+		Complete:   tick.CONS_END == 1,
+		Gap:        tick.Lost > 0,
+	}
+	c.Mid = midPrice(c.Bid, c.Offer)
+
+	return c
+}
+
+// CandleFromMarketPrice - candle of a price history entry at resolution
+// The last entry of a history may be the running bar, see Candle.End.
+func CandleFromMarketPrice(epic string, p MarketPrice, resolution string) (Candle, error) {
+	start, err := time.ParseInLocation("2006-01-02T15:04:05", p.SnapshotTimeUTC, time.UTC)
+	if err != nil {
+		return Candle{}, fmt.Errorf("igmarkets: unable to parse snapshot time: %v", err)
+	}
+
+	var end time.Time
+	switch resolution {
+	case ResolutionWeek:
+		end = start.AddDate(0, 0, 7)
+	case ResolutionMonth:
+		end = start.AddDate(0, 1, 0)
+	default:
+		d, err := ResolutionDuration(resolution)
+		if err != nil {
+			return Candle{}, err
+		}
+		end = start.Add(d)
+	}
+
+	price := func(open, high, low, close float64) CandlePrice {
+		return CandlePrice{Open: open, High: high, Low: low, Close: close}
+	}
+
+	c := Candle{
+		Epic:       epic,
+		Start:      start,
+		End:        end,
+		Bid:        price(p.OpenPrice.Bid, p.HighPrice.Bid, p.LowPrice.Bid, p.ClosePrice.Bid),
+		Offer:      price(p.OpenPrice.Ask, p.HighPrice.Ask, p.LowPrice.Ask, p.ClosePrice.Ask),
+		LastTraded: price(p.OpenPrice.LastTraded, p.HighPrice.LastTraded, p.LowPrice.LastTraded, p.ClosePrice.LastTraded),
+		Volume:     float64(p.LastTradedVolume),
+		Complete:   true,
+	}
+	c.Mid = midPrice(c.Bid, c.Offer)
+
+	return c, nil
+}
+
+// Candles - prices of epic as candles of resolution, bars not ended at the
+// time of the call are not Complete
+func (r *PriceResponse) Candles(epic, resolution string) ([]Candle, error) {
+	now := time.Now()
+
+	candles := make([]Candle, 0, len(r.Prices))
+	for _, p := range r.Prices {
+		c, err := CandleFromMarketPrice(epic, p, resolution)
+		if err != nil {
+			return nil, err
+		}
+		c.Complete = !c.End.After(now)
+		candles = append(candles, c)
+	}
+
+	return candles, nil
+}
+
+// ATR - average true range of the mid prices of the last period candles
+// One more candle than period is needed for the first true range.
+func ATR(candles []Candle, period int) (float64, error) {
+	if period <= 0 || len(candles) < period+1 {
+		return 0, fmt.Errorf("igmarkets: ATR over %d candles needs %d candles, got %d", period, period+1, len(candles))
+	}
+
+	var sum float64
+	for i := len(candles) - period; i < len(candles); i++ {
+		prevClose, c := candles[i-1].Mid.Close, candles[i].Mid
+		tr := c.High - c.Low
+		if d := c.High - prevClose; d > tr {
+			tr = d
+		}
+		if d := prevClose - c.Low; d > tr {
+			tr = d
+		}
+		sum += tr
+	}
+
+	return sum / float64(period), nil
+}
+
+// ChartIntervalDuration - duration of a CHART subscription interval
+func ChartIntervalDuration(interval string) (time.Duration, error) {
+	switch interval {
+	case "SECOND":
+		return time.Second, nil
+	case "1MINUTE":
+		return time.Minute, nil
+	case "5MINUTE":
+		return 5 * time.Minute, nil
+	case "HOUR":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("igmarkets: unsupported chart interval %q", interval)
+}
+
+// candleFields - CHART fields needed to build candles
+var candleFields = []string{
+	"UTM", "LTV", "TTV",
+	"OFR_OPEN", "OFR_HIGH", "OFR_LOW", "OFR_CLOSE",
+	"BID_OPEN", "BID_HIGH", "BID_LOW", "BID_CLOSE",
+	"LTP_OPEN", "LTP_HIGH", "LTP_LOW", "LTP_CLOSE",
+	"CONS_END", "CONS_TICK_COUNT",
+}
+
+// ChartCandleBuilder - turns CHART ticks into candles
+// Every tick carries the state of the running candle, the candle is complete
+// once a tick has CONS_END=1. When the end update is missed, e.g. during a
+// reconnection, the candle is completed by the first tick of the next one and
+// flagged as Gap. It is safe for concurrent use.
+type ChartCandleBuilder struct {
+	Interval   time.Duration
+	InProgress bool // also return the running candle on every tick
+
+	mu    sync.Mutex
+	epics map[string]*candleState
+}
+
+type candleState struct {
+	current *Candle
+	lastEnd time.Time // End of the last complete candle
+	volume  float64   // sum of LTV, used without TTV
+	traded  time.Time // UTM of the last LTV added to volume
+	gap     bool      // reconnected since the last tick
+}
+
+// NewChartCandleBuilder - builder for CHART ticks of the given interval
+func NewChartCandleBuilder(interval time.Duration, inProgress bool) *ChartCandleBuilder {
+	return &ChartCandleBuilder{
+		Interval:   interval,
+		InProgress: inProgress,
+		epics:      make(map[string]*candleState),
+	}
+}
+
+// Reconnected - ticks may have been missed, running candles are flagged as Gap
+func (b *ChartCandleBuilder) Reconnected() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, st := range b.epics {
+		st.gap = true
+		if st.current != nil {
+			st.current.Gap = true
+		}
+	}
+}
+
+// Add - candles completed or updated by tick, in time order
+func (b *ChartCandleBuilder) Add(tick LightStreamChartTick) []Candle {
+	if tick.UTM == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.epics[tick.EPIC]
+	if !ok {
+		st = &candleState{}
+		b.epics[tick.EPIC] = st
+	}
+
+	start := tick.UTM.Truncate(b.Interval)
+
+	// candle already completed, e.g. sent again in the snapshot after a reconnection
+	if !st.lastEnd.IsZero() && start.Before(st.lastEnd) {
+		return nil
+	}
+
+	var candles []Candle
+
+	if st.current != nil && !st.current.Start.Equal(start) {
+		st.current.Complete = true
+		st.current.Gap = true
+		candles = append(candles, *st.current)
+		st.lastEnd = st.current.End
+		st.current = nil
+	}
+
+	if st.current == nil {
+		st.current = &Candle{Epic: tick.EPIC, Start: start, End: start.Add(b.Interval)}
+		st.current.Gap = st.gap && !st.lastEnd.IsZero() && start.After(st.lastEnd)
+		st.volume = 0
+	}
+	st.gap = false
+
+	c := st.current
+	update := CandleFromChartTick(tick, b.Interval)
+	c.Bid, c.Offer, c.Mid, c.LastTraded = update.Bid, update.Offer, update.Mid, update.LastTraded
+	c.Ticks = update.Ticks
+	c.Gap = c.Gap || update.Gap
+
+	// MERGE mode leaves out an LTV equal to the previous one, a new UTM is
+	// a new trade all the same
+	if tick.Present.Has(ChartTickTTV) {
+		c.Volume = tick.TTV
+	} else if tick.Present.Has(ChartTickLTV) && (tick.Changed.Has(ChartTickLTV) || !tick.UTM.Equal(st.traded)) {
+		st.volume += tick.LTV
+		st.traded = *tick.UTM
+		c.Volume = st.volume
+	}
+
+	if update.Complete {
+		c.Complete = true
+		candles = append(candles, *c)
+		st.lastEnd = c.End
+		st.current = nil
+	} else if b.InProgress {
+		candles = append(candles, *c)
+	}
+
+	return candles
+}
+
+// CandleStreamOptions - options of OpenCandleStream
+// Fields, SubType and Mode of LightStreamOptions are set by the stream.
+type CandleStreamOptions struct {
+	LightStreamOptions
+
+	// InProgress - also deliver the running candle on every update, with
+	// Complete set to false
+	InProgress bool
+}
+
+// OpenCandleStream - complete candles of o.Epics at o.Interval (SECOND,
+// 1MINUTE, 5MINUTE or HOUR) built from a CHART subscription
+func (ig *IGMarkets) OpenCandleStream(ctx context.Context, o CandleStreamOptions) (<-chan Candle, <-chan error, error) {
+	interval, err := ChartIntervalDuration(o.Interval)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	builder := NewChartCandleBuilder(interval, o.InProgress)
+
+	lo := o.LightStreamOptions
+	lo.Fields = candleFields
+	lo.SubType = "CHART"
+	lo.Mode = "MERGE"
+	lo.OnStateChange = func(e StreamStateEvent) {
+		if e.State == StreamReconnecting {
+			builder.Reconnected()
+		}
+		if o.OnStateChange != nil {
+			o.OnStateChange(e)
+		}
+	}
+
+	ticks, errs, err := ig.OpenLightStreamerSubscription(ctx, lo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candleChan := make(chan Candle)
+
+	go func() {
+		defer close(candleChan)
+
+		for tick := range ticks {
+			for _, c := range builder.Add(tick) {
+				select {
+				case candleChan <- c:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}()
+
+	return candleChan, errs, nil
+}
@@ -0,0 +1,398 @@
+package igmarkets
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ResolutionDuration - bar length of an intraday or daily resolution
+// WEEK and MONTH bars do not have a fixed length, see CandleAggregator.
+func ResolutionDuration(resolution string) (time.Duration, error) {
+	switch resolution {
+	case ResolutionSecond:
+		return time.Second, nil
+	case ResolutionMinute:
+		return time.Minute, nil
+	case "MINUTE_2":
+		return 2 * time.Minute, nil
+	case "MINUTE_3":
+		return 3 * time.Minute, nil
+	case ResolutionFiveMinute:
+		return 5 * time.Minute, nil
+	case "MINUTE_10":
+		return 10 * time.Minute, nil
+	case ResolutionFifteenMinute:
+		return 15 * time.Minute, nil
+	case ResolutionThirtyMinute:
+		return 30 * time.Minute, nil
+	case ResolutionHour:
+		return time.Hour, nil
+	case ResolutionTwoHour:
+		return 2 * time.Hour, nil
+	case ResolutionThreeHour:
+		return 3 * time.Hour, nil
+	case ResolutionFourHour:
+		return 4 * time.Hour, nil
+	case ResolutionDay:
+		return 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("igmarkets: resolution %q has no fixed duration", resolution)
+}
+
+// CandleAggregator - builds candles of any resolution from smaller candles or
+// prices, per epic
+//
+// Bars are aligned on the daily session start in Location: a bar never spans
+// two sessions, the last bar of a session is shortened when Duration does not
+// divide the day. Bars longer than a day are counted from the first session of
+// the week of 5 January 1970. Bars are only produced for periods with data, market closures
+// such as weekends leave no empty bars. It is safe for concurrent use.
+type CandleAggregator struct {
+	// Resolution - ResolutionWeek or ResolutionMonth for calendar bars,
+	// Duration is used otherwise
+	Resolution string
+	Duration   time.Duration
+
+	Location     *time.Location // Time zone of the sessions, UTC when nil
+	SessionStart time.Duration  // Session start from midnight, e.g. 22h for FX in UTC
+	WeekStart    time.Weekday   // First session of WEEK bars
+
+	// InProgress - also return the running bar on every update
+	InProgress bool
+
+	mu    sync.Mutex
+	epics map[string]*aggregatorState
+}
+
+type aggregatorState struct {
+	bar     *Candle   // merge of the complete inputs of the running bar
+	merged  bool      // bar holds at least one complete input
+	partial *Candle   // last incomplete input
+	lastEnd time.Time // End of the last complete bar
+	covered time.Time // inputs ending before are already in bar, see seed
+}
+
+// NewCandleAggregator - aggregator for a Resolution* constant
+func NewCandleAggregator(resolution string) (*CandleAggregator, error) {
+	if resolution == ResolutionWeek || resolution == ResolutionMonth {
+		return &CandleAggregator{Resolution: resolution, WeekStart: time.Monday}, nil
+	}
+
+	d, err := ResolutionDuration(resolution)
+	if err != nil {
+		return nil, err
+	}
+	return NewDurationAggregator(d), nil
+}
+
+// NewDurationAggregator - aggregator for bars of any duration, e.g. 3 minutes
+func NewDurationAggregator(d time.Duration) *CandleAggregator {
+	return &CandleAggregator{Duration: d, WeekStart: time.Monday}
+}
+
+func (a *CandleAggregator) location() *time.Location {
+	if a.Location == nil {
+		return time.UTC
+	}
+	return a.Location
+}
+
+// sessionStart - start of the session t belongs to
+func (a *CandleAggregator) sessionStart(t time.Time) time.Time {
+	lt := t.In(a.location())
+	// wall clock offset, the session starts at the same local time across DST changes
+	start := time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, int(a.SessionStart), a.location())
+	for start.After(lt) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+// Bounds - start and end of the bar t belongs to
+func (a *CandleAggregator) Bounds(t time.Time) (time.Time, time.Time) {
+	session := a.sessionStart(t)
+
+	switch a.Resolution {
+	case ResolutionWeek:
+		days := (int(session.Weekday()) - int(a.WeekStart) + 7) % 7
+		start := session.AddDate(0, 0, -days)
+		return start, start.AddDate(0, 0, 7)
+	case ResolutionMonth:
+		start := session.AddDate(0, 0, 1-session.Day())
+		return start, start.AddDate(0, 1, 0)
+	}
+
+	if a.Duration > 24*time.Hour {
+		// counted from the first session of a week in Location, floored for
+		// the times before it
+		origin := a.sessionStart(time.Date(1970, 1, 5, 12, 0, 0, 0, a.location()))
+		n := t.Sub(origin) / a.Duration
+		if t.Before(origin.Add(n * a.Duration)) {
+			n--
+		}
+		start := origin.Add(n * a.Duration)
+		return start, start.Add(a.Duration)
+	}
+
+	start := session.Add(t.Sub(session) / a.Duration * a.Duration)
+	end := start.Add(a.Duration)
+	if next := session.AddDate(0, 0, 1); end.After(next) {
+		end = next
+	}
+	return start, end
+}
+
+// AddCandle - add a candle of a smaller resolution, Duration must be a
+// multiple of it. Incomplete candles replace each other until the complete one
+// is added. Bars completed by c are returned, followed by the running bar with
+// InProgress.
+func (a *CandleAggregator) AddCandle(c Candle) []Candle {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.epics == nil {
+		a.epics = make(map[string]*aggregatorState)
+	}
+	st, ok := a.epics[c.Epic]
+	if !ok {
+		st = &aggregatorState{}
+		a.epics[c.Epic] = st
+	}
+
+	start, end := a.Bounds(c.Start)
+
+	if start.Before(st.lastEnd) || (st.bar != nil && start.Before(st.bar.Start)) || !c.End.After(st.covered) {
+		log.Debugf("igmarkets : ignoring late candle %s of %s", c.Start, c.Epic)
+		return nil
+	}
+
+	var candles []Candle
+
+	if st.bar != nil && start.After(st.bar.Start) {
+		candles = append(candles, st.complete())
+	}
+
+	if st.bar == nil {
+		st.bar = &Candle{Epic: c.Epic, Start: start, End: end}
+	}
+
+	// the input completing the partial one was missed
+	if st.partial != nil && c.Start.After(st.partial.Start) {
+		st.partial.Gap = true
+		mergeCandle(st.bar, *st.partial, !st.merged)
+		st.merged = true
+		st.partial = nil
+	}
+
+	if c.Complete {
+		mergeCandle(st.bar, c, !st.merged)
+		st.merged = true
+		st.partial = nil
+	} else {
+		partial := c
+		st.partial = &partial
+	}
+
+	if c.Complete && !c.End.Before(st.bar.End) {
+		candles = append(candles, st.complete())
+	} else if a.InProgress {
+		candles = append(candles, st.current())
+	}
+
+	return candles
+}
+
+// seed - resume the bars of epic after the complete bars of history, the
+// running bar is rebuilt from inputs: its complete inputs, then the running
+// one which later inputs of the same start replace. Inputs ending before the
+// last complete one are ignored afterwards.
+func (a *CandleAggregator) seed(epic string, history []Candle, inputs []Candle) {
+	a.mu.Lock()
+	if a.epics == nil {
+		a.epics = make(map[string]*aggregatorState)
+	}
+	st := &aggregatorState{}
+	if len(history) > 0 {
+		st.lastEnd = history[len(history)-1].End
+	}
+	a.epics[epic] = st
+	a.mu.Unlock()
+
+	var covered time.Time
+	for _, c := range inputs {
+		a.AddCandle(c)
+		if c.Complete {
+			covered = c.End
+		}
+	}
+
+	a.mu.Lock()
+	st.covered = covered
+	a.mu.Unlock()
+}
+
+// AddPrice - add a single price, e.g. from a MARKET subscription
+func (a *CandleAggregator) AddPrice(epic string, t time.Time, bid, offer, volume float64) []Candle {
+	p := func(v float64) CandlePrice { return CandlePrice{Open: v, High: v, Low: v, Close: v} }
+
+	return a.AddCandle(Candle{
+		Epic:     epic,
+		Start:    t,
+		End:      t,
+		Bid:      p(bid),
+		Offer:    p(offer),
+		Mid:      p((bid + offer) / 2),
+		Volume:   volume,
+		Ticks:    1,
+		Complete: true,
+	})
+}
+
+// Flush - complete the bars ended at now, e.g. the last bar before a market
+// closure, when the input completing them was missed
+func (a *CandleAggregator) Flush(now time.Time) []Candle {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var candles []Candle
+	for _, st := range a.epics {
+		if st.bar != nil && !now.Before(st.bar.End) {
+			candles = append(candles, st.complete())
+		}
+	}
+	return candles
+}
+
+// current - running bar including the partial input
+func (st *aggregatorState) current() Candle {
+	c := *st.bar
+	if st.partial != nil {
+		mergeCandle(&c, *st.partial, !st.merged)
+	}
+	c.Complete = false
+	return c
+}
+
+// complete - close the running bar, with a Gap when its last input is partial
+func (st *aggregatorState) complete() Candle {
+	c := st.current()
+	c.Complete = true
+	c.Gap = c.Gap || st.partial != nil
+	st.lastEnd = c.End
+	st.bar, st.merged, st.partial = nil, false, nil
+	return c
+}
+
+// mergeCandle - extend bar with the later candle c, first when bar is empty
+func mergeCandle(bar *Candle, c Candle, first bool) {
+	merge := func(dest *CandlePrice, src CandlePrice) {
+		if first {
+			*dest = src
+			return
+		}
+		dest.High = math.Max(dest.High, src.High)
+		dest.Low = math.Min(dest.Low, src.Low)
+		dest.Close = src.Close
+	}
+
+	merge(&bar.Bid, c.Bid)
+	merge(&bar.Offer, c.Offer)
+	merge(&bar.Mid, c.Mid)
+	merge(&bar.LastTraded, c.LastTraded)
+	bar.Volume += c.Volume
+	bar.Ticks += c.Ticks
+	bar.Gap = bar.Gap || c.Gap
+}
+
+// aggregatorInterval - largest CHART interval bars of a are made of
+func aggregatorInterval(a *CandleAggregator) string {
+	if a.Resolution == ResolutionWeek || a.Resolution == ResolutionMonth {
+		for _, interval := range []string{"HOUR", "1MINUTE"} {
+			if d, _ := ChartIntervalDuration(interval); a.sessionAligned(d) {
+				return interval
+			}
+		}
+		return "SECOND"
+	}
+
+	for _, interval := range []string{"HOUR", "5MINUTE", "1MINUTE"} {
+		d, _ := ChartIntervalDuration(interval)
+		if a.Duration%d == 0 && (24*time.Hour)%d == 0 && a.sessionAligned(d) {
+			return interval
+		}
+	}
+	return "SECOND"
+}
+
+// sessionAligned - true if the sessions of a start on a multiple of d in UTC,
+// where CHART candles start: SessionStart and the UTC offsets of Location over
+// the year are multiples of d
+func (a *CandleAggregator) sessionAligned(d time.Duration) bool {
+	if a.SessionStart%d != 0 {
+		return false
+	}
+	year := time.Now().Year()
+	for _, month := range []time.Month{time.January, time.July} {
+		_, offset := time.Date(year, month, 1, 0, 0, 0, 0, a.location()).Zone()
+		if (time.Duration(offset)*time.Second)%d != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// OpenAggregatedCandleStream - candles of o.Epics built by agg from the
+// largest CHART interval matching its bars, o.Interval and o.InProgress are
+// set from agg
+func (ig *IGMarkets) OpenAggregatedCandleStream(
+	ctx context.Context,
+	o CandleStreamOptions,
+	agg *CandleAggregator) (<-chan Candle, <-chan error, error) {
+
+	o.Interval = aggregatorInterval(agg)
+	o.InProgress = agg.InProgress
+
+	candles, errs, err := ig.OpenCandleStream(ctx, o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	interval, _ := ChartIntervalDuration(o.Interval)
+	aggChan := make(chan Candle)
+
+	go func() {
+		defer close(aggChan)
+
+		flush := time.NewTicker(interval)
+		defer flush.Stop()
+
+		send := func(out []Candle) {
+			for _, c := range out {
+				select {
+				case aggChan <- c:
+				case <-ctx.Done():
+				}
+			}
+		}
+
+		for {
+			select {
+			case c, ok := <-candles:
+				if !ok {
+					return
+				}
+				send(agg.AddCandle(c))
+			case now := <-flush.C:
+				// leave one interval for the candle completing the bar
+				send(agg.Flush(now.Add(-interval)))
+			}
+		}
+	}()
+
+	return aggChan, errs, nil
+}
@@ -0,0 +1,166 @@
+package igmarkets
+
+import (
+	"testing"
+	"time"
+)
+
+func testCandle(start time.Time, d time.Duration, low, high, volume float64, ticks int, complete bool) Candle {
+	p := CandlePrice{Open: low, High: high, Low: low, Close: high}
+	return Candle{
+		Epic:     "EPIC",
+		Start:    start,
+		End:      start.Add(d),
+		Bid:      p,
+		Offer:    p,
+		Mid:      p,
+		Volume:   volume,
+		Ticks:    ticks,
+		Complete: complete,
+	}
+}
+
+func TestSeedRebuildsRunningBar(t *testing.T) {
+	at := func(hour, min int) time.Time { return time.Date(2021, 3, 1, hour, min, 0, 0, time.UTC) }
+	input := func(hour, min int, low, high, volume float64, ticks int, complete bool) Candle {
+		return testCandle(at(hour, min), 5*time.Minute, low, high, volume, ticks, complete)
+	}
+
+	newAggregator := func() *CandleAggregator {
+		agg := NewDurationAggregator(10 * time.Minute)
+		history := []Candle{
+			testCandle(at(9, 40), 10*time.Minute, 1.0, 1.1, 100, 50, true),
+			testCandle(at(9, 50), 10*time.Minute, 1.0, 1.1, 100, 50, true),
+		}
+		agg.seed("EPIC", history, []Candle{
+			input(10, 0, 1.0, 1.2, 10, 5, true),
+			input(10, 5, 1.1, 1.15, 3, 2, false),
+		})
+		return agg
+	}
+
+	t.Run("stream continues the running input", func(t *testing.T) {
+		agg := newAggregator()
+
+		late := []Candle{
+			input(9, 55, 0.5, 2, 1000, 1000, true), // in the history
+			input(10, 0, 0.5, 2, 1000, 1000, true), // complete input of the history
+		}
+		for _, c := range late {
+			if out := agg.AddCandle(c); len(out) != 0 {
+				t.Fatalf("late input %s produced %+v", c.Start, out)
+			}
+		}
+
+		// snapshot of the running input, volume and ticks since its start
+		if out := agg.AddCandle(input(10, 5, 1.1, 1.16, 4, 3, false)); len(out) != 0 {
+			t.Fatalf("running input produced %+v", out)
+		}
+		out := agg.AddCandle(input(10, 5, 1.1, 1.3, 6, 4, true))
+		if len(out) != 1 {
+			t.Fatalf("got %d bars, want 1", len(out))
+		}
+
+		bar := out[0]
+		if !bar.Complete || bar.Gap || !bar.Start.Equal(at(10, 0)) || !bar.End.Equal(at(10, 10)) {
+			t.Fatalf("unexpected bar %+v", bar)
+		}
+		if bar.Volume != 16 || bar.Ticks != 9 {
+			t.Fatalf("volume %v ticks %d, want 16 and 9", bar.Volume, bar.Ticks)
+		}
+		if bar.Bid.Open != 1.0 || bar.Bid.High != 1.3 || bar.Bid.Low != 1.0 || bar.Bid.Close != 1.3 {
+			t.Fatalf("unexpected prices %+v", bar.Bid)
+		}
+	})
+
+	t.Run("running input missed", func(t *testing.T) {
+		agg := newAggregator()
+
+		out := agg.AddCandle(input(10, 10, 1.2, 1.25, 7, 3, true))
+		if len(out) != 1 {
+			t.Fatalf("got %d bars, want 1", len(out))
+		}
+		bar := out[0]
+		if !bar.Gap || bar.Volume != 13 || bar.Ticks != 7 || bar.Bid.Close != 1.15 {
+			t.Fatalf("unexpected bar %+v", bar)
+		}
+	})
+
+	t.Run("partial input missed within the bar", func(t *testing.T) {
+		agg := NewDurationAggregator(10 * time.Minute)
+		agg.AddCandle(input(10, 0, 1.0, 1.1, 2, 1, false))
+
+		out := agg.AddCandle(input(10, 5, 1.1, 1.2, 5, 2, true))
+		if len(out) != 1 || !out[0].Gap || out[0].Volume != 7 || out[0].Bid.Open != 1.0 {
+			t.Fatalf("unexpected bars %+v", out)
+		}
+	})
+}
+
+func TestCandleAggregatorBounds(t *testing.T) {
+	india := time.FixedZone("IST", 5*3600+1800)
+	utc := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name       string
+		duration   time.Duration
+		location   *time.Location
+		t          time.Time
+		start, end time.Time
+	}{
+		{"hour in UTC", time.Hour, nil, utc(2026, 3, 2, 10, 45), utc(2026, 3, 2, 10, 0), utc(2026, 3, 2, 11, 0)},
+		{"hour at +05:30", time.Hour, india, utc(2026, 3, 2, 10, 45), utc(2026, 3, 2, 10, 30), utc(2026, 3, 2, 11, 30)},
+		{"4 hours at +05:30", 4 * time.Hour, india, utc(2026, 3, 2, 10, 45), utc(2026, 3, 2, 10, 30), utc(2026, 3, 2, 14, 30)},
+		{"day at +05:30", 24 * time.Hour, india, utc(2026, 3, 2, 20, 0), utc(2026, 3, 2, 18, 30), utc(2026, 3, 3, 18, 30)},
+		{"2 days at +05:30", 48 * time.Hour, india, utc(1970, 1, 7, 18, 29), utc(1970, 1, 6, 18, 30), utc(1970, 1, 8, 18, 30)},
+		{"2 days just before the origin", 48 * time.Hour, nil, utc(1970, 1, 4, 12, 0), utc(1970, 1, 3, 0, 0), utc(1970, 1, 5, 0, 0)},
+		{"2 days before the origin", 48 * time.Hour, nil, utc(1969, 12, 31, 23, 0), utc(1969, 12, 30, 0, 0), utc(1970, 1, 1, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewDurationAggregator(tt.duration)
+			a.Location = tt.location
+			start, end := a.Bounds(tt.t)
+			if !start.Equal(tt.start) || !end.Equal(tt.end) {
+				t.Fatalf("bounds %s - %s, want %s - %s", start.UTC(), end.UTC(), tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestAggregatorInterval(t *testing.T) {
+	india := time.FixedZone("IST", 5*3600+1800)
+	nepal := time.FixedZone("NPT", 5*3600+2700)
+
+	tests := []struct {
+		name         string
+		resolution   string
+		location     *time.Location
+		sessionStart time.Duration
+		want         string
+	}{
+		{"hour in UTC", ResolutionHour, nil, 0, "HOUR"},
+		{"hour at +05:30", ResolutionHour, india, 0, "5MINUTE"},
+		{"day at +05:45", ResolutionDay, nepal, 0, "5MINUTE"},
+		{"day from 22h", ResolutionDay, nil, 22 * time.Hour, "HOUR"},
+		{"15 minutes at +05:30", ResolutionFifteenMinute, india, 0, "5MINUTE"},
+		{"week in UTC", ResolutionWeek, nil, 0, "HOUR"},
+		{"week at +05:30", ResolutionWeek, india, 0, "1MINUTE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewCandleAggregator(tt.resolution)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.Location, a.SessionStart = tt.location, tt.sessionStart
+			if got := aggregatorInterval(a); got != tt.want {
+				t.Fatalf("interval %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package igmarkets
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// OpenCandleHistoryStream - the last bars complete candles of epic at
+// resolution from the price history, followed by the live candles
+//
+// The bar running at the boundary is delivered once, complete: it is rebuilt
+// from the history of its complete inputs, at the resolution of the CHART
+// interval streamed, and from the stream for its running input, so that no
+// volume or tick is counted twice.
+func (ig *IGMarkets) OpenCandleHistoryStream(
+	ctx context.Context,
+	epic, resolution string,
+	bars int,
+	o CandleStreamOptions) (<-chan Candle, <-chan error, error) {
+
+	agg, err := NewCandleAggregator(resolution)
+	if err != nil {
+		return nil, nil, err
+	}
+	agg.InProgress = o.InProgress
+
+	prices, err := ig.GetPriceHistory(epic, resolution, bars+1, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, nil, err
+	}
+	history, err := prices.Candles(epic, resolution)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(history) == 0 {
+		return nil, nil, fmt.Errorf("igmarkets: no price history for %s", epic)
+	}
+
+	complete := history
+	var inputs []Candle
+	if running := history[len(history)-1]; !running.Complete {
+		complete = history[:len(history)-1]
+		if inputs, err = ig.barInputs(epic, resolution, running, aggregatorInterval(agg)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	agg.seed(epic, complete, inputs)
+
+	if len(complete) > bars {
+		complete = complete[len(complete)-bars:]
+	}
+
+	o.Epics = []string{epic}
+	live, errs, err := ig.OpenAggregatedCandleStream(ctx, o, agg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candleChan := make(chan Candle)
+
+	go func() {
+		defer close(candleChan)
+
+		for _, c := range complete {
+			select {
+			case candleChan <- c:
+			case <-ctx.Done():
+			}
+		}
+
+		for c := range live {
+			select {
+			case candleChan <- c:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return candleChan, errs, nil
+}
+
+// barInputs - candles of the CHART interval making the running bar of
+// resolution so far, the last one not Complete
+func (ig *IGMarkets) barInputs(epic, resolution string, running Candle, interval string) ([]Candle, error) {
+	inputResolution := chartIntervalResolution(interval)
+	if inputResolution == resolution {
+		return []Candle{running}, nil
+	}
+
+	prices, err := ig.GetPriceHistory(epic, inputResolution, 0, running.Start, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	candles, err := prices.Candles(epic, inputResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := make([]Candle, 0, len(candles))
+	for _, c := range candles {
+		if !c.Start.Before(running.Start) {
+			inputs = append(inputs, c)
+		}
+	}
+	return inputs, nil
+}
+
+// chartIntervalResolution - price history resolution of a CHART interval
+func chartIntervalResolution(interval string) string {
+	switch interval {
+	case "1MINUTE":
+		return ResolutionMinute
+	case "5MINUTE":
+		return ResolutionFiveMinute
+	case "HOUR":
+		return ResolutionHour
+	}
+	return ResolutionSecond
+}
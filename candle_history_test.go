@@ -0,0 +1,110 @@
+package igmarkets_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+	"github.com/amaurybrisou/igmarkets/igmarketstest"
+)
+
+func TestCandleHistoryStream(t *testing.T) {
+	r := newStreamRig(t)
+
+	var running time.Time
+	r.srv.Mux.HandleFunc("/gateway/deal/prices/"+testEpic, func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if q.Get("resolution") != igmarkets.ResolutionMinute || q.Get("max") != "4" || q.Get("pageSize") != "0" {
+			t.Errorf("unexpected price history query %s", req.URL.RawQuery)
+		}
+
+		running = time.Now().UTC().Truncate(time.Minute)
+		var prices igmarkets.PriceResponse
+		for i := 3; i >= 0; i-- {
+			p := igmarkets.Price{Bid: 1.1, Ask: 1.2}
+			prices.Prices = append(prices.Prices, igmarkets.MarketPrice{
+				SnapshotTimeUTC:  running.Add(-time.Duration(i) * time.Minute).Format("2006-01-02T15:04:05"),
+				OpenPrice:        p,
+				HighPrice:        p,
+				LowPrice:         p,
+				ClosePrice:       p,
+				LastTradedVolume: 100,
+			})
+		}
+		json.NewEncoder(w).Encode(prices)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	candles, _, err := r.ig.OpenCandleHistoryStream(ctx, testEpic, igmarkets.ResolutionMinute, 3,
+		igmarkets.CandleStreamOptions{LightStreamOptions: r.options()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func() igmarkets.Candle {
+		t.Helper()
+		select {
+		case c := <-candles:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("no candle received")
+		}
+		return igmarkets.Candle{}
+	}
+
+	for i := 3; i > 0; i-- {
+		c := receive()
+		if !c.Complete || !c.Start.Equal(running.Add(-time.Duration(i)*time.Minute)) || c.Volume != 100 {
+			t.Fatalf("unexpected history candle %+v", c)
+		}
+	}
+
+	// the stream carries the volume and ticks of the whole running candle
+	item := "CHART:" + testEpic + ":1MINUTE"
+	ctxWait, cancelWait := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelWait()
+	if err := r.ls.WaitForSubscription(ctxWait, item); err != nil {
+		t.Fatal(err)
+	}
+	utm := strconv.FormatInt(running.Add(30*time.Second).UnixNano()/int64(time.Millisecond), 10)
+	r.ls.Push(item, map[string]string{
+		"UTM": utm, "TTV": "150", "CONS_TICK_COUNT": "20",
+		"BID_OPEN": "1.1", "BID_HIGH": "1.3", "BID_LOW": "1.05", "BID_CLOSE": "1.25",
+		"OFR_OPEN": "1.2", "OFR_HIGH": "1.4", "OFR_LOW": "1.15", "OFR_CLOSE": "1.35",
+	})
+	r.ls.Push(item, map[string]string{"TTV": "160", "CONS_TICK_COUNT": "21", "CONS_END": "1"})
+
+	c := receive()
+	if !c.Complete || !c.Start.Equal(running) || c.Volume != 160 || c.Ticks != 21 {
+		t.Fatalf("unexpected boundary candle %+v", c)
+	}
+	if c.Bid.Open != 1.1 || c.Bid.High != 1.3 || c.Bid.Low != 1.05 || c.Bid.Close != 1.25 {
+		t.Fatalf("unexpected boundary prices %+v", c.Bid)
+	}
+}
+
+func TestGetPriceHistoryUTC(t *testing.T) {
+	srv := igmarketstest.NewServer("")
+	defer srv.Close()
+
+	var from, to string
+	srv.Mux.HandleFunc("/gateway/deal/prices/"+testEpic, func(w http.ResponseWriter, req *http.Request) {
+		from, to = req.URL.Query().Get("from"), req.URL.Query().Get("to")
+		w.Write([]byte(`{"prices":[]}`))
+	})
+
+	// the running bar of a client outside UTC
+	india := time.FixedZone("IST", 5*3600+1800)
+	start := time.Date(2026, 3, 2, 15, 30, 0, 0, india)
+	if _, err := srv.NewClient(false).GetPriceHistory(testEpic, igmarkets.ResolutionMinute, 0, start, start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if from != "2026-03-02T10:00:00" || to != "2026-03-02T11:00:00" {
+		t.Fatalf("price history from %s to %s, want UTC", from, to)
+	}
+}
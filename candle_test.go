@@ -0,0 +1,61 @@
+package igmarkets_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+)
+
+func TestChartCandleBuilderVolume(t *testing.T) {
+	start := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	type tick struct {
+		second  int
+		ltv     float64
+		ttv     float64
+		changed igmarkets.ChartTickFields
+	}
+	trade := igmarkets.ChartTickUTM | igmarkets.ChartTickLTV
+
+	tests := []struct {
+		name   string
+		ticks  []tick
+		volume float64
+	}{
+		{"changed LTV", []tick{{0, 2, 0, trade}, {1, 3, 0, trade}}, 5},
+		{"repeated LTV", []tick{{0, 2, 0, trade}, {1, 2, 0, igmarkets.ChartTickUTM}, {2, 2, 0, igmarkets.ChartTickUTM}}, 6},
+		{"price update of the same trade", []tick{{0, 2, 0, trade}, {0, 2, 0, igmarkets.ChartTickBID_CLOSE}}, 2},
+		{"TTV", []tick{{0, 2, 10, trade | igmarkets.ChartTickTTV}, {1, 2, 12, igmarkets.ChartTickUTM | igmarkets.ChartTickTTV}}, 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := igmarkets.NewChartCandleBuilder(time.Minute, true)
+
+			var last igmarkets.Candle
+			for _, k := range tt.ticks {
+				utm := start.Add(time.Duration(k.second) * time.Second)
+				present := igmarkets.ChartTickUTM | igmarkets.ChartTickLTV | igmarkets.ChartTickBID_CLOSE
+				if k.ttv > 0 {
+					present |= igmarkets.ChartTickTTV
+				}
+				candles := b.Add(igmarkets.LightStreamChartTick{
+					EPIC:      "EPIC",
+					UTM:       &utm,
+					LTV:       k.ltv,
+					TTV:       k.ttv,
+					BID_CLOSE: 1.1,
+					Present:   present,
+					Changed:   k.changed,
+				})
+				if len(candles) != 1 {
+					t.Fatalf("%d candles, want the running one", len(candles))
+				}
+				last = candles[0]
+			}
+			if last.Volume != tt.volume {
+				t.Fatalf("volume %g, want %g", last.Volume, tt.volume)
+			}
+		})
+	}
+}
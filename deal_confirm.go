@@ -0,0 +1,160 @@
+package igmarkets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DealStatusAccepted - deal accepted by IG
+	DealStatusAccepted = "ACCEPTED"
+	// DealStatusRejected - deal rejected by IG, see OTCDealConfirmation.Reason
+	DealStatusRejected = "REJECTED"
+
+	// DefaultConfirmTimeout - confirmation deadline used when the context has none
+	DefaultConfirmTimeout = 30 * time.Second
+
+	confirmMinBackoff = 100 * time.Millisecond
+	confirmMaxBackoff = 2 * time.Second
+)
+
+// DealRejectedError - the deal was rejected, Reason is IG's rejection reason
+// e.g. "MARKET_CLOSED_WITH_EDITS" or "INSUFFICIENT_FUNDS"
+type DealRejectedError struct {
+	DealReference string
+	Reason        string
+	Confirmation  *OTCDealConfirmation
+}
+
+func (e *DealRejectedError) Error() string {
+	return fmt.Sprintf("igmarkets: deal %s rejected: %s", e.DealReference, e.Reason)
+}
+
+// WaitForDealConfirmation - final confirmation of dealRef
+// GetDealConfirmation is polled with an exponential backoff while the deal is
+// unknown, throttled or IG fails, until ctx is done. Confirmations of an open
+// trade stream are used as soon as they arrive. A rejected deal is returned
+// with a *DealRejectedError.
+func (ig *IGMarkets) WaitForDealConfirmation(ctx context.Context, dealRef string) (*OTCDealConfirmation, error) {
+	confirmation, err := ig.waitForDealConfirmation(ctx, dealRef)
+	if guard := ig.riskGuard(); guard != nil && confirmation != nil {
+		guard.settle(dealRef)
+	}
+	ig.journal(JournalRecord{Kind: JournalConfirmation, DealReference: dealRef, Confirmation: confirmation}, nil, nil, err)
+	return confirmation, err
+}
+
+func (ig *IGMarkets) waitForDealConfirmation(ctx context.Context, dealRef string) (*OTCDealConfirmation, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultConfirmTimeout)
+		defer cancel()
+	}
+
+	streamed, cancel := ig.confirmHub().wait(dealRef)
+	defer cancel()
+
+	backoff := confirmMinBackoff
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("igmarkets: no confirmation for deal %s: %v", dealRef, ctx.Err())
+		case confirmation := <-streamed:
+			return confirmed(dealRef, confirmation)
+		case <-timer.C:
+		}
+
+		confirmation, err := ig.GetDealConfirmation(dealRef)
+		switch {
+		case err == nil && confirmation.DealStatus != "":
+			return confirmed(dealRef, confirmation)
+		case err != nil && !retryConfirmation(err):
+			return nil, err
+		case err != nil:
+			log.WithError(err).Debugf("igmarkets : confirmation of %s", dealRef)
+		}
+
+		timer.Reset(backoff)
+		if backoff *= 2; backoff > confirmMaxBackoff {
+			backoff = confirmMaxBackoff
+		}
+	}
+}
+
+// retryConfirmation - true if the confirmation may still come after err: the
+// deal is not known yet, requests are throttled, IG or the network failed.
+// Other client errors are final.
+func retryConfirmation(err error) bool {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		return true
+	}
+	return apiErr.StatusCode == http.StatusNotFound ||
+		apiErr.StatusCode == http.StatusTooManyRequests ||
+		apiErr.StatusCode >= 500
+}
+
+// confirmed - confirmation with the rejection as an error
+func confirmed(dealRef string, confirmation *OTCDealConfirmation) (*OTCDealConfirmation, error) {
+	if confirmation.DealStatus == DealStatusRejected {
+		return confirmation, &DealRejectedError{
+			DealReference: dealRef,
+			Reason:        confirmation.Reason,
+			Confirmation:  confirmation,
+		}
+	}
+	return confirmation, nil
+}
+
+// PlaceOTCOrderAndConfirm - place order and wait for its confirmation
+func (ig *IGMarkets) PlaceOTCOrderAndConfirm(ctx context.Context, order OTCOrderRequest) (*OTCDealConfirmation, error) {
+	ref, err := ig.PlaceOTCOrder(order)
+	if err != nil {
+		return nil, err
+	}
+	return ig.WaitForDealConfirmation(ctx, ref.DealReference)
+}
+
+// PlaceOTCWorkingOrderAndConfirm - place order and wait for its confirmation
+func (ig *IGMarkets) PlaceOTCWorkingOrderAndConfirm(ctx context.Context, order OTCWorkingOrderRequest) (*OTCDealConfirmation, error) {
+	ref, err := ig.PlaceOTCWorkingOrder(order)
+	if err != nil {
+		return nil, err
+	}
+	return ig.WaitForDealConfirmation(ctx, ref.DealReference)
+}
+
+// CloseOTCPositionAndConfirm - close a position and wait for the confirmation
+func (ig *IGMarkets) CloseOTCPositionAndConfirm(ctx context.Context, close OTCPositionCloseRequest) (*OTCDealConfirmation, error) {
+	ref, err := ig.CloseOTCPosition(close)
+	if err != nil {
+		return nil, err
+	}
+	return ig.WaitForDealConfirmation(ctx, ref.DealReference)
+}
+
+// UpdateOTCOrderAndConfirm - update a position and wait for the confirmation
+func (ig *IGMarkets) UpdateOTCOrderAndConfirm(ctx context.Context, dealID string, order OTCUpdateOrderRequest) (*OTCDealConfirmation, error) {
+	ref, err := ig.UpdateOTCOrder(dealID, order)
+	if err != nil {
+		return nil, err
+	}
+	return ig.WaitForDealConfirmation(ctx, ref.DealReference)
+}
+
+// UpdateOTCWorkingOrderAndConfirm - update a working order and wait for the
+// confirmation
+func (ig *IGMarkets) UpdateOTCWorkingOrderAndConfirm(ctx context.Context, dealID string, order OTCWorkingOrderUpdateRequest) (*OTCDealConfirmation, error) {
+	ref, err := ig.UpdateOTCWorkingOrder(dealID, order)
+	if err != nil {
+		return nil, err
+	}
+	return ig.WaitForDealConfirmation(ctx, ref.DealReference)
+}
@@ -0,0 +1,172 @@
+package igmarkets_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+	"github.com/amaurybrisou/igmarkets/igmarketstest"
+)
+
+func TestWaitForDealConfirmation(t *testing.T) {
+	const (
+		accepted = `{"dealReference":"REF1","dealId":"DIAAA","dealStatus":"ACCEPTED","reason":"SUCCESS"}`
+		rejected = `{"dealReference":"REF1","dealStatus":"REJECTED","reason":"MARKET_CLOSED_WITH_EDITS"}`
+	)
+	type response struct {
+		status int
+		body   string
+	}
+
+	tests := []struct {
+		name      string
+		responses []response // the last one is repeated
+		timeout   time.Duration
+		status    string
+		rejected  bool
+		calls     int
+	}{
+		{"accepted", []response{{200, accepted}}, time.Second, igmarkets.DealStatusAccepted, false, 1},
+		{"rejected", []response{{200, rejected}}, time.Second, igmarkets.DealStatusRejected, true, 1},
+		{"not found yet", []response{{404, `{"errorCode":"error.confirms.deal-not-found"}`}, {200, accepted}},
+			time.Second, igmarkets.DealStatusAccepted, false, 2},
+		{"throttled", []response{{429, `{"errorCode":"error.public-api.exceeded-api-key-allowance"}`}, {200, accepted}},
+			time.Second, igmarkets.DealStatusAccepted, false, 2},
+		{"server errors", []response{{500, ""}, {503, ""}, {200, accepted}},
+			2 * time.Second, igmarkets.DealStatusAccepted, false, 3},
+		{"bad request", []response{{400, `{"errorCode":"error.request.invalid"}`}, {200, accepted}},
+			time.Second, "", false, 1},
+		{"forbidden", []response{{403, `{"errorCode":"error.security.forbidden"}`}, {200, accepted}},
+			time.Second, "", false, 1},
+		{"never found", []response{{404, ""}}, 300 * time.Millisecond, "", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := igmarketstest.NewServer("")
+			defer srv.Close()
+
+			var mu sync.Mutex
+			calls := 0
+			srv.Mux.HandleFunc("/gateway/deal/confirms/REF1", func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				r := tt.responses[len(tt.responses)-1]
+				if calls < len(tt.responses) {
+					r = tt.responses[calls]
+				}
+				calls++
+				mu.Unlock()
+				w.WriteHeader(r.status)
+				w.Write([]byte(r.body))
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			confirmation, err := srv.NewClient(false).WaitForDealConfirmation(ctx, "REF1")
+
+			if _, ok := err.(*igmarkets.DealRejectedError); ok != tt.rejected {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tt.status == "" {
+				if err == nil {
+					t.Fatalf("confirmation %+v, want an error", confirmation)
+				}
+			} else if confirmation == nil || confirmation.DealStatus != tt.status {
+				t.Fatalf("confirmation %+v, error %v, want %s", confirmation, err, tt.status)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.calls > 0 && calls != tt.calls {
+				t.Fatalf("%d confirmation requests, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestSubmitOTCOrderResubmit(t *testing.T) {
+	tests := []struct {
+		name     string
+		resubmit bool
+		placed   int
+	}{
+		{"lookup only", false, 1},
+		{"resubmitted", true, 2},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := igmarketstest.NewServer("")
+			defer srv.Close()
+
+			var mu sync.Mutex
+			var refs []string
+			srv.Mux.HandleFunc("/gateway/deal/positions/otc", func(w http.ResponseWriter, req *http.Request) {
+				var order igmarkets.OTCOrderRequest
+				json.NewDecoder(req.Body).Decode(&order)
+				mu.Lock()
+				refs = append(refs, order.DealReference)
+				first := len(refs) == 1
+				mu.Unlock()
+				if first {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte(`{"dealReference":"` + order.DealReference + `"}`))
+			})
+			srv.Mux.HandleFunc("/gateway/deal/confirms/", func(w http.ResponseWriter, req *http.Request) {
+				ref := strings.TrimPrefix(req.URL.Path, "/gateway/deal/confirms/")
+				mu.Lock()
+				lost := ref == refs[0]
+				mu.Unlock()
+				if lost {
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte(`{"errorCode":"error.confirms.deal-not-found"}`))
+					return
+				}
+				w.Write([]byte(`{"dealReference":"` + ref + `","dealId":"DIAAA","dealStatus":"ACCEPTED","reason":"SUCCESS"}`))
+			})
+			srv.Mux.HandleFunc("/gateway/deal/history/activity", func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"activities":[]}`))
+			})
+
+			ig := srv.NewClient(false)
+			ig.ResubmitDeals = tt.resubmit
+			confirmation, err := ig.SubmitOTCOrder(context.Background(), igmarkets.OTCOrderRequest{
+				Epic:         "EPIC",
+				Direction:    igmarkets.DirectionBuy,
+				OrderType:    igmarkets.OrderTypeMarket,
+				Size:         1,
+				CurrencyCode: "USD",
+				Expiry:       igmarkets.ExpiryNone,
+				ForceOpen:    true,
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(refs) != tt.placed {
+				t.Fatalf("order placed %d times, want %d", len(refs), tt.placed)
+			}
+			if !tt.resubmit {
+				if err == nil {
+					t.Fatalf("confirmation %+v, want an error", confirmation)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if refs[0] == refs[1] || confirmation.DealReference != refs[1] {
+				t.Fatalf("confirmation %+v of references %v, want a new reference", confirmation, refs)
+			}
+		})
+	}
+}
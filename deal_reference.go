@@ -0,0 +1,217 @@
+package igmarkets
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dealReferencePattern - deal references accepted by IG
+var dealReferencePattern = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,30}$`)
+
+// ValidDealReference - true if ref is accepted by IG: 1 to 30 letters, digits,
+// "_" or "-"
+func ValidDealReference(ref string) bool {
+	return dealReferencePattern.MatchString(ref)
+}
+
+// DealReferenceGenerator - unique deal references for the orders of a client
+type DealReferenceGenerator struct {
+	Prefix string
+	// Format - reference after the prefix, the time, a sequence number and a
+	// random part in base 36 when nil
+	Format func(now time.Time, seq uint64) string
+
+	seq uint64
+}
+
+// NewDealReferenceGenerator - generator of references starting with prefix
+func NewDealReferenceGenerator(prefix string) *DealReferenceGenerator {
+	return &DealReferenceGenerator{Prefix: prefix}
+}
+
+// Next - a new deal reference
+func (g *DealReferenceGenerator) Next() (string, error) {
+	seq := atomic.AddUint64(&g.seq, 1)
+
+	format := g.Format
+	if format == nil {
+		format = defaultDealReferenceFormat
+	}
+
+	ref := g.Prefix + format(time.Now(), seq)
+	if !ValidDealReference(ref) {
+		return "", fmt.Errorf("igmarkets: invalid deal reference %q", ref)
+	}
+	return ref, nil
+}
+
+// defaultDealReferenceFormat - 8 chars of time, the sequence and 4 random chars
+func defaultDealReferenceFormat(now time.Time, seq uint64) string {
+	var random [4]byte
+	_, _ = rand.Read(random[:])
+
+	return strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 36) +
+		base36(seq%(36*36), 2) + base36(uint64(binary.BigEndian.Uint32(random[:]))%(36*36*36*36), 4)
+}
+
+// base36 - v in base 36, left padded with zeros to width chars
+func base36(v uint64, width int) string {
+	s := strconv.FormatUint(v, 36)
+	for len(s) < width {
+		s = "0" + s
+	}
+	return s
+}
+
+// nextDealReference - reference from ig.DealReferences, a default generator
+// is used when not set
+func (ig *IGMarkets) nextDealReference() (string, error) {
+	ig.Lock()
+	if ig.DealReferences == nil {
+		ig.DealReferences = NewDealReferenceGenerator("")
+	}
+	g := ig.DealReferences
+	ig.Unlock()
+
+	return g.Next()
+}
+
+const (
+	// DealResolveTimeout - time given to a deal confirmation to show up after
+	// an ambiguous submission failure before the activity is checked
+	DealResolveTimeout = 5 * time.Second
+
+	submitAttempts = 3
+)
+
+// SubmitOTCOrder - place order and wait for its confirmation. When the
+// submission fails without a clear answer from IG (timeout, connection or
+// server error) the deal is looked up by reference, through its confirmation
+// then the account activity. A deal not found is only submitted again, with a
+// new reference, when ig.ResubmitDeals is set. Other errors, e.g. a RiskError
+// or any error in paper trading mode, are returned at once.
+func (ig *IGMarkets) SubmitOTCOrder(ctx context.Context, order OTCOrderRequest) (*OTCDealConfirmation, error) {
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+
+	return ig.submitDeal(ctx, order.DealReference, func(ref string) (*DealReference, error) {
+		order.DealReference = ref
+		return ig.PlaceOTCOrder(order)
+	})
+}
+
+// SubmitOTCWorkingOrder - place order and wait for its confirmation, see
+// SubmitOTCOrder
+func (ig *IGMarkets) SubmitOTCWorkingOrder(ctx context.Context, order OTCWorkingOrderRequest) (*OTCDealConfirmation, error) {
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+
+	return ig.submitDeal(ctx, order.DealReference, func(ref string) (*DealReference, error) {
+		order.DealReference = ref
+		return ig.PlaceOTCWorkingOrder(order)
+	})
+}
+
+func (ig *IGMarkets) submitDeal(ctx context.Context, ref string, place func(ref string) (*DealReference, error)) (*OTCDealConfirmation, error) {
+	for attempt := 1; ; attempt++ {
+		if ref == "" || attempt > 1 {
+			var err error
+			if ref, err = ig.nextDealReference(); err != nil {
+				return nil, err
+			}
+		}
+
+		submitted := time.Now()
+		dealRef, err := place(ref)
+		if err == nil {
+			return ig.WaitForDealConfirmation(ctx, dealRef.DealReference)
+		}
+		if !ambiguousSubmission(err) || ig.paperBroker() != nil {
+			return nil, err
+		}
+
+		confirmation, found, resolveErr := ig.resolveDeal(ctx, ref, submitted)
+		if resolveErr != nil {
+			return nil, fmt.Errorf("igmarkets: outcome of deal %s unknown after %v: %v", ref, err, resolveErr)
+		}
+		if found {
+			confirmation, err := confirmed(ref, confirmation)
+			ig.journal(JournalRecord{Kind: JournalConfirmation, DealReference: ref, Confirmation: confirmation}, nil, nil, err)
+			return confirmation, err
+		}
+		if !ig.ResubmitDeals {
+			return nil, fmt.Errorf("igmarkets: deal %s not found after %v, not submitted again", ref, err)
+		}
+		if attempt == submitAttempts {
+			return nil, err
+		}
+
+		log.WithError(err).Warnf("igmarkets : deal %s not found, submitting again", ref)
+	}
+}
+
+// ambiguousSubmission - true if the request may have reached IG despite err:
+// connection failures, timeouts and server errors. Orders refused by IG, the
+// validation or the risk guard return other errors.
+func ambiguousSubmission(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	return errors.As(err, &netErr) || errors.As(err, &urlErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// resolveDeal - confirmation of ref if the deal reached IG
+func (ig *IGMarkets) resolveDeal(ctx context.Context, ref string, submitted time.Time) (*OTCDealConfirmation, bool, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, DealResolveTimeout)
+	confirmation, err := ig.waitForDealConfirmation(waitCtx, ref)
+	cancel()
+
+	if confirmation != nil {
+		return confirmation, true, nil
+	}
+	if ctx.Err() != nil {
+		return nil, false, ctx.Err()
+	}
+	if _, ok := err.(*APIError); ok {
+		return nil, false, err
+	}
+
+	activity, err := ig.GetActivity(submitted.Add(-time.Minute), time.Now().Add(time.Minute), true)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, a := range activity.Activities {
+		if a.Details == nil || a.Details.DealReference != ref {
+			continue
+		}
+		return &OTCDealConfirmation{
+			Epic:          a.Epic,
+			DealStatus:    a.Status,
+			Direction:     a.Details.Direction,
+			Level:         a.Details.Level,
+			Size:          a.Details.Size,
+			DealReference: ref,
+			DealID:        a.DealID,
+		}, true, nil
+	}
+
+	return nil, false, nil
+}
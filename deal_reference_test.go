@@ -0,0 +1,51 @@
+package igmarkets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAmbiguousSubmission(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &APIError{StatusCode: 503}, true},
+		{"refused", &APIError{StatusCode: 400, ErrorCode: "error.invalid"}, false},
+		{"transport", fmt.Errorf("igmarkets: unable to get markets data: %w", &url.Error{Op: "Post", Err: io.EOF}), true},
+		{"timeout", fmt.Errorf("igmarkets: unable to get markets data: %w", context.DeadlineExceeded), true},
+		{"body cut", fmt.Errorf("igmarkets: unable to get body of transactions markets data: %w", io.ErrUnexpectedEOF), true},
+		{"risk", &RiskError{Rule: "tripped", Reason: "kill file present"}, false},
+		{"validation", errors.New("igmarkets: size must be positive"), false},
+		{"reference", fmt.Errorf("igmarkets: invalid deal reference %q", "a b"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ambiguousSubmission(tt.err); got != tt.want {
+				t.Errorf("ambiguousSubmission(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultDealReferenceFormat(t *testing.T) {
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	for _, seq := range []uint64{1, 36, 36*36 - 1, 36 * 36} {
+		ref := defaultDealReferenceFormat(now, seq)
+		if len(ref) != 14 || !ValidDealReference(ref) {
+			t.Errorf("reference %q of sequence %d, want 14 valid chars", ref, seq)
+		}
+	}
+
+	if a, b := defaultDealReferenceFormat(now, 1), defaultDealReferenceFormat(now, 36); a[8:10] != "01" || b[8:10] != "10" {
+		t.Errorf("sequences %q and %q, want 01 and 10", a[8:10], b[8:10])
+	}
+}
@@ -0,0 +1,332 @@
+package igmarkets
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// UnitPoints - UnitValueFloat in points
+	UnitPoints = "POINTS"
+	// UnitPercentage - UnitValueFloat in percentage of the price
+	UnitPercentage = "PERCENTAGE"
+)
+
+// RuleViolation - an order field breaking a dealing rule
+type RuleViolation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// DealingRulesError - all the violations of an order
+type DealingRulesError struct {
+	Epic       string          `json:"epic"`
+	Violations []RuleViolation `json:"violations"`
+}
+
+func (e *DealingRulesError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return fmt.Sprintf("igmarkets: order on %s breaks dealing rules: %s", e.Epic, strings.Join(messages, "; "))
+}
+
+func (e *DealingRulesError) add(field, rule, format string, args ...interface{}) {
+	e.Violations = append(e.Violations, RuleViolation{Field: field, Rule: rule, Message: fmt.Sprintf(format, args...)})
+}
+
+// err - nil without violations
+func (e *DealingRulesError) err() error {
+	if len(e.Violations) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Points - v in points for a price, percentages are relative to price
+func (v UnitValueFloat) Points(price float64) float64 {
+	if v.Unit == UnitPercentage {
+		return v.Value / 100 * price
+	}
+	return v.Value
+}
+
+// pointSize - price move of one point on market, 1/scalingFactor or 1 when the
+// scaling factor is not given
+func pointSize(market *MarketsResponse) float64 {
+	if f := market.Snapshot.ScalingFactor; f > 0 {
+		return 1 / f
+	}
+	return 1
+}
+
+// distancePoints - v in points at price, percentages are relative to price
+// and converted with point, the price move of one point
+func distancePoints(v UnitValueFloat, price, point float64) float64 {
+	if v.Unit == UnitPercentage {
+		return v.Value / 100 * price / point
+	}
+	return v.Value
+}
+
+// CheckOrder - violations of the dealing rules of market by order
+// Distances are checked from the offer for BUY orders and the bid for SELL ones.
+// They are in points, stop and limit levels are converted with the scaling
+// factor of the market.
+func CheckOrder(order OTCOrderRequest, market *MarketsResponse) error {
+	e := &DealingRulesError{Epic: order.Epic}
+
+	if err := order.Validate(); err != nil {
+		e.add("", "request", "%v", strings.TrimPrefix(err.Error(), "igmarkets: "))
+	}
+
+	rules, instrument := market.DealingRules, market.Instrument
+
+	price := market.Snapshot.Offer
+	if order.Direction == DirectionSell {
+		price = market.Snapshot.Bid
+	}
+	if level, err := strconv.ParseFloat(order.Level, 64); err == nil && order.Level != "" {
+		price = level
+	}
+
+	if order.OrderType == OrderTypeMarket && rules.MarketOrderPreference == "NOT_AVAILABLE" {
+		e.add("orderType", "marketOrderPreference", "market orders are not available")
+	}
+	if order.ForceOpen && !instrument.ForceOpenAllowed {
+		e.add("forceOpen", "forceOpenAllowed", "force open is not allowed")
+	}
+
+	checkSize(e, order.Size, rules, price)
+	checkStopLimit(e, stopLimit{
+		direction:      order.Direction,
+		price:          price,
+		stopDistance:   order.StopDistance,
+		stopLevel:      order.StopLevel,
+		limitDistance:  order.LimitDistance,
+		limitLevel:     order.LimitLevel,
+		guaranteedStop: order.GuaranteedStop,
+		trailingStop:   order.TrailingStop,
+		trailingStep:   order.TrailingStopIncrement,
+	}, market)
+
+	return e.err()
+}
+
+// CheckWorkingOrder - violations of the dealing rules of market by order
+// Distances are checked from the order level.
+func CheckWorkingOrder(order OTCWorkingOrderRequest, market *MarketsResponse) error {
+	e := &DealingRulesError{Epic: order.Epic}
+
+	if err := order.Validate(); err != nil {
+		e.add("", "request", "%v", strings.TrimPrefix(err.Error(), "igmarkets: "))
+	}
+
+	if order.ForceOpen && !market.Instrument.ForceOpenAllowed {
+		e.add("forceOpen", "forceOpenAllowed", "force open is not allowed")
+	}
+
+	checkSize(e, order.Size, market.DealingRules, order.Level)
+	checkStopLimit(e, stopLimit{
+		direction:      order.Direction,
+		price:          order.Level,
+		stopDistance:   order.StopDistance,
+		stopLevel:      order.StopLevel,
+		limitDistance:  order.LimitDistance,
+		limitLevel:     order.LimitLevel,
+		guaranteedStop: order.GuaranteedStop,
+	}, market)
+
+	return e.err()
+}
+
+func checkSize(e *DealingRulesError, size float64, rules DealingRules, price float64) {
+	if min := rules.MinDealSize.Points(price); size < min {
+		e.add("size", "minDealSize", "size %g is below the minimum deal size %g", size, min)
+	}
+}
+
+// stopLimit - stop and limit of an order, distances and levels as sent to IG
+type stopLimit struct {
+	direction                    Direction
+	price                        float64
+	stopDistance, stopLevel      string
+	limitDistance, limitLevel    string
+	guaranteedStop, trailingStop bool
+	trailingStep                 string
+}
+
+func checkStopLimit(e *DealingRulesError, o stopLimit, market *MarketsResponse) {
+	rules := market.DealingRules
+
+	if o.guaranteedStop && !market.Instrument.ControlledRiskAllowed {
+		e.add("guaranteedStop", "controlledRiskAllowed", "guaranteed stops are not allowed")
+	}
+	if o.trailingStop && rules.TrailingStopsPreference != "AVAILABLE" {
+		e.add("trailingStop", "trailingStopsPreference", "trailing stops are not available")
+	}
+
+	// a stop is on the losing side: below the price when buying
+	sign := 1.0
+	if o.direction == DirectionSell {
+		sign = -1
+	}
+
+	point := pointSize(market)
+	minNormal := distancePoints(rules.MinNormalStopOrLimitDistance, o.price, point)
+	max := distancePoints(rules.MaxStopOrLimitDistance, o.price, point)
+
+	if stop, field, ok := distance(e, "stop", o.stopDistance, o.stopLevel, o.price, sign, point); ok {
+		min, rule := minNormal, "minNormalStopOrLimitDistance"
+		if o.guaranteedStop {
+			min, rule = distancePoints(rules.MinControlledRiskStopDistance, o.price, point), "minControlledRiskStopDistance"
+		}
+		checkDistance(e, field, rule, "stop", stop, min, max)
+	}
+
+	if limit, field, ok := distance(e, "limit", o.limitDistance, o.limitLevel, o.price, -sign, point); ok {
+		checkDistance(e, field, "minNormalStopOrLimitDistance", "limit", limit, minNormal, max)
+	}
+
+	if o.trailingStop && o.trailingStep != "" {
+		step, err := strconv.ParseFloat(o.trailingStep, 64)
+		if err != nil {
+			e.add("trailingStopIncrement", "format", "invalid trailing stop increment %q", o.trailingStep)
+		} else if min := distancePoints(rules.MinStepDistance, o.price, point); step < min {
+			e.add("trailingStopIncrement", "minStepDistance", "trailing stop increment %g is below the minimum step %g", step, min)
+		}
+	}
+}
+
+// distance - distance in points of a stop or limit set either as a distance or
+// as a level, levels must be on the side given by sign: below price when 1.
+// point is the price move of one point.
+func distance(e *DealingRulesError, name, dist, level string, price, sign, point float64) (float64, string, bool) {
+	if dist != "" {
+		d, err := strconv.ParseFloat(dist, 64)
+		if err != nil {
+			e.add(name+"Distance", "format", "invalid %s distance %q", name, dist)
+			return 0, "", false
+		}
+		return d, name + "Distance", true
+	}
+
+	if level != "" {
+		l, err := strconv.ParseFloat(level, 64)
+		if err != nil {
+			e.add(name+"Level", "format", "invalid %s level %q", name, level)
+			return 0, "", false
+		}
+		d := (price - l) * sign
+		if d <= 0 {
+			e.add(name+"Level", "side", "%s level %g is on the wrong side of %g", name, l, price)
+			return 0, "", false
+		}
+		// rounded for the floating point error of the level difference
+		return math.Round(d/point*1e6) / 1e6, name + "Level", true
+	}
+
+	return 0, "", false
+}
+
+func checkDistance(e *DealingRulesError, field, rule, name string, d, min, max float64) {
+	if d < min {
+		e.add(field, rule, "%s distance %g is below the minimum %g", name, d, min)
+	}
+	if max > 0 && d > max {
+		e.add(field, "maxStopOrLimitDistance", "%s distance %g is above the maximum %g", name, d, max)
+	}
+}
+
+// OrderValidator - checks orders against the dealing rules of their market
+// before submission, markets are cached for TTL
+type OrderValidator struct {
+	TTL time.Duration
+
+	ig      *IGMarkets
+	mu      sync.Mutex
+	markets map[string]cachedMarket
+}
+
+type cachedMarket struct {
+	market *MarketsResponse
+	time   time.Time
+}
+
+// NewOrderValidator - validator caching markets for ttl
+func NewOrderValidator(ig *IGMarkets, ttl time.Duration) *OrderValidator {
+	return &OrderValidator{
+		TTL:     ttl,
+		ig:      ig,
+		markets: make(map[string]cachedMarket),
+	}
+}
+
+// Market - market of epic, from the cache when fresh enough
+func (v *OrderValidator) Market(epic string) (*MarketsResponse, error) {
+	v.mu.Lock()
+	cached, ok := v.markets[epic]
+	v.mu.Unlock()
+
+	if ok && time.Since(cached.time) < v.TTL {
+		return cached.market, nil
+	}
+
+	market, err := v.ig.GetMarkets(epic)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	v.markets[epic] = cachedMarket{market: market, time: time.Now()}
+	v.mu.Unlock()
+
+	return market, nil
+}
+
+// Invalidate - drop epic from the cache
+func (v *OrderValidator) Invalidate(epic string) {
+	v.mu.Lock()
+	delete(v.markets, epic)
+	v.mu.Unlock()
+}
+
+// ValidateOrder - *DealingRulesError listing the violations of order
+func (v *OrderValidator) ValidateOrder(order OTCOrderRequest) error {
+	market, err := v.Market(order.Epic)
+	if err != nil {
+		return err
+	}
+	return CheckOrder(order, market)
+}
+
+// ValidateWorkingOrder - *DealingRulesError listing the violations of order
+func (v *OrderValidator) ValidateWorkingOrder(order OTCWorkingOrderRequest) error {
+	market, err := v.Market(order.Epic)
+	if err != nil {
+		return err
+	}
+	return CheckWorkingOrder(order, market)
+}
+
+// PlaceOTCOrder - validate then place order
+func (v *OrderValidator) PlaceOTCOrder(order OTCOrderRequest) (*DealReference, error) {
+	if err := v.ValidateOrder(order); err != nil {
+		return nil, err
+	}
+	return v.ig.PlaceOTCOrder(order)
+}
+
+// PlaceOTCWorkingOrder - validate then place order
+func (v *OrderValidator) PlaceOTCWorkingOrder(order OTCWorkingOrderRequest) (*DealReference, error) {
+	if err := v.ValidateWorkingOrder(order); err != nil {
+		return nil, err
+	}
+	return v.ig.PlaceOTCWorkingOrder(order)
+}
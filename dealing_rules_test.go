@@ -0,0 +1,167 @@
+package igmarkets_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/amaurybrisou/igmarkets"
+)
+
+// rulesMarket - market quoted bid/offer, scale points to a unit of price
+func rulesMarket(bid, offer, scale float64, rules igmarkets.DealingRules) *igmarkets.MarketsResponse {
+	return &igmarkets.MarketsResponse{
+		DealingRules: rules,
+		Instrument:   igmarkets.Instrument{Epic: "EPIC", ControlledRiskAllowed: true, ForceOpenAllowed: true},
+		Snapshot:     igmarkets.Snapshot{MarketStatus: "TRADEABLE", Bid: bid, Offer: offer, ScalingFactor: scale},
+	}
+}
+
+// violations - field/rule of every violation of err
+func violations(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	e, ok := err.(*igmarkets.DealingRulesError)
+	if !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var got []string
+	for _, v := range e.Violations {
+		got = append(got, v.Field+"/"+v.Rule)
+	}
+	return got
+}
+
+func TestCheckOrderDistances(t *testing.T) {
+	points := func(v float64) igmarkets.UnitValueFloat {
+		return igmarkets.UnitValueFloat{Unit: igmarkets.UnitPoints, Value: v}
+	}
+	rules := igmarkets.DealingRules{
+		TrailingStopsPreference:       "AVAILABLE",
+		MinDealSize:                   points(1),
+		MinNormalStopOrLimitDistance:  points(5),
+		MinControlledRiskStopDistance: points(10),
+		MaxStopOrLimitDistance:        points(50),
+		MinStepDistance:               points(2),
+	}
+	index := rulesMarket(100, 101, 1, rules)
+
+	fxRules := rules
+	fxRules.MaxStopOrLimitDistance = igmarkets.UnitValueFloat{Unit: igmarkets.UnitPercentage, Value: 1}
+	fx := rulesMarket(1.1, 1.1002, 10000, fxRules)
+
+	order := func(direction igmarkets.Direction, set func(o *igmarkets.OTCOrderRequest)) igmarkets.OTCOrderRequest {
+		o := igmarkets.OTCOrderRequest{
+			Epic:         "EPIC",
+			Direction:    direction,
+			Size:         1,
+			OrderType:    igmarkets.OrderTypeMarket,
+			CurrencyCode: "USD",
+			Expiry:       "-",
+			ForceOpen:    true,
+		}
+		set(&o)
+		return o
+	}
+	buy := func(set func(o *igmarkets.OTCOrderRequest)) igmarkets.OTCOrderRequest {
+		return order(igmarkets.DirectionBuy, set)
+	}
+	sell := func(set func(o *igmarkets.OTCOrderRequest)) igmarkets.OTCOrderRequest {
+		return order(igmarkets.DirectionSell, set)
+	}
+
+	tests := []struct {
+		name   string
+		market *igmarkets.MarketsResponse
+		order  igmarkets.OTCOrderRequest
+		want   []string
+	}{
+		{"buy stop distance", index, buy(func(o *igmarkets.OTCOrderRequest) { o.StopDistance = "5" }), nil},
+		{"buy stop distance too close", index, buy(func(o *igmarkets.OTCOrderRequest) { o.StopDistance = "4" }),
+			[]string{"stopDistance/minNormalStopOrLimitDistance"}},
+		{"buy stop level from the offer", index, buy(func(o *igmarkets.OTCOrderRequest) { o.StopLevel = "96" }), nil},
+		{"buy stop level too close", index, buy(func(o *igmarkets.OTCOrderRequest) { o.StopLevel = "97" }),
+			[]string{"stopLevel/minNormalStopOrLimitDistance"}},
+		{"buy stop level above the price", index, buy(func(o *igmarkets.OTCOrderRequest) { o.StopLevel = "102" }),
+			[]string{"stopLevel/side"}},
+		{"buy limit too far", index, buy(func(o *igmarkets.OTCOrderRequest) { o.LimitLevel = "152" }),
+			[]string{"limitLevel/maxStopOrLimitDistance"}},
+		{"buy limit at the maximum", index, buy(func(o *igmarkets.OTCOrderRequest) { o.LimitLevel = "151" }), nil},
+		{"buy guaranteed stop too close", index, buy(func(o *igmarkets.OTCOrderRequest) {
+			o.GuaranteedStop = true
+			o.StopDistance = "8"
+		}), []string{"stopDistance/minControlledRiskStopDistance"}},
+		{"sell stop level from the bid", index, sell(func(o *igmarkets.OTCOrderRequest) { o.StopLevel = "105" }), nil},
+		{"sell stop level too close", index, sell(func(o *igmarkets.OTCOrderRequest) { o.StopLevel = "104" }),
+			[]string{"stopLevel/minNormalStopOrLimitDistance"}},
+		{"sell stop level below the price", index, sell(func(o *igmarkets.OTCOrderRequest) { o.StopLevel = "99" }),
+			[]string{"stopLevel/side"}},
+		{"sell limit too far", index, sell(func(o *igmarkets.OTCOrderRequest) { o.LimitDistance = "51" }),
+			[]string{"limitDistance/maxStopOrLimitDistance"}},
+		{"sell limit level", index, sell(func(o *igmarkets.OTCOrderRequest) { o.LimitLevel = "50" }), nil},
+		{"trailing step too small", index, buy(func(o *igmarkets.OTCOrderRequest) {
+			o.StopDistance = "10"
+			o.TrailingStop = true
+			o.TrailingStopIncrement = "1"
+		}), []string{"trailingStopIncrement/minStepDistance"}},
+
+		// levels are 10000 points to a unit of price
+		{"fx buy stop level 10 points away", fx, buy(func(o *igmarkets.OTCOrderRequest) { o.StopLevel = "1.0992" }), nil},
+		{"fx buy stop level 4 points away", fx, buy(func(o *igmarkets.OTCOrderRequest) { o.StopLevel = "1.0998" }),
+			[]string{"stopLevel/minNormalStopOrLimitDistance"}},
+		{"fx sell stop level 10 points away", fx, sell(func(o *igmarkets.OTCOrderRequest) { o.StopLevel = "1.101" }), nil},
+		{"fx sell limit level 100 points away", fx, sell(func(o *igmarkets.OTCOrderRequest) { o.LimitLevel = "1.09" }), nil},
+		{"fx sell limit level over 1% away", fx, sell(func(o *igmarkets.OTCOrderRequest) { o.LimitLevel = "1.088" }),
+			[]string{"limitLevel/maxStopOrLimitDistance"}},
+		{"fx buy stop distance in points", fx, buy(func(o *igmarkets.OTCOrderRequest) { o.StopDistance = "10" }), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := violations(t, igmarkets.CheckOrder(tt.order, tt.market))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("violations %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckWorkingOrderDistances(t *testing.T) {
+	rules := igmarkets.DealingRules{
+		MinDealSize:                  igmarkets.UnitValueFloat{Unit: igmarkets.UnitPoints, Value: 1},
+		MinNormalStopOrLimitDistance: igmarkets.UnitValueFloat{Unit: igmarkets.UnitPoints, Value: 5},
+	}
+	fx := rulesMarket(1.1, 1.1002, 10000, rules)
+
+	tests := []struct {
+		name      string
+		direction igmarkets.Direction
+		stopLevel string
+		want      []string
+	}{
+		{"buy stop from the order level", igmarkets.DirectionBuy, "1.0795", nil},
+		{"buy stop too close", igmarkets.DirectionBuy, "1.0797", []string{"stopLevel/minNormalStopOrLimitDistance"}},
+		{"sell stop from the order level", igmarkets.DirectionSell, "1.0805", nil},
+		{"sell stop on the wrong side", igmarkets.DirectionSell, "1.0795", []string{"stopLevel/side"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := igmarkets.OTCWorkingOrderRequest{
+				Epic:         "EPIC",
+				Direction:    tt.direction,
+				Size:         1,
+				Level:        1.08,
+				Type:         igmarkets.WorkingOrderTypeLimit,
+				TimeInForce:  igmarkets.TimeInForceGoodTillCancelled,
+				CurrencyCode: "USD",
+				Expiry:       "-",
+				StopLevel:    tt.stopLevel,
+			}
+			if got := violations(t, igmarkets.CheckWorkingOrder(order, fx)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("violations %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package igmarkets
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -19,3 +20,30 @@ func LightStreamErrorHandler(resp *http.Response, err error) error {
 	}
 	return fmt.Errorf("calling lightstreamer endpoint failed: %v", err)
 }
+
+// APIError - IG answered with an unexpected HTTP status code
+type APIError struct {
+	StatusCode int
+	ErrorCode  string // e.g. "error.confirms.deal-not-found", empty if not sent
+	Body       []byte
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("igmarkets: unexpected HTTP status code: %d (body=%q)", e.StatusCode, e.Body)
+}
+
+// newAPIError - error of a response with status code and body
+func newAPIError(statusCode int, body []byte) *APIError {
+	var igErr struct {
+		ErrorCode string `json:"errorCode"`
+	}
+	_ = json.Unmarshal(body, &igErr)
+
+	return &APIError{StatusCode: statusCode, ErrorCode: igErr.ErrorCode, Body: body}
+}
+
+// IsNotFound - true if err is an APIError with status 404
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
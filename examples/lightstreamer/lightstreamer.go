@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"time"
 
 	"github.com/amaurybrisou/igmarkets"
@@ -30,65 +30,44 @@ func main() {
 		log.WithError(err).Fatal("env loading failed")
 	}
 
-	igHandle, _ := igmarkets.New(conf.igAPIURL, conf.igAPIKey, conf.igAccountID, conf.igIdentifier, conf.igPassword, time.Second*30)
+	igHandle, err := igmarkets.New(conf.igAPIURL, conf.igAPIKey, conf.igAccountID, conf.igIdentifier, conf.igPassword, true, time.Second*30)
+	if err != nil {
+		log.WithError(err).Fatal("new failed")
+	}
 	if err := igHandle.Login(); err != nil {
-		log.WithError(err).Error("new fialed")
+		log.WithError(err).Error("login failed")
 		return
 	}
 
-	tickChan := make(chan igmarkets.LightStreamChartTick)
-	err := igHandle.OpenLightStreamerSubscription([]string{"CS.D.ETHUSD.CFD.IP"}, []string{
-		"UTM",
-		"OFR_OPEN",
-		"OFR_HIGH",
-		"OFR_LOW",
-		"OFR_CLOSE",
-	}, "CHART", "SECOND", "MERGE", tickChan)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Second)
+	defer cancel()
+
+	tickChan, _, err := igHandle.OpenLightStreamerSubscription(ctx, igmarkets.LightStreamOptions{
+		Epics: []string{conf.instrument},
+		Fields: []string{
+			"UTM",
+			"OFR_OPEN",
+			"OFR_HIGH",
+			"OFR_LOW",
+			"OFR_CLOSE",
+		},
+		SubType:          "CHART",
+		Interval:         "SECOND",
+		Mode:             "MERGE",
+		ReconnectionTime: 5,
+		MaxReconnection:  5,
+		StallTimeout:     30,
+		OnStateChange: func(e igmarkets.StreamStateEvent) {
+			log.Infof("stream %s attempt=%d delay=%s err=%v", e.State, e.Attempt, e.NextDelay, e.Err)
+		},
+	})
 	if err != nil {
-		log.WithError(err).Error("open stream fialed")
-	}
-
-	run := func(stop chan bool) {
-		for tick := range tickChan {
-			log.Infof("tick: %+v", tick)
-		}
-		log.Info("run ended")
-	}
-
-	stop := make(chan bool)
-	go run(stop)
-
-	log.Infof("Server closed stream, restarting...")
-
-	<-time.After(50 * time.Second)
-
-	// log.Info("sending stop")
-	// stop <- true
-	// log.Info("unsubscribe")
-	err = retry(5, time.Second*5, func() error { return igHandle.CloseLightStreamerSubscription() })
-	if err != nil {
-		log.Error(err)
+		log.WithError(err).Error("open stream failed")
+		return
 	}
 
 	for tick := range tickChan {
-		log.Infof("tick !!!: %+v", tick)
-	}
-}
-
-func retry(attempts int, sleep time.Duration, f func() error) (err error) {
-	for i := 0; ; i++ {
-		err = f()
-		if err == nil {
-			return
-		}
-
-		if i >= (attempts - 1) {
-			break
-		}
-
-		time.Sleep(sleep)
-
-		log.Println("retrying after error:", err)
+		log.Infof("tick: %+v", tick)
 	}
-	return fmt.Errorf("after %d attempts, last error: %s", attempts, err)
+	log.Info("run ended")
 }
@@ -21,8 +21,9 @@ func main() {
 	igIdent := ""
 	igPassword := ""
 
-	ig, _ := igmarkets.New(igmarkets.DemoAPIURL, apiKey, accountID, igIdent, igPassword, time.Duration(5*time.Second))
-	err := ig.Login()
+	ig, err := igmarkets.New(igmarkets.DemoAPIURL, apiKey, accountID, igIdent, igPassword, false, time.Duration(5*time.Second))
+	checkErr(err)
+	err = ig.Login()
 	checkErr(err)
 
 	watchlistID, err := ig.CreateWatchlist("example watchlist", []string{})
@@ -17,65 +17,95 @@ import (
 
 // OTCPositionCloseRequest - request struct for closing positions
 type OTCPositionCloseRequest struct {
-	DealID      string  `json:"dealId,omitempty"`
-	Direction   string  `json:"direction"` // "BUY" or "SELL"
-	Epic        string  `json:"epic,omitempty"`
-	Expiry      string  `json:"expiry,omitempty"`
-	Level       string  `json:"level,omitempty"`
-	OrderType   string  `json:"orderType"`
-	QuoteID     string  `json:"quoteId,omitempty"`
-	Size        float64 `json:"size"`                  // Deal size
-	TimeInForce string  `json:"timeInForce,omitempty"` // "EXECUTE_AND_ELIMINATE" or "FILL_OR_KILL"
+	DealID      string      `json:"dealId,omitempty"`
+	Direction   Direction   `json:"direction"`
+	Epic        string      `json:"epic,omitempty"`
+	Expiry      string      `json:"expiry,omitempty"`
+	Level       string      `json:"level,omitempty"`
+	OrderType   OrderType   `json:"orderType"`
+	QuoteID     string      `json:"quoteId,omitempty"`
+	Size        float64     `json:"size"`                  // Deal size
+	TimeInForce TimeInForce `json:"timeInForce,omitempty"` // EXECUTE_AND_ELIMINATE or FILL_OR_KILL
+	// Strategy - tag of the request in the audit journal, not sent to IG
+	Strategy string `json:"-"`
 }
 
 // OTCOrderRequest - request struct for placing orders
 type OTCOrderRequest struct {
-	Epic                  string  `json:"epic"`
-	Level                 string  `json:"level,omitempty"`
-	ForceOpen             bool    `json:"forceOpen"`
-	OrderType             string  `json:"orderType"`
-	CurrencyCode          string  `json:"currencyCode"`
-	Direction             string  `json:"direction"` // "BUY" or "SELL"
-	Expiry                string  `json:"expiry"`
-	Size                  float64 `json:"size"` // Deal size
-	StopDistance          string  `json:"stopDistance,omitempty"`
-	StopLevel             string  `json:"stopLevel,omitempty"`
-	LimitDistance         string  `json:"limitDistance,omitempty"`
-	LimitLevel            string  `json:"limitLevel,omitempty"`
-	QuoteID               string  `json:"quoteId,omitempty"`
-	TimeInForce           string  `json:"timeInForce,omitempty"` // "EXECUTE_AND_ELIMINATE" or "FILL_OR_KILL"
-	TrailingStop          bool    `json:"trailingStop"`
-	TrailingStopIncrement string  `json:"trailingStopIncrement,omitempty"`
-	GuaranteedStop        bool    `json:"guaranteedStop"`
-	DealReference         string  `json:"dealReference,omitempty"`
-}
-
-// OTCUpdateOrderRequest - request struct for updating orders
+	Epic                  string      `json:"epic"`
+	Level                 string      `json:"level,omitempty"`
+	ForceOpen             bool        `json:"forceOpen"`
+	OrderType             OrderType   `json:"orderType"`
+	CurrencyCode          string      `json:"currencyCode"`
+	Direction             Direction   `json:"direction"`
+	Expiry                string      `json:"expiry"`
+	Size                  float64     `json:"size"` // Deal size
+	StopDistance          string      `json:"stopDistance,omitempty"`
+	StopLevel             string      `json:"stopLevel,omitempty"`
+	LimitDistance         string      `json:"limitDistance,omitempty"`
+	LimitLevel            string      `json:"limitLevel,omitempty"`
+	QuoteID               string      `json:"quoteId,omitempty"`
+	TimeInForce           TimeInForce `json:"timeInForce,omitempty"` // EXECUTE_AND_ELIMINATE or FILL_OR_KILL
+	TrailingStop          bool        `json:"trailingStop"`
+	TrailingStopIncrement string      `json:"trailingStopIncrement,omitempty"`
+	GuaranteedStop        bool        `json:"guaranteedStop"`
+	DealReference         string      `json:"dealReference,omitempty"`
+	// Strategy - tag of the request in the audit journal, not sent to IG
+	Strategy string `json:"-"`
+}
+
+// OTCUpdateOrderRequest - request struct for updating positions
+// The update replaces the stop and the limit of the position: an empty stop or
+// limit removes it, "0" is sent as a level of 0.
+// Version 2
 type OTCUpdateOrderRequest struct {
-	StopLevel             float64 `json:"stopLevel"`
-	LimitLevel            float64 `json:"limitLevel"`
-	TrailingStop          bool    `json:"trailingStop"`
-	TrailingStopIncrement string  `json:"trailingStopIncrement,omitempty"`
+	GuaranteedStop        bool   `json:"guaranteedStop"`
+	LimitDistance         string `json:"limitDistance,omitempty"`
+	LimitLevel            string `json:"limitLevel,omitempty"`
+	StopDistance          string `json:"stopDistance,omitempty"`
+	StopLevel             string `json:"stopLevel,omitempty"`
+	TrailingStop          bool   `json:"trailingStop"`
+	TrailingStopDistance  string `json:"trailingStopDistance,omitempty"`
+	TrailingStopIncrement string `json:"trailingStopIncrement,omitempty"`
+	// Strategy - tag of the request in the audit journal, not sent to IG
+	Strategy string `json:"-"`
 }
 
 // OTCWorkingOrderRequest - request struct for placing workingorders
 type OTCWorkingOrderRequest struct {
-	CurrencyCode   string  `json:"currencyCode"`
-	DealReference  string  `json:"dealReference,omitempty"`
-	Direction      string  `json:"direction"` // "BUY" or "SELL"
-	Epic           string  `json:"epic"`
-	Expiry         string  `json:"expiry"`
-	ForceOpen      bool    `json:"forceOpen"`
-	GoodTillDate   string  `json:"goodTillDate,omitempty"`
-	GuaranteedStop bool    `json:"guaranteedStop"`
-	Level          float64 `json:"level"`
-	LimitDistance  string  `json:"limitDistance,omitempty"`
-	LimitLevel     string  `json:"limitLevel,omitempty"`
-	Size           float64 `json:"size"` // Deal size
-	StopDistance   string  `json:"stopDistance,omitempty"`
-	StopLevel      string  `json:"stopLevel,omitempty"`
-	TimeInForce    string  `json:"timeInForce,omitempty"` // "GOOD_TILL_CANCELLED", "GOOD_TILL_DATE"
-	Type           string  `json:"type"`
+	CurrencyCode   string           `json:"currencyCode"`
+	DealReference  string           `json:"dealReference,omitempty"`
+	Direction      Direction        `json:"direction"`
+	Epic           string           `json:"epic"`
+	Expiry         string           `json:"expiry"`
+	ForceOpen      bool             `json:"forceOpen"`
+	GoodTillDate   string           `json:"goodTillDate,omitempty"`
+	GuaranteedStop bool             `json:"guaranteedStop"`
+	Level          float64          `json:"level"`
+	LimitDistance  string           `json:"limitDistance,omitempty"`
+	LimitLevel     string           `json:"limitLevel,omitempty"`
+	Size           float64          `json:"size"` // Deal size
+	StopDistance   string           `json:"stopDistance,omitempty"`
+	StopLevel      string           `json:"stopLevel,omitempty"`
+	TimeInForce    TimeInForce      `json:"timeInForce,omitempty"` // GOOD_TILL_CANCELLED or GOOD_TILL_DATE
+	Type           WorkingOrderType `json:"type"`
+	// Strategy - tag of the request in the audit journal, not sent to IG
+	Strategy string `json:"-"`
+}
+
+// OTCWorkingOrderUpdateRequest - request struct for updating workingorders
+type OTCWorkingOrderUpdateRequest struct {
+	GoodTillDate   string           `json:"goodTillDate,omitempty"`
+	GuaranteedStop bool             `json:"guaranteedStop"`
+	Level          float64          `json:"level"`
+	LimitDistance  string           `json:"limitDistance,omitempty"`
+	LimitLevel     string           `json:"limitLevel,omitempty"`
+	StopDistance   string           `json:"stopDistance,omitempty"`
+	StopLevel      string           `json:"stopLevel,omitempty"`
+	TimeInForce    TimeInForce      `json:"timeInForce"` // GOOD_TILL_CANCELLED or GOOD_TILL_DATE
+	Type           WorkingOrderType `json:"type"`
+	// Strategy - tag of the request in the audit journal, not sent to IG
+	Strategy string `json:"-"`
 }
 
 // WorkingOrders - Working orders
@@ -91,17 +121,19 @@ type OTCWorkingOrder struct {
 
 // MarketData - Subset of OTCWorkingOrder
 type MarketData struct {
-	Bid                      float64 `json:"bid"`
-	DelayTime                int     `json:"delayTime"`
-	Epic                     string  `json:"epic"`
-	ExchangeID               string  `json:"exchangeId"`
-	Expiry                   string  `json:"expiry"`
-	High                     float64 `json:"high"`
-	InstrumentName           string  `json:"instrumentName"`
-	InstrumentType           string  `json:"instrumentType"`
-	LotSize                  float64 `json:"lotSize"`
-	Low                      float64 `json:"low"`
-	MarektStatus             string  `json:"marketStatus"`
+	Bid            float64 `json:"bid"`
+	DelayTime      int     `json:"delayTime"`
+	Epic           string  `json:"epic"`
+	ExchangeID     string  `json:"exchangeId"`
+	Expiry         string  `json:"expiry"`
+	High           float64 `json:"high"`
+	InstrumentName string  `json:"instrumentName"`
+	InstrumentType string  `json:"instrumentType"`
+	LotSize        float64 `json:"lotSize"`
+	Low            float64 `json:"low"`
+	MarketStatus   string  `json:"marketStatus"`
+	// Deprecated: use MarketStatus, still set when decoding
+	MarektStatus             string  `json:"-"`
 	NetChange                float64 `json:"netChange"`
 	Offer                    float64 `json:"offer"`
 	PercentageChange         float64 `json:"percentageChange"`
@@ -118,22 +150,22 @@ type MarketSearchResponse struct {
 
 // WorkingOrderData - Subset of OTCWorkingOrder
 type WorkingOrderData struct {
-	CreatedDate     string  `json:"createdDate"`
-	CreatedDateUTC  string  `json:"createdDateUTC"`
-	CurrencyCode    string  `json:"currencyCode"`
-	DealID          string  `json:"dealId"`
-	Direction       string  `json:"direction"` // "BUY" or "SELL"
-	DMA             bool    `json:"dma"`
-	Epic            string  `json:"epic"`
-	GoodTillDate    string  `json:"goodTillDate"`
-	GoodTillDateISO string  `json:"goodTillDateISO"`
-	GuaranteedStop  bool    `json:"guaranteedStop"`
-	LimitDistance   float64 `json:"limitDistance"`
-	OrderLevel      float64 `json:"orderLevel"`
-	OrderSize       float64 `json:"orderSize"` // Deal size
-	OrderType       string  `json:"orderType"`
-	StopDistance    float64 `json:"stopDistance"`
-	TimeInForce     string  `json:"timeInForce,omitempty"` // "EXECUTE_AND_ELIMINATE" or "FILL_OR_KILL"
+	CreatedDate     string           `json:"createdDate"`
+	CreatedDateUTC  string           `json:"createdDateUTC"`
+	CurrencyCode    string           `json:"currencyCode"`
+	DealID          string           `json:"dealId"`
+	Direction       Direction        `json:"direction"`
+	DMA             bool             `json:"dma"`
+	Epic            string           `json:"epic"`
+	GoodTillDate    string           `json:"goodTillDate"`
+	GoodTillDateISO string           `json:"goodTillDateISO"`
+	GuaranteedStop  bool             `json:"guaranteedStop"`
+	LimitDistance   float64          `json:"limitDistance"`
+	OrderLevel      float64          `json:"orderLevel"`
+	OrderSize       float64          `json:"orderSize"` // Deal size
+	OrderType       WorkingOrderType `json:"orderType"`
+	StopDistance    float64          `json:"stopDistance"`
+	TimeInForce     TimeInForce      `json:"timeInForce,omitempty"` // GOOD_TILL_CANCELLED or GOOD_TILL_DATE
 }
 
 // PositionsResponse - Response from positions endpoint
@@ -143,23 +175,30 @@ type PositionsResponse struct {
 
 // Position - part of PositionsResponse
 type Position struct {
-	MarketData MarketData `json:"market"`
-	Position   struct {
-		ContractSize         float64 `json:"contractSize"`
-		ControlledRisk       bool    `json:"controlledRisk"`
-		CreatedDate          string  `json:"createdDate"`
-		CreatedDateUTC       string  `json:"createdDateUTC"`
-		Currencry            string  `json:"currency"`
-		DealID               string  `json:"dealId"`
-		DealReference        string  `json:"dealReference"`
-		Direction            string  `json:"direction"`
-		Level                float64 `json:"level"`
-		LimitLevel           float64 `json:"limitLevel"`
-		Size                 float64 `json:"size"`
-		StopLevel            float64 `json:"stopLevel"`
-		TrailingStep         float64 `json:"trailingStep"`
-		TrailingStopDistance float64 `json:"trailingStopDistance"`
-	} `json:"position"`
+	MarketData MarketData   `json:"market"`
+	Position   PositionData `json:"position"`
+}
+
+// PositionData - Part of Position
+type PositionData struct {
+	ContractSize   float64 `json:"contractSize"`
+	ControlledRisk bool    `json:"controlledRisk"`
+	CreatedDate    string  `json:"createdDate"`
+	CreatedDateUTC string  `json:"createdDateUTC"`
+	// Created - CreatedDateUTC, set when decoding
+	Created  time.Time `json:"-"`
+	Currency string    `json:"currency"`
+	// Deprecated: use Currency, still set when decoding
+	Currencry            string    `json:"-"`
+	DealID               string    `json:"dealId"`
+	DealReference        string    `json:"dealReference"`
+	Direction            Direction `json:"direction"`
+	Level                float64   `json:"level"`
+	LimitLevel           float64   `json:"limitLevel"`
+	Size                 float64   `json:"size"`
+	StopLevel            float64   `json:"stopLevel"`
+	TrailingStep         float64   `json:"trailingStep"`
+	TrailingStopDistance float64   `json:"trailingStopDistance"`
 }
 
 // HistoryTransactionResponse - Response for  transactions endpoint
@@ -192,6 +231,51 @@ type Transaction struct {
 	TransactionType string `json:"transactionType"`
 }
 
+// HistoryActivityResponse - Response for activity endpoint
+type HistoryActivityResponse struct {
+	Activities []Activity `json:"activities"`
+	MetaData   struct {
+		Paging struct {
+			Next string `json:"next"`
+			Size int    `json:"size"`
+		} `json:"paging"`
+	} `json:"metadata"`
+}
+
+// Activity - Part of HistoryActivityResponse
+type Activity struct {
+	Channel     string           `json:"channel"`
+	Date        string           `json:"date"`
+	DealID      string           `json:"dealId"`
+	Description string           `json:"description"`
+	Details     *ActivityDetails `json:"details,omitempty"` // Set with detailed queries
+	Epic        string           `json:"epic"`
+	Period      string           `json:"period"`
+	Status      string           `json:"status"` // "ACCEPTED", "REJECTED" or "UNKNOWN"
+	Type        string           `json:"type"`   // "POSITION", "WORKING_ORDER", "EDIT_STOP_AND_LIMIT", "SYSTEM"
+}
+
+// ActivityDetails - Part of Activity
+type ActivityDetails struct {
+	Actions []struct {
+		ActionType     string `json:"actionType"`
+		AffectedDealID string `json:"affectedDealId"`
+	} `json:"actions"`
+	Currency       string    `json:"currency"`
+	DealReference  string    `json:"dealReference"`
+	Direction      Direction `json:"direction"`
+	GoodTillDate   string    `json:"goodTillDate"`
+	GuaranteedStop bool      `json:"guaranteedStop"`
+	Level          float64   `json:"level"`
+	LimitDistance  float64   `json:"limitDistance"`
+	LimitLevel     float64   `json:"limitLevel"`
+	MarketName     string    `json:"marketName"`
+	Size           float64   `json:"size"`
+	StopDistance   float64   `json:"stopDistance"`
+	StopLevel      float64   `json:"stopLevel"`
+	TrailingStep   float64   `json:"trailingStep"`
+}
+
 // AffectedDeal - part of order confirmation
 type AffectedDeal struct {
 	DealID   string `json:"dealId"`
@@ -207,6 +291,9 @@ type Time time.Time
 
 func (me *Time) UnmarshalJSON(data []byte) error {
 	dateAsStr := strings.ReplaceAll(string(data), "\"", "")
+	if dateAsStr == "null" || dateAsStr == "" {
+		return nil
+	}
 	expectedDate, err := time.ParseInLocation("2006-01-02T15:04:05", dateAsStr, time.UTC)
 	if err != nil {
 		log.Error(err)
@@ -218,6 +305,15 @@ func (me *Time) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// MarshalJSON - in the layout IG sends, null for the zero time
+func (me Time) MarshalJSON() ([]byte, error) {
+	t := time.Time(me)
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return []byte(`"` + t.UTC().Format("2006-01-02T15:04:05") + `"`), nil
+}
+
 // OTCDealConfirmation - Deal confirmation
 type OTCDealConfirmation struct {
 	Epic                  string         `json:"epic"`
@@ -228,11 +324,11 @@ type OTCDealConfirmation struct {
 	DealStatus            string         `json:"dealStatus"`
 	Reason                string         `json:"reason"`
 	Status                string         `json:"status"`
-	OrderType             string         `json:"orderType"`
+	OrderType             OrderType      `json:"orderType"`
 	Profit                float64        `json:"profit"`
 	ProfitCurrency        string         `json:"profitCurrency"`
 	CurrencyCode          string         `json:"currencyCode"`
-	Direction             string         `json:"direction"` // "BUY" or "SELL"
+	Direction             Direction      `json:"direction"`
 	Expiry                string         `json:"expiry,omitempty"`
 	Size                  float64        `json:"size"` // Deal size
 	StopDistance          float64        `json:"stopDistance"`
@@ -240,7 +336,7 @@ type OTCDealConfirmation struct {
 	LimitDistance         string         `json:"limitDistance,omitempty"`
 	LimitLevel            float64        `json:"limitLevel"`
 	QuoteID               string         `json:"quoteId,omitempty"`
-	TimeInForce           string         `json:"timeInForce,omitempty"` // "EXECUTE_AND_ELIMINATE" or "FILL_OR_KILL"
+	TimeInForce           TimeInForce    `json:"timeInForce,omitempty"`
 	TrailingStop          bool           `json:"trailingStop"`
 	TrailingStopIncrement float64        `json:"trailingIncrement"`
 	GuaranteedStop        bool           `json:"guaranteedStop"`
@@ -297,6 +393,17 @@ type Instrument struct {
 	OnePipMeans              string         `json:"onePipMeans"`
 	ContractSize             string         `json:"contractSize"`
 	SpecialInfo              []string       `json:"specialInfo"`
+	// MarginDepositBands - margin of the parts of a deal size, in percent
+	MarginDepositBands []MarginDepositBand `json:"marginDepositBands"`
+}
+
+// MarginDepositBand - Part of Instrument, the margin of the part of a deal
+// size between Min and Max, no upper bound when Max is 0
+type MarginDepositBand struct {
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	Margin   float64 `json:"margin"`
+	Currency string  `json:"currency"`
 }
 
 // Snapshot - Part of MarketsResponse
@@ -458,17 +565,31 @@ const (
 
 // IGMarkets - Object with all information we need to access IG REST API
 type IGMarkets struct {
-	APIURL                      string
-	APIKey                      string
-	AccountID                   string
-	Identifier                  string
-	Password                    string
-	OAuthToken                  OAuthToken
-	SessionVersion2             SessionVersion2
-	SessionID                   string
+	APIURL     string
+	APIKey     string
+	AccountID  string
+	Identifier string
+	Password   string
+	OAuthToken OAuthToken
+	// Deprecated: no longer set, lightstreamer sessions are handled by the lightstreamer package
+	SessionVersion2 SessionVersion2
+	// Deprecated: no longer set, lightstreamer sessions are handled by the lightstreamer package
+	SessionID string
+	// DealReferences - references of the orders placed without one
+	DealReferences *DealReferenceGenerator
+	// ResubmitDeals - let SubmitOTCOrder and SubmitOTCWorkingOrder submit again
+	// a deal whose submission failed and which is not found by its reference.
+	// IG may still be processing the first submission: the deal can then be
+	// opened twice.
+	ResubmitDeals               bool
 	httpClient                  *http.Client
 	connected, AutoRefreshToken bool
 	logout                      chan bool
+	lightStreams                map[*lightStream]struct{}
+	confirms                    *confirmHub
+	paper                       *PaperBroker
+	guard                       *RiskGuard
+	auditJournal                *AuditJournal
 	sync.RWMutex
 }
 
@@ -667,7 +788,11 @@ func (ig *IGMarkets) Logout() error {
 
 	log.Debug("igmarkets: logged out")
 
-	ig.logout <- true
+	// stop the token auto refresh, if any
+	select {
+	case ig.logout <- true:
+	default:
+	}
 
 	ig.Lock()
 	ig.connected = false
@@ -700,8 +825,34 @@ func (ig *IGMarkets) GetPrice(epic string) (*PriceResponse, error) {
 	return ig.GetPriceHistory(epic, ResolutionSecond, 1, time.Time{}, time.Time{})
 }
 
+// GetActivity - Return the account activity between from and to, with the
+// deal references and actions when detailed
+func (ig *IGMarkets) GetActivity(from, to time.Time, detailed bool) (*HistoryActivityResponse, error) {
+	bodyReq := new(bytes.Buffer)
+	fromStr := from.UTC().Format("2006-01-02T15:04:05")
+	toStr := to.UTC().Format("2006-01-02T15:04:05")
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/gateway/deal/history/activity?from=%s&to=%s&detailed=%t&pageSize=500",
+		ig.APIURL, fromStr, toStr, detailed), bodyReq)
+	if err != nil {
+		return nil, fmt.Errorf("igmarkets: unable to get activity: %v", err)
+	}
+
+	igResponseInterface, err := ig.doRequest(req, 3, HistoryActivityResponse{})
+	if err != nil {
+		return nil, err
+	}
+	igResponse, _ := igResponseInterface.(*HistoryActivityResponse)
+
+	return igResponse, err
+}
+
 // GetTransactions - Return all transaction
 func (ig *IGMarkets) GetTransactions(transactionType string, from time.Time) (*HistoryTransactionResponse, error) {
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.GetTransactions(transactionType, from)
+	}
+
 	bodyReq := new(bytes.Buffer)
 	fromStr := from.Format("2006-01-02T15:04:05")
 
@@ -720,21 +871,24 @@ func (ig *IGMarkets) GetTransactions(transactionType string, from time.Time) (*H
 	return igResponse, err
 }
 
-// GetPriceHistory - Return the minute prices for the last 10 minutes for the given epic.
+// GetPriceHistory - Return the prices of epic at resolution, the max last ones
+// or those between from and to, sent in UTC, without paging, the last 100
+// otherwise.
 func (ig *IGMarkets) GetPriceHistory(epic, resolution string, max int, from, to time.Time) (*PriceResponse, error) {
 	bodyReq := new(bytes.Buffer)
 
 	limitStr := ""
+	page := "&max=100&pageSize=100"
 	if !to.IsZero() && !from.IsZero() {
-		fromStr := from.Format("2006-01-02T15:04:05")
-		toStr := to.Format("2006-01-02T15:04:05")
+		fromStr := from.UTC().Format("2006-01-02T15:04:05")
+		toStr := to.UTC().Format("2006-01-02T15:04:05")
 		limitStr = fmt.Sprintf("&from=%s&to=%s", fromStr, toStr)
+		page = "&pageSize=0"
 	} else if max > 0 {
 		limitStr = fmt.Sprintf("&max=%d", max)
+		page = "&pageSize=0"
 	}
 
-	page := "&max=100&pageSize=100"
-
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/gateway/deal/prices/%s?resolution=%s",
 		ig.APIURL, epic, resolution)+limitStr+page, bodyReq)
 	if err != nil {
@@ -752,6 +906,35 @@ func (ig *IGMarkets) GetPriceHistory(epic, resolution string, max int, from, to
 
 // PlaceOTCOrder - Place an OTC order
 func (ig *IGMarkets) PlaceOTCOrder(order OTCOrderRequest) (*DealReference, error) {
+	if order.DealReference == "" {
+		ref, err := ig.nextDealReference()
+		if err != nil {
+			return nil, err
+		}
+		order.DealReference = ref
+	}
+
+	r := JournalRecord{Kind: JournalOrder, Strategy: order.Strategy, DealReference: order.DealReference}
+	return ig.journaled(r, order, func() (*DealReference, error) {
+		return ig.placeOTCOrder(order)
+	})
+}
+
+func (ig *IGMarkets) placeOTCOrder(order OTCOrderRequest) (ref *DealReference, err error) {
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+	if guard := ig.riskGuard(); guard != nil {
+		done, blocked := guard.admitOrder(order)
+		if blocked != nil {
+			return nil, blocked
+		}
+		defer func() { done(err) }()
+	}
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.PlaceOTCOrder(order)
+	}
+
 	bodyReq, err := json.Marshal(&order)
 	if err != nil {
 		return nil, fmt.Errorf("igmarkets: cannot marshal: %v", err)
@@ -768,8 +951,27 @@ func (ig *IGMarkets) PlaceOTCOrder(order OTCOrderRequest) (*DealReference, error
 	return igResponseInterface.(*DealReference), nil
 }
 
-// UpdateOTCOrder - Update an exisiting OTC order
+// UpdateOTCOrder - Update the stop and limit of an exisiting OTC position
 func (ig *IGMarkets) UpdateOTCOrder(dealID string, order OTCUpdateOrderRequest) (*DealReference, error) {
+	r := JournalRecord{Kind: JournalUpdate, Strategy: order.Strategy, DealID: dealID}
+	return ig.journaled(r, order, func() (*DealReference, error) {
+		return ig.updateOTCOrder(dealID, order)
+	})
+}
+
+func (ig *IGMarkets) updateOTCOrder(dealID string, order OTCUpdateOrderRequest) (*DealReference, error) {
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+	if guard := ig.riskGuard(); guard != nil {
+		if err := guard.CheckUpdate(dealID, order); err != nil {
+			return nil, err
+		}
+	}
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.UpdateOTCOrder(dealID, order)
+	}
+
 	bodyReq, err := json.Marshal(&order)
 	if err != nil {
 		return nil, fmt.Errorf("igmarkets: cannot marshal: %v", err)
@@ -788,6 +990,20 @@ func (ig *IGMarkets) UpdateOTCOrder(dealID string, order OTCUpdateOrderRequest)
 
 // CloseOTCPosition - Close an OTC position
 func (ig *IGMarkets) CloseOTCPosition(close OTCPositionCloseRequest) (*DealReference, error) {
+	r := JournalRecord{Kind: JournalClose, Strategy: close.Strategy, DealID: close.DealID}
+	return ig.journaled(r, close, func() (*DealReference, error) {
+		return ig.closeOTCPosition(close)
+	})
+}
+
+func (ig *IGMarkets) closeOTCPosition(close OTCPositionCloseRequest) (*DealReference, error) {
+	if err := close.Validate(); err != nil {
+		return nil, err
+	}
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.CloseOTCPosition(close)
+	}
+
 	bodyReq, err := json.Marshal(&close)
 	if err != nil {
 		return nil, fmt.Errorf("igmarkets: cannot marshal: %v", err)
@@ -808,6 +1024,10 @@ func (ig *IGMarkets) CloseOTCPosition(close OTCPositionCloseRequest) (*DealRefer
 
 // GetDealConfirmation - Check if the given order was closed/filled
 func (ig *IGMarkets) GetDealConfirmation(dealRef string) (*OTCDealConfirmation, error) {
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.GetDealConfirmation(dealRef)
+	}
+
 	bodyReq := new(bytes.Buffer)
 
 	req, err := http.NewRequest("GET", ig.APIURL+"/gateway/deal/confirms/"+dealRef, bodyReq)
@@ -826,6 +1046,10 @@ func (ig *IGMarkets) GetDealConfirmation(dealRef string) (*OTCDealConfirmation,
 
 // GetPositions - Get all open positions
 func (ig *IGMarkets) GetPositions() (*PositionsResponse, error) {
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.GetPositions()
+	}
+
 	bodyReq := new(bytes.Buffer)
 
 	req, err := http.NewRequest("GET", ig.APIURL+"/gateway/deal/positions/", bodyReq)
@@ -844,6 +1068,10 @@ func (ig *IGMarkets) GetPositions() (*PositionsResponse, error) {
 
 // GetPosition - Get the open position by reference
 func (ig *IGMarkets) GetPosition(dealRef string) (*Position, error) {
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.GetPosition(dealRef)
+	}
+
 	bodyReq := new(bytes.Buffer)
 
 	req, err := http.NewRequest("GET", ig.APIURL+"/gateway/deal/positions/"+dealRef, bodyReq)
@@ -860,21 +1088,66 @@ func (ig *IGMarkets) GetPosition(dealRef string) (*Position, error) {
 	return igResponse, nil
 }
 
-// DeletePositionsOTC - Closes one or more OTC positions
+// DeletePositionsOTC - Closes all the OTC positions at market, without waiting
+// for the confirmations: the error only tells which closes IG refused to take.
+// Deprecated: use CloseAllPositions for the outcome of each close
 func (ig *IGMarkets) DeletePositionsOTC() error {
-	bodyReq := new(bytes.Buffer)
-
-	req, err := http.NewRequest("DELETE", ig.APIURL+"/gateway/deal/positions/otc", bodyReq)
+	positions, err := ig.GetPositions()
 	if err != nil {
-		return fmt.Errorf("igmarkets: unable to create HTTP request: %v", err)
+		return err
 	}
 
-	_, err = ig.doRequest(req, 1, nil)
-	return err
+	failed := 0
+	var firstErr error
+	for _, position := range positions.Positions {
+		close, err := PositionCloseRequest(position, 0)
+		if err == nil {
+			_, err = ig.CloseOTCPosition(close)
+		}
+		if err != nil {
+			if failed == 0 {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("igmarkets: %d of %d positions not closed: %v", failed, len(positions.Positions), firstErr)
+	}
+	return nil
 }
 
 // PlaceOTCWorkingOrder - Place an OTC workingorder
 func (ig *IGMarkets) PlaceOTCWorkingOrder(order OTCWorkingOrderRequest) (*DealReference, error) {
+	if order.DealReference == "" {
+		ref, err := ig.nextDealReference()
+		if err != nil {
+			return nil, err
+		}
+		order.DealReference = ref
+	}
+
+	r := JournalRecord{Kind: JournalWorkingOrder, Strategy: order.Strategy, DealReference: order.DealReference}
+	return ig.journaled(r, order, func() (*DealReference, error) {
+		return ig.placeOTCWorkingOrder(order)
+	})
+}
+
+func (ig *IGMarkets) placeOTCWorkingOrder(order OTCWorkingOrderRequest) (ref *DealReference, err error) {
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+	if guard := ig.riskGuard(); guard != nil {
+		done, blocked := guard.admitWorkingOrder(order)
+		if blocked != nil {
+			return nil, blocked
+		}
+		defer func() { done(err) }()
+	}
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.PlaceOTCWorkingOrder(order)
+	}
+
 	bodyReq, err := json.Marshal(&order)
 	if err != nil {
 		return nil, fmt.Errorf("igmarkets: unable to marshal JSON: %v", err)
@@ -893,6 +1166,10 @@ func (ig *IGMarkets) PlaceOTCWorkingOrder(order OTCWorkingOrderRequest) (*DealRe
 
 // GetOTCWorkingOrders - Get all working orders
 func (ig *IGMarkets) GetOTCWorkingOrders() (*WorkingOrders, error) {
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.GetOTCWorkingOrders()
+	}
+
 	bodyReq := new(bytes.Buffer)
 	req, err := http.NewRequest("GET", ig.APIURL+"/gateway/deal/workingorders/", bodyReq)
 	if err != nil {
@@ -908,8 +1185,57 @@ func (ig *IGMarkets) GetOTCWorkingOrders() (*WorkingOrders, error) {
 	return igResponse, err
 }
 
+// UpdateOTCWorkingOrder - Update workingorder
+func (ig *IGMarkets) UpdateOTCWorkingOrder(dealID string, order OTCWorkingOrderUpdateRequest) (*DealReference, error) {
+	r := JournalRecord{Kind: JournalUpdateWorkingOrder, Strategy: order.Strategy, DealID: dealID}
+	return ig.journaled(r, order, func() (*DealReference, error) {
+		return ig.updateOTCWorkingOrder(dealID, order)
+	})
+}
+
+func (ig *IGMarkets) updateOTCWorkingOrder(dealID string, order OTCWorkingOrderUpdateRequest) (*DealReference, error) {
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+	if guard := ig.riskGuard(); guard != nil {
+		if err := guard.CheckWorkingOrderUpdate(dealID, order); err != nil {
+			return nil, err
+		}
+	}
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.UpdateOTCWorkingOrder(dealID, order)
+	}
+
+	bodyReq, err := json.Marshal(&order)
+	if err != nil {
+		return nil, fmt.Errorf("igmarkets: unable to marshal JSON: %v", err)
+	}
+	req, err := http.NewRequest("PUT", ig.APIURL+"/gateway/deal/workingorders/otc/"+dealID, bytes.NewReader(bodyReq))
+	if err != nil {
+		return nil, fmt.Errorf("igmarkets: unable to create HTTP request: %v", err)
+	}
+
+	igResponseInterface, err := ig.doRequest(req, 2, DealReference{})
+	if err != nil {
+		return nil, err
+	}
+	return igResponseInterface.(*DealReference), err
+}
+
 // DeleteOTCWorkingOrder - Delete workingorder
 func (ig *IGMarkets) DeleteOTCWorkingOrder(dealRef string) error {
+	r := JournalRecord{Kind: JournalDeleteWorkingOrder, DealID: dealRef}
+	_, err := ig.journaled(r, nil, func() (*DealReference, error) {
+		return nil, ig.deleteOTCWorkingOrder(dealRef)
+	})
+	return err
+}
+
+func (ig *IGMarkets) deleteOTCWorkingOrder(dealRef string) error {
+	if paper := ig.paperBroker(); paper != nil {
+		return paper.DeleteOTCWorkingOrder(dealRef)
+	}
+
 	bodyReq := new(bytes.Buffer)
 
 	req, err := http.NewRequest("DELETE", ig.APIURL+"/gateway/deal/workingorders/otc/"+dealRef, bodyReq)
@@ -929,7 +1255,7 @@ func (ig *IGMarkets) GetMarkets(epic string) (*MarketsResponse, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/gateway/deal/markets/%s",
 		ig.APIURL, epic), bodyReq)
 	if err != nil {
-		return nil, fmt.Errorf("igmarkets: unable to get markets data: %v", err)
+		return nil, fmt.Errorf("igmarkets: unable to get markets data: %w", err)
 	}
 
 	igResponseInterface, err := ig.doRequest(req, 3, MarketsResponse{})
@@ -963,7 +1289,7 @@ func (ig *IGMarkets) MarketSearch(term string) (*MarketSearchResponse, error) {
 	url := fmt.Sprintf("%s/gateway/deal/markets?searchTerm=%s", ig.APIURL, term)
 	req, err := http.NewRequest("GET", url, bodyReq)
 	if err != nil {
-		return nil, fmt.Errorf("igmarkets: unable to get markets data: %v", err)
+		return nil, fmt.Errorf("igmarkets: unable to get markets data: %w", err)
 	}
 
 	igResponseInterface, err := ig.doRequest(req, 1, MarketSearchResponse{})
@@ -1016,7 +1342,7 @@ func (ig *IGMarkets) doRequestWithResponseHeaders(req *http.Request, endpointVer
 
 	resp, err := ig.httpClient.Do(req)
 	if err != nil {
-		return igResponse, nil, fmt.Errorf("igmarkets: unable to get markets data: %v", err)
+		return igResponse, nil, fmt.Errorf("igmarkets: unable to get markets data: %w", err)
 	}
 
 	//handle logout 204
@@ -1032,10 +1358,10 @@ func (ig *IGMarkets) doRequestWithResponseHeaders(req *http.Request, endpointVer
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return igResponse, nil, fmt.Errorf("igmarkets: unable to get body of transactions markets data: %v", err)
+		return igResponse, nil, fmt.Errorf("igmarkets: unable to get body of transactions markets data: %w", err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return igResponse, nil, fmt.Errorf("igmarkets: unexpected HTTP status code: %d (body=%q)", resp.StatusCode, body)
+		return igResponse, nil, newAPIError(resp.StatusCode, body)
 	}
 
 	if igResponse != nil {
@@ -0,0 +1,76 @@
+package igmarkets_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/amaurybrisou/igmarkets"
+	"github.com/amaurybrisou/igmarkets/igmarketstest"
+)
+
+func TestUpdateOTCWorkingOrder(t *testing.T) {
+	update := igmarkets.OTCWorkingOrderUpdateRequest{
+		Type:         igmarkets.WorkingOrderTypeLimit,
+		TimeInForce:  igmarkets.TimeInForceGoodTillDate,
+		GoodTillDate: "2030/01/02 15:04",
+		Level:        1.05,
+		StopDistance: "20",
+		LimitLevel:   "1.1",
+	}
+
+	tests := []struct {
+		name   string
+		update igmarkets.OTCWorkingOrderUpdateRequest
+		status int
+		sent   bool
+		err    bool
+	}{
+		{"updated", update, http.StatusOK, true, false},
+		{"invalid update not sent", igmarkets.OTCWorkingOrderUpdateRequest{Type: igmarkets.WorkingOrderTypeLimit, Level: 1.05}, http.StatusOK, false, true},
+		{"unknown working order", update, http.StatusNotFound, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := igmarketstest.NewServer("")
+			defer srv.Close()
+
+			sent := false
+			srv.Mux.HandleFunc("/gateway/deal/workingorders/otc/DIAAA", func(w http.ResponseWriter, req *http.Request) {
+				sent = true
+				var got igmarkets.OTCWorkingOrderUpdateRequest
+				if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+					t.Error(err)
+				}
+				if req.Method != http.MethodPut || req.Header.Get("VERSION") != "2" || !reflect.DeepEqual(got, tt.update) {
+					t.Errorf("unexpected request %s version %s %+v", req.Method, req.Header.Get("VERSION"), got)
+				}
+				if tt.status != http.StatusOK {
+					http.Error(w, `{"errorCode":"error.service.otc.working-order.not-found"}`, tt.status)
+					return
+				}
+				w.Write([]byte(`{"dealReference":"REF1"}`))
+			})
+			srv.Mux.HandleFunc("/gateway/deal/confirms/REF1", func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"dealReference":"REF1","dealId":"DIAAA","dealStatus":"ACCEPTED","status":"AMENDED"}`))
+			})
+
+			confirmation, err := srv.NewClient(false).UpdateOTCWorkingOrderAndConfirm(context.Background(), "DIAAA", tt.update)
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if sent != tt.sent {
+				t.Fatalf("sent %v, want %v", sent, tt.sent)
+			}
+			if !tt.err && (confirmation.DealID != "DIAAA" || confirmation.DealStatus != igmarkets.DealStatusAccepted) {
+				t.Fatalf("unexpected confirmation %+v", confirmation)
+			}
+			if tt.status == http.StatusNotFound && !igmarkets.IsNotFound(err) {
+				t.Fatalf("error %v, want not found", err)
+			}
+		})
+	}
+}
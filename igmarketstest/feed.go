@@ -0,0 +1,191 @@
+package igmarketstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RandomFeed - random walk generator for CHART, MARKET and TRADE items
+// Candles of CHART items are ended (CONS_END=1) by the last update before
+// the next candle starts, assuming Next is called every Tick.
+type RandomFeed struct {
+	Price      float64       // Starting mid price
+	Spread     float64       // Offer - Bid
+	Volatility float64       // Max mid price move per update
+	Tick       time.Duration // Expected period between two Next calls
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	mid     float64
+	dayOpen float64
+	dayHigh float64
+	dayLow  float64
+	candles map[string]*feedCandle
+	deals   int
+}
+
+type feedCandle struct {
+	start                  time.Time
+	open, high, low, close float64
+	ticks                  int
+	volume                 float64
+}
+
+// NewRandomFeed - deterministic feed for the given seed
+func NewRandomFeed(seed int64, price, spread float64) *RandomFeed {
+	return &RandomFeed{
+		Price:      price,
+		Spread:     spread,
+		Volatility: spread,
+		Tick:       time.Second,
+		rand:       rand.New(rand.NewSource(seed)),
+		candles:    make(map[string]*feedCandle),
+	}
+}
+
+// Next - fields of the next update for item at now
+// item is either "CHART:<epic>:<interval>", "MARKET:<epic>" or "TRADE:<account>".
+func (f *RandomFeed) Next(item string, now time.Time) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.walk()
+
+	parts := strings.Split(item, ":")
+	switch parts[0] {
+	case "CHART":
+		interval := ""
+		if len(parts) > 2 {
+			interval = parts[2]
+		}
+		return f.chart(item, chartInterval(interval), now)
+	case "MARKET":
+		return f.market(now)
+	case "TRADE":
+		return f.trade(parts[len(parts)-1], now)
+	}
+	return map[string]string{}
+}
+
+func (f *RandomFeed) walk() {
+	if f.mid == 0 {
+		f.mid = f.Price
+		f.dayOpen, f.dayHigh, f.dayLow = f.mid, f.mid, f.mid
+	}
+	f.mid += (f.rand.Float64()*2 - 1) * f.Volatility
+	f.dayHigh = math.Max(f.dayHigh, f.mid)
+	f.dayLow = math.Min(f.dayLow, f.mid)
+}
+
+func chartInterval(interval string) time.Duration {
+	switch interval {
+	case "1MINUTE":
+		return time.Minute
+	case "5MINUTE":
+		return 5 * time.Minute
+	case "HOUR":
+		return time.Hour
+	}
+	return time.Second
+}
+
+func (f *RandomFeed) chart(item string, interval time.Duration, now time.Time) map[string]string {
+	start := now.Truncate(interval)
+
+	c, ok := f.candles[item]
+	if !ok || !c.start.Equal(start) {
+		c = &feedCandle{start: start, open: f.mid, high: f.mid, low: f.mid}
+		f.candles[item] = c
+	}
+
+	c.close = f.mid
+	c.high = math.Max(c.high, f.mid)
+	c.low = math.Min(c.low, f.mid)
+	c.ticks++
+	volume := float64(f.rand.Intn(10) + 1)
+	c.volume += volume
+
+	consEnd := "0"
+	if !now.Add(f.Tick).Truncate(interval).Equal(start) {
+		consEnd = "1"
+	}
+
+	half := f.Spread / 2
+	return map[string]string{
+		"UTM":              strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10),
+		"LTV":              formatFloat(volume),
+		"TTV":              formatFloat(c.volume),
+		"DAY_OPEN_MID":     formatFloat(f.dayOpen),
+		"DAY_NET_CHG_MID":  formatFloat(f.mid - f.dayOpen),
+		"DAY_PERC_CHG_MID": formatFloat((f.mid - f.dayOpen) / f.dayOpen * 100),
+		"DAY_HIGH":         formatFloat(f.dayHigh),
+		"DAY_LOW":          formatFloat(f.dayLow),
+		"OFR_OPEN":         formatFloat(c.open + half),
+		"OFR_HIGH":         formatFloat(c.high + half),
+		"OFR_LOW":          formatFloat(c.low + half),
+		"OFR_CLOSE":        formatFloat(c.close + half),
+		"BID_OPEN":         formatFloat(c.open - half),
+		"BID_HIGH":         formatFloat(c.high - half),
+		"BID_LOW":          formatFloat(c.low - half),
+		"BID_CLOSE":        formatFloat(c.close - half),
+		"LTP_OPEN":         formatFloat(c.open),
+		"LTP_HIGH":         formatFloat(c.high),
+		"LTP_LOW":          formatFloat(c.low),
+		"LTP_CLOSE":        formatFloat(c.close),
+		"CONS_END":         consEnd,
+		"CONS_TICK_COUNT":  strconv.Itoa(c.ticks),
+	}
+}
+
+func (f *RandomFeed) market(now time.Time) map[string]string {
+	half := f.Spread / 2
+	return map[string]string{
+		"BID":          formatFloat(f.mid - half),
+		"OFFER":        formatFloat(f.mid + half),
+		"HIGH":         formatFloat(f.dayHigh),
+		"LOW":          formatFloat(f.dayLow),
+		"MID_OPEN":     formatFloat(f.dayOpen),
+		"CHANGE":       formatFloat(f.mid - f.dayOpen),
+		"CHANGE_PCT":   formatFloat((f.mid - f.dayOpen) / f.dayOpen * 100),
+		"UPDATE_TIME":  now.UTC().Format("15:04:05"),
+		"MARKET_DELAY": "0",
+		"MARKET_STATE": "TRADEABLE",
+	}
+}
+
+func (f *RandomFeed) trade(account string, now time.Time) map[string]string {
+	f.deals++
+
+	direction := "BUY"
+	if f.rand.Intn(2) == 0 {
+		direction = "SELL"
+	}
+
+	opu, _ := json.Marshal(map[string]interface{}{
+		"dealReference": fmt.Sprintf("REF%06d", f.deals),
+		"dealId":        fmt.Sprintf("DIAAAA%06d", f.deals),
+		"direction":     direction,
+		"epic":          "CS.D.EURUSD.MINI.IP",
+		"status":        "OPEN",
+		"dealStatus":    "ACCEPTED",
+		"level":         f.mid,
+		"size":          float64(f.rand.Intn(5) + 1),
+		"currency":      "EUR",
+		"expiry":        "-",
+		"timestamp":     now.UTC().Format("2006-01-02T15:04:05.000"),
+		"channel":       "PublicRestOTC",
+		"account":       account,
+	})
+
+	return map[string]string{"OPU": string(opu)}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 5, 64)
+}
@@ -0,0 +1,495 @@
+package igmarketstest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lightstreamer operations which can be made to fail with FailNext
+const (
+	OpCreateSession = "create_session"
+	OpControl       = "control"
+	OpBindSession   = "bind_session"
+)
+
+// Subscription - table added through control.txt
+type Subscription struct {
+	Session  string
+	Table    int
+	Items    []string
+	Schema   []string
+	Mode     string
+	Snapshot bool
+}
+
+// Update - scripted update
+type Update struct {
+	Delay  time.Duration     // Wait before pushing the update
+	Item   string            // e.g. "CHART:CS.D.EURUSD.MINI.IP:SECOND"
+	Fields map[string]string // Missing schema fields are sent unchanged
+}
+
+// LightstreamerServer - Lightstreamer server stand-in speaking the text protocol
+// used by IG: create_session.txt, control.txt and bind_session.txt
+type LightstreamerServer struct {
+	*httptest.Server
+
+	// ControlAddress - returned on session creation, empty keeps the client on URL
+	ControlAddress string
+	// ProbeInterval - PROBE period on bound streams, 0 disables probes
+	ProbeInterval time.Duration
+	// Authenticate - checks LS_user and LS_password, nil accepts everyone
+	Authenticate func(user, password string) bool
+
+	mu       sync.Mutex
+	nextID   int
+	sessions map[string]*lsSession
+	failures map[string][]string
+	last     map[string]map[string]string // item -> field -> last pushed value
+}
+
+type lsSession struct {
+	id     string
+	user   string
+	tables map[int]*Subscription
+	events chan lsEvent
+	done   chan struct{}
+}
+
+type lsEvent struct {
+	line       string
+	loop       bool
+	disconnect bool
+}
+
+// NewLightstreamerServer - Start a Lightstreamer stand-in
+func NewLightstreamerServer() *LightstreamerServer {
+	s := &LightstreamerServer{
+		ProbeInterval: 5 * time.Second,
+		sessions:      make(map[string]*lsSession),
+		failures:      make(map[string][]string),
+		last:          make(map[string]map[string]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lightstreamer/create_session.txt", s.handleCreateSession)
+	mux.HandleFunc("/lightstreamer/control.txt", s.handleControl)
+	mux.HandleFunc("/lightstreamer/bind_session.txt", s.handleBindSession)
+
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Close - destroy every session and shut the server down
+func (s *LightstreamerServer) Close() {
+	s.mu.Lock()
+	for id, sess := range s.sessions {
+		close(sess.done)
+		delete(s.sessions, id)
+	}
+	s.mu.Unlock()
+
+	s.Server.Close()
+}
+
+// FailNext - the next request to op answers ERROR with the given code and message
+func (s *LightstreamerServer) FailNext(op string, code int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[op] = append(s.failures[op], fmt.Sprintf("ERROR\r\n%d\r\n%s\r\n", code, message))
+}
+
+func (s *LightstreamerServer) nextFailure(op string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.failures[op]) == 0 {
+		return "", false
+	}
+	failure := s.failures[op][0]
+	s.failures[op] = s.failures[op][1:]
+	return failure, true
+}
+
+// Subscriptions - tables currently added on all sessions
+func (s *LightstreamerServer) Subscriptions() []Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var subs []Subscription
+	for _, sess := range s.sessions {
+		for _, t := range sess.tables {
+			subs = append(subs, *t)
+		}
+	}
+	return subs
+}
+
+// WaitForSubscription - block until item is subscribed on any session
+func (s *LightstreamerServer) WaitForSubscription(ctx context.Context, item string) error {
+	for {
+		for _, sub := range s.Subscriptions() {
+			for _, it := range sub.Items {
+				if it == item {
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("igmarketstest: %s not subscribed: %v", item, ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+type delivery struct {
+	sess *lsSession
+	line string
+}
+
+// Push - send an update to every table subscribed to item
+// fields missing from values are sent as unchanged. Pushed values are kept
+// as the item snapshot sent to new subscriptions asking for it.
+func (s *LightstreamerServer) Push(item string, values map[string]string) {
+	var deliveries []delivery
+
+	s.mu.Lock()
+	last, ok := s.last[item]
+	if !ok {
+		last = make(map[string]string, len(values))
+		s.last[item] = last
+	}
+	for k, v := range values {
+		last[k] = v
+	}
+	for _, sess := range s.sessions {
+		for _, t := range sess.tables {
+			for i, it := range t.Items {
+				if it != item {
+					continue
+				}
+				line := fmt.Sprintf("%d,%d", t.Table, i+1)
+				for _, field := range t.Schema {
+					line += "|" + encodeValue(values, field)
+				}
+				deliveries = append(deliveries, delivery{sess: sess, line: line})
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, d := range deliveries {
+		d.sess.send(lsEvent{line: d.line})
+	}
+}
+
+// encodeValue - "" unchanged, "$" empty string, "#" null
+func encodeValue(values map[string]string, field string) string {
+	v, ok := values[field]
+	if !ok {
+		return ""
+	}
+	if v == "" {
+		return "$"
+	}
+	return v
+}
+
+// Play - push the scripted updates in order, honouring their delays
+func (s *LightstreamerServer) Play(ctx context.Context, script []Update) error {
+	for _, u := range script {
+		if u.Delay > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(u.Delay):
+			}
+		}
+		s.Push(u.Item, u.Fields)
+	}
+	return nil
+}
+
+// Stream - push updates generated by feed for item every interval until ctx is done
+func (s *LightstreamerServer) Stream(ctx context.Context, item string, interval time.Duration, feed *RandomFeed) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.Push(item, feed.Next(item, now))
+		}
+	}
+}
+
+// Overflow - notify every table subscribed to item that lost updates were dropped
+func (s *LightstreamerServer) Overflow(item string, lost int) {
+	var deliveries []delivery
+
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		for _, t := range sess.tables {
+			for i, it := range t.Items {
+				if it == item {
+					deliveries = append(deliveries, delivery{sess: sess, line: fmt.Sprintf("%d,%d,OV%d", t.Table, i+1, lost)})
+				}
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, d := range deliveries {
+		d.sess.send(lsEvent{line: d.line})
+	}
+}
+
+// Probe - send PROBE on every bound stream
+func (s *LightstreamerServer) Probe() {
+	s.broadcast(lsEvent{line: "PROBE"})
+}
+
+// Loop - send LOOP and end every bound stream, clients are expected to rebind
+func (s *LightstreamerServer) Loop() {
+	s.broadcast(lsEvent{loop: true})
+}
+
+// Disconnect - abruptly close every bound stream
+func (s *LightstreamerServer) Disconnect() {
+	s.broadcast(lsEvent{disconnect: true})
+}
+
+// SendRaw - write line as is on every bound stream, e.g. "ERROR" or "END"
+func (s *LightstreamerServer) SendRaw(line string) {
+	s.broadcast(lsEvent{line: line})
+}
+
+func (s *LightstreamerServer) broadcast(e lsEvent) {
+	s.mu.Lock()
+	sessions := make([]*lsSession, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		sess.send(e)
+	}
+}
+
+func (sess *lsSession) send(e lsEvent) {
+	select {
+	case sess.events <- e:
+	case <-sess.done:
+	}
+}
+
+func (s *LightstreamerServer) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.nextFailure(OpCreateSession); ok {
+		fmt.Fprint(w, failure)
+		return
+	}
+
+	user, password := r.FormValue("LS_user"), r.FormValue("LS_password")
+	if s.Authenticate != nil && !s.Authenticate(user, password) {
+		fmt.Fprint(w, "ERROR\r\n1\r\nUser/password check failed\r\n")
+		return
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	sess := &lsSession{
+		id:     fmt.Sprintf("S%08d", s.nextID),
+		user:   user,
+		tables: make(map[int]*Subscription),
+		events: make(chan lsEvent, 1024),
+		done:   make(chan struct{}),
+	}
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+
+	fmt.Fprint(w, s.sessionHeader(sess))
+}
+
+func (s *LightstreamerServer) sessionHeader(sess *lsSession) string {
+	keepalive := s.ProbeInterval.Milliseconds()
+	return fmt.Sprintf("OK\r\nSessionId:%s\r\nControlAddress:%s\r\nKeepaliveMillis:%d\r\nMaxBandwidth:0.0\r\n\r\n",
+		sess.id, s.ControlAddress, keepalive)
+}
+
+func (s *LightstreamerServer) handleControl(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.nextFailure(OpControl); ok {
+		fmt.Fprint(w, failure)
+		return
+	}
+
+	var snapshot []delivery
+
+	s.mu.Lock()
+
+	sess, ok := s.sessions[r.FormValue("LS_session")]
+	if !ok {
+		s.mu.Unlock()
+		fmt.Fprint(w, "SYNC ERROR\r\n")
+		return
+	}
+
+	table, _ := strconv.Atoi(formValue(r, "LS_table", "LS_Table"))
+
+	switch r.FormValue("LS_op") {
+	case "add":
+		sub := &Subscription{
+			Session:  sess.id,
+			Table:    table,
+			Items:    splitList(r.FormValue("LS_id")),
+			Schema:   splitList(r.FormValue("LS_schema")),
+			Mode:     r.FormValue("LS_mode"),
+			Snapshot: r.FormValue("LS_snapshot") == "true",
+		}
+		sess.tables[table] = sub
+		if sub.Snapshot {
+			snapshot = s.snapshot(sess, sub)
+		}
+	case "delete":
+		delete(sess.tables, table)
+	case "destroy":
+		close(sess.done)
+		delete(s.sessions, sess.id)
+	default:
+		s.mu.Unlock()
+		fmt.Fprintf(w, "ERROR\r\n%d\r\n%s\r\n", 21, "Unsupported operation")
+		return
+	}
+
+	s.mu.Unlock()
+
+	fmt.Fprint(w, "OK\r\n")
+
+	for _, d := range snapshot {
+		d.sess.send(lsEvent{line: d.line})
+	}
+}
+
+// snapshot - MERGE items get a single update, null when nothing was pushed yet,
+// DISTINCT and COMMAND items get their last update followed by EOS
+func (s *LightstreamerServer) snapshot(sess *lsSession, sub *Subscription) []delivery {
+	var deliveries []delivery
+
+	for i, item := range sub.Items {
+		id := fmt.Sprintf("%d,%d", sub.Table, i+1)
+		last, ok := s.last[item]
+
+		switch sub.Mode {
+		case "MERGE":
+			line := id
+			for _, field := range sub.Schema {
+				v := encodeValue(last, field)
+				if v == "" {
+					v = "#"
+				}
+				line += "|" + v
+			}
+			deliveries = append(deliveries, delivery{sess: sess, line: line})
+		case "DISTINCT", "COMMAND":
+			if ok {
+				line := id
+				for _, field := range sub.Schema {
+					line += "|" + encodeValue(last, field)
+				}
+				deliveries = append(deliveries, delivery{sess: sess, line: line})
+			}
+			deliveries = append(deliveries, delivery{sess: sess, line: id + ",EOS"})
+		}
+	}
+
+	return deliveries
+}
+
+func (s *LightstreamerServer) handleBindSession(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.nextFailure(OpBindSession); ok {
+		fmt.Fprint(w, failure)
+		return
+	}
+
+	s.mu.Lock()
+	sess, ok := s.sessions[r.FormValue("LS_session")]
+	s.mu.Unlock()
+	if !ok {
+		fmt.Fprint(w, "SYNC ERROR\r\n")
+		return
+	}
+
+	limit, err := strconv.Atoi(r.FormValue("LS_content_length"))
+	if err != nil || limit <= 0 {
+		limit = 100000000
+	}
+
+	flusher, _ := w.(http.Flusher)
+	written := 0
+	write := func(str string) {
+		n, _ := fmt.Fprint(w, str)
+		written += n
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	write(s.sessionHeader(sess))
+
+	var probe <-chan time.Time
+	if s.ProbeInterval > 0 {
+		t := time.NewTicker(s.ProbeInterval)
+		defer t.Stop()
+		probe = t.C
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sess.done:
+			write("END\r\n")
+			return
+		case <-probe:
+			write("PROBE\r\n")
+		case e := <-sess.events:
+			switch {
+			case e.disconnect:
+				panic(http.ErrAbortHandler)
+			case e.loop:
+				write("LOOP\r\n\r\n")
+				return
+			}
+			write(e.line + "\r\n")
+			if written >= limit {
+				write("LOOP\r\n\r\n")
+				return
+			}
+		}
+	}
+}
+
+func formValue(r *http.Request, keys ...string) string {
+	for _, k := range keys {
+		if v := r.FormValue(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// splitList - items and fields are joined with "+", which form decoding turns into spaces
+func splitList(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool { return r == '+' || r == ' ' })
+}
@@ -0,0 +1,117 @@
+// Package igmarketstest provides IG REST API and Lightstreamer stand-ins
+// so that streaming code can be tested and demonstrated without an IG account.
+//
+//	ls := igmarketstest.NewLightstreamerServer()
+//	defer ls.Close()
+//	srv := igmarketstest.NewServer(ls.URL)
+//	defer srv.Close()
+//
+//	ig := srv.NewClient(false)
+//	ticks, _, _ := ig.OpenLightStreamerSubscription(ctx, options)
+//	ls.Push("CHART:CS.D.EURUSD.MINI.IP:SECOND", map[string]string{"UTM": "1606054455000"})
+package igmarketstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+)
+
+// Server - IG REST API stand-in serving the session endpoints
+// Other endpoints can be added to Mux.
+type Server struct {
+	*httptest.Server
+	Mux *http.ServeMux
+
+	AccountID             string
+	CurrencyIsoCode       string
+	CST                   string
+	XST                   string
+	LightstreamerEndpoint string // Returned by the version 2 session endpoint
+}
+
+// NewServer - Start an IG REST API stand-in pointing to the given lightstreamer endpoint
+func NewServer(lightstreamerEndpoint string) *Server {
+	s := &Server{
+		Mux:                   http.NewServeMux(),
+		AccountID:             "ABC123",
+		CurrencyIsoCode:       "EUR",
+		CST:                   "cst-token",
+		XST:                   "xst-token",
+		LightstreamerEndpoint: lightstreamerEndpoint,
+	}
+
+	s.Mux.HandleFunc("/gateway/deal/session", s.handleSession)
+	s.Mux.HandleFunc("/gateway/deal/session/refresh-token", s.handleRefreshToken)
+
+	s.Server = httptest.NewServer(s.Mux)
+
+	return s
+}
+
+// NewClient - Create an igmarkets client using this server
+func (s *Server) NewClient(autoRefreshToken bool) *igmarkets.IGMarkets {
+	ig, _ := igmarkets.New(igmarkets.DemoAPIURL, "api-key", s.AccountID, "identifier", "password",
+		autoRefreshToken, 5*time.Second)
+	ig.APIURL = s.URL
+	return ig
+}
+
+func (s *Server) oauthToken() igmarkets.OAuthToken {
+	return igmarkets.OAuthToken{
+		AccessToken:  "access-token",
+		ExpiresIn:    "60",
+		RefreshToken: "refresh-token",
+		Scope:        "profile",
+		TokenType:    "Bearer",
+	}
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		if r.Header.Get("VERSION") == "2" {
+			w.Header().Set("CST", s.CST)
+			w.Header().Set("X-SECURITY-TOKEN", s.XST)
+			writeJSON(w, igmarkets.SessionVersion2{
+				AccountType:           "CFD",
+				CurrencyIsoCode:       s.CurrencyIsoCode,
+				CurrentAccountId:      s.AccountID,
+				LightstreamerEndpoint: s.LightstreamerEndpoint,
+				ClientID:              "client",
+				DealingEnabled:        true,
+			})
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"clientId":              "client",
+			"accountId":             s.AccountID,
+			"lightstreamerEndpoint": s.LightstreamerEndpoint,
+			"oauthToken":            s.oauthToken(),
+			"timezoneOffset":        0,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.oauthToken())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,496 @@
+package igmarkets
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of JournalRecord
+const (
+	JournalOrder        = "ORDER"
+	JournalWorkingOrder = "WORKING_ORDER"
+	JournalUpdate       = "UPDATE"
+	JournalClose        = "CLOSE"
+	JournalConfirmation = "CONFIRMATION"
+
+	JournalUpdateWorkingOrder = "UPDATE_WORKING_ORDER"
+	JournalDeleteWorkingOrder = "DELETE_WORKING_ORDER"
+)
+
+// Stages of the JournalRecord of a request
+const (
+	// JournalRequest - written before the request is sent
+	JournalRequest = "REQUEST"
+	// JournalOutcome - written once IG answered, or the request failed
+	JournalOutcome = "OUTCOME"
+)
+
+// journalRotationFormat - suffix of the rotated files of a JournalFile
+const journalRotationFormat = "20060102T150405.000000000"
+
+// JournalRecord - an order request or a deal confirmation in the audit journal
+type JournalRecord struct {
+	Seq      uint64    `json:"seq"` // set by JournalFile
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Strategy string    `json:"strategy,omitempty"`
+	// Stage - JournalRequest or JournalOutcome, empty for confirmations
+	Stage string `json:"stage,omitempty"`
+
+	// DealReference - of the order, or returned by IG for updates and closes
+	DealReference string `json:"dealReference,omitempty"`
+	// DealID - position updated or closed
+	DealID string `json:"dealId,omitempty"`
+
+	Request      json.RawMessage      `json:"request,omitempty"`
+	Confirmation *OTCDealConfirmation `json:"confirmation,omitempty"`
+	Error        string               `json:"error,omitempty"`
+
+	// Checksum - set by JournalFile, SHA-256 of the previous checksum and of
+	// the record without its checksum
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// JournalSink - where an AuditJournal writes its records
+type JournalSink interface {
+	Write(JournalRecord) error
+}
+
+// AuditJournal - record of every order, working order, update, close and
+// working order deletion sent by an IGMarkets, before it is sent and once it
+// is answered, and of the confirmations waited for, see EnableAuditJournal
+type AuditJournal struct {
+	// Strategy - tag of the requests without one
+	Strategy string
+
+	sink JournalSink
+}
+
+// NewAuditJournal - journal writing to sink
+func NewAuditJournal(sink JournalSink) *AuditJournal {
+	return &AuditJournal{sink: sink}
+}
+
+// EnableAuditJournal - record the requests of ig to sink
+func (ig *IGMarkets) EnableAuditJournal(sink JournalSink) *AuditJournal {
+	j := NewAuditJournal(sink)
+
+	ig.Lock()
+	ig.auditJournal = j
+	ig.Unlock()
+
+	return j
+}
+
+// DisableAuditJournal - stop recording the requests of ig
+func (ig *IGMarkets) DisableAuditJournal() {
+	ig.Lock()
+	ig.auditJournal = nil
+	ig.Unlock()
+}
+
+// journaled - send between the records of request and of its outcome, a
+// request without outcome was interrupted and may have reached IG
+func (ig *IGMarkets) journaled(r JournalRecord, request interface{}, send func() (*DealReference, error)) (*DealReference, error) {
+	r.Stage = JournalRequest
+	ig.journal(r, request, nil, nil)
+
+	ref, err := send()
+
+	r.Stage = JournalOutcome
+	ig.journal(r, nil, ref, err)
+	return ref, err
+}
+
+// journal - write r with request or its outcome when a journal is enabled,
+// failures are logged and never block a request
+func (ig *IGMarkets) journal(r JournalRecord, request interface{}, ref *DealReference, err error) {
+	ig.RLock()
+	j := ig.auditJournal
+	ig.RUnlock()
+	if j == nil {
+		return
+	}
+
+	r.Time = time.Now().UTC()
+	if r.Strategy == "" {
+		r.Strategy = j.Strategy
+	}
+	if ref != nil && ref.DealReference != "" {
+		r.DealReference = ref.DealReference
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if request != nil {
+		b, merr := json.Marshal(request)
+		if merr != nil {
+			log.WithError(merr).Error("igmarkets : cannot marshal journal request")
+		}
+		r.Request = b
+	}
+
+	if werr := j.sink.Write(r); werr != nil {
+		log.WithError(werr).WithField("dealReference", r.DealReference).Error("igmarkets : cannot write audit journal")
+	}
+}
+
+// JournalFile - JSON Lines sink, records are chained by their checksum. The
+// file is renamed with a timestamp suffix and a new one started once it
+// reaches MaxSize bytes.
+type JournalFile struct {
+	Path    string
+	MaxSize int64 // no rotation when 0
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	seq  uint64
+	prev string
+}
+
+// OpenJournalFile - journal file at path, appended to if it exists
+func OpenJournalFile(path string, maxSize int64) (*JournalFile, error) {
+	files, err := journalFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	jf := &JournalFile{Path: path, MaxSize: maxSize}
+	for i := len(files) - 1; i >= 0 && jf.prev == ""; i-- {
+		records, err := readJournalFile(files[i], "", false)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			last := records[len(records)-1]
+			jf.seq, jf.prev = last.Seq, last.Checksum
+		}
+	}
+
+	if err := jf.open(); err != nil {
+		return nil, err
+	}
+	return jf, nil
+}
+
+func (jf *JournalFile) open() error {
+	f, err := os.OpenFile(jf.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("igmarkets: cannot open journal: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("igmarkets: cannot open journal: %v", err)
+	}
+	jf.f, jf.size = f, info.Size()
+	return nil
+}
+
+// Write - append r, numbered and chained to the previous record
+func (jf *JournalFile) Write(r JournalRecord) error {
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+
+	if jf.f == nil {
+		return fmt.Errorf("igmarkets: journal %s closed", jf.Path)
+	}
+
+	r.Seq = jf.seq + 1
+	line, checksum, err := journalLine(r, jf.prev)
+	if err != nil {
+		return err
+	}
+
+	if jf.MaxSize > 0 && jf.size > 0 && jf.size+int64(len(line)) > jf.MaxSize {
+		if err := jf.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := jf.f.Write(line); err != nil {
+		return fmt.Errorf("igmarkets: cannot write journal: %v", err)
+	}
+	if err := jf.f.Sync(); err != nil {
+		return fmt.Errorf("igmarkets: cannot sync journal: %v", err)
+	}
+
+	jf.size += int64(len(line))
+	jf.seq, jf.prev = r.Seq, checksum
+	return nil
+}
+
+// rotate - rename the current file and start a new one
+func (jf *JournalFile) rotate() error {
+	if err := jf.f.Close(); err != nil {
+		return fmt.Errorf("igmarkets: cannot close journal: %v", err)
+	}
+	jf.f = nil
+
+	rotated := jf.Path + "." + time.Now().UTC().Format(journalRotationFormat)
+	if err := os.Rename(jf.Path, rotated); err != nil {
+		return fmt.Errorf("igmarkets: cannot rotate journal: %v", err)
+	}
+	return jf.open()
+}
+
+// Close - close the file, records cannot be written anymore
+func (jf *JournalFile) Close() error {
+	jf.mu.Lock()
+	defer jf.mu.Unlock()
+
+	if jf.f == nil {
+		return nil
+	}
+	err := jf.f.Close()
+	jf.f = nil
+	return err
+}
+
+// journalLine - r as a JSON line with its checksum as the last field
+func journalLine(r JournalRecord, prev string) ([]byte, string, error) {
+	r.Checksum = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("igmarkets: cannot marshal journal record: %v", err)
+	}
+
+	sum := sha256.Sum256(append([]byte(prev), b...))
+	checksum := hex.EncodeToString(sum[:])
+
+	line := make([]byte, 0, len(b)+len(checksum)+16)
+	line = append(line, b[:len(b)-1]...)
+	line = append(line, `,"checksum":"`...)
+	line = append(line, checksum...)
+	line = append(line, "\"}\n"...)
+	return line, checksum, nil
+}
+
+// journalFiles - rotated files of the journal at path, oldest first, then path
+// if it exists
+func journalFiles(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("igmarkets: cannot list journal files: %v", err)
+	}
+
+	var files []string
+	for _, m := range matches {
+		if _, err := time.Parse(journalRotationFormat, m[len(path)+1:]); err == nil {
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// ReadJournal - records of the journal at path, its rotated files included,
+// with their checksums verified. The records read before a broken checksum are
+// returned with the error.
+func ReadJournal(path string) ([]JournalRecord, error) {
+	files, err := journalFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []JournalRecord
+	prev := ""
+	for _, file := range files {
+		r, err := readJournalFile(file, prev, true)
+		records = append(records, r...)
+		if err != nil {
+			return records, err
+		}
+		if len(r) > 0 {
+			prev = r[len(r)-1].Checksum
+		}
+	}
+	return records, nil
+}
+
+// readJournalFile - records of file, their checksums are verified from prev
+// when verify is set
+func readJournalFile(file, prev string, verify bool) ([]JournalRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("igmarkets: cannot open journal: %v", err)
+	}
+	defer f.Close()
+
+	var records []JournalRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var r JournalRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return records, fmt.Errorf("igmarkets: journal %s line %d: %v", file, n, err)
+		}
+
+		if verify {
+			suffix := []byte(`,"checksum":"` + r.Checksum + `"}`)
+			if !bytes.HasSuffix(line, suffix) {
+				return records, fmt.Errorf("igmarkets: journal %s line %d: checksum missing", file, n)
+			}
+			b := append(append([]byte(nil), line[:len(line)-len(suffix)]...), '}')
+			sum := sha256.Sum256(append([]byte(prev), b...))
+			if hex.EncodeToString(sum[:]) != r.Checksum {
+				return records, fmt.Errorf("igmarkets: journal %s line %d: checksum mismatch", file, n)
+			}
+		}
+
+		prev = r.Checksum
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return records, fmt.Errorf("igmarkets: cannot read journal %s: %v", file, err)
+	}
+	return records, nil
+}
+
+// JournalQuery - filter of journal records, empty fields match any record
+type JournalQuery struct {
+	Strategy      string
+	DealReference string
+	DealID        string // target of the request or affected by the confirmation
+	Kinds         []string
+	From, To      time.Time
+}
+
+// Match - true if r passes the filter
+func (q JournalQuery) Match(r JournalRecord) bool {
+	if q.Strategy != "" && r.Strategy != q.Strategy {
+		return false
+	}
+	if q.DealReference != "" && r.DealReference != q.DealReference {
+		return false
+	}
+	if q.DealID != "" && !r.concerns(q.DealID) {
+		return false
+	}
+	if len(q.Kinds) > 0 {
+		found := false
+		for _, k := range q.Kinds {
+			found = found || k == r.Kind
+		}
+		if !found {
+			return false
+		}
+	}
+	if !q.From.IsZero() && r.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !r.Time.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// concerns - true if r targets or affects the deal dealID
+func (r JournalRecord) concerns(dealID string) bool {
+	if r.DealID == dealID {
+		return true
+	}
+	if c := r.Confirmation; c != nil {
+		if c.DealID == dealID {
+			return true
+		}
+		for _, d := range c.AffectedDeals {
+			if d.DealID == dealID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dealIDs - deals r targets or affects
+func (r JournalRecord) dealIDs() []string {
+	var ids []string
+	if r.DealID != "" {
+		ids = append(ids, r.DealID)
+	}
+	if c := r.Confirmation; c != nil {
+		if c.DealID != "" {
+			ids = append(ids, c.DealID)
+		}
+		for _, d := range c.AffectedDeals {
+			ids = append(ids, d.DealID)
+		}
+	}
+	return ids
+}
+
+// FilterJournal - records matching q, in order
+func FilterJournal(records []JournalRecord, q JournalQuery) []JournalRecord {
+	var matching []JournalRecord
+	for _, r := range records {
+		if q.Match(r) {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
+
+// DealLifecycle - records of the deal with reference or deal ID id, in
+// order: the order, its confirmation, then the updates and closes of the
+// positions it opened and their confirmations
+func DealLifecycle(records []JournalRecord, id string) []JournalRecord {
+	refs := map[string]bool{id: true}
+	ids := map[string]bool{id: true}
+	in := make([]bool, len(records))
+
+	for changed := true; changed; {
+		changed = false
+		for i, r := range records {
+			if in[i] {
+				continue
+			}
+
+			linked := r.DealReference != "" && refs[r.DealReference]
+			for _, d := range r.dealIDs() {
+				linked = linked || ids[d]
+			}
+			if !linked {
+				continue
+			}
+
+			in[i], changed = true, true
+			if r.DealReference != "" {
+				refs[r.DealReference] = true
+			}
+			for _, d := range r.dealIDs() {
+				ids[d] = true
+			}
+		}
+	}
+
+	var lifecycle []JournalRecord
+	for i, r := range records {
+		if in[i] {
+			lifecycle = append(lifecycle, r)
+		}
+	}
+	return lifecycle
+}
@@ -0,0 +1,135 @@
+package igmarkets_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/amaurybrisou/igmarkets"
+)
+
+// memoryJournal - sink keeping the records, and the trade updates of the
+// paper broker as records of kind "SENT"
+type memoryJournal struct {
+	mu      sync.Mutex
+	records []igmarkets.JournalRecord
+}
+
+func (m *memoryJournal) Write(r igmarkets.JournalRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = append(m.records, r)
+	return nil
+}
+
+func (m *memoryJournal) sent(igmarkets.TradeUpdate) {
+	m.Write(igmarkets.JournalRecord{Kind: "SENT"})
+}
+
+func (m *memoryJournal) take() []igmarkets.JournalRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := m.records
+	m.records = nil
+	return records
+}
+
+func TestAuditJournalRequestAndOutcome(t *testing.T) {
+	_, ig, paper := newPaperClient(t)
+	journal := &memoryJournal{}
+	ig.EnableAuditJournal(journal).Strategy = "test"
+	paper.OnTradeUpdate = journal.sent
+
+	order := paperOrder(igmarkets.DirectionBuy, 1, true)
+	order.DealReference = "ORDER1"
+	working := igmarkets.OTCWorkingOrderRequest{
+		Epic:          "FX",
+		Direction:     igmarkets.DirectionBuy,
+		Size:          1,
+		Level:         110,
+		Type:          igmarkets.WorkingOrderTypeStop,
+		TimeInForce:   igmarkets.TimeInForceGoodTillCancelled,
+		CurrencyCode:  "USD",
+		Expiry:        "-",
+		DealReference: "WORKING1",
+	}
+
+	var position, workingOrder string
+	steps := []struct {
+		kind string
+		call func() error
+	}{
+		{igmarkets.JournalOrder, func() error {
+			_, err := ig.PlaceOTCOrder(order)
+			positions, _ := ig.GetPositions()
+			position = positions.Positions[0].Position.DealID
+			return err
+		}},
+		{igmarkets.JournalUpdate, func() error {
+			_, err := ig.UpdateOTCOrder(position, igmarkets.OTCUpdateOrderRequest{StopLevel: "90"})
+			return err
+		}},
+		{igmarkets.JournalClose, func() error {
+			_, err := ig.CloseOTCPosition(igmarkets.OTCPositionCloseRequest{
+				DealID: position, Direction: igmarkets.DirectionSell, Size: 1, OrderType: igmarkets.OrderTypeMarket,
+			})
+			return err
+		}},
+		{igmarkets.JournalWorkingOrder, func() error {
+			_, err := ig.PlaceOTCWorkingOrder(working)
+			orders, _ := ig.GetOTCWorkingOrders()
+			workingOrder = orders.WorkingOrders[0].WorkingOrderData.DealID
+			return err
+		}},
+		{igmarkets.JournalUpdateWorkingOrder, func() error {
+			_, err := ig.UpdateOTCWorkingOrder(workingOrder, igmarkets.OTCWorkingOrderUpdateRequest{
+				Level: 112, Type: igmarkets.WorkingOrderTypeStop, TimeInForce: igmarkets.TimeInForceGoodTillCancelled,
+			})
+			return err
+		}},
+		{igmarkets.JournalDeleteWorkingOrder, func() error {
+			return ig.DeleteOTCWorkingOrder(workingOrder)
+		}},
+	}
+
+	for _, step := range steps {
+		if err := step.call(); err != nil {
+			t.Fatalf("%s: %v", step.kind, err)
+		}
+
+		records := journal.take()
+		if len(records) < 3 {
+			t.Fatalf("%s: got records %+v, want the request, the updates sent and the outcome", step.kind, records)
+		}
+		request, sent, outcome := records[0], records[1:len(records)-1], records[len(records)-1]
+		if request.Kind != step.kind || request.Stage != igmarkets.JournalRequest || request.Strategy != "test" {
+			t.Errorf("%s: unexpected request record %+v", step.kind, request)
+		}
+		if step.kind != igmarkets.JournalDeleteWorkingOrder && len(request.Request) == 0 {
+			t.Errorf("%s: request not recorded", step.kind)
+		}
+		for _, r := range sent {
+			if r.Kind != "SENT" {
+				t.Errorf("%s: unexpected record %+v between the request and its outcome", step.kind, r)
+			}
+		}
+		if outcome.Kind != step.kind || outcome.Stage != igmarkets.JournalOutcome || outcome.Error != "" || len(outcome.Request) != 0 {
+			t.Errorf("%s: unexpected outcome record %+v", step.kind, outcome)
+		}
+	}
+}
+
+func TestAuditJournalRecordsFailures(t *testing.T) {
+	_, ig, _ := newPaperClient(t)
+	journal := &memoryJournal{}
+	ig.EnableAuditJournal(journal)
+
+	if err := ig.DeleteOTCWorkingOrder("UNKNOWN"); !igmarkets.IsNotFound(err) {
+		t.Fatalf("got %v, want not found", err)
+	}
+
+	records := journal.take()
+	if len(records) != 2 || records[0].Stage != igmarkets.JournalRequest || records[1].Stage != igmarkets.JournalOutcome ||
+		records[1].DealID != "UNKNOWN" || records[1].Error == "" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+}
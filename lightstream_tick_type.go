@@ -1,11 +1,8 @@
 package igmarkets
 
 import (
-	"encoding/json"
 	"fmt"
-	"reflect"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -33,128 +30,216 @@ type LightStreamChartTick struct {
 	LTP_CLOSE        float64    `json:"LTP_CLOSE,omitempty"`        //Candle close price (Last Traded Price)
 	CONS_END         float64    `json:"CONS_END,omitempty"`         //1 when candle ends, otherwise 0
 	CONS_TICK_COUNT  float64    `json:"CONS_TICK_COUNT,omitempty"`  //Number of ticks in candle
+
+	Snapshot bool `json:"snapshot,omitempty"` //Part of the initial snapshot, not a real-time update
+	Lost     int  `json:"lost,omitempty"`     //Updates dropped by the server before this tick
+
+	Present ChartTickFields `json:"-"` //Fields holding a value
+	Changed ChartTickFields `json:"-"` //Fields updated by this tick
 }
 
-func (dest *LightStreamChartTick) Merge(src LightStreamChartTick) {
-	if dest.LTV == 0 && src.LTV != 0 {
-		(*dest).LTV = src.LTV
-	}
-	if dest.TTV == 0 && src.TTV != 0 {
-		(*dest).TTV = src.TTV
-	}
-	if dest.UTM == nil && src.UTM != nil {
-		(*dest).UTM = src.UTM
-	}
-	if dest.DAY_OPEN_MID == 0 && src.DAY_OPEN_MID != 0 {
-		(*dest).DAY_OPEN_MID = src.DAY_OPEN_MID
-	}
-	if dest.DAY_NET_CHG_MID == 0 && src.DAY_NET_CHG_MID != 0 {
-		(*dest).DAY_NET_CHG_MID = src.DAY_NET_CHG_MID
-	}
-	if dest.DAY_PERC_CHG_MID == 0 && src.DAY_PERC_CHG_MID != 0 {
-		(*dest).DAY_PERC_CHG_MID = src.DAY_PERC_CHG_MID
-	}
-	if dest.DAY_HIGH == 0 && src.DAY_HIGH != 0 {
-		(*dest).DAY_HIGH = src.DAY_HIGH
-	}
-	if dest.DAY_LOW == 0 && src.DAY_LOW != 0 {
-		(*dest).DAY_LOW = src.DAY_LOW
-	}
-	if dest.OFR_OPEN == 0 && src.OFR_OPEN != 0 {
-		(*dest).OFR_OPEN = src.OFR_OPEN
-	}
-	if dest.OFR_HIGH == 0 && src.OFR_HIGH != 0 {
-		(*dest).OFR_HIGH = src.OFR_HIGH
-	}
-	if dest.OFR_LOW == 0 && src.OFR_LOW != 0 {
-		(*dest).OFR_LOW = src.OFR_LOW
-	}
-	if dest.OFR_CLOSE == 0 && src.OFR_CLOSE != 0 {
-		(*dest).OFR_CLOSE = src.OFR_CLOSE
-	}
-	if dest.BID_OPEN == 0 && src.BID_OPEN != 0 {
-		(*dest).BID_OPEN = src.BID_OPEN
-	}
-	if dest.BID_HIGH == 0 && src.BID_HIGH != 0 {
-		(*dest).BID_HIGH = src.BID_HIGH
-	}
-	if dest.BID_LOW == 0 && src.BID_LOW != 0 {
-		(*dest).BID_LOW = src.BID_LOW
+// ChartTickFields - set of LightStreamChartTick fields
+type ChartTickFields uint32
+
+// ChartTickFields values, one per CHART field
+const (
+	ChartTickLTV ChartTickFields = 1 << iota
+	ChartTickTTV
+	ChartTickUTM
+	ChartTickDAY_OPEN_MID
+	ChartTickDAY_NET_CHG_MID
+	ChartTickDAY_PERC_CHG_MID
+	ChartTickDAY_HIGH
+	ChartTickDAY_LOW
+	ChartTickOFR_OPEN
+	ChartTickOFR_HIGH
+	ChartTickOFR_LOW
+	ChartTickOFR_CLOSE
+	ChartTickBID_OPEN
+	ChartTickBID_HIGH
+	ChartTickBID_LOW
+	ChartTickBID_CLOSE
+	ChartTickLTP_OPEN
+	ChartTickLTP_HIGH
+	ChartTickLTP_LOW
+	ChartTickLTP_CLOSE
+	ChartTickCONS_END
+	ChartTickCONS_TICK_COUNT
+)
+
+// Has - true if all the fields of f are in the set
+func (s ChartTickFields) Has(f ChartTickFields) bool {
+	return s&f == f
+}
+
+// chartTickField - CHART field descriptor, float is nil for UTM
+type chartTickField struct {
+	name  string
+	bit   ChartTickFields
+	float func(*LightStreamChartTick) *float64
+}
+
+var chartTickFields = []chartTickField{
+	{"LTV", ChartTickLTV, func(t *LightStreamChartTick) *float64 { return &t.LTV }},
+	{"TTV", ChartTickTTV, func(t *LightStreamChartTick) *float64 { return &t.TTV }},
+	{"UTM", ChartTickUTM, nil},
+	{"DAY_OPEN_MID", ChartTickDAY_OPEN_MID, func(t *LightStreamChartTick) *float64 { return &t.DAY_OPEN_MID }},
+	{"DAY_NET_CHG_MID", ChartTickDAY_NET_CHG_MID, func(t *LightStreamChartTick) *float64 { return &t.DAY_NET_CHG_MID }},
+	{"DAY_PERC_CHG_MID", ChartTickDAY_PERC_CHG_MID, func(t *LightStreamChartTick) *float64 { return &t.DAY_PERC_CHG_MID }},
+	{"DAY_HIGH", ChartTickDAY_HIGH, func(t *LightStreamChartTick) *float64 { return &t.DAY_HIGH }},
+	{"DAY_LOW", ChartTickDAY_LOW, func(t *LightStreamChartTick) *float64 { return &t.DAY_LOW }},
+	{"OFR_OPEN", ChartTickOFR_OPEN, func(t *LightStreamChartTick) *float64 { return &t.OFR_OPEN }},
+	{"OFR_HIGH", ChartTickOFR_HIGH, func(t *LightStreamChartTick) *float64 { return &t.OFR_HIGH }},
+	{"OFR_LOW", ChartTickOFR_LOW, func(t *LightStreamChartTick) *float64 { return &t.OFR_LOW }},
+	{"OFR_CLOSE", ChartTickOFR_CLOSE, func(t *LightStreamChartTick) *float64 { return &t.OFR_CLOSE }},
+	{"BID_OPEN", ChartTickBID_OPEN, func(t *LightStreamChartTick) *float64 { return &t.BID_OPEN }},
+	{"BID_HIGH", ChartTickBID_HIGH, func(t *LightStreamChartTick) *float64 { return &t.BID_HIGH }},
+	{"BID_LOW", ChartTickBID_LOW, func(t *LightStreamChartTick) *float64 { return &t.BID_LOW }},
+	{"BID_CLOSE", ChartTickBID_CLOSE, func(t *LightStreamChartTick) *float64 { return &t.BID_CLOSE }},
+	{"LTP_OPEN", ChartTickLTP_OPEN, func(t *LightStreamChartTick) *float64 { return &t.LTP_OPEN }},
+	{"LTP_HIGH", ChartTickLTP_HIGH, func(t *LightStreamChartTick) *float64 { return &t.LTP_HIGH }},
+	{"LTP_LOW", ChartTickLTP_LOW, func(t *LightStreamChartTick) *float64 { return &t.LTP_LOW }},
+	{"LTP_CLOSE", ChartTickLTP_CLOSE, func(t *LightStreamChartTick) *float64 { return &t.LTP_CLOSE }},
+	{"CONS_END", ChartTickCONS_END, func(t *LightStreamChartTick) *float64 { return &t.CONS_END }},
+	{"CONS_TICK_COUNT", ChartTickCONS_TICK_COUNT, func(t *LightStreamChartTick) *float64 { return &t.CONS_TICK_COUNT }},
+}
+
+// chartTickFieldsByName - lightstreamer field name -> descriptor
+var chartTickFieldsByName = func() map[string]*chartTickField {
+	m := make(map[string]*chartTickField, len(chartTickFields))
+	for i := range chartTickFields {
+		m[chartTickFields[i].name] = &chartTickFields[i]
+	}
+	return m
+}()
+
+// set - parse value into the field of tick
+func (f *chartTickField) set(tick *LightStreamChartTick, value string) error {
+	if f.float == nil {
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		utm := time.Unix(0, v*int64(time.Millisecond))
+		tick.UTM = &utm
+		return nil
 	}
-	if dest.BID_CLOSE == 0 && src.BID_CLOSE != 0 {
-		(*dest).BID_CLOSE = src.BID_CLOSE
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
 	}
-	if dest.LTP_OPEN == 0 && src.LTP_OPEN != 0 {
-		(*dest).LTP_OPEN = src.LTP_OPEN
+	*f.float(tick) = v
+	return nil
+}
+
+// copy - copy the field from src to dest
+func (f *chartTickField) copy(dest, src *LightStreamChartTick) {
+	if f.float == nil {
+		dest.UTM = src.UTM
+		return
 	}
-	if dest.LTP_HIGH == 0 && src.LTP_HIGH != 0 {
-		(*dest).LTP_HIGH = src.LTP_HIGH
+	*f.float(dest) = *f.float(src)
+}
+
+// isZero - true if the field of tick holds its zero value
+func (f *chartTickField) isZero(tick *LightStreamChartTick) bool {
+	if f.float == nil {
+		return tick.UTM == nil
 	}
-	if dest.LTP_LOW == 0 && src.LTP_LOW != 0 {
-		(*dest).LTP_LOW = src.LTP_LOW
+	return *f.float(tick) == 0
+}
+
+// present - fields holding a value, guessed from non-zero values for ticks
+// built without a decoder
+func (tick *LightStreamChartTick) present() ChartTickFields {
+	if tick.Present != 0 {
+		return tick.Present
 	}
-	if dest.LTP_CLOSE == 0 && src.LTP_CLOSE != 0 {
-		(*dest).LTP_CLOSE = src.LTP_CLOSE
+
+	var present ChartTickFields
+	for i := range chartTickFields {
+		if !chartTickFields[i].isZero(tick) {
+			present |= chartTickFields[i].bit
+		}
 	}
-	if dest.CONS_END == 0 && src.CONS_END != 0 {
-		(*dest).CONS_END = src.CONS_END
+	return present
+}
+
+// Merge - fill the fields missing from dest with the ones of src
+// Presence is used rather than zero-ness so an explicit 0 in dest is kept.
+func (dest *LightStreamChartTick) Merge(src LightStreamChartTick) {
+	destPresent, srcPresent := dest.present(), src.present()
+
+	for i := range chartTickFields {
+		f := &chartTickFields[i]
+		if !destPresent.Has(f.bit) && srcPresent.Has(f.bit) {
+			f.copy(dest, &src)
+			destPresent |= f.bit
+		}
 	}
-	if dest.CONS_TICK_COUNT == 0 && src.CONS_TICK_COUNT != 0 {
-		(*dest).CONS_TICK_COUNT = src.CONS_TICK_COUNT
+
+	dest.Present = destPresent
+}
+
+// ChartTickDecoder - decodes CHART updates with the descriptors of the
+// subscription fields resolved once, unknown fields are ignored
+type ChartTickDecoder struct {
+	fields []*chartTickField
+}
+
+// NewChartTickDecoder - decoder for updates of the given fields
+func NewChartTickDecoder(fields []string) *ChartTickDecoder {
+	d := &ChartTickDecoder{fields: make([]*chartTickField, len(fields))}
+	for i, field := range fields {
+		d.fields[i] = chartTickFieldsByName[field]
 	}
+	return d
 }
 
-func NewLightStreamChartTick(epic string, fields []string, values []string) (tick LightStreamChartTick, err error) {
-	if len(fields) != len(values) {
-		return tick, fmt.Errorf("not enough values for fields number")
+// Decode - set the fields of tick from values, in the decoder fields order
+// empty ("", "$") and null ("#") values are skipped, the others are added to
+// tick.Present.
+func (d *ChartTickDecoder) Decode(tick *LightStreamChartTick, values []string) error {
+	if len(values) != len(d.fields) {
+		return fmt.Errorf("not enough values for fields number")
 	}
-	reflectType := reflect.TypeOf(LightStreamChartTick{})
 
-	sliceToUnmarshal := make(map[string]interface{}, len(fields)+1)
-	for i := 0; i < len(fields); i++ {
-		value := strings.ReplaceAll(values[i], "\r\n", "")
-		if value == "" || value == "$" || value == "#" {
+	for i, f := range d.fields {
+		value := values[i]
+		if f == nil || value == "" || value == "$" || value == "#" {
 			continue
 		}
-
-		if reflectStructField, ok := reflectType.FieldByName(fields[i]); ok {
-			t := reflectStructField.Type.Kind()
-			switch t {
-			case reflect.Float64:
-				v, err := strconv.ParseFloat(value, 64)
-				if err != nil {
-					return tick, err
-				}
-				sliceToUnmarshal[fields[i]] = v
-			case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64:
-				v, err := strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return tick, err
-				}
-				sliceToUnmarshal[fields[i]] = v
-			case reflect.TypeOf(&time.Time{}).Kind():
-				v, err := strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return tick, err
-				}
-				sliceToUnmarshal[fields[i]] = time.Unix(0, v*int64(time.Millisecond))
-			}
+		if err := f.set(tick, value); err != nil {
+			return err
 		}
+		tick.Present |= f.bit
 	}
 
-	sliceToUnmarshal["EPIC"] = epic
+	return nil
+}
 
-	bytesToUnmarshal, err := json.Marshal(sliceToUnmarshal)
-	if err != nil {
-		return tick, err
+// Changed - fields flagged in changed, in the decoder fields order
+func (d *ChartTickDecoder) Changed(changed []bool) ChartTickFields {
+	var fields ChartTickFields
+	for i, f := range d.fields {
+		if f != nil && i < len(changed) && changed[i] {
+			fields |= f.bit
+		}
 	}
+	return fields
+}
 
-	//fmt.Println(sliceToUnmarshal, string(bytesToUnmarshal))
-
-	err = json.Unmarshal(bytesToUnmarshal, &tick)
-	if err != nil {
-		return tick, err
+// NewLightStreamChartTick - decode a single raw update, where unchanged fields
+// are empty, prefer a ChartTickDecoder built once per subscription on hot paths
+func NewLightStreamChartTick(epic string, fields []string, values []string) (tick LightStreamChartTick, err error) {
+	if len(fields) != len(values) {
+		return tick, fmt.Errorf("not enough values for fields number")
 	}
 
-	return tick, nil
+	tick.EPIC = epic
+	err = NewChartTickDecoder(fields).Decode(&tick, values)
+	tick.Changed = tick.Present
+
+	return tick, err
 }
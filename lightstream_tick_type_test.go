@@ -0,0 +1,154 @@
+package igmarkets_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+	"github.com/amaurybrisou/igmarkets/igmarketstest"
+	"github.com/amaurybrisou/igmarkets/lightstreamer"
+)
+
+var benchFields = []string{
+	"UTM", "LTV", "TTV", "DAY_OPEN_MID", "DAY_NET_CHG_MID", "DAY_PERC_CHG_MID",
+	"DAY_HIGH", "DAY_LOW", "OFR_OPEN", "OFR_HIGH", "OFR_LOW", "OFR_CLOSE",
+	"BID_OPEN", "BID_HIGH", "BID_LOW", "BID_CLOSE", "CONS_END", "CONS_TICK_COUNT",
+}
+
+// benchUpdates - n random CHART updates of item, as values and as a stream body
+func benchUpdates(item string, n int) ([][]string, string) {
+	feed := igmarketstest.NewRandomFeed(1, 1.1, 0.0001)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	values := make([][]string, n)
+	var body strings.Builder
+	for i := range values {
+		next := feed.Next(item, now.Add(time.Duration(i)*time.Second))
+		values[i] = make([]string, len(benchFields))
+		for j, field := range benchFields {
+			values[i][j] = next[field]
+		}
+		fmt.Fprintf(&body, "1,1|%s\r\n", strings.Join(values[i], "|"))
+	}
+	return values, body.String()
+}
+
+func TestChartTickDecoderMatchesReflection(t *testing.T) {
+	values, _ := benchUpdates(testItem, 100)
+	decoder := igmarkets.NewChartTickDecoder(benchFields)
+
+	for _, v := range values {
+		var tick igmarkets.LightStreamChartTick
+		if err := decoder.Decode(&tick, v); err != nil {
+			t.Fatal(err)
+		}
+		legacy, err := legacyChartTick(testEpic, benchFields, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tick.EPIC, tick.Present = testEpic, 0
+		if !tick.UTM.Equal(*legacy.UTM) {
+			t.Fatalf("UTM %v, want %v", tick.UTM, legacy.UTM)
+		}
+		tick.UTM, legacy.UTM = nil, nil
+		if tick != legacy {
+			t.Fatalf("decoded %+v, want %+v", tick, legacy)
+		}
+	}
+}
+
+// BenchmarkChartTickDecoder - one update per op
+func BenchmarkChartTickDecoder(b *testing.B) {
+	values, _ := benchUpdates(testItem, 1000)
+	decoder := igmarkets.NewChartTickDecoder(benchFields)
+	var tick igmarkets.LightStreamChartTick
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := decoder.Decode(&tick, values[n%len(values)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLegacyChartTick - one update per op, with the reflection and JSON
+// decoding used before ChartTickDecoder
+func BenchmarkLegacyChartTick(b *testing.B) {
+	values, _ := benchUpdates(testItem, 1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := legacyChartTick(testEpic, benchFields, values[n%len(values)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkChartTickReplay - 1000 updates per op through the whole dispatch path
+func BenchmarkChartTickReplay(b *testing.B) {
+	_, stream := benchUpdates(testItem, 1000)
+	decoder := igmarkets.NewChartTickDecoder(benchFields)
+	var tick igmarkets.LightStreamChartTick
+	listener := lightstreamer.ListenerFunc(func(sub *lightstreamer.Subscription, u lightstreamer.Update) {
+		if err := decoder.Decode(&tick, u.Values); err != nil {
+			b.Fatal(err)
+		}
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		sub := &lightstreamer.Subscription{Items: []string{testItem}, Fields: benchFields, Mode: lightstreamer.ModeMerge}
+		if err := lightstreamer.Replay(strings.NewReader(stream), listener, sub); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// legacyChartTick - decoding used before ChartTickDecoder, kept for comparison
+func legacyChartTick(epic string, fields []string, values []string) (tick igmarkets.LightStreamChartTick, err error) {
+	reflectType := reflect.TypeOf(igmarkets.LightStreamChartTick{})
+
+	sliceToUnmarshal := make(map[string]interface{}, len(fields)+1)
+	for i := 0; i < len(fields); i++ {
+		value := strings.ReplaceAll(values[i], "\r\n", "")
+		if value == "" || value == "$" || value == "#" {
+			continue
+		}
+
+		if reflectStructField, ok := reflectType.FieldByName(fields[i]); ok {
+			switch reflectStructField.Type.Kind() {
+			case reflect.Float64:
+				v, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return tick, err
+				}
+				sliceToUnmarshal[fields[i]] = v
+			case reflect.Ptr:
+				v, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return tick, err
+				}
+				sliceToUnmarshal[fields[i]] = time.Unix(0, v*int64(time.Millisecond))
+			}
+		}
+	}
+
+	sliceToUnmarshal["EPIC"] = epic
+
+	bytesToUnmarshal, err := json.Marshal(sliceToUnmarshal)
+	if err != nil {
+		return tick, err
+	}
+
+	err = json.Unmarshal(bytesToUnmarshal, &tick)
+	return tick, err
+}
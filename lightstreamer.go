@@ -3,20 +3,17 @@ package igmarkets
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"strings"
-	"sync"
 	"time"
 
+	"github.com/amaurybrisou/igmarkets/lightstreamer"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	contentLength = "100000000"
-	contentType   = "application/x-www-form-urlencoded"
-)
+// lightStreamerCID - LS_cid sent by IG clients
+const lightStreamerCID = "mgQkwtwdysogQz2BJ4Ji kOj2Bg"
 
 type LightStreamerTick struct {
 	Epic             string
@@ -28,248 +25,315 @@ type LightStreamerTick struct {
 	LastTradedVolume float64
 }
 
+const (
+	// DefaultStreamReconnectionTime - ReconnectionTime of the streams the
+	// OCO manager and the paper broker open in the background
+	DefaultStreamReconnectionTime = 1
+	// DefaultStreamMaxReconnection - MaxReconnection of those streams,
+	// reset once a stream stayed up a minute
+	DefaultStreamMaxReconnection = 10
+)
+
 type LightStreamOptions struct {
-	Epics, Fields                     []string
-	SubType, Interval, Mode           string
-	ReconnectionTime, MaxReconnection int
+	Epics, Fields           []string
+	SubType, Interval, Mode string
+
+	// ReconnectionTime - seconds, the stream waits attempt times
+	// ReconnectionTime, 1 second when 0, and at most a minute before reconnecting
+	ReconnectionTime int
+	// MaxReconnection - reconnections attempted before the stream fails, 0 for
+	// none, negative to retry forever
+	MaxReconnection int
+
+	// StallTimeout - seconds without any data (PROBE included) before the
+	// stream is considered stalled and reconnected, 0 disables the check
+	StallTimeout int
+
+	// OnStateChange - called from the stream goroutine on every state
+	// transition, it must not block
+	OnStateChange func(StreamStateEvent)
+
+	// SkipSnapshot - do not ask for the current state of the epics, only
+	// real-time ticks are delivered
+	SkipSnapshot bool
+	// OnEndOfSnapshot - called from the stream goroutine once the snapshot
+	// of epic has been delivered, it must not block
+	OnEndOfSnapshot func(epic string)
+
+	// OnOverflow - called from the stream goroutine when the server dropped
+	// lost updates of epic, it must not block. The next tick of the epic
+	// carries the count in Lost.
+	OnOverflow func(epic string, lost int)
+	// ResnapshotOnOverflow - ask for a new snapshot of epics with lost updates
+	ResnapshotOnOverflow bool
 }
 
-func (ig *IGMarkets) LogoutLightStreamer() error {
-	err := ig.CloseLightStreamerSubscription()
-	if err != nil {
-		return err
-	}
+// StreamState - health of a lightstreamer subscription
+type StreamState = lightstreamer.State
 
-	err = ig.Logout()
-	if err != nil {
-		return err
-	}
+// StreamStateEvent - stream state transition
+type StreamStateEvent = lightstreamer.StateEvent
 
-	return nil
-}
-
-func (ig *IGMarkets) CloseLightStreamerSubscription() error {
+const (
+	// StreamConnecting - logging in and creating the lightstreamer session
+	StreamConnecting = lightstreamer.Connecting
+	// StreamConnected - lightstreamer session created
+	StreamConnected = lightstreamer.Connected
+	// StreamSubscribed - subscription added and stream bound
+	StreamSubscribed = lightstreamer.Subscribed
+	// StreamStalled - no data received for StallTimeout seconds
+	StreamStalled = lightstreamer.Stalled
+	// StreamRebinding - server sent LOOP, binding the same session again
+	StreamRebinding = lightstreamer.Rebinding
+	// StreamReconnecting - waiting NextDelay before reconnection Attempt
+	StreamReconnecting = lightstreamer.Reconnecting
+	// StreamFailed - MaxReconnection reached, the stream is closed
+	StreamFailed = lightstreamer.Failed
+	// StreamClosed - context cancelled, the stream is closed
+	StreamClosed = lightstreamer.Closed
+)
 
-	const contentType = "application/x-www-form-urlencoded"
+// lightStream - running subscription, see CloseLightStreamerSubscription
+type lightStream struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
 
-	tr := &http.Transport{
-		MaxIdleConns:          1,
-		IdleConnTimeout:       30 * time.Second,
-		ResponseHeaderTimeout: 30 * time.Second,
-		DisableCompression:    true,
+// LightStreamItem - IG item name, e.g. CHART:CS.D.EURUSD.MINI.IP:SECOND or MARKET:CS.D.EURUSD.MINI.IP
+func LightStreamItem(subType, epic, interval string) string {
+	if interval == "" {
+		return subType + ":" + epic
 	}
-	c := &http.Client{Transport: tr, Timeout: 30 * time.Second}
+	return subType + ":" + epic + ":" + interval
+}
 
-	body := []byte(fmt.Sprintf("LS_session=%s&LS_op=destroy", ig.SessionID))
-	url := fmt.Sprintf("%s/lightstreamer/control.txt", ig.SessionVersion2.LightstreamerEndpoint)
-	resp, err := c.Post(url, contentType, bytes.NewBuffer(body))
-	if err != nil {
-		return LightStreamErrorHandler(resp, err)
+// LightStreamerCredentials - IG authenticates lightstreamer sessions with the
+// current account and the CST and XST tokens of a version 2 login
+func (ig *IGMarkets) LightStreamerCredentials(ctx context.Context) (lightstreamer.Credentials, error) {
+	if err := ig.Login(); err != nil {
+		return lightstreamer.Credentials{}, err
 	}
-	defer resp.Body.Close()
 
-	bodyResp, err := ioutil.ReadAll(resp.Body)
+	session, err := ig.LoginVersion2()
 	if err != nil {
-		return LightStreamErrorHandler(resp, err)
-	}
-
-	sessionMsg := strings.Trim(string(bodyResp[:]), "\n")
-
-	if !strings.HasPrefix(string(sessionMsg), "OK") {
-		return fmt.Errorf("unexpected response from lightstreamer session endpoint %q: %q", url, string(sessionMsg))
+		return lightstreamer.Credentials{}, err
 	}
 
-	log.Debug("lightstreamer: subscription closed")
-
-	return nil
+	return lightstreamer.Credentials{
+		User:     session.CurrentAccountId,
+		Password: "CST-" + session.CSTToken + "|XST-" + session.XSTToken,
+		Endpoint: session.LightstreamerEndpoint,
+	}, nil
+}
 
+// NewLightStreamerClient - lightstreamer client authenticated with this IG account
+func (ig *IGMarkets) NewLightStreamerClient() *lightstreamer.Client {
+	c := lightstreamer.NewClient("", lightstreamer.CredentialsFunc(ig.LightStreamerCredentials))
+	c.CID = lightStreamerCID
+	return c
 }
 
-func (ig *IGMarkets) connectLightStreamer(options LightStreamOptions) (*http.Response, error) {
-	if err := ig.Login(); err != nil {
-		return nil, err
+// LogoutLightStreamer - close all subscriptions, then log out of the REST
+// session they share with the other calls. Streams ending alone keep the session.
+func (ig *IGMarkets) LogoutLightStreamer() error {
+	err := ig.CloseLightStreamerSubscription()
+	if err != nil {
+		return err
 	}
 
-	// Obtain CST and XST tokens first
-	sessionVersion2, err := ig.LoginVersion2()
+	err = ig.Logout()
 	if err != nil {
-		return nil, fmt.Errorf("ig.LoginVersion2() failed: %v", err)
+		return err
 	}
 
-	log.Debug("lightstreamer : connected")
-
-	ig.SessionVersion2 = *sessionVersion2
+	return nil
+}
 
-	tr := &http.Transport{
-		MaxIdleConns:       5,
-		IdleConnTimeout:    30 * time.Second,
-		DisableCompression: true,
+// CloseLightStreamerSubscription - Stop all subscriptions opened with OpenLightStreamerSubscription
+func (ig *IGMarkets) CloseLightStreamerSubscription() error {
+	ig.Lock()
+	streams := ig.lightStreams
+	ig.lightStreams = nil
+	ig.Unlock()
+
+	for s := range streams {
+		s.cancel()
+		<-s.done
 	}
-	c := &http.Client{Transport: tr}
-
-	bodyAsStr := "LS_polling=true&LS_polling_millis=0&LS_idle_millis=0" +
-		"&LS_op2=create&LS_password=CST-" +
-		sessionVersion2.CSTToken + "|" + "XST-" + sessionVersion2.XSTToken + "&LS_user=" +
-		sessionVersion2.CurrentAccountId + "&LS_cid=mgQkwtwdysogQz2BJ4Ji kOj2Bg"
 
-	// Create Lightstreamer Session
-	body := []byte(bodyAsStr)
-
-	bodyBuf := bytes.NewBuffer(body)
-	url := fmt.Sprintf("%s/lightstreamer/create_session.txt", sessionVersion2.LightstreamerEndpoint)
-	resp, err := c.Post(url, contentType, bodyBuf)
-	if err != nil {
-		return nil, LightStreamErrorHandler(resp, err)
-	}
-	respBody, _ := ioutil.ReadAll(resp.Body)
+	log.Debug("lightstreamer: subscription closed")
 
-	sessionMsg := string(respBody[:])
+	return nil
+}
 
-	if !strings.HasPrefix(sessionMsg, "OK") {
-		return nil, fmt.Errorf("unexpected response from lightstreamer session endpoint %q: %q", url, sessionMsg)
+func (ig *IGMarkets) addLightStream(s *lightStream) {
+	ig.Lock()
+	defer ig.Unlock()
+	if ig.lightStreams == nil {
+		ig.lightStreams = make(map[*lightStream]struct{})
 	}
-	sessionParts := strings.Split(sessionMsg, "\r\n")
-	sessionID := sessionParts[1]
-	sessionID = strings.ReplaceAll(sessionID, "SessionId:", "")
-	ig.SessionID = sessionID
-
-	if len(sessionParts) > 2 {
-		controlAddr := sessionParts[2]
-		controlAddr = strings.ReplaceAll(controlAddr, "ControlAddress:", "")
-		if controlAddr != "" {
-			ig.SessionVersion2.LightstreamerEndpoint = "https://" + controlAddr
-		}
-	}
-
-	log.Debug("lightstreamer : session created")
+	ig.lightStreams[s] = struct{}{}
+}
 
-	// Adding subscription for epic
-	var epicList string
-	for i := range options.Epics {
-		epicList = epicList + options.SubType + ":" + options.Epics[i] + ":" + options.Interval + "+"
-	}
+func (ig *IGMarkets) removeLightStream(s *lightStream) {
+	ig.Lock()
+	defer ig.Unlock()
+	delete(ig.lightStreams, s)
+}
 
-	body = []byte("LS_session=" + sessionID +
-		"&LS_polling=true&LS_polling_millis=0&LS_idle_millis=0&LS_op=add&LS_Table=1&LS_id=" +
-		epicList + "&LS_schema=" + strings.Join(options.Fields[:], "+") + "&LS_mode=" + options.Mode)
-	bodyBuf = bytes.NewBuffer(body)
-	url = fmt.Sprintf("%s/lightstreamer/control.txt", sessionVersion2.LightstreamerEndpoint)
-	resp, err = c.Post(url, contentType, bodyBuf)
+// OpenLightStreamerSubscription - Subscribe to lightstreamer updates
+// ticks are delivered on the first channel, connection errors on the second one.
+// Errors are dropped when nobody is receiving, use o.OnStateChange to follow
+// the stream health. The final StreamFailed or StreamClosed state is notified
+// before both channels are closed.
+func (ig *IGMarkets) OpenLightStreamerSubscription(
+	ctx context.Context,
+	o LightStreamOptions) (<-chan LightStreamChartTick, <-chan error, error) {
 
-	if err != nil {
-		return nil, LightStreamErrorHandler(resp, err)
-	}
+	tickChan := make(chan LightStreamChartTick)
 
-	body, _ = ioutil.ReadAll(resp.Body)
-	if !strings.HasPrefix(string(body), "OK") {
-		return nil, fmt.Errorf("unexpected control.txt response: %q", body)
+	items := make([]string, len(o.Epics))
+	for i, epic := range o.Epics {
+		items[i] = LightStreamItem(o.SubType, epic, o.Interval)
 	}
 
-	log.Debug("lightstreamer : subscription created")
-
-	// Binding to subscription
-	body = []byte("LS_session=" + sessionID + "&LS_polling=false&LS_content_length=" + contentLength)
-	bodyBuf = bytes.NewBuffer(body)
-	url = fmt.Sprintf("%s/lightstreamer/bind_session.txt", sessionVersion2.LightstreamerEndpoint)
-	resp, err = c.Post(url, contentType, bodyBuf)
-	if err != nil {
-		return nil, LightStreamErrorHandler(resp, err)
+	sub := &lightstreamer.Subscription{
+		Items:    items,
+		Fields:   o.Fields,
+		Mode:     o.Mode,
+		Snapshot: !o.SkipSnapshot,
 	}
 
-	log.Debug("lightstreamer : subscription bound")
+	errChan := ig.startLightStream(ctx, o, sub, func(ctx context.Context) lightstreamer.Listener {
+		return &chartTickListener{
+			ctx:     ctx,
+			options: o,
+			decoder: NewChartTickDecoder(o.Fields),
+			ticks:   tickChan,
+		}
+	}, func() { close(tickChan) })
 
-	return resp, nil
+	return tickChan, errChan, nil
 }
 
-// GetOTCWorkingOrders - Get all working orders
-// epic: e.g. CS.D.BITCOIN.CFD.IP
-// tickReceiver: receives all ticks from lightstreamer API
-func (ig *IGMarkets) OpenLightStreamerSubscription(
+// startLightStream - run sub in the background until ctx is done or the
+// connection failed, then call done and close the returned error channel.
+// Reconnection causes are sent on the channel when it is ready.
+func (ig *IGMarkets) startLightStream(
 	ctx context.Context,
-	o LightStreamOptions) (<-chan LightStreamChartTick, <-chan error, error) {
+	o LightStreamOptions,
+	sub *lightstreamer.Subscription,
+	newListener func(ctx context.Context) lightstreamer.Listener,
+	done func()) <-chan error {
+
+	errChan := make(chan error, 1)
+
+	client := ig.NewLightStreamerClient()
+	client.ReconnectionTime = time.Duration(o.ReconnectionTime) * time.Second
+	client.MaxReconnection = o.MaxReconnection
+	client.StallTimeout = time.Duration(o.StallTimeout) * time.Second
+	client.ResnapshotOnOverflow = o.ResnapshotOnOverflow
+	client.OnStateChange = func(e StreamStateEvent) {
+		if e.State == StreamReconnecting || e.State == StreamFailed {
+			select {
+			case errChan <- e.Err:
+			default:
+			}
+		}
+		if o.OnStateChange != nil {
+			o.OnStateChange(e)
+		}
+	}
 
-	tickChan := make(chan LightStreamChartTick)
-	errChan := make(chan error)
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &lightStream{cancel: cancel, done: make(chan struct{})}
+	ig.addLightStream(stream)
 
-	go func() {
-		attempts := 1
+	listener := newListener(ctx)
 
-		defer close(tickChan)
+	go func() {
+		defer close(stream.done)
 		defer close(errChan)
+		defer done()
+		defer cancel()
 
-		for attempts < o.MaxReconnection {
-
-			resp, err := ig.connectLightStreamer(o)
-
-			if err != nil {
-				errChan <- err
-				attempts++
-				time.Sleep(time.Duration(attempts) * time.Duration(o.ReconnectionTime) * time.Second)
-				continue
-			}
-
-			internalErrChan := make(chan error)
-			internalTickChan := make(chan LightStreamChartTick)
+		client.Run(ctx, listener, sub)
 
-			go readLightStreamSubscription(o.Epics, o.Fields, internalTickChan, resp.Body, internalErrChan)
+		ig.removeLightStream(stream)
+	}()
 
-			var wg sync.WaitGroup
-			stop := make(chan bool)
+	return errChan
+}
 
-			wg.Add(1)
+// chartTickListener - converts lightstreamer updates into LightStreamChartTick
+type chartTickListener struct {
+	ctx     context.Context
+	options LightStreamOptions
+	decoder *ChartTickDecoder
+	ticks   chan<- LightStreamChartTick
+}
 
-			go func() {
-				defer wg.Done()
+func (l *chartTickListener) OnUpdate(_ *lightstreamer.Subscription, u lightstreamer.Update) {
+	if u.Snapshot && l.options.SkipSnapshot {
+		return
+	}
 
-				for {
-					select {
-					case t := <-internalTickChan:
-						if t.UTM != nil {
-							tickChan <- t
-						}
-					case <-stop:
-						log.Debug("lightstreamer: stopping stream")
-						return
-					case <-ctx.Done():
-						log.Debug("lightstreamer: stopping stream")
-						return
-					}
-				}
-			}()
+	tick := LightStreamChartTick{EPIC: l.options.Epics[u.Item-1]}
+	if err := l.decoder.Decode(&tick, u.Values); err != nil {
+		log.Errorf("lighstream could not parse tick %v", err)
+		return
+	}
+	if tick.UTM == nil {
+		return
+	}
+	tick.Changed = l.decoder.Changed(u.Changed)
+	tick.Snapshot = u.Snapshot
+	tick.Lost = u.Lost
 
-			select {
-			case err := <-internalErrChan:
-				log.WithError(err).Error("lightstreamer : ")
+	select {
+	case l.ticks <- tick:
+	case <-l.ctx.Done():
+	}
+}
 
-				stop <- true
+func (l *chartTickListener) OnEndOfSnapshot(_ *lightstreamer.Subscription, item int, _ string) {
+	if l.options.OnEndOfSnapshot != nil {
+		l.options.OnEndOfSnapshot(l.options.Epics[item-1])
+	}
+}
 
-				err = ig.LogoutLightStreamer()
-				if err != nil {
-					log.WithError(err).Error("lightstreamer : ")
-				}
+func (l *chartTickListener) OnOverflow(_ *lightstreamer.Subscription, item int, _ string, lost int) {
+	if l.options.OnOverflow != nil {
+		l.options.OnOverflow(l.options.Epics[item-1], lost)
+	}
+}
 
-				wg.Wait()
+// LoginVersion2 - use old login version. contains required data for LightStreamer API
+func (ig *IGMarkets) LoginVersion2() (*SessionVersion2, error) {
+	bodyReq := new(bytes.Buffer)
 
-				log.Printf("sleeping for %s", time.Second*time.Duration(o.ReconnectionTime*attempts))
-				time.Sleep(time.Second * time.Duration(o.ReconnectionTime*attempts))
+	var authReq = authRequest{
+		Identifier: ig.Identifier,
+		Password:   ig.Password,
+	}
 
-			case <-ctx.Done():
-				err := ig.LogoutLightStreamer()
-				if err != nil {
-					log.WithError(err).Error("lightstreamer : ")
-				}
+	if err := json.NewEncoder(bodyReq).Encode(authReq); err != nil {
+		return nil, fmt.Errorf("igmarkets: unable to encode JSON response: %v", err)
+	}
 
-				wg.Wait()
-				log.Debug("lightstreamer: stopping stream restarter")
-				return
-			}
-		}
-		log.Error("lightsreamer : stopping...")
-		err := ig.LogoutLightStreamer()
-		if err != nil {
-			log.WithError(err).Error("lightstreamer : ")
-		}
-	}()
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", ig.APIURL, "gateway/deal/session"), bodyReq)
+	if err != nil {
+		return nil, fmt.Errorf("igmarkets: unable to send HTTP request: %v", err)
+	}
 
-	return tickChan, errChan, nil
+	igResponseInterface, headers, err := ig.doRequestWithResponseHeaders(req, 2, SessionVersion2{}, false)
+	if err != nil {
+		return nil, err
+	}
+	session, _ := igResponseInterface.(*SessionVersion2)
+	if headers != nil {
+		session.CSTToken = headers.Get("CST")
+		session.XSTToken = headers.Get("X-SECURITY-TOKEN")
+	}
+	return session, nil
 }
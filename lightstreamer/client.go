@@ -0,0 +1,453 @@
+// Package lightstreamer implements the client side of the Lightstreamer text
+// protocol: session creation, control operations, session binding and stream
+// parsing. It knows nothing about IG, credentials and item names are supplied
+// by the caller.
+package lightstreamer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultContentLength = 100000000
+	formContentType      = "application/x-www-form-urlencoded"
+)
+
+// Credentials - LS_user and LS_password of a new session
+type Credentials struct {
+	User     string
+	Password string
+	// Endpoint - overrides Client.Endpoint when not empty, for servers
+	// whose address is only known after authenticating
+	Endpoint string
+}
+
+// CredentialsProvider - called before each session creation
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// CredentialsFunc - CredentialsProvider adapter for functions
+type CredentialsFunc func(ctx context.Context) (Credentials, error)
+
+// Credentials - call f
+func (f CredentialsFunc) Credentials(ctx context.Context) (Credentials, error) {
+	return f(ctx)
+}
+
+// StaticCredentials - CredentialsProvider always returning the same user and password
+func StaticCredentials(user, password string) CredentialsProvider {
+	return CredentialsFunc(func(context.Context) (Credentials, error) {
+		return Credentials{User: user, Password: password}, nil
+	})
+}
+
+// Client - Lightstreamer server access
+type Client struct {
+	Endpoint      string // e.g. https://push.lightstreamer.com
+	Credentials   CredentialsProvider
+	AdapterSet    string // LS_adapter_set, server default when empty
+	CID           string // LS_cid
+	ContentLength int    // LS_content_length of bound streams
+
+	HTTPClient       *http.Client // create_session and control requests
+	StreamHTTPClient *http.Client // bind_session requests, must not time out
+
+	// ReconnectionTime - Run waits Attempt * ReconnectionTime before
+	// reconnecting, DefaultReconnectionTime when 0
+	ReconnectionTime time.Duration
+	// MaxReconnectionDelay - longest wait of Run before reconnecting,
+	// DefaultMaxReconnectionDelay when 0
+	MaxReconnectionDelay time.Duration
+	// MaxReconnection - reconnections attempted by Run before it gives up, 0
+	// for none, negative to retry forever. Sessions bound less than a minute
+	// count as failed attempts.
+	MaxReconnection int
+	// StallTimeout - bound streams without any data (PROBE included) for
+	// StallTimeout are closed, 0 disables the check
+	StallTimeout time.Duration
+	// OnStateChange - called by Run on every state transition, it must not block
+	OnStateChange func(StateEvent)
+
+	// ResnapshotOnOverflow - request a new snapshot of MERGE items whose updates
+	// were dropped by the server, it is delivered as a Snapshot update
+	ResnapshotOnOverflow bool
+
+	lostMu      sync.Mutex
+	lostUpdates map[string]int
+}
+
+// NewClient - Create a client for the given server
+func NewClient(endpoint string, credentials CredentialsProvider) *Client {
+	return &Client{
+		Endpoint:      endpoint,
+		Credentials:   credentials,
+		ContentLength: defaultContentLength,
+		HTTPClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConns:          5,
+				IdleConnTimeout:       30 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+				DisableCompression:    true,
+			},
+		},
+		StreamHTTPClient: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConns:       5,
+				IdleConnTimeout:    30 * time.Second,
+				DisableCompression: true,
+			},
+		},
+	}
+}
+
+// LostUpdates - updates dropped by the server per item name since the client was created
+func (c *Client) LostUpdates() map[string]int {
+	c.lostMu.Lock()
+	defer c.lostMu.Unlock()
+
+	lost := make(map[string]int, len(c.lostUpdates))
+	for item, n := range c.lostUpdates {
+		lost[item] = n
+	}
+	return lost
+}
+
+func (c *Client) addLostUpdates(item string, lost int) {
+	c.lostMu.Lock()
+	defer c.lostMu.Unlock()
+
+	if c.lostUpdates == nil {
+		c.lostUpdates = make(map[string]int)
+	}
+	c.lostUpdates[item] += lost
+}
+
+// Session - Lightstreamer session
+type Session struct {
+	ID         string
+	ControlURL string // Base URL of control and bind requests
+	KeepAlive  time.Duration
+
+	client    *Client
+	mu        sync.Mutex
+	nextTable int
+	tables    map[int]*Subscription
+	items     map[itemKey]*itemState
+}
+
+type itemKey struct {
+	table, item int
+}
+
+// itemState - current values of an item, kept across stream rebinds
+type itemState struct {
+	values   []string
+	changed  []bool
+	snapshot bool // snapshot not fully delivered yet
+	lost     int  // updates dropped since the last delivered update
+}
+
+// CreateSession - Authenticate and create a new session
+func (c *Client) CreateSession(ctx context.Context) (*Session, error) {
+	creds, err := c.Credentials.Credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("lightstreamer: unable to get credentials: %v", err)
+	}
+
+	endpoint := c.Endpoint
+	if creds.Endpoint != "" {
+		endpoint = creds.Endpoint
+	}
+
+	form := url.Values{
+		"LS_polling":        {"true"},
+		"LS_polling_millis": {"0"},
+		"LS_idle_millis":    {"0"},
+		"LS_op2":            {"create"},
+		"LS_user":           {creds.User},
+		"LS_password":       {creds.Password},
+	}
+	if c.CID != "" {
+		form.Set("LS_cid", c.CID)
+	}
+	if c.AdapterSet != "" {
+		form.Set("LS_adapter_set", c.AdapterSet)
+	}
+
+	resp, err := c.post(ctx, c.HTTPClient, endpoint+"/lightstreamer/create_session.txt", form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	headers, err := readHeaders(bufio.NewReader(resp.Body))
+	if err != nil {
+		return nil, fmt.Errorf("lightstreamer: unable to create session: %w", err)
+	}
+
+	s := &Session{
+		ID:         headers["SessionId"],
+		ControlURL: endpoint,
+		client:     c,
+		tables:     make(map[int]*Subscription),
+		items:      make(map[itemKey]*itemState),
+	}
+	if s.ID == "" {
+		return nil, fmt.Errorf("lightstreamer: no SessionId in create_session response")
+	}
+	if addr := headers["ControlAddress"]; addr != "" {
+		scheme := "https"
+		if u, err := url.Parse(endpoint); err == nil && u.Scheme != "" {
+			scheme = u.Scheme
+		}
+		s.ControlURL = scheme + "://" + addr
+	}
+	if ms, err := strconv.Atoi(headers["KeepaliveMillis"]); err == nil {
+		s.KeepAlive = time.Duration(ms) * time.Millisecond
+	}
+
+	log.Debugf("lightstreamer : session %s created", s.ID)
+
+	return s, nil
+}
+
+// Subscribe - Add the subscription to the session (LS_op=add)
+// sub.Table is allocated when 0.
+func (s *Session) Subscribe(ctx context.Context, sub *Subscription) error {
+	s.addTable(sub)
+
+	form := url.Values{
+		"LS_op":       {"add"},
+		"LS_table":    {strconv.Itoa(sub.Table)},
+		"LS_id":       {strings.Join(sub.Items, " ")},
+		"LS_schema":   {strings.Join(sub.Fields, " ")},
+		"LS_mode":     {sub.Mode},
+		"LS_snapshot": {strconv.FormatBool(sub.Snapshot)},
+	}
+	if sub.DataAdapter != "" {
+		form.Set("LS_data_adapter", sub.DataAdapter)
+	}
+
+	if err := s.control(ctx, form); err != nil {
+		s.removeTable(sub)
+		return fmt.Errorf("lightstreamer: unable to subscribe to %v: %w", sub.Items, err)
+	}
+
+	log.Debugf("lightstreamer : table %d subscribed to %v", sub.Table, sub.Items)
+
+	return nil
+}
+
+// Unsubscribe - Remove the subscription from the session (LS_op=delete)
+func (s *Session) Unsubscribe(ctx context.Context, sub *Subscription) error {
+	err := s.control(ctx, url.Values{
+		"LS_op":    {"delete"},
+		"LS_table": {strconv.Itoa(sub.Table)},
+	})
+	if err != nil {
+		return fmt.Errorf("lightstreamer: unable to unsubscribe table %d: %w", sub.Table, err)
+	}
+
+	s.removeTable(sub)
+
+	return nil
+}
+
+func (s *Session) addTable(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub.Table == 0 {
+		s.nextTable++
+		sub.Table = s.nextTable
+	} else if sub.Table > s.nextTable {
+		s.nextTable = sub.Table
+	}
+	s.tables[sub.Table] = sub
+	for i := range sub.Items {
+		s.items[itemKey{table: sub.Table, item: i + 1}] = &itemState{
+			values:   make([]string, len(sub.Fields)),
+			changed:  make([]bool, len(sub.Fields)),
+			snapshot: sub.Snapshot && sub.Mode != ModeRaw,
+		}
+	}
+}
+
+func (s *Session) removeTable(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tables, sub.Table)
+	for i := range sub.Items {
+		delete(s.items, itemKey{table: sub.Table, item: i + 1})
+	}
+}
+
+// Destroy - Close the session (LS_op=destroy)
+func (s *Session) Destroy(ctx context.Context) error {
+	if err := s.control(ctx, url.Values{"LS_op": {"destroy"}}); err != nil {
+		return fmt.Errorf("lightstreamer: unable to destroy session %s: %w", s.ID, err)
+	}
+
+	log.Debugf("lightstreamer : session %s destroyed", s.ID)
+
+	return nil
+}
+
+// Bind - Open the stream connection of the session
+// The stream ends with ErrLoop when the server wants it to be bound again.
+func (s *Session) Bind(ctx context.Context) (*Stream, error) {
+	contentLength := s.client.ContentLength
+	if contentLength <= 0 {
+		contentLength = defaultContentLength
+	}
+
+	resp, err := s.client.post(ctx, s.client.StreamHTTPClient, s.ControlURL+"/lightstreamer/bind_session.txt", url.Values{
+		"LS_session":        {s.ID},
+		"LS_polling":        {"false"},
+		"LS_content_length": {strconv.Itoa(contentLength)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.ReadCloser = resp.Body
+	var stall *stallReader
+	if s.client.StallTimeout > 0 {
+		stall = newStallReader(resp.Body, s.client.StallTimeout)
+		body = stall
+	}
+
+	st := &Stream{
+		session: s,
+		body:    body,
+		stall:   stall,
+		reader:  bufio.NewReader(body),
+	}
+
+	if _, err := readHeaders(st.reader); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("lightstreamer: unable to bind session %s: %w", s.ID, err)
+	}
+
+	log.Debugf("lightstreamer : session %s bound", s.ID)
+
+	return st, nil
+}
+
+// requestSnapshot - subscribe a temporary table to item of sub to get its current state
+func (s *Session) requestSnapshot(sub *Subscription, item int) {
+	tmp := &Subscription{
+		Items:          []string{sub.Items[item-1]},
+		Fields:         sub.Fields,
+		Mode:           sub.Mode,
+		DataAdapter:    sub.DataAdapter,
+		Snapshot:       true,
+		resnapshotOf:   sub,
+		resnapshotItem: item,
+	}
+
+	if err := s.Subscribe(context.Background(), tmp); err != nil {
+		log.WithError(err).Error("lightstreamer : ")
+	}
+}
+
+// item - subscription and state of an item
+func (s *Session) item(table, item int) (*Subscription, *itemState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.tables[table]
+	if !ok {
+		return nil, nil, false
+	}
+	state, ok := s.items[itemKey{table: table, item: item}]
+	return sub, state, ok
+}
+
+func (s *Session) control(ctx context.Context, form url.Values) error {
+	form.Set("LS_session", s.ID)
+
+	resp, err := s.client.post(ctx, s.client.HTTPClient, s.ControlURL+"/lightstreamer/control.txt", form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = readHeaders(bufio.NewReader(resp.Body))
+	return err
+}
+
+func (c *Client) post(ctx context.Context, client *http.Client, u string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("lightstreamer: unable to create HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", formContentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("lightstreamer: calling %s failed: %w", u, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("lightstreamer: calling %s failed: http.StatusCode:%d Body: %q", u, resp.StatusCode, body)
+	}
+
+	return resp, nil
+}
+
+// readHeaders - read an OK response up to its first empty line
+// "Key:Value" lines are returned, ERROR and SYNC ERROR responses become errors.
+func readHeaders(r *bufio.Reader) (map[string]string, error) {
+	status, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch status {
+	case "OK":
+	case "SYNC ERROR":
+		return nil, ErrSync
+	case "ERROR":
+		code, _ := readLine(r)
+		message, _ := readLine(r)
+		c, _ := strconv.Atoi(code)
+		return nil, &ServerError{Code: c, Message: message}
+	default:
+		return nil, fmt.Errorf("unexpected response %q", status)
+	}
+
+	headers := make(map[string]string)
+	for {
+		line, err := readLine(r)
+		if line == "" || err != nil {
+			return headers, nil
+		}
+		if i := strings.Index(line, ":"); i > 0 {
+			headers[line[:i]] = line[i+1:]
+		}
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+	if err != nil && line != "" && err == io.EOF {
+		err = nil
+	}
+	return line, err
+}
@@ -0,0 +1,412 @@
+package lightstreamer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets/igmarketstest"
+	"github.com/amaurybrisou/igmarkets/lightstreamer"
+)
+
+const testItem = "CHART:CS.D.EURUSD.MINI.IP:SECOND"
+
+// recorder - listener and state observer sending everything to channels
+type recorder struct {
+	updates   chan lightstreamer.Update
+	snapshots chan string
+	overflows chan int
+	states    chan lightstreamer.StateEvent
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		updates:   make(chan lightstreamer.Update, 64),
+		snapshots: make(chan string, 64),
+		overflows: make(chan int, 64),
+		states:    make(chan lightstreamer.StateEvent, 64),
+	}
+}
+
+func (r *recorder) OnUpdate(_ *lightstreamer.Subscription, u lightstreamer.Update) {
+	u.Values = append([]string(nil), u.Values...)
+	u.Changed = append([]bool(nil), u.Changed...)
+	r.updates <- u
+}
+
+func (r *recorder) OnEndOfSnapshot(_ *lightstreamer.Subscription, _ int, itemName string) {
+	r.snapshots <- itemName
+}
+
+func (r *recorder) OnOverflow(_ *lightstreamer.Subscription, _ int, _ string, lost int) {
+	r.overflows <- lost
+}
+
+func (r *recorder) OnStateChange(e lightstreamer.StateEvent) {
+	r.states <- e
+}
+
+func (r *recorder) update(t *testing.T) lightstreamer.Update {
+	t.Helper()
+	select {
+	case u := <-r.updates:
+		return u
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update received")
+	}
+	return lightstreamer.Update{}
+}
+
+// waitState - wait for state, failing on Failed or Closed when not expected
+func (r *recorder) waitState(t *testing.T, state lightstreamer.State) lightstreamer.StateEvent {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case e := <-r.states:
+			if e.State == state {
+				return e
+			}
+			if e.State == lightstreamer.Failed || e.State == lightstreamer.Closed {
+				t.Fatalf("got %s waiting for %s: %v", e.State, state, e.Err)
+			}
+		case <-timeout:
+			t.Fatalf("state %s not reached", state)
+		}
+	}
+}
+
+type testStream struct {
+	ls     *igmarketstest.LightstreamerServer
+	client *lightstreamer.Client
+	rec    *recorder
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// startStream - run a client subscribed to sub on a new simulator, once
+// configure has been applied to both
+func startStream(t *testing.T, sub *lightstreamer.Subscription,
+	configure func(*igmarketstest.LightstreamerServer, *lightstreamer.Client)) *testStream {
+	t.Helper()
+
+	ls := igmarketstest.NewLightstreamerServer()
+	ls.Authenticate = func(user, password string) bool {
+		return user == "user" && password == "password"
+	}
+
+	client := lightstreamer.NewClient(ls.URL, lightstreamer.StaticCredentials("user", "password"))
+	client.ReconnectionTime = 10 * time.Millisecond
+	client.MaxReconnection = -1
+	rec := newRecorder()
+	client.OnStateChange = rec.OnStateChange
+
+	if configure != nil {
+		configure(ls, client)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &testStream{ls: ls, client: client, rec: rec, cancel: cancel, done: make(chan error, 1)}
+	go func() { s.done <- client.Run(ctx, rec, sub) }()
+
+	t.Cleanup(func() {
+		s.stop(t)
+		ls.Close()
+	})
+	return s
+}
+
+// stop - cancel Run and wait for it to return
+func (s *testStream) stop(t *testing.T) error {
+	s.cancel()
+	select {
+	case err := <-s.done:
+		s.done <- err
+		return err
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run did not return")
+	}
+	return nil
+}
+
+func (s *testStream) waitForSubscription(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.ls.WaitForSubscription(ctx, testItem); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mergeSubscription(snapshot bool) *lightstreamer.Subscription {
+	return &lightstreamer.Subscription{
+		Items:    []string{testItem},
+		Fields:   []string{"UTM", "BID_CLOSE", "OFR_CLOSE"},
+		Mode:     lightstreamer.ModeMerge,
+		Snapshot: snapshot,
+	}
+}
+
+func TestRunCreatesAndBindsSession(t *testing.T) {
+	s := startStream(t, mergeSubscription(false), nil)
+
+	s.rec.waitState(t, lightstreamer.Connected)
+	s.rec.waitState(t, lightstreamer.Subscribed)
+	s.waitForSubscription(t)
+
+	subs := s.ls.Subscriptions()
+	if len(subs) != 1 || subs[0].Mode != lightstreamer.ModeMerge || len(subs[0].Schema) != 3 || subs[0].Snapshot {
+		t.Fatalf("unexpected subscriptions %+v", subs)
+	}
+
+	s.ls.Push(testItem, map[string]string{"UTM": "1000", "BID_CLOSE": "1.1", "OFR_CLOSE": "1.2"})
+	u := s.rec.update(t)
+	if u.ItemName != testItem || u.Snapshot || u.Values[1] != "1.1" || u.Values[2] != "1.2" {
+		t.Fatalf("unexpected update %+v", u)
+	}
+
+	// missing fields are unchanged
+	s.ls.Push(testItem, map[string]string{"UTM": "2000", "BID_CLOSE": "1.15"})
+	u = s.rec.update(t)
+	if u.Values[0] != "2000" || u.Values[1] != "1.15" || u.Values[2] != "1.2" || u.Changed[2] || !u.Changed[1] {
+		t.Fatalf("unexpected merged update %+v", u)
+	}
+
+	if err := s.stop(t); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run returned %v", err)
+	}
+	s.rec.waitState(t, lightstreamer.Closed)
+}
+
+func TestRunRejectsBadCredentials(t *testing.T) {
+	s := startStream(t, mergeSubscription(false), func(_ *igmarketstest.LightstreamerServer, c *lightstreamer.Client) {
+		c.Credentials = lightstreamer.StaticCredentials("user", "wrong")
+		c.MaxReconnection = 0
+	})
+
+	select {
+	case err := <-s.done:
+		s.done <- err
+		var serr *lightstreamer.ServerError
+		if !errors.As(err, &serr) || serr.Code != 1 {
+			t.Fatalf("Run returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not fail")
+	}
+}
+
+func TestMergeSnapshot(t *testing.T) {
+	s := startStream(t, mergeSubscription(true), func(ls *igmarketstest.LightstreamerServer, _ *lightstreamer.Client) {
+		ls.Push(testItem, map[string]string{"UTM": "1000", "BID_CLOSE": "1.1"})
+	})
+
+	u := s.rec.update(t)
+	if !u.Snapshot || u.Values[0] != "1000" || u.Values[1] != "1.1" || u.Values[2] != "" {
+		t.Fatalf("unexpected snapshot %+v", u)
+	}
+	select {
+	case item := <-s.rec.snapshots:
+		if item != testItem {
+			t.Fatalf("end of snapshot of %s", item)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no end of snapshot")
+	}
+
+	s.ls.Push(testItem, map[string]string{"UTM": "2000"})
+	if u = s.rec.update(t); u.Snapshot || u.Values[0] != "2000" || u.Values[1] != "1.1" {
+		t.Fatalf("unexpected real-time update %+v", u)
+	}
+}
+
+func TestDistinctSnapshotEndsWithEOS(t *testing.T) {
+	sub := mergeSubscription(true)
+	sub.Mode = lightstreamer.ModeDistinct
+	s := startStream(t, sub, func(ls *igmarketstest.LightstreamerServer, _ *lightstreamer.Client) {
+		ls.Push(testItem, map[string]string{"UTM": "1000"})
+	})
+
+	if u := s.rec.update(t); !u.Snapshot || u.Values[0] != "1000" {
+		t.Fatalf("unexpected snapshot %+v", u)
+	}
+	select {
+	case <-s.rec.snapshots:
+	case <-time.After(time.Second):
+		t.Fatal("no end of snapshot")
+	}
+
+	s.ls.Push(testItem, map[string]string{"UTM": "2000"})
+	if u := s.rec.update(t); u.Snapshot {
+		t.Fatalf("update after EOS flagged as snapshot %+v", u)
+	}
+}
+
+func TestLoopRebindsSameSession(t *testing.T) {
+	s := startStream(t, mergeSubscription(false), nil)
+	s.rec.waitState(t, lightstreamer.Subscribed)
+	s.waitForSubscription(t)
+	session := s.ls.Subscriptions()[0].Session
+
+	s.ls.Loop()
+	s.rec.waitState(t, lightstreamer.Rebinding)
+	s.rec.waitState(t, lightstreamer.Subscribed)
+
+	s.ls.Push(testItem, map[string]string{"UTM": "1000"})
+	s.rec.update(t)
+	if subs := s.ls.Subscriptions(); len(subs) != 1 || subs[0].Session != session {
+		t.Fatalf("session changed on LOOP: %+v", subs)
+	}
+}
+
+func TestOverflowResnapshot(t *testing.T) {
+	s := startStream(t, mergeSubscription(false), func(_ *igmarketstest.LightstreamerServer, c *lightstreamer.Client) {
+		c.ResnapshotOnOverflow = true
+	})
+	s.rec.waitState(t, lightstreamer.Subscribed)
+	s.waitForSubscription(t)
+
+	s.ls.Push(testItem, map[string]string{"UTM": "1000", "BID_CLOSE": "1.1"})
+	s.rec.update(t)
+
+	s.ls.Push(testItem, map[string]string{"UTM": "3000", "BID_CLOSE": "1.3"}) // missed by the client below
+	s.rec.update(t)
+	s.ls.Overflow(testItem, 3)
+
+	select {
+	case lost := <-s.rec.overflows:
+		if lost != 3 {
+			t.Fatalf("lost %d updates, want 3", lost)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no overflow")
+	}
+
+	u := s.rec.update(t)
+	if !u.Snapshot || u.Lost != 3 || u.Values[0] != "3000" || u.Values[1] != "1.3" {
+		t.Fatalf("unexpected resnapshot %+v", u)
+	}
+	if lost := s.client.LostUpdates()[testItem]; lost != 3 {
+		t.Fatalf("LostUpdates %d, want 3", lost)
+	}
+
+	// the temporary table is removed
+	deadline := time.Now().Add(time.Second)
+	for len(s.ls.Subscriptions()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("resnapshot table not removed: %+v", s.ls.Subscriptions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProbesKeepStreamAlive(t *testing.T) {
+	s := startStream(t, mergeSubscription(false), func(ls *igmarketstest.LightstreamerServer, c *lightstreamer.Client) {
+		ls.ProbeInterval = 20 * time.Millisecond
+		c.StallTimeout = 100 * time.Millisecond
+	})
+	s.rec.waitState(t, lightstreamer.Subscribed)
+
+	select {
+	case e := <-s.rec.states:
+		t.Fatalf("stream left SUBSCRIBED with probes: %s %v", e.State, e.Err)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestStalledStreamReconnects(t *testing.T) {
+	s := startStream(t, mergeSubscription(false), func(ls *igmarketstest.LightstreamerServer, c *lightstreamer.Client) {
+		ls.ProbeInterval = 0
+		c.StallTimeout = 100 * time.Millisecond
+	})
+	s.rec.waitState(t, lightstreamer.Subscribed)
+
+	if e := s.rec.waitState(t, lightstreamer.Stalled); !errors.Is(e.Err, lightstreamer.ErrStalled) {
+		t.Fatalf("stalled with %v", e.Err)
+	}
+	if e := s.rec.waitState(t, lightstreamer.Reconnecting); e.Attempt != 1 {
+		t.Fatalf("reconnection attempt %d", e.Attempt)
+	}
+	s.rec.waitState(t, lightstreamer.Subscribed)
+}
+
+func TestDisconnectReconnects(t *testing.T) {
+	s := startStream(t, mergeSubscription(false), nil)
+	s.rec.waitState(t, lightstreamer.Subscribed)
+	s.waitForSubscription(t)
+	session := s.ls.Subscriptions()[0].Session
+
+	s.ls.Disconnect()
+	e := s.rec.waitState(t, lightstreamer.Reconnecting)
+	if e.Attempt != 1 || e.NextDelay != 10*time.Millisecond || e.Err == nil {
+		t.Fatalf("unexpected reconnection %+v", e)
+	}
+	s.rec.waitState(t, lightstreamer.Subscribed)
+	s.waitForSubscription(t)
+
+	if subs := s.ls.Subscriptions(); len(subs) != 1 || subs[0].Session == session {
+		t.Fatalf("session not recreated: %+v", subs)
+	}
+	s.ls.Push(testItem, map[string]string{"UTM": "1000"})
+	s.rec.update(t)
+}
+
+func TestShortSessionsCountAsAttempts(t *testing.T) {
+	var ls *igmarketstest.LightstreamerServer
+	s := startStream(t, mergeSubscription(false), func(l *igmarketstest.LightstreamerServer, c *lightstreamer.Client) {
+		ls = l
+		c.MaxReconnection = 2
+		c.OnStateChange = func(e lightstreamer.StateEvent) {
+			if e.State == lightstreamer.Subscribed {
+				go ls.Disconnect()
+			}
+		}
+	})
+
+	select {
+	case err := <-s.done:
+		s.done <- err
+		if err == nil || errors.Is(err, context.Canceled) {
+			t.Fatalf("Run returned %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run kept reconnecting sessions dropped at once")
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	for _, op := range []string{igmarketstest.OpCreateSession, igmarketstest.OpControl, igmarketstest.OpBindSession} {
+		t.Run(op, func(t *testing.T) {
+			t.Run("no reconnection", func(t *testing.T) {
+				s := startStream(t, mergeSubscription(false), func(ls *igmarketstest.LightstreamerServer, c *lightstreamer.Client) {
+					ls.FailNext(op, 60, "test failure")
+					c.MaxReconnection = 0
+				})
+
+				select {
+				case err := <-s.done:
+					s.done <- err
+					var serr *lightstreamer.ServerError
+					if !errors.As(err, &serr) || serr.Code != 60 || serr.Message != "test failure" {
+						t.Fatalf("Run returned %v", err)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("Run did not fail")
+				}
+				if e := s.rec.waitState(t, lightstreamer.Failed); e.Err == nil {
+					t.Fatal("FAILED without cause")
+				}
+			})
+
+			t.Run("reconnection", func(t *testing.T) {
+				s := startStream(t, mergeSubscription(false), func(ls *igmarketstest.LightstreamerServer, c *lightstreamer.Client) {
+					ls.FailNext(op, 60, "test failure")
+					c.MaxReconnection = 1
+				})
+				s.rec.waitState(t, lightstreamer.Reconnecting)
+				s.rec.waitState(t, lightstreamer.Subscribed)
+			})
+		})
+	}
+}
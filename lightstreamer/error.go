@@ -0,0 +1,27 @@
+package lightstreamer
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrLoop - the server ended the stream, the session must be bound again
+	ErrLoop = errors.New("lightstreamer: recv LOOP")
+	// ErrStalled - no data received on the stream for Client.StallTimeout
+	ErrStalled = errors.New("lightstreamer: stream stalled")
+	// ErrSync - the session is unknown to the server
+	ErrSync = errors.New("lightstreamer: SYNC ERROR")
+
+	errEOF = errors.New("lightstreamer: recv EOF")
+)
+
+// ServerError - ERROR response or END message from the server
+type ServerError struct {
+	Code    int
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("lightstreamer: server error %d: %s", e.Code, e.Message)
+}
@@ -0,0 +1,193 @@
+package lightstreamer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// State - health of a connection maintained by Client.Run
+type State int
+
+const (
+	// Connecting - authenticating and creating the session
+	Connecting State = iota
+	// Connected - session created
+	Connected
+	// Subscribed - subscriptions added and stream bound
+	Subscribed
+	// Stalled - no data received for StallTimeout
+	Stalled
+	// Rebinding - server sent LOOP, binding the same session again
+	Rebinding
+	// Reconnecting - waiting NextDelay before reconnection Attempt
+	Reconnecting
+	// Failed - MaxReconnection reached, Run returned
+	Failed
+	// Closed - context cancelled, Run returned
+	Closed
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "CONNECTING"
+	case Connected:
+		return "CONNECTED"
+	case Subscribed:
+		return "SUBSCRIBED"
+	case Stalled:
+		return "STALLED"
+	case Rebinding:
+		return "REBINDING"
+	case Reconnecting:
+		return "RECONNECTING"
+	case Failed:
+		return "FAILED"
+	case Closed:
+		return "CLOSED"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// StateEvent - state transition
+type StateEvent struct {
+	State     State
+	Time      time.Time
+	Attempt   int           // Reconnection attempt, set with Reconnecting
+	NextDelay time.Duration // Delay before the attempt, set with Reconnecting
+	Err       error         // Cause, set with Stalled, Reconnecting, Failed and Closed
+}
+
+func (c *Client) notify(e StateEvent) {
+	e.Time = time.Now()
+	log.Debugf("lightstreamer : %s", e.State)
+	if c.OnStateChange != nil {
+		c.OnStateChange(e)
+	}
+}
+
+// Reconnection backoff of Run
+const (
+	// DefaultReconnectionTime - backoff step when Client.ReconnectionTime is 0
+	DefaultReconnectionTime = time.Second
+	// DefaultMaxReconnectionDelay - longest backoff when Client.MaxReconnectionDelay is 0
+	DefaultMaxReconnectionDelay = time.Minute
+)
+
+// stableSession - sessions bound at least that long reset the attempts of Run,
+// shorter ones count as failed attempts
+var stableSession = time.Minute
+
+// Run - keep a session with subs alive until ctx is done
+// Sessions are bound again on LOOP and recreated with a linear backoff, capped
+// at MaxReconnectionDelay, on failures. The final Failed or Closed state is notified before Run returns.
+func (c *Client) Run(ctx context.Context, listener Listener, subs ...*Subscription) error {
+	attempts := 0
+
+	for {
+		c.notify(StateEvent{State: Connecting})
+
+		bound, err := c.runSession(ctx, listener, subs)
+		if ctx.Err() != nil {
+			c.notify(StateEvent{State: Closed, Err: ctx.Err()})
+			return ctx.Err()
+		}
+
+		log.WithError(err).Error("lightstreamer : ")
+
+		if bound >= stableSession {
+			attempts = 0
+		}
+		attempts++
+
+		if c.MaxReconnection >= 0 && attempts > c.MaxReconnection {
+			c.notify(StateEvent{State: Failed, Err: err})
+			return err
+		}
+
+		delay := c.reconnectionDelay(attempts)
+		c.notify(StateEvent{State: Reconnecting, Attempt: attempts, NextDelay: delay, Err: err})
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			c.notify(StateEvent{State: Closed, Err: ctx.Err()})
+			return ctx.Err()
+		}
+	}
+}
+
+// reconnectionDelay - attempt times ReconnectionTime, at most MaxReconnectionDelay
+func (c *Client) reconnectionDelay(attempt int) time.Duration {
+	step := c.ReconnectionTime
+	if step <= 0 {
+		step = DefaultReconnectionTime
+	}
+	max := c.MaxReconnectionDelay
+	if max <= 0 {
+		max = DefaultMaxReconnectionDelay
+	}
+	if max < step {
+		max = step
+	}
+
+	if attempt > int(max/step) {
+		return max
+	}
+	return time.Duration(attempt) * step
+}
+
+// runSession - returns how long the stream stayed bound, LOOP rebinding included
+func (c *Client) runSession(ctx context.Context, listener Listener, subs []*Subscription) (time.Duration, error) {
+	session, err := c.CreateSession(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		// ctx may be done already, the HTTP client timeout applies
+		if err := session.Destroy(context.Background()); err != nil {
+			log.WithError(err).Debug("lightstreamer : ")
+		}
+	}()
+
+	c.notify(StateEvent{State: Connected})
+
+	for _, sub := range subs {
+		if err := session.Subscribe(ctx, sub); err != nil {
+			return 0, err
+		}
+	}
+
+	stream, err := session.Bind(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	c.notify(StateEvent{State: Subscribed})
+	start := time.Now()
+
+	for {
+		err = stream.Dispatch(listener)
+		if ctx.Err() != nil {
+			return time.Since(start), ctx.Err()
+		}
+
+		switch err {
+		case ErrStalled:
+			c.notify(StateEvent{State: Stalled, Err: err})
+			return time.Since(start), err
+		case ErrLoop:
+			c.notify(StateEvent{State: Rebinding})
+			if stream, err = session.Bind(ctx); err != nil {
+				return time.Since(start), err
+			}
+			c.notify(StateEvent{State: Subscribed})
+		default:
+			return time.Since(start), err
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package lightstreamer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectionDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		step     time.Duration
+		max      time.Duration
+		attempt  int
+		expected time.Duration
+	}{
+		{"default step", 0, 0, 1, DefaultReconnectionTime},
+		{"linear", 0, 0, 3, 3 * DefaultReconnectionTime},
+		{"default cap", 0, 0, 1000, DefaultMaxReconnectionDelay},
+		{"step", 5 * time.Second, 0, 2, 10 * time.Second},
+		{"cap", 5 * time.Second, 12 * time.Second, 3, 12 * time.Second},
+		{"step above cap", 2 * time.Minute, 0, 3, 2 * time.Minute},
+		{"negative step", -time.Second, 0, 2, 2 * DefaultReconnectionTime},
+		{"overflow", time.Hour, 0, 1 << 40, time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{ReconnectionTime: tt.step, MaxReconnectionDelay: tt.max}
+			if d := c.reconnectionDelay(tt.attempt); d != tt.expected {
+				t.Fatalf("got %v, want %v", d, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package lightstreamer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stream - bound stream connection of a session
+type Stream struct {
+	session *Session
+	body    io.ReadCloser
+	stall   *stallReader
+	reader  *bufio.Reader
+}
+
+// Replay - dispatch a recorded stream body to listener
+// subs are the subscriptions of the recorded session, tables are allocated in
+// order when not set. Replay returns nil once r is exhausted.
+func Replay(r io.Reader, listener Listener, subs ...*Subscription) error {
+	session := &Session{
+		client: &Client{},
+		tables: make(map[int]*Subscription),
+		items:  make(map[itemKey]*itemState),
+	}
+	for _, sub := range subs {
+		session.addTable(sub)
+	}
+
+	st := &Stream{
+		session: session,
+		body:    ioutil.NopCloser(r),
+		reader:  bufio.NewReader(r),
+	}
+
+	if err := st.Dispatch(listener); err != errEOF {
+		return err
+	}
+	return nil
+}
+
+// Close - close the stream connection, the session stays alive
+func (st *Stream) Close() error {
+	return st.body.Close()
+}
+
+// Dispatch - deliver updates to listener until the stream ends
+// ErrLoop is returned when the server asks for the session to be bound again,
+// ErrStalled when nothing was received for Client.StallTimeout.
+func (st *Stream) Dispatch(listener Listener) error {
+	defer st.body.Close()
+
+	for {
+		line, err := st.reader.ReadString('\n')
+
+		if log.IsLevelEnabled(log.TraceLevel) {
+			log.Traceln(line, err)
+		}
+
+		if err != nil {
+			if st.stall != nil && st.stall.Stalled() {
+				return ErrStalled
+			}
+			if err == io.EOF {
+				return errEOF
+			}
+			return fmt.Errorf("lightstreamer: reading stream failed: %w", err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "", line == "PROBE":
+			continue
+		case line == "LOOP":
+			return ErrLoop
+		case line == "SYNC ERROR":
+			return ErrSync
+		case line == "ERROR":
+			code, _ := readLine(st.reader)
+			message, _ := readLine(st.reader)
+			c, _ := strconv.Atoi(code)
+			return &ServerError{Code: c, Message: message}
+		case strings.HasPrefix(line, "END"):
+			code, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "END")))
+			return &ServerError{Code: code, Message: "session closed by the server"}
+		}
+
+		if !st.dispatchLine(line, listener) {
+			log.Debugf("lightstreamer : ignoring %q", line)
+		}
+	}
+}
+
+// dispatchLine - "<table>,<item>|<value>|<value>..." or "<table>,<item>,EOS"
+// The line is scanned in place, values are substrings of it.
+func (st *Stream) dispatchLine(line string, listener Listener) bool {
+	head, values := line, ""
+	bar := strings.IndexByte(line, '|')
+	if bar >= 0 {
+		head, values = line[:bar], line[bar+1:]
+	}
+
+	comma := strings.IndexByte(head, ',')
+	if comma < 0 {
+		return false
+	}
+	table, err := strconv.Atoi(head[:comma])
+	if err != nil {
+		return false
+	}
+
+	itemID, notice := head[comma+1:], ""
+	if comma = strings.IndexByte(itemID, ','); comma >= 0 {
+		itemID, notice = itemID[:comma], itemID[comma+1:]
+	}
+	item, err := strconv.Atoi(itemID)
+	if err != nil {
+		return false
+	}
+
+	sub, state, ok := st.session.item(table, item)
+	if !ok {
+		return false
+	}
+
+	if notice != "" {
+		if bar >= 0 {
+			return false
+		}
+		switch {
+		case notice == "EOS":
+			if state.snapshot {
+				state.snapshot = false
+				notifyEndOfSnapshot(listener, sub, item)
+			}
+		case strings.HasPrefix(notice, "OV"):
+			lost, err := strconv.Atoi(notice[2:])
+			if err != nil {
+				return false
+			}
+			st.overflow(listener, sub, item, state, lost)
+		default:
+			return false
+		}
+		return true
+	}
+
+	if bar < 0 || strings.Count(values, "|")+1 != len(sub.Fields) {
+		return false
+	}
+
+	if sub.resnapshotOf != nil {
+		st.resnapshot(listener, sub, state, values)
+		return true
+	}
+
+	st.update(listener, sub, item, state, values, state.snapshot)
+
+	// the snapshot of a MERGE item is a single update, no EOS is sent
+	if state.snapshot && sub.Mode == ModeMerge {
+		state.snapshot = false
+		notifyEndOfSnapshot(listener, sub, item)
+	}
+
+	return true
+}
+
+// update - apply the "|" separated values to state and deliver them
+func (st *Stream) update(listener Listener, sub *Subscription, item int, state *itemState, values string, snapshot bool) {
+	for i := range state.changed {
+		v := values
+		if bar := strings.IndexByte(values, '|'); bar >= 0 {
+			v, values = values[:bar], values[bar+1:]
+		}
+
+		state.changed[i] = v != ""
+		if v != "" {
+			state.values[i] = decodeValue(v)
+		}
+	}
+
+	u := Update{
+		Table:    sub.Table,
+		Item:     item,
+		ItemName: sub.Items[item-1],
+		Fields:   sub.Fields,
+		Values:   state.values,
+		Changed:  state.changed,
+		Snapshot: snapshot,
+		Lost:     state.lost,
+	}
+	state.lost = 0
+
+	listener.OnUpdate(sub, u)
+}
+
+// overflow - "<table>,<item>,OV<lost>", the server dropped lost updates of the item
+func (st *Stream) overflow(listener Listener, sub *Subscription, item int, state *itemState, lost int) {
+	itemName := sub.Items[item-1]
+
+	log.Warnf("lightstreamer : %d updates lost for %s", lost, itemName)
+
+	state.lost += lost
+	st.session.client.addLostUpdates(itemName, lost)
+
+	if l, ok := listener.(OverflowListener); ok {
+		l.OnOverflow(sub, item, itemName, lost)
+	}
+
+	if st.session.client.ResnapshotOnOverflow && sub.Mode == ModeMerge {
+		go st.session.requestSnapshot(sub, item)
+	}
+}
+
+// resnapshot - deliver the snapshot received on a temporary table as a
+// snapshot update of the original item, then drop the temporary table
+func (st *Stream) resnapshot(listener Listener, tmp *Subscription, tmpState *itemState, values string) {
+	if !tmpState.snapshot {
+		return
+	}
+	tmpState.snapshot = false
+
+	go func() {
+		if err := st.session.Unsubscribe(context.Background(), tmp); err != nil {
+			log.WithError(err).Error("lightstreamer : ")
+		}
+	}()
+
+	sub, state, ok := st.session.item(tmp.resnapshotOf.Table, tmp.resnapshotItem)
+	if !ok {
+		return
+	}
+
+	st.update(listener, sub, tmp.resnapshotItem, state, values, true)
+}
+
+func notifyEndOfSnapshot(listener Listener, sub *Subscription, item int) {
+	if l, ok := listener.(SnapshotListener); ok {
+		l.OnEndOfSnapshot(sub, item, sub.Items[item-1])
+	}
+}
+
+// decodeValue - "$" is an empty string and "#" null
+func decodeValue(raw string) string {
+	if raw == "$" || raw == "#" {
+		return ""
+	}
+	return raw
+}
+
+// stallReader - closes the stream when nothing was read for timeout
+type stallReader struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+}
+
+func newStallReader(body io.ReadCloser, timeout time.Duration) *stallReader {
+	s := &stallReader{ReadCloser: body, timeout: timeout}
+	s.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&s.stalled, 1)
+		body.Close()
+	})
+	return s
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	return n, err
+}
+
+func (s *stallReader) Close() error {
+	s.timer.Stop()
+	return s.ReadCloser.Close()
+}
+
+// Stalled - true if the stream was closed because of the timeout
+func (s *stallReader) Stalled() bool {
+	return atomic.LoadInt32(&s.stalled) == 1
+}
@@ -0,0 +1,78 @@
+package lightstreamer
+
+// Subscription modes
+const (
+	ModeMerge    = "MERGE"
+	ModeDistinct = "DISTINCT"
+	ModeRaw      = "RAW"
+	ModeCommand  = "COMMAND"
+)
+
+// Subscription - table of items and fields added to a session
+type Subscription struct {
+	Table       int // LS_table, allocated by Session.Subscribe when 0
+	Items       []string
+	Fields      []string
+	Mode        string
+	DataAdapter string // LS_data_adapter, server default when empty
+	Snapshot    bool   // LS_snapshot, ask for the current state of the items first
+
+	// temporary table requesting a new snapshot of resnapshotOf item resnapshotItem
+	resnapshotOf   *Subscription
+	resnapshotItem int
+}
+
+// Update - new values of one item
+// Values holds the current value of every field, fields not sent by the
+// server keep their previous value and are reported as not Changed.
+// Snapshot is set on the updates sent before the end of the item snapshot,
+// in MERGE mode the snapshot is the first update of the item.
+// Lost counts the updates of the item dropped by the server since the
+// previous update.
+// Values and Changed are reused by the next update of the item, they must
+// be copied to be kept after OnUpdate returns.
+type Update struct {
+	Table    int
+	Item     int // 1-based position of the item in Subscription.Items
+	ItemName string
+	Fields   []string
+	Values   []string
+	Changed  []bool
+	Snapshot bool
+	Lost     int
+}
+
+// Value - current value of field
+func (u Update) Value(field string) (string, bool) {
+	for i, f := range u.Fields {
+		if f == field {
+			return u.Values[i], true
+		}
+	}
+	return "", false
+}
+
+// Listener - receives the updates of a stream
+type Listener interface {
+	OnUpdate(sub *Subscription, u Update)
+}
+
+// ListenerFunc - Listener adapter for functions
+type ListenerFunc func(sub *Subscription, u Update)
+
+// OnUpdate - call f
+func (f ListenerFunc) OnUpdate(sub *Subscription, u Update) {
+	f(sub, u)
+}
+
+// SnapshotListener - optionally implemented by listeners to be told when the
+// snapshot of an item has been delivered, real-time updates follow
+type SnapshotListener interface {
+	OnEndOfSnapshot(sub *Subscription, item int, itemName string)
+}
+
+// OverflowListener - optionally implemented by listeners to be told when the
+// server dropped updates of an item because of buffer limits
+type OverflowListener interface {
+	OnOverflow(sub *Subscription, item int, itemName string, lost int)
+}
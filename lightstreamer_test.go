@@ -0,0 +1,266 @@
+package igmarkets_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+	"github.com/amaurybrisou/igmarkets/igmarketstest"
+)
+
+const (
+	testEpic = "CS.D.EURUSD.MINI.IP"
+	testItem = "CHART:" + testEpic + ":SECOND"
+)
+
+// streamRig - IG stand-in, Lightstreamer simulator and a client of both
+type streamRig struct {
+	ls      *igmarketstest.LightstreamerServer
+	srv     *igmarketstest.Server
+	ig      *igmarkets.IGMarkets
+	logouts int32
+	states  chan igmarkets.StreamStateEvent
+}
+
+func newStreamRig(t *testing.T) *streamRig {
+	t.Helper()
+
+	r := &streamRig{states: make(chan igmarkets.StreamStateEvent, 64)}
+	r.ls = igmarketstest.NewLightstreamerServer()
+	r.srv = igmarketstest.NewServer(r.ls.URL)
+	r.ls.Authenticate = func(user, password string) bool {
+		return user == r.srv.AccountID && password == "CST-"+r.srv.CST+"|XST-"+r.srv.XST
+	}
+
+	// count the logouts on the way to the IG stand-in
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete && req.URL.Path == "/gateway/deal/session" {
+			atomic.AddInt32(&r.logouts, 1)
+		}
+		r.srv.Mux.ServeHTTP(w, req)
+	}))
+
+	r.ig = r.srv.NewClient(false)
+	r.ig.APIURL = api.URL
+
+	t.Cleanup(func() {
+		r.ig.CloseLightStreamerSubscription()
+		api.Close()
+		r.srv.Close()
+		r.ls.Close()
+	})
+	return r
+}
+
+func (r *streamRig) options() igmarkets.LightStreamOptions {
+	return igmarkets.LightStreamOptions{
+		Epics:           []string{testEpic},
+		Fields:          []string{"UTM", "BID_CLOSE", "OFR_CLOSE"},
+		SubType:         "CHART",
+		Interval:        "SECOND",
+		Mode:            "MERGE",
+		MaxReconnection: 3,
+		OnStateChange:   func(e igmarkets.StreamStateEvent) { r.states <- e },
+	}
+}
+
+func (r *streamRig) waitState(t *testing.T, state igmarkets.StreamState) igmarkets.StreamStateEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-r.states:
+			if e.State == state {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("state %s not reached", state)
+		}
+	}
+}
+
+func (r *streamRig) waitForSubscription(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.ls.WaitForSubscription(ctx, testItem); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receiveTick(t *testing.T, ticks <-chan igmarkets.LightStreamChartTick) igmarkets.LightStreamChartTick {
+	t.Helper()
+	select {
+	case tick, ok := <-ticks:
+		if !ok {
+			t.Fatal("tick channel closed")
+		}
+		return tick
+	case <-time.After(5 * time.Second):
+		t.Fatal("no tick received")
+	}
+	return igmarkets.LightStreamChartTick{}
+}
+
+func TestLightStreamerSubscription(t *testing.T) {
+	r := newStreamRig(t)
+	r.ls.Push(testItem, map[string]string{"UTM": "1606054455000", "BID_CLOSE": "1.1", "OFR_CLOSE": "1.2"})
+
+	snapshots := make(chan string, 1)
+	o := r.options()
+	o.OnEndOfSnapshot = func(epic string) { snapshots <- epic }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticks, errs, err := r.ig.OpenLightStreamerSubscription(ctx, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tick := receiveTick(t, ticks)
+	if !tick.Snapshot || tick.EPIC != testEpic || tick.BID_CLOSE != 1.1 || tick.OFR_CLOSE != 1.2 ||
+		tick.UTM.UnixNano() != 1606054455000*int64(time.Millisecond) {
+		t.Fatalf("unexpected snapshot tick %+v", tick)
+	}
+	if epic := <-snapshots; epic != testEpic {
+		t.Fatalf("end of snapshot of %s", epic)
+	}
+
+	r.ls.Push(testItem, map[string]string{"UTM": "1606054456000", "BID_CLOSE": "1.15"})
+	tick = receiveTick(t, ticks)
+	if tick.Snapshot || tick.BID_CLOSE != 1.15 || tick.OFR_CLOSE != 1.2 ||
+		!tick.Changed.Has(igmarkets.ChartTickBID_CLOSE) || tick.Changed.Has(igmarkets.ChartTickOFR_CLOSE) {
+		t.Fatalf("unexpected tick %+v", tick)
+	}
+
+	r.ls.Loop()
+	r.waitState(t, igmarkets.StreamRebinding)
+	r.waitState(t, igmarkets.StreamSubscribed)
+	r.ls.Push(testItem, map[string]string{"UTM": "1606054457000"})
+	receiveTick(t, ticks)
+
+	cancel()
+	for range ticks {
+	}
+	for range errs {
+	}
+	r.waitState(t, igmarkets.StreamClosed)
+
+	if n := atomic.LoadInt32(&r.logouts); n != 0 {
+		t.Fatalf("stream end logged out %d times", n)
+	}
+	if err := r.ig.LogoutLightStreamer(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&r.logouts); n != 1 {
+		t.Fatalf("LogoutLightStreamer logged out %d times", n)
+	}
+}
+
+func TestLightStreamerOverflow(t *testing.T) {
+	r := newStreamRig(t)
+
+	type overflow struct {
+		epic string
+		lost int
+	}
+	overflows := make(chan overflow, 1)
+	o := r.options()
+	o.ResnapshotOnOverflow = true
+	o.OnOverflow = func(epic string, lost int) { overflows <- overflow{epic, lost} }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticks, _, _ := r.ig.OpenLightStreamerSubscription(ctx, o)
+	r.waitForSubscription(t)
+
+	// the empty snapshot has no UTM and is not delivered
+	r.ls.Push(testItem, map[string]string{"UTM": "1606054455000", "BID_CLOSE": "1.1"})
+	receiveTick(t, ticks)
+
+	r.ls.Push(testItem, map[string]string{"UTM": "1606054456000", "BID_CLOSE": "1.3"})
+	receiveTick(t, ticks)
+	r.ls.Overflow(testItem, 5)
+	if ov := <-overflows; ov.epic != testEpic || ov.lost != 5 {
+		t.Fatalf("unexpected overflow %+v", ov)
+	}
+
+	tick := receiveTick(t, ticks)
+	if !tick.Snapshot || tick.Lost != 5 || tick.BID_CLOSE != 1.3 {
+		t.Fatalf("unexpected resnapshot tick %+v", tick)
+	}
+}
+
+func TestLightStreamerReconnection(t *testing.T) {
+	r := newStreamRig(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticks, errs, _ := r.ig.OpenLightStreamerSubscription(ctx, r.options())
+	r.waitForSubscription(t)
+
+	r.ls.Disconnect()
+	e := r.waitState(t, igmarkets.StreamReconnecting)
+	if e.Attempt != 1 || e.NextDelay != time.Second {
+		t.Fatalf("unexpected reconnection %+v", e)
+	}
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("nil reconnection cause")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reconnection cause not sent")
+	}
+
+	r.waitState(t, igmarkets.StreamSubscribed)
+	r.waitForSubscription(t)
+	r.ls.Push(testItem, map[string]string{"UTM": "1606054455000"})
+	receiveTick(t, ticks)
+
+	if n := atomic.LoadInt32(&r.logouts); n != 0 {
+		t.Fatalf("reconnection logged out %d times", n)
+	}
+}
+
+func TestLightStreamerStall(t *testing.T) {
+	r := newStreamRig(t)
+	r.ls.ProbeInterval = 0
+
+	o := r.options()
+	o.StallTimeout = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.ig.OpenLightStreamerSubscription(ctx, o)
+
+	r.waitState(t, igmarkets.StreamSubscribed)
+	r.waitState(t, igmarkets.StreamStalled)
+	r.waitState(t, igmarkets.StreamReconnecting)
+	r.waitState(t, igmarkets.StreamSubscribed)
+}
+
+func TestLightStreamerFailure(t *testing.T) {
+	r := newStreamRig(t)
+	r.ls.FailNext(igmarketstest.OpCreateSession, 7, "licensed maximum number of sessions reached")
+
+	o := r.options()
+	o.MaxReconnection = 0
+
+	ticks, errs, _ := r.ig.OpenLightStreamerSubscription(context.Background(), o)
+
+	e := r.waitState(t, igmarkets.StreamFailed)
+	if e.Err == nil {
+		t.Fatal("FAILED without cause")
+	}
+	if err := <-errs; err == nil {
+		t.Fatal("failure cause not sent")
+	}
+	if _, ok := <-ticks; ok {
+		t.Fatal("tick channel not closed")
+	}
+}
@@ -0,0 +1,318 @@
+package igmarkets
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// MarginEstimate - notional exposure and margin of a deal in the account
+// currency
+type MarginEstimate struct {
+	Epic      string    `json:"epic"`
+	DealID    string    `json:"dealId,omitempty"` // of a position
+	Direction Direction `json:"direction"`
+	Size      float64   `json:"size"`
+	Level     float64   `json:"level"` // price the deal is valued at
+
+	Currency        string  `json:"currency"`
+	AccountCurrency string  `json:"accountCurrency"`
+	ExchangeRate    float64 `json:"exchangeRate"` // account currency for one unit of Currency
+
+	MarginFactor     float64 `json:"marginFactor"`
+	MarginFactorUnit string  `json:"marginFactorUnit"`
+
+	Notional float64 `json:"notional"`
+	Margin   float64 `json:"margin"`
+	// GuaranteedStopPremium - premium of the guaranteed stop, part of Margin
+	GuaranteedStopPremium float64 `json:"guaranteedStopPremium,omitempty"`
+
+	// Assumptions - how the market details were read
+	Assumptions []string `json:"assumptions"`
+}
+
+func (e *MarginEstimate) assume(format string, args ...interface{}) {
+	e.Assumptions = append(e.Assumptions, fmt.Sprintf(format, args...))
+}
+
+// marginDeal - what the margin of a deal depends on
+type marginDeal struct {
+	epic, dealID, currency string
+	direction              Direction
+	size, level            float64
+	guaranteedStop         bool
+	stopDistance           float64
+}
+
+// EstimateOrderMargin - margin order would consume on market, valued at its
+// level or at the current price for market orders
+func EstimateOrderMargin(market *MarketsResponse, order OTCOrderRequest, accountCurrency string) (*MarginEstimate, error) {
+	level := market.Snapshot.Offer
+	if order.Direction == DirectionSell {
+		level = market.Snapshot.Bid
+	}
+	if order.Level != "" {
+		l, err := strconv.ParseFloat(order.Level, 64)
+		if err != nil {
+			return nil, fmt.Errorf("igmarkets: invalid level %q", order.Level)
+		}
+		level = l
+	}
+
+	deal := marginDeal{
+		epic:           order.Epic,
+		currency:       order.CurrencyCode,
+		direction:      order.Direction,
+		size:           order.Size,
+		level:          level,
+		guaranteedStop: order.GuaranteedStop,
+	}
+	if order.GuaranteedStop {
+		e := &DealingRulesError{}
+		d, _, ok := distance(e, "stop", order.StopDistance, order.StopLevel, level, stopSign(order.Direction), pointSize(market))
+		if !ok {
+			return nil, fmt.Errorf("igmarkets: guaranteed stop of the order: %v", e.err())
+		}
+		deal.stopDistance = d
+	}
+
+	return estimateMargin(market, deal, accountCurrency)
+}
+
+// EstimateWorkingOrderMargin - margin order would consume once filled
+func EstimateWorkingOrderMargin(market *MarketsResponse, order OTCWorkingOrderRequest, accountCurrency string) (*MarginEstimate, error) {
+	deal := marginDeal{
+		epic:           order.Epic,
+		currency:       order.CurrencyCode,
+		direction:      order.Direction,
+		size:           order.Size,
+		level:          order.Level,
+		guaranteedStop: order.GuaranteedStop,
+	}
+	if order.GuaranteedStop {
+		e := &DealingRulesError{}
+		d, _, ok := distance(e, "stop", order.StopDistance, order.StopLevel, order.Level, stopSign(order.Direction), pointSize(market))
+		if !ok {
+			return nil, fmt.Errorf("igmarkets: guaranteed stop of the order: %v", e.err())
+		}
+		deal.stopDistance = d
+	}
+
+	return estimateMargin(market, deal, accountCurrency)
+}
+
+// EstimatePositionMargin - margin held by position, valued at the price
+// closing it
+func EstimatePositionMargin(market *MarketsResponse, position Position, accountCurrency string) (*MarginEstimate, error) {
+	p := position.Position
+	level := closePrice(&position, market)
+
+	deal := marginDeal{
+		epic:           position.MarketData.Epic,
+		dealID:         p.DealID,
+		currency:       p.Currency,
+		direction:      p.Direction,
+		size:           p.Size,
+		level:          level,
+		guaranteedStop: p.ControlledRisk,
+	}
+	if p.ControlledRisk && p.StopLevel != 0 {
+		deal.stopDistance = (level - p.StopLevel) * stopSign(p.Direction) / pointSize(market)
+	}
+
+	return estimateMargin(market, deal, accountCurrency)
+}
+
+// estimateMargin - notional of size at level, in points times the value of a
+// point, times the margin factor or the margins of the deposit bands. At most
+// the loss at a guaranteed stop plus its premium.
+func estimateMargin(market *MarketsResponse, deal marginDeal, accountCurrency string) (*MarginEstimate, error) {
+	instrument := market.Instrument
+	e := &MarginEstimate{
+		Epic:             deal.epic,
+		DealID:           deal.dealID,
+		Direction:        deal.direction,
+		Size:             deal.size,
+		Level:            deal.level,
+		AccountCurrency:  accountCurrency,
+		MarginFactor:     instrument.MarginFactor,
+		MarginFactorUnit: instrument.MarginFactorUnit,
+	}
+	if e.Epic == "" {
+		e.Epic = instrument.Epic
+	}
+	if deal.level <= 0 {
+		return nil, fmt.Errorf("igmarkets: no price to value %s at", e.Epic)
+	}
+
+	currency, err := dealCurrency(market, deal.currency)
+	if err != nil {
+		return nil, err
+	}
+	e.Currency = currency.Code
+	if e.ExchangeRate, err = accountExchangeRate(currency, accountCurrency); err != nil {
+		return nil, err
+	}
+	if e.Currency != accountCurrency {
+		e.assume("1 %s = %g %s", e.Currency, e.ExchangeRate, accountCurrency)
+	}
+
+	pointValue, err := valueOfOnePoint(instrument, e.Currency, e.assume)
+	if err != nil {
+		return nil, err
+	}
+	perPoint := deal.size * pointValue * e.ExchangeRate
+	point := pointSize(market)
+
+	e.Notional = deal.level / point * perPoint
+
+	switch {
+	case len(instrument.MarginDepositBands) > 0:
+		e.Margin = e.Notional * bandsMargin(instrument.MarginDepositBands, deal.size) / 100
+		e.assume("margin of %g%% of the notional from the deposit bands", e.Margin/e.Notional*100)
+	case instrument.MarginFactorUnit == UnitPercentage:
+		e.Margin = e.Notional * instrument.MarginFactor / 100
+	case instrument.MarginFactorUnit == UnitPoints:
+		e.Margin = instrument.MarginFactor * perPoint
+	default:
+		return nil, fmt.Errorf("igmarkets: unknown margin factor unit %q on %s", instrument.MarginFactorUnit, e.Epic)
+	}
+
+	if deal.guaranteedStop && deal.stopDistance > 0 {
+		e.GuaranteedStopPremium = distancePoints(instrument.LimitedRiskPremium, deal.level, point) * perPoint
+		if atStop := deal.stopDistance * perPoint; atStop < e.Margin {
+			e.Margin = atStop
+			e.assume("margin limited to the loss at the guaranteed stop, %g points away", deal.stopDistance)
+		}
+		e.Margin += e.GuaranteedStopPremium
+	}
+
+	return e, nil
+}
+
+// bandsMargin - margin in percent of the notional of size, each part of size
+// at the margin of its deposit band
+func bandsMargin(bands []MarginDepositBand, size float64) float64 {
+	if size <= 0 {
+		return 0
+	}
+	margin := 0.0
+	for _, b := range bands {
+		upper := size
+		if b.Max > 0 && b.Max < upper {
+			upper = b.Max
+		}
+		if upper > b.Min {
+			margin += (upper - b.Min) * b.Margin
+		}
+	}
+	return margin / size
+}
+
+// MarginCheck - margin of a proposed deal against the funds of the account
+type MarginCheck struct {
+	Estimate  *MarginEstimate `json:"estimate"`
+	Available float64         `json:"available"` // before the deal
+	Remaining float64         `json:"remaining"` // after the deal
+	Covered   bool            `json:"covered"`
+}
+
+// Exposure - notional exposure and margin of the open positions
+type Exposure struct {
+	AccountCurrency string            `json:"accountCurrency"`
+	Positions       []*MarginEstimate `json:"positions"`
+	// NetNotional - long minus short notional by epic
+	NetNotional   map[string]float64 `json:"netNotional"`
+	GrossNotional float64            `json:"grossNotional"`
+	Margin        float64            `json:"margin"`
+	// Available - funds available for new deals, the margin of the
+	// positions already deducted
+	Available float64 `json:"available"`
+}
+
+// currentAccount - the account of ig
+func (ig *IGMarkets) currentAccount() (*Account, error) {
+	accounts, err := ig.GetAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	ig.RLock()
+	accountID := ig.AccountID
+	ig.RUnlock()
+
+	for i := range accounts.Accounts {
+		if accounts.Accounts[i].AccountID == accountID {
+			return &accounts.Accounts[i], nil
+		}
+	}
+	return nil, fmt.Errorf("igmarkets: account %s not found", accountID)
+}
+
+// CheckOrderMargin - margin order would consume and whether the available
+// funds of the account cover it
+func (ig *IGMarkets) CheckOrderMargin(order OTCOrderRequest) (*MarginCheck, error) {
+	account, err := ig.currentAccount()
+	if err != nil {
+		return nil, err
+	}
+	market, err := ig.GetMarkets(order.Epic)
+	if err != nil {
+		return nil, err
+	}
+
+	estimate, err := EstimateOrderMargin(market, order, account.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	available := account.Balance.Available
+	return &MarginCheck{
+		Estimate:  estimate,
+		Available: available,
+		Remaining: available - estimate.Margin,
+		Covered:   estimate.Margin <= available,
+	}, nil
+}
+
+// GetExposure - exposure and margin of the open positions, valued at the
+// current prices
+func (ig *IGMarkets) GetExposure() (*Exposure, error) {
+	account, err := ig.currentAccount()
+	if err != nil {
+		return nil, err
+	}
+	positions, err := ig.GetPositions()
+	if err != nil {
+		return nil, err
+	}
+
+	exposure := &Exposure{
+		AccountCurrency: account.Currency,
+		NetNotional:     make(map[string]float64),
+		Available:       account.Balance.Available,
+	}
+
+	markets := make(map[string]*MarketsResponse)
+	for _, position := range positions.Positions {
+		epic := position.MarketData.Epic
+		market, ok := markets[epic]
+		if !ok {
+			if market, err = ig.GetMarkets(epic); err != nil {
+				return nil, err
+			}
+			markets[epic] = market
+		}
+
+		estimate, err := EstimatePositionMargin(market, position, account.Currency)
+		if err != nil {
+			return nil, err
+		}
+
+		exposure.Positions = append(exposure.Positions, estimate)
+		exposure.GrossNotional += estimate.Notional
+		exposure.NetNotional[epic] += estimate.Notional * stopSign(estimate.Direction)
+		exposure.Margin += estimate.Margin
+	}
+
+	return exposure, nil
+}
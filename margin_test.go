@@ -0,0 +1,228 @@
+package igmarkets_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/amaurybrisou/igmarkets"
+)
+
+func TestEstimateMargin(t *testing.T) {
+	// an index at 1000/1001, one point worth 2 USD for a size of 1
+	index := func(set func(m *igmarkets.MarketsResponse)) *igmarkets.MarketsResponse {
+		m := &igmarkets.MarketsResponse{
+			Instrument: igmarkets.Instrument{
+				Epic:             "INDEX",
+				ValueOfOnePip:    "2",
+				MarginFactor:     5,
+				MarginFactorUnit: igmarkets.UnitPercentage,
+				Currencies:       []igmarkets.Currency{{Code: "USD", IsDefault: true, ExchangeRate: 0.8}},
+			},
+			Snapshot: igmarkets.Snapshot{Bid: 1000, Offer: 1001, ScalingFactor: 1},
+		}
+		if set != nil {
+			set(m)
+		}
+		return m
+	}
+	order := func(size float64, set func(o *igmarkets.OTCOrderRequest)) igmarkets.OTCOrderRequest {
+		o := igmarkets.OTCOrderRequest{
+			Epic:         "INDEX",
+			Direction:    igmarkets.DirectionSell,
+			Size:         size,
+			OrderType:    igmarkets.OrderTypeMarket,
+			CurrencyCode: "USD",
+			Expiry:       "-",
+		}
+		if set != nil {
+			set(&o)
+		}
+		return o
+	}
+	bands := []igmarkets.MarginDepositBand{
+		{Min: 0, Max: 10, Margin: 5, Currency: "USD"},
+		{Min: 10, Max: 20, Margin: 10, Currency: "USD"},
+		{Min: 20, Margin: 20, Currency: "USD"},
+	}
+
+	tests := []struct {
+		name     string
+		market   *igmarkets.MarketsResponse
+		order    igmarkets.OTCOrderRequest
+		account  string
+		notional float64
+		margin   float64
+		premium  float64
+	}{
+		{
+			name:     "percentage of the notional",
+			market:   index(nil),
+			order:    order(1, nil),
+			account:  "USD",
+			notional: 2000, // 1000 points x 2
+			margin:   100,
+		},
+		{
+			name:     "in the account currency",
+			market:   index(nil),
+			order:    order(1, nil),
+			account:  "GBP",
+			notional: 1600,
+			margin:   80,
+		},
+		{
+			name: "points of margin",
+			market: index(func(m *igmarkets.MarketsResponse) {
+				m.Instrument.MarginFactor = 50
+				m.Instrument.MarginFactorUnit = igmarkets.UnitPoints
+			}),
+			order:    order(2, nil),
+			account:  "USD",
+			notional: 4000,
+			margin:   200, // 50 points x 2 x 2
+		},
+		{
+			name:     "first deposit band",
+			market:   index(func(m *igmarkets.MarketsResponse) { m.Instrument.MarginDepositBands = bands }),
+			order:    order(10, nil),
+			account:  "USD",
+			notional: 20000,
+			margin:   1000,
+		},
+		{
+			name:     "size over three deposit bands",
+			market:   index(func(m *igmarkets.MarketsResponse) { m.Instrument.MarginDepositBands = bands }),
+			order:    order(25, nil),
+			account:  "USD",
+			notional: 50000,
+			margin:   1000 + 2000 + 2000, // 10 at 5%, 10 at 10%, 5 at 20% of 2000 each
+		},
+		{
+			name: "levels in points of the scaling factor",
+			market: index(func(m *igmarkets.MarketsResponse) {
+				m.Instrument.ValueOfOnePip = "10"
+				m.Snapshot = igmarkets.Snapshot{Bid: 1.1, Offer: 1.1002, ScalingFactor: 10000}
+			}),
+			order:    order(1, nil),
+			account:  "USD",
+			notional: 110000, // 11000 points x 10
+			margin:   5500,
+		},
+		{
+			name: "limited to the loss at a guaranteed stop",
+			market: index(func(m *igmarkets.MarketsResponse) {
+				m.Instrument.LimitedRiskPremium = igmarkets.UnitValueFloat{Unit: igmarkets.UnitPoints, Value: 3}
+			}),
+			order: order(1, func(o *igmarkets.OTCOrderRequest) {
+				o.GuaranteedStop = true
+				o.StopLevel = "1020"
+			}),
+			account:  "USD",
+			notional: 2000,
+			margin:   46, // 20 points x 2 plus the premium
+			premium:  6,
+		},
+		{
+			name: "guaranteed stop further than the margin",
+			market: index(func(m *igmarkets.MarketsResponse) {
+				m.Instrument.LimitedRiskPremium = igmarkets.UnitValueFloat{Unit: igmarkets.UnitPercentage, Value: 0.1}
+			}),
+			order: order(1, func(o *igmarkets.OTCOrderRequest) {
+				o.GuaranteedStop = true
+				o.StopDistance = "100"
+			}),
+			account:  "USD",
+			notional: 2000,
+			margin:   102, // the premium is 0.1% of 1000 points
+			premium:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := igmarkets.EstimateOrderMargin(tt.market, tt.order, tt.account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(e.Notional-tt.notional) > 1e-6 || math.Abs(e.Margin-tt.margin) > 1e-6 ||
+				math.Abs(e.GuaranteedStopPremium-tt.premium) > 1e-6 {
+				t.Fatalf("notional %g, margin %g, premium %g, want %g, %g, %g (%v)",
+					e.Notional, e.Margin, e.GuaranteedStopPremium, tt.notional, tt.margin, tt.premium, e.Assumptions)
+			}
+		})
+	}
+}
+
+func TestEstimatePositionMargin(t *testing.T) {
+	market := &igmarkets.MarketsResponse{
+		Instrument: igmarkets.Instrument{
+			Epic:             "FX",
+			ValueOfOnePip:    "10",
+			MarginFactor:     3.33,
+			MarginFactorUnit: igmarkets.UnitPercentage,
+			Currencies:       []igmarkets.Currency{{Code: "USD", IsDefault: true}},
+		},
+		Snapshot: igmarkets.Snapshot{Bid: 1.1, Offer: 1.1002, ScalingFactor: 10000},
+	}
+	position := igmarkets.Position{
+		MarketData: igmarkets.MarketData{Epic: "FX"},
+		Position: igmarkets.PositionData{
+			Currency:       "USD",
+			Direction:      igmarkets.DirectionBuy,
+			Size:           2,
+			Level:          1.09,
+			StopLevel:      1.098,
+			ControlledRisk: true,
+		},
+	}
+
+	e, err := igmarkets.EstimatePositionMargin(market, position, "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// valued at the bid, the guaranteed stop 20 points below it
+	if math.Abs(e.Notional-220000) > 1e-6 || math.Abs(e.Margin-400) > 1e-6 {
+		t.Fatalf("notional %g, margin %g (%v)", e.Notional, e.Margin, e.Assumptions)
+	}
+}
+
+func TestEstimateMarginErrors(t *testing.T) {
+	market := &igmarkets.MarketsResponse{
+		Instrument: igmarkets.Instrument{
+			Epic:             "INDEX",
+			ValueOfOnePip:    "2",
+			MarginFactor:     5,
+			MarginFactorUnit: igmarkets.UnitPercentage,
+			Currencies:       []igmarkets.Currency{{Code: "USD", IsDefault: true}},
+		},
+		Snapshot: igmarkets.Snapshot{Bid: 1000, Offer: 1001},
+	}
+	order := igmarkets.OTCOrderRequest{Epic: "INDEX", Direction: igmarkets.DirectionBuy, Size: 1, CurrencyCode: "USD"}
+
+	tests := []struct {
+		name    string
+		account string
+		set     func(m *igmarkets.MarketsResponse, o *igmarkets.OTCOrderRequest)
+	}{
+		{"no rate to the account currency", "GBP", func(m *igmarkets.MarketsResponse, o *igmarkets.OTCOrderRequest) {}},
+		{"unknown currency", "USD", func(m *igmarkets.MarketsResponse, o *igmarkets.OTCOrderRequest) { o.CurrencyCode = "JPY" }},
+		{"unknown margin unit", "USD", func(m *igmarkets.MarketsResponse, o *igmarkets.OTCOrderRequest) {
+			m.Instrument.MarginFactorUnit = "OTHER"
+		}},
+		{"guaranteed stop on the wrong side", "USD", func(m *igmarkets.MarketsResponse, o *igmarkets.OTCOrderRequest) {
+			o.GuaranteedStop = true
+			o.StopLevel = "1100"
+		}},
+		{"no price", "USD", func(m *igmarkets.MarketsResponse, o *igmarkets.OTCOrderRequest) { m.Snapshot.Offer = 0 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, o := *market, order
+			tt.set(&m, &o)
+			if _, err := igmarkets.EstimateOrderMargin(&m, o, tt.account); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
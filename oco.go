@@ -0,0 +1,526 @@
+package igmarkets
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultOCOPollInterval - period of the working order and position checks of
+// an OCOManager when not set
+const DefaultOCOPollInterval = 5 * time.Second
+
+// OCOLegStatus - state of a working order of an OCO group
+type OCOLegStatus string
+
+const (
+	// OCOLegWorking - the working order is waiting for the market, or was
+	// deleted and is not known yet to be filled or cancelled
+	OCOLegWorking OCOLegStatus = "WORKING"
+	// OCOLegFilled - the working order opened a position
+	OCOLegFilled OCOLegStatus = "FILLED"
+	// OCOLegCancelled - the working order was deleted or expired
+	OCOLegCancelled OCOLegStatus = "CANCELLED"
+)
+
+// OCOLeg - working order of an OCO group
+type OCOLeg struct {
+	DealReference  string                 `json:"dealReference"`
+	DealID         string                 `json:"dealId"` // of the working order
+	Order          OTCWorkingOrderRequest `json:"order"`
+	Status         OCOLegStatus           `json:"status"`
+	PositionDealID string                 `json:"positionDealId,omitempty"` // when filled
+}
+
+// OCOGroup - working orders cancelling each other: the first one leaving
+// the book, filled or not, cancels the others
+type OCOGroup struct {
+	ID   string   `json:"id"`
+	Legs []OCOLeg `json:"legs"`
+	Done bool     `json:"done"` // no working leg left
+}
+
+// Filled - the filled legs, more than one if a sibling filled before it could
+// be cancelled
+func (g OCOGroup) Filled() []OCOLeg {
+	var filled []OCOLeg
+	for _, leg := range g.Legs {
+		if leg.Status == OCOLegFilled {
+			filled = append(filled, leg)
+		}
+	}
+	return filled
+}
+
+// OCOManager - one-cancels-other groups of working orders
+// The legs of a group get the deal references Prefix + group ID + "-" + index,
+// which is how Recover finds them after a restart. Fills are watched with the
+// trade stream while Run is running, the working orders and the positions are
+// also polled every PollInterval in case the stream misses them.
+type OCOManager struct {
+	Prefix       string
+	PollInterval time.Duration
+	// OnDone - called once a group has no working leg left
+	OnDone func(OCOGroup)
+	// StreamOptions - reconnection and stall settings of the trade stream
+	// opened by Run
+	StreamOptions LightStreamOptions
+
+	ig     *IGMarkets
+	ids    *DealReferenceGenerator
+	mu     sync.Mutex
+	groups map[string]*OCOGroup
+}
+
+// NewOCOManager - manager of the groups with deal references starting with
+// prefix, "OCO" when empty
+func NewOCOManager(ig *IGMarkets, prefix string) *OCOManager {
+	if prefix == "" {
+		prefix = "OCO"
+	}
+	return &OCOManager{
+		Prefix:       prefix,
+		PollInterval: DefaultOCOPollInterval,
+		StreamOptions: LightStreamOptions{
+			ReconnectionTime: DefaultStreamReconnectionTime,
+			MaxReconnection:  DefaultStreamMaxReconnection,
+		},
+		ig:     ig,
+		ids:    NewDealReferenceGenerator(""),
+		groups: make(map[string]*OCOGroup),
+	}
+}
+
+// legReference - deal reference of leg i of group id
+func (m *OCOManager) legReference(id string, i int) string {
+	return m.Prefix + id + "-" + strconv.Itoa(i)
+}
+
+// parseLegReference - group ID and leg index of a deal reference of m
+func (m *OCOManager) parseLegReference(ref string) (string, int, bool) {
+	if !strings.HasPrefix(ref, m.Prefix) {
+		return "", 0, false
+	}
+	ref = ref[len(m.Prefix):]
+
+	sep := strings.LastIndex(ref, "-")
+	if sep <= 0 {
+		return "", 0, false
+	}
+	i, err := strconv.Atoi(ref[sep+1:])
+	if err != nil || i < 0 {
+		return "", 0, false
+	}
+	return ref[:sep], i, true
+}
+
+// Place - place orders as one group, their deal references are set by the
+// manager. If an order fails the ones already placed are deleted.
+func (m *OCOManager) Place(ctx context.Context, orders ...OTCWorkingOrderRequest) (OCOGroup, error) {
+	if len(orders) < 2 {
+		return OCOGroup{}, fmt.Errorf("igmarkets: an OCO group needs at least 2 orders")
+	}
+
+	id, err := m.ids.Next()
+	if err != nil {
+		return OCOGroup{}, err
+	}
+	group := &OCOGroup{ID: id}
+
+	for i, order := range orders {
+		order.DealReference = m.legReference(id, i)
+		if !ValidDealReference(order.DealReference) {
+			return OCOGroup{}, fmt.Errorf("igmarkets: invalid deal reference %q", order.DealReference)
+		}
+
+		confirmation, err := m.ig.PlaceOTCWorkingOrderAndConfirm(ctx, order)
+		if err != nil {
+			for _, leg := range group.Legs {
+				if delErr := m.ig.DeleteOTCWorkingOrder(leg.DealID); delErr != nil {
+					log.WithError(delErr).Errorf("igmarkets : unable to delete working order %s of OCO group %s", leg.DealID, id)
+				}
+			}
+			return OCOGroup{}, fmt.Errorf("igmarkets: OCO group %s: order %d: %v", id, i, err)
+		}
+
+		group.Legs = append(group.Legs, OCOLeg{
+			DealReference: order.DealReference,
+			DealID:        confirmation.DealID,
+			Order:         order,
+			Status:        OCOLegWorking,
+		})
+	}
+
+	m.mu.Lock()
+	m.groups[id] = group
+	snapshot := copyOCOGroup(group)
+	m.mu.Unlock()
+
+	return snapshot, nil
+}
+
+// Bracket - breakout group of order: a BUY STOP at high and a SELL STOP at low
+func (m *OCOManager) Bracket(ctx context.Context, order OTCWorkingOrderRequest, high, low float64) (OCOGroup, error) {
+	if high <= low {
+		return OCOGroup{}, fmt.Errorf("igmarkets: bracket high %g must be above low %g", high, low)
+	}
+
+	buy, sell := order, order
+	buy.Direction, buy.Type, buy.Level = DirectionBuy, WorkingOrderTypeStop, high
+	sell.Direction, sell.Type, sell.Level = DirectionSell, WorkingOrderTypeStop, low
+
+	return m.Place(ctx, buy, sell)
+}
+
+// Cancel - delete the working legs of group id
+func (m *OCOManager) Cancel(id string) error {
+	m.mu.Lock()
+	group, ok := m.groups[id]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("igmarkets: unknown OCO group %s", id)
+	}
+	cancels, done := m.cancelLegs(group, -1)
+	m.mu.Unlock()
+
+	m.done(done)
+	return m.deleteLegs(id, cancels)
+}
+
+// Groups - state of the groups
+func (m *OCOManager) Groups() []OCOGroup {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	groups := make([]OCOGroup, 0, len(m.groups))
+	for _, g := range m.groups {
+		groups = append(groups, copyOCOGroup(g))
+	}
+	return groups
+}
+
+// Group - state of group id
+func (m *OCOManager) Group(id string) (OCOGroup, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[id]
+	if !ok {
+		return OCOGroup{}, false
+	}
+	return copyOCOGroup(g), true
+}
+
+func copyOCOGroup(g *OCOGroup) OCOGroup {
+	c := *g
+	c.Legs = append([]OCOLeg(nil), g.Legs...)
+	return c
+}
+
+// Run - watch the groups until ctx is done, with the trade stream and polling
+// every PollInterval. Polling goes on alone if the stream cannot be opened or
+// ends.
+func (m *OCOManager) Run(ctx context.Context) error {
+	updates, errs, err := m.ig.OpenTradeStream(ctx, m.StreamOptions)
+	if err != nil {
+		log.WithError(err).Warn("igmarkets : OCO manager without trade stream")
+	}
+
+	interval := m.PollInterval
+	if interval <= 0 {
+		interval = DefaultOCOPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case u, ok := <-updates:
+			if !ok {
+				log.Warn("igmarkets : OCO manager trade stream ended, polling only")
+				updates = nil
+				continue
+			}
+			m.handle(u)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.WithError(err).Warn("igmarkets : OCO manager trade stream")
+		case <-ticker.C:
+			if err := m.Poll(); err != nil {
+				log.WithError(err).Error("igmarkets : OCO manager poll")
+			}
+		}
+	}
+}
+
+// handle - legs leaving the book according to the trade stream. A fill
+// deletes the working order before its position opens, so a deleted leg only
+// cancels its siblings: it is settled by its position or the next Poll.
+func (m *OCOManager) handle(u TradeUpdate) {
+	switch {
+	case u.WorkingOrder != nil && u.WorkingOrder.Status == TradeStatusDeleted:
+		m.legLeaving(u.WorkingOrder.DealReference, u.WorkingOrder.DealID)
+	case u.Position != nil && u.Position.Status == TradeStatusOpen:
+		m.legGone(u.Position.DealReference, u.Position.DealIDOrigin, OCOLegFilled, u.Position.DealID)
+	}
+}
+
+// Poll - legs no longer in the working orders, filled when a position has
+// their deal reference
+func (m *OCOManager) Poll() error {
+	orders, err := m.ig.GetOTCWorkingOrders()
+	if err != nil {
+		return err
+	}
+	positions, err := m.ig.GetPositions()
+	if err != nil {
+		return err
+	}
+
+	working := make(map[string]bool, len(orders.WorkingOrders))
+	for _, o := range orders.WorkingOrders {
+		working[o.WorkingOrderData.DealID] = true
+	}
+	opened := make(map[string]string, len(positions.Positions))
+	for _, p := range positions.Positions {
+		opened[p.Position.DealReference] = p.Position.DealID
+	}
+
+	type gone struct {
+		ref, dealID, positionDealID string
+		status                      OCOLegStatus
+	}
+	var filled, cancelled []gone
+
+	m.mu.Lock()
+	for _, g := range m.groups {
+		for _, leg := range g.Legs {
+			if positionDealID, ok := opened[leg.DealReference]; ok && leg.Status != OCOLegFilled {
+				filled = append(filled, gone{leg.DealReference, leg.DealID, positionDealID, OCOLegFilled})
+			} else if leg.Status == OCOLegWorking && !working[leg.DealID] {
+				cancelled = append(cancelled, gone{leg.DealReference, leg.DealID, "", OCOLegCancelled})
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	// fills first, the siblings they cancel are not mistaken for the cause
+	for _, l := range append(filled, cancelled...) {
+		m.legGone(l.ref, l.dealID, l.status, l.positionDealID)
+	}
+	return nil
+}
+
+// legGone - leg identified by ref or dealID left the book with status, its
+// working siblings are cancelled
+func (m *OCOManager) legGone(ref, dealID string, status OCOLegStatus, positionDealID string) {
+	m.mu.Lock()
+
+	group, i := m.findLeg(ref, dealID)
+	if group == nil {
+		m.mu.Unlock()
+		return
+	}
+
+	leg := &group.Legs[i]
+	if leg.Status == OCOLegFilled || (leg.Status == status) {
+		m.mu.Unlock()
+		return
+	}
+
+	wasWorking := leg.Status == OCOLegWorking
+	if status == OCOLegFilled && !wasWorking {
+		log.Warnf("igmarkets : leg %s of OCO group %s filled after it was cancelled", leg.DealReference, group.ID)
+	}
+	leg.Status = status
+	leg.PositionDealID = positionDealID
+
+	var cancels []OCOLeg
+	var done *OCOGroup
+	if wasWorking {
+		cancels, done = m.cancelLegs(group, i)
+	}
+	m.mu.Unlock()
+
+	m.done(done)
+	if err := m.deleteLegs(group.ID, cancels); err != nil {
+		log.WithError(err).Errorf("igmarkets : OCO group %s", group.ID)
+	}
+}
+
+// legLeaving - leg identified by ref or dealID is leaving the book, filled or
+// not: its working siblings are cancelled and it stays working until settled
+func (m *OCOManager) legLeaving(ref, dealID string) {
+	m.mu.Lock()
+
+	group, i := m.findLeg(ref, dealID)
+	if group == nil || group.Legs[i].Status != OCOLegWorking {
+		m.mu.Unlock()
+		return
+	}
+	cancels, done := m.cancelLegs(group, i)
+	m.mu.Unlock()
+
+	m.done(done)
+	if err := m.deleteLegs(group.ID, cancels); err != nil {
+		log.WithError(err).Errorf("igmarkets : OCO group %s", group.ID)
+	}
+}
+
+// findLeg - group and index of the leg with ref or dealID
+func (m *OCOManager) findLeg(ref, dealID string) (*OCOGroup, int) {
+	if id, i, ok := m.parseLegReference(ref); ok {
+		if g, ok := m.groups[id]; ok && i < len(g.Legs) {
+			return g, i
+		}
+	}
+	if dealID == "" {
+		return nil, 0
+	}
+	for _, g := range m.groups {
+		for i, leg := range g.Legs {
+			if leg.DealID == dealID {
+				return g, i
+			}
+		}
+	}
+	return nil, 0
+}
+
+// cancelLegs - mark the working legs of group but except as cancelled and
+// return them for deletion, with the group if it just got done
+func (m *OCOManager) cancelLegs(group *OCOGroup, except int) ([]OCOLeg, *OCOGroup) {
+	var cancels []OCOLeg
+	for i := range group.Legs {
+		if i != except && group.Legs[i].Status == OCOLegWorking {
+			group.Legs[i].Status = OCOLegCancelled
+			cancels = append(cancels, group.Legs[i])
+		}
+	}
+
+	if except >= 0 && group.Legs[except].Status == OCOLegWorking {
+		return cancels, nil
+	}
+	if group.Done {
+		return cancels, nil
+	}
+	group.Done = true
+	done := copyOCOGroup(group)
+	return cancels, &done
+}
+
+// done - report group to OnDone, if any
+func (m *OCOManager) done(group *OCOGroup) {
+	if group != nil && m.OnDone != nil {
+		m.OnDone(*group)
+	}
+}
+
+// deleteLegs - delete the working orders of legs, already deleted ones are
+// ignored
+func (m *OCOManager) deleteLegs(id string, legs []OCOLeg) error {
+	var firstErr error
+	for _, leg := range legs {
+		err := m.ig.DeleteOTCWorkingOrder(leg.DealID)
+		if err == nil || IsNotFound(err) {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("igmarkets: unable to cancel working order %s of OCO group %s: %v", leg.DealID, id, err)
+		}
+	}
+	return firstErr
+}
+
+// Recover - rebuild the groups placed since with the deal references of the
+// account activity, then settle them with Poll
+func (m *OCOManager) Recover(since time.Time) error {
+	activity, err := m.ig.GetActivity(since, time.Now().Add(time.Minute), true)
+	if err != nil {
+		return err
+	}
+	orders, err := m.ig.GetOTCWorkingOrders()
+	if err != nil {
+		return err
+	}
+
+	working := make(map[string]WorkingOrderData, len(orders.WorkingOrders))
+	for _, o := range orders.WorkingOrders {
+		working[o.WorkingOrderData.DealID] = o.WorkingOrderData
+	}
+
+	m.mu.Lock()
+	for _, a := range activity.Activities {
+		if a.Details == nil {
+			continue
+		}
+		id, i, ok := m.parseLegReference(a.Details.DealReference)
+		if !ok {
+			continue
+		}
+		dealID := createdWorkingOrder(a)
+		if dealID == "" {
+			continue
+		}
+
+		group, ok := m.groups[id]
+		if !ok {
+			group = &OCOGroup{ID: id}
+			m.groups[id] = group
+		}
+		for len(group.Legs) <= i {
+			group.Legs = append(group.Legs, OCOLeg{
+				DealReference: m.legReference(id, len(group.Legs)),
+				Status:        OCOLegCancelled,
+			})
+		}
+
+		leg := &group.Legs[i]
+		if leg.DealID != "" {
+			continue
+		}
+		// settled by Poll when no longer working
+		leg.DealID = dealID
+		leg.Status = OCOLegWorking
+		if w, ok := working[dealID]; ok {
+			leg.Order = OTCWorkingOrderRequest{
+				CurrencyCode:   w.CurrencyCode,
+				DealReference:  leg.DealReference,
+				Direction:      w.Direction,
+				Epic:           w.Epic,
+				GoodTillDate:   w.GoodTillDate,
+				GuaranteedStop: w.GuaranteedStop,
+				Level:          w.OrderLevel,
+				Size:           w.OrderSize,
+				TimeInForce:    w.TimeInForce,
+				Type:           w.OrderType,
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	return m.Poll()
+}
+
+// createdWorkingOrder - deal ID of the working order created by activity a
+func createdWorkingOrder(a Activity) string {
+	if a.Status != DealStatusAccepted {
+		return ""
+	}
+	for _, action := range a.Details.Actions {
+		if action.ActionType == "WORKING_ORDER_CREATED" {
+			return action.AffectedDealID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,252 @@
+package igmarkets_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+)
+
+func TestOCOManagerTradeStreamReconnects(t *testing.T) {
+	r := newStreamRig(t)
+
+	oco := igmarkets.NewOCOManager(r.ig, "")
+	oco.PollInterval = time.Hour
+	if oco.StreamOptions.ReconnectionTime <= 0 || oco.StreamOptions.MaxReconnection == 0 {
+		t.Fatalf("trade stream without reconnection %+v", oco.StreamOptions)
+	}
+	oco.StreamOptions.OnStateChange = func(e igmarkets.StreamStateEvent) { r.states <- e }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go oco.Run(ctx)
+	r.waitState(t, igmarkets.StreamSubscribed)
+
+	r.ls.Disconnect()
+	r.waitState(t, igmarkets.StreamReconnecting)
+	r.waitState(t, igmarkets.StreamSubscribed)
+}
+
+// ocoBook - working orders and positions of the IG stand-in of an OCO test
+type ocoBook struct {
+	mu        sync.Mutex
+	working   map[string]string // deal ID to deal reference
+	positions map[string]string // deal reference to deal ID
+	deleted   []string
+}
+
+func newOCOBook(r *streamRig) *ocoBook {
+	b := &ocoBook{working: make(map[string]string), positions: make(map[string]string)}
+	mux := r.srv.Mux
+
+	mux.HandleFunc("/gateway/deal/workingorders/otc", func(w http.ResponseWriter, req *http.Request) {
+		var order igmarkets.OTCWorkingOrderRequest
+		if err := json.NewDecoder(req.Body).Decode(&order); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.mu.Lock()
+		b.working["DIAAA"+order.DealReference] = order.DealReference
+		b.mu.Unlock()
+		fmt.Fprintf(w, `{"dealReference":%q}`, order.DealReference)
+	})
+	mux.HandleFunc("/gateway/deal/workingorders/otc/", func(w http.ResponseWriter, req *http.Request) {
+		dealID := path.Base(req.URL.Path)
+		b.mu.Lock()
+		delete(b.working, dealID)
+		b.deleted = append(b.deleted, dealID)
+		b.mu.Unlock()
+		fmt.Fprintf(w, `{"dealReference":"DEL-%s"}`, dealID)
+	})
+	mux.HandleFunc("/gateway/deal/workingorders/", func(w http.ResponseWriter, req *http.Request) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		var orders igmarkets.WorkingOrders
+		for dealID := range b.working {
+			o := igmarkets.OTCWorkingOrder{}
+			o.WorkingOrderData.DealID = dealID
+			orders.WorkingOrders = append(orders.WorkingOrders, o)
+		}
+		json.NewEncoder(w).Encode(orders)
+	})
+	mux.HandleFunc("/gateway/deal/positions/", func(w http.ResponseWriter, req *http.Request) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		var positions igmarkets.PositionsResponse
+		for ref, dealID := range b.positions {
+			p := igmarkets.Position{}
+			p.Position.DealID, p.Position.DealReference = dealID, ref
+			positions.Positions = append(positions.Positions, p)
+		}
+		json.NewEncoder(w).Encode(positions)
+	})
+	mux.HandleFunc("/gateway/deal/confirms/", func(w http.ResponseWriter, req *http.Request) {
+		ref := path.Base(req.URL.Path)
+		fmt.Fprintf(w, `{"dealReference":%q,"dealId":%q,"dealStatus":"ACCEPTED","status":"OPEN"}`, ref, "DIAAA"+ref)
+	})
+	return b
+}
+
+// fill - leg dealID opens a position, the trade stream is sent the working
+// order deletion before the position the way IG and paper send them
+func (b *ocoBook) fill(r *streamRig, leg igmarkets.OCOLeg, opened bool) {
+	b.mu.Lock()
+	delete(b.working, leg.DealID)
+	if opened {
+		b.positions[leg.DealReference] = "DIPOS" + leg.DealID
+	}
+	b.mu.Unlock()
+
+	item := "TRADE:" + r.srv.AccountID
+	r.ls.Push(item, map[string]string{"WOU": fmt.Sprintf(
+		`{"dealReference":%q,"dealId":%q,"status":"DELETED","dealStatus":"ACCEPTED"}`, leg.DealReference, leg.DealID)})
+	if opened {
+		r.ls.Push(item, map[string]string{"OPU": fmt.Sprintf(
+			`{"dealReference":%q,"dealId":%q,"dealIdOrigin":%q,"status":"OPEN","dealStatus":"ACCEPTED"}`,
+			leg.DealReference, "DIPOS"+leg.DealID, leg.DealID)})
+	}
+}
+
+func (b *ocoBook) wasDeleted(dealID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, id := range b.deleted {
+		if id == dealID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOCOManagerTradeStreamFill(t *testing.T) {
+	order := igmarkets.OTCWorkingOrderRequest{
+		Epic:         testEpic,
+		Size:         1,
+		TimeInForce:  igmarkets.TimeInForceGoodTillCancelled,
+		CurrencyCode: "USD",
+		Expiry:       "-",
+	}
+
+	tests := []struct {
+		name   string
+		opened bool // the deleted leg opens a position
+		want   igmarkets.OCOLegStatus
+	}{
+		{"deleted then opened", true, igmarkets.OCOLegFilled},
+		{"deleted only", false, igmarkets.OCOLegCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newStreamRig(t)
+			book := newOCOBook(r)
+
+			done := make(chan igmarkets.OCOGroup, 1)
+			oco := igmarkets.NewOCOManager(r.ig, "")
+			oco.PollInterval = time.Hour
+			oco.OnDone = func(g igmarkets.OCOGroup) { done <- g }
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go oco.Run(ctx)
+			wait, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+			defer waitCancel()
+			if err := r.ls.WaitForSubscription(wait, "TRADE:"+r.srv.AccountID); err != nil {
+				t.Fatal(err)
+			}
+
+			group, err := oco.Bracket(ctx, order, 1.2, 1.1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leg, sibling := group.Legs[0], group.Legs[1]
+			book.fill(r, leg, tt.opened)
+
+			// the sibling is cancelled on the deletion alone
+			deadline := time.Now().Add(5 * time.Second)
+			for !book.wasDeleted(sibling.DealID) {
+				if time.Now().After(deadline) {
+					t.Fatalf("sibling %s not deleted", sibling.DealID)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if !tt.opened {
+				select {
+				case g := <-done:
+					t.Fatalf("group settled before the poll %+v", g)
+				case <-time.After(100 * time.Millisecond):
+				}
+				if err := oco.Poll(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case g := <-done:
+				if g.Legs[0].Status != tt.want || g.Legs[1].Status != igmarkets.OCOLegCancelled {
+					t.Fatalf("legs %s and %s, want %s and %s",
+						g.Legs[0].Status, g.Legs[1].Status, tt.want, igmarkets.OCOLegCancelled)
+				}
+				if tt.opened && g.Legs[0].PositionDealID != "DIPOS"+leg.DealID {
+					t.Fatalf("position %q of the filled leg", g.Legs[0].PositionDealID)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("group not done")
+			}
+		})
+	}
+}
+
+func TestOCOManagerPaperFill(t *testing.T) {
+	_, ig, paper := newPaperClient(t)
+
+	done := make(chan igmarkets.OCOGroup, 1)
+	oco := igmarkets.NewOCOManager(ig, "")
+	oco.PollInterval = time.Hour
+	oco.OnDone = func(g igmarkets.OCOGroup) { done <- g }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go oco.Run(ctx)
+
+	order := igmarkets.OTCWorkingOrderRequest{
+		Epic:         "FX",
+		Size:         1,
+		TimeInForce:  igmarkets.TimeInForceGoodTillCancelled,
+		CurrencyCode: "USD",
+		Expiry:       "-",
+		ForceOpen:    true,
+	}
+	group, err := oco.Bracket(ctx, order, 105, 95)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the buy stop fills, the paper trade stream settles the group
+	paper.SetQuote("FX", 105, 106)
+
+	select {
+	case g := <-done:
+		if g.ID != group.ID || g.Legs[0].Status != igmarkets.OCOLegFilled || g.Legs[1].Status != igmarkets.OCOLegCancelled {
+			t.Fatalf("legs %s and %s, want %s and %s",
+				g.Legs[0].Status, g.Legs[1].Status, igmarkets.OCOLegFilled, igmarkets.OCOLegCancelled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("group not done")
+	}
+
+	orders, err := ig.GetOTCWorkingOrders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders.WorkingOrders) != 0 {
+		t.Fatalf("%d working orders left", len(orders.WorkingOrders))
+	}
+}
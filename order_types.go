@@ -0,0 +1,285 @@
+package igmarkets
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Direction - deal direction
+type Direction string
+
+const (
+	// DirectionBuy - buy, long
+	DirectionBuy Direction = "BUY"
+	// DirectionSell - sell, short
+	DirectionSell Direction = "SELL"
+)
+
+// Valid - true for a known direction
+func (d Direction) Valid() bool {
+	return d == DirectionBuy || d == DirectionSell
+}
+
+// Opposite - direction closing a position of direction d
+func (d Direction) Opposite() Direction {
+	if d == DirectionBuy {
+		return DirectionSell
+	}
+	return DirectionBuy
+}
+
+// MarshalJSON - reject unknown directions
+func (d Direction) MarshalJSON() ([]byte, error) {
+	return marshalEnum("direction", string(d), d.Valid())
+}
+
+// OrderType - type of a deal
+type OrderType string
+
+const (
+	// OrderTypeMarket - filled at the market price
+	OrderTypeMarket OrderType = "MARKET"
+	// OrderTypeLimit - filled at Level or better, within TimeInForce
+	OrderTypeLimit OrderType = "LIMIT"
+	// OrderTypeQuote - filled at the Level of the quote QuoteID
+	OrderTypeQuote OrderType = "QUOTE"
+)
+
+// Valid - true for a known order type
+func (t OrderType) Valid() bool {
+	return t == OrderTypeMarket || t == OrderTypeLimit || t == OrderTypeQuote
+}
+
+// MarshalJSON - reject unknown order types
+func (t OrderType) MarshalJSON() ([]byte, error) {
+	return marshalEnum("order type", string(t), t.Valid())
+}
+
+// TimeInForce - lifetime of an order
+type TimeInForce string
+
+const (
+	// TimeInForceExecuteAndEliminate - fill what can be filled, cancel the rest
+	TimeInForceExecuteAndEliminate TimeInForce = "EXECUTE_AND_ELIMINATE"
+	// TimeInForceFillOrKill - fill the whole size or nothing
+	TimeInForceFillOrKill TimeInForce = "FILL_OR_KILL"
+	// TimeInForceGoodTillCancelled - working order kept until deleted
+	TimeInForceGoodTillCancelled TimeInForce = "GOOD_TILL_CANCELLED"
+	// TimeInForceGoodTillDate - working order kept until GoodTillDate
+	TimeInForceGoodTillDate TimeInForce = "GOOD_TILL_DATE"
+)
+
+// Valid - true for a known time in force
+func (t TimeInForce) Valid() bool {
+	return t.validForOrder() || t.validForWorkingOrder()
+}
+
+func (t TimeInForce) validForOrder() bool {
+	return t == TimeInForceExecuteAndEliminate || t == TimeInForceFillOrKill
+}
+
+func (t TimeInForce) validForWorkingOrder() bool {
+	return t == TimeInForceGoodTillCancelled || t == TimeInForceGoodTillDate
+}
+
+// MarshalJSON - reject unknown times in force
+func (t TimeInForce) MarshalJSON() ([]byte, error) {
+	return marshalEnum("time in force", string(t), t.Valid())
+}
+
+// WorkingOrderType - type of a working order
+type WorkingOrderType string
+
+const (
+	// WorkingOrderTypeLimit - filled at Level or better
+	WorkingOrderTypeLimit WorkingOrderType = "LIMIT"
+	// WorkingOrderTypeStop - filled once the price crosses Level
+	WorkingOrderTypeStop WorkingOrderType = "STOP"
+)
+
+// Valid - true for a known working order type
+func (t WorkingOrderType) Valid() bool {
+	return t == WorkingOrderTypeLimit || t == WorkingOrderTypeStop
+}
+
+// MarshalJSON - reject unknown working order types
+func (t WorkingOrderType) MarshalJSON() ([]byte, error) {
+	return marshalEnum("working order type", string(t), t.Valid())
+}
+
+const (
+	// ExpiryNone - expiry of instruments without expiry, e.g. CFDs
+	ExpiryNone = "-"
+	// ExpiryDFB - expiry of daily funded bets
+	ExpiryDFB = "DFB"
+)
+
+// marshalEnum - value as a JSON string, empty values are left to Validate
+func marshalEnum(name, value string, valid bool) ([]byte, error) {
+	if value != "" && !valid {
+		return nil, fmt.Errorf("igmarkets: invalid %s %q", name, value)
+	}
+	return json.Marshal(value)
+}
+
+// Validate - check the request before it is sent
+func (r OTCOrderRequest) Validate() error {
+	switch {
+	case r.DealReference != "" && !ValidDealReference(r.DealReference):
+		return fmt.Errorf("igmarkets: invalid deal reference %q", r.DealReference)
+	case r.Epic == "":
+		return fmt.Errorf("igmarkets: epic is required")
+	case r.Expiry == "":
+		return fmt.Errorf("igmarkets: expiry is required")
+	case r.CurrencyCode == "":
+		return fmt.Errorf("igmarkets: currency code is required")
+	case !r.Direction.Valid():
+		return fmt.Errorf("igmarkets: invalid direction %q", r.Direction)
+	case !r.OrderType.Valid():
+		return fmt.Errorf("igmarkets: invalid order type %q", r.OrderType)
+	case r.TimeInForce != "" && !r.TimeInForce.validForOrder():
+		return fmt.Errorf("igmarkets: invalid time in force %q for an order", r.TimeInForce)
+	case r.Size <= 0:
+		return fmt.Errorf("igmarkets: size must be positive")
+	}
+
+	if err := validateOrderLevel(r.OrderType, r.Level, r.QuoteID); err != nil {
+		return err
+	}
+
+	switch {
+	case r.StopDistance != "" && r.StopLevel != "":
+		return fmt.Errorf("igmarkets: stop distance and stop level are exclusive")
+	case r.LimitDistance != "" && r.LimitLevel != "":
+		return fmt.Errorf("igmarkets: limit distance and limit level are exclusive")
+	case !r.ForceOpen && (r.StopDistance != "" || r.StopLevel != "" || r.LimitDistance != "" || r.LimitLevel != ""):
+		return fmt.Errorf("igmarkets: force open is required with a stop or a limit")
+	case r.TrailingStop && (r.StopDistance == "" || r.StopLevel != "" || r.TrailingStopIncrement == ""):
+		return fmt.Errorf("igmarkets: trailing stop requires a stop distance and a trailing stop increment")
+	case r.TrailingStop && r.GuaranteedStop:
+		return fmt.Errorf("igmarkets: trailing stop and guaranteed stop are exclusive")
+	case r.GuaranteedStop && r.StopDistance == "" && r.StopLevel == "":
+		return fmt.Errorf("igmarkets: guaranteed stop requires a stop distance or a stop level")
+	}
+
+	return nil
+}
+
+// Validate - check the request before it is sent
+func (r OTCWorkingOrderRequest) Validate() error {
+	switch {
+	case r.DealReference != "" && !ValidDealReference(r.DealReference):
+		return fmt.Errorf("igmarkets: invalid deal reference %q", r.DealReference)
+	case r.Epic == "":
+		return fmt.Errorf("igmarkets: epic is required")
+	case r.Expiry == "":
+		return fmt.Errorf("igmarkets: expiry is required")
+	case r.CurrencyCode == "":
+		return fmt.Errorf("igmarkets: currency code is required")
+	case !r.Direction.Valid():
+		return fmt.Errorf("igmarkets: invalid direction %q", r.Direction)
+	case !r.Type.Valid():
+		return fmt.Errorf("igmarkets: invalid working order type %q", r.Type)
+	case !r.TimeInForce.validForWorkingOrder():
+		return fmt.Errorf("igmarkets: invalid time in force %q for a working order", r.TimeInForce)
+	case r.TimeInForce == TimeInForceGoodTillDate && r.GoodTillDate == "":
+		return fmt.Errorf("igmarkets: good till date is required with %s", TimeInForceGoodTillDate)
+	case r.Size <= 0:
+		return fmt.Errorf("igmarkets: size must be positive")
+	case r.Level <= 0:
+		return fmt.Errorf("igmarkets: level must be positive")
+	case r.StopDistance != "" && r.StopLevel != "":
+		return fmt.Errorf("igmarkets: stop distance and stop level are exclusive")
+	case r.LimitDistance != "" && r.LimitLevel != "":
+		return fmt.Errorf("igmarkets: limit distance and limit level are exclusive")
+	case r.GuaranteedStop && r.StopDistance == "" && r.StopLevel == "":
+		return fmt.Errorf("igmarkets: guaranteed stop requires a stop distance or a stop level")
+	}
+
+	return nil
+}
+
+// Validate - check the request before it is sent
+func (r OTCWorkingOrderUpdateRequest) Validate() error {
+	switch {
+	case !r.Type.Valid():
+		return fmt.Errorf("igmarkets: invalid working order type %q", r.Type)
+	case !r.TimeInForce.validForWorkingOrder():
+		return fmt.Errorf("igmarkets: invalid time in force %q for a working order", r.TimeInForce)
+	case r.TimeInForce == TimeInForceGoodTillDate && r.GoodTillDate == "":
+		return fmt.Errorf("igmarkets: good till date is required with %s", TimeInForceGoodTillDate)
+	case r.TimeInForce == TimeInForceGoodTillCancelled && r.GoodTillDate != "":
+		return fmt.Errorf("igmarkets: good till date must not be set with %s", TimeInForceGoodTillCancelled)
+	case r.Level <= 0:
+		return fmt.Errorf("igmarkets: level must be positive")
+	case r.StopDistance != "" && r.StopLevel != "":
+		return fmt.Errorf("igmarkets: stop distance and stop level are exclusive")
+	case r.LimitDistance != "" && r.LimitLevel != "":
+		return fmt.Errorf("igmarkets: limit distance and limit level are exclusive")
+	case r.GuaranteedStop && r.StopDistance == "" && r.StopLevel == "":
+		return fmt.Errorf("igmarkets: guaranteed stop requires a stop distance or a stop level")
+	}
+
+	return nil
+}
+
+// Validate - check the request before it is sent
+func (r OTCUpdateOrderRequest) Validate() error {
+	switch {
+	case r.StopDistance != "" && r.StopLevel != "":
+		return fmt.Errorf("igmarkets: stop distance and stop level are exclusive")
+	case r.LimitDistance != "" && r.LimitLevel != "":
+		return fmt.Errorf("igmarkets: limit distance and limit level are exclusive")
+	case r.TrailingStop && (r.StopLevel == "" || r.TrailingStopDistance == "" || r.TrailingStopIncrement == ""):
+		return fmt.Errorf("igmarkets: trailing stop requires a stop level, a trailing stop distance and a trailing stop increment")
+	case !r.TrailingStop && (r.TrailingStopDistance != "" || r.TrailingStopIncrement != ""):
+		return fmt.Errorf("igmarkets: trailing stop distance and increment require a trailing stop")
+	case r.TrailingStop && r.GuaranteedStop:
+		return fmt.Errorf("igmarkets: trailing stop and guaranteed stop are exclusive")
+	case r.GuaranteedStop && r.StopDistance == "" && r.StopLevel == "":
+		return fmt.Errorf("igmarkets: guaranteed stop requires a stop distance or a stop level")
+	}
+
+	return nil
+}
+
+// Validate - check the request before it is sent
+func (r OTCPositionCloseRequest) Validate() error {
+	switch {
+	case r.DealID == "" && r.Epic == "":
+		return fmt.Errorf("igmarkets: deal ID or epic is required")
+	case r.DealID != "" && r.Epic != "":
+		return fmt.Errorf("igmarkets: deal ID and epic are exclusive")
+	case r.Epic != "" && r.Expiry == "":
+		return fmt.Errorf("igmarkets: expiry is required with epic")
+	case !r.Direction.Valid():
+		return fmt.Errorf("igmarkets: invalid direction %q", r.Direction)
+	case !r.OrderType.Valid():
+		return fmt.Errorf("igmarkets: invalid order type %q", r.OrderType)
+	case r.TimeInForce != "" && !r.TimeInForce.validForOrder():
+		return fmt.Errorf("igmarkets: invalid time in force %q for an order", r.TimeInForce)
+	case r.Size <= 0:
+		return fmt.Errorf("igmarkets: size must be positive")
+	}
+
+	return validateOrderLevel(r.OrderType, r.Level, r.QuoteID)
+}
+
+// validateOrderLevel - level and quote ID required by the order type
+func validateOrderLevel(orderType OrderType, level, quoteID string) error {
+	switch orderType {
+	case OrderTypeMarket:
+		if level != "" || quoteID != "" {
+			return fmt.Errorf("igmarkets: level and quote ID must not be set with %s", orderType)
+		}
+	case OrderTypeLimit:
+		if level == "" {
+			return fmt.Errorf("igmarkets: level is required with %s", orderType)
+		}
+	case OrderTypeQuote:
+		if level == "" || quoteID == "" {
+			return fmt.Errorf("igmarkets: level and quote ID are required with %s", orderType)
+		}
+	}
+	return nil
+}
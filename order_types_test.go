@@ -0,0 +1,347 @@
+package igmarkets_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/amaurybrisou/igmarkets"
+)
+
+var (
+	testDirections   = []igmarkets.Direction{igmarkets.DirectionBuy, igmarkets.DirectionSell, "", "HOLD"}
+	testOrderTypes   = []igmarkets.OrderType{igmarkets.OrderTypeMarket, igmarkets.OrderTypeLimit, igmarkets.OrderTypeQuote, "", "STOP"}
+	testTimesInForce = []igmarkets.TimeInForce{
+		"",
+		igmarkets.TimeInForceExecuteAndEliminate,
+		igmarkets.TimeInForceFillOrKill,
+		igmarkets.TimeInForceGoodTillCancelled,
+		igmarkets.TimeInForceGoodTillDate,
+		"NOW",
+	}
+	testWorkingOrderTypes = []igmarkets.WorkingOrderType{igmarkets.WorkingOrderTypeLimit, igmarkets.WorkingOrderTypeStop, "", "MARKET"}
+)
+
+// orderLevel - level and quote ID satisfying orderType
+func orderLevel(orderType igmarkets.OrderType) (string, string) {
+	switch orderType {
+	case igmarkets.OrderTypeLimit:
+		return "1.1", ""
+	case igmarkets.OrderTypeQuote:
+		return "1.1", "Q1"
+	}
+	return "", ""
+}
+
+// checkValid - fail unless err is nil exactly when valid
+func checkValid(t *testing.T, err error, valid bool) {
+	t.Helper()
+	if valid && err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !valid && err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestOTCOrderRequestValidateEnums(t *testing.T) {
+	for _, d := range testDirections {
+		for _, ot := range testOrderTypes {
+			for _, tif := range testTimesInForce {
+				t.Run(fmt.Sprintf("%q/%q/%q", d, ot, tif), func(t *testing.T) {
+					level, quoteID := orderLevel(ot)
+					order := igmarkets.OTCOrderRequest{
+						Epic:         "EPIC",
+						Direction:    d,
+						OrderType:    ot,
+						TimeInForce:  tif,
+						Size:         1,
+						CurrencyCode: "USD",
+						Expiry:       igmarkets.ExpiryNone,
+						Level:        level,
+						QuoteID:      quoteID,
+					}
+					valid := d.Valid() && ot.Valid() &&
+						(tif == "" || tif == igmarkets.TimeInForceExecuteAndEliminate || tif == igmarkets.TimeInForceFillOrKill)
+					checkValid(t, order.Validate(), valid)
+				})
+			}
+		}
+	}
+}
+
+func TestOTCOrderRequestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(o *igmarkets.OTCOrderRequest)
+		valid bool
+	}{
+		{"market order", func(o *igmarkets.OTCOrderRequest) {}, true},
+		{"invalid deal reference", func(o *igmarkets.OTCOrderRequest) { o.DealReference = "a b" }, false},
+		{"no epic", func(o *igmarkets.OTCOrderRequest) { o.Epic = "" }, false},
+		{"no expiry", func(o *igmarkets.OTCOrderRequest) { o.Expiry = "" }, false},
+		{"no currency", func(o *igmarkets.OTCOrderRequest) { o.CurrencyCode = "" }, false},
+		{"no size", func(o *igmarkets.OTCOrderRequest) { o.Size = 0 }, false},
+		{"market order with a level", func(o *igmarkets.OTCOrderRequest) { o.Level = "1.1" }, false},
+		{"market order with a quote", func(o *igmarkets.OTCOrderRequest) { o.QuoteID = "Q1" }, false},
+		{"limit order without level", func(o *igmarkets.OTCOrderRequest) { o.OrderType = igmarkets.OrderTypeLimit }, false},
+		{"quote order without quote", func(o *igmarkets.OTCOrderRequest) {
+			o.OrderType, o.Level = igmarkets.OrderTypeQuote, "1.1"
+		}, false},
+		{"stop distance", func(o *igmarkets.OTCOrderRequest) { o.StopDistance = "10" }, true},
+		{"stop without force open", func(o *igmarkets.OTCOrderRequest) { o.ForceOpen, o.StopDistance = false, "10" }, false},
+		{"limit without force open", func(o *igmarkets.OTCOrderRequest) { o.ForceOpen, o.LimitLevel = false, "1.2" }, false},
+		{"stop distance and level", func(o *igmarkets.OTCOrderRequest) { o.StopDistance, o.StopLevel = "10", "1" }, false},
+		{"limit distance and level", func(o *igmarkets.OTCOrderRequest) { o.LimitDistance, o.LimitLevel = "10", "1.2" }, false},
+		{"trailing stop", func(o *igmarkets.OTCOrderRequest) {
+			o.TrailingStop, o.StopDistance, o.TrailingStopIncrement = true, "10", "2"
+		}, true},
+		{"trailing stop without increment", func(o *igmarkets.OTCOrderRequest) {
+			o.TrailingStop, o.StopDistance = true, "10"
+		}, false},
+		{"trailing stop level", func(o *igmarkets.OTCOrderRequest) {
+			o.TrailingStop, o.StopLevel, o.TrailingStopIncrement = true, "1", "2"
+		}, false},
+		{"guaranteed trailing stop", func(o *igmarkets.OTCOrderRequest) {
+			o.TrailingStop, o.GuaranteedStop, o.StopDistance, o.TrailingStopIncrement = true, true, "10", "2"
+		}, false},
+		{"guaranteed stop level", func(o *igmarkets.OTCOrderRequest) { o.GuaranteedStop, o.StopLevel = true, "1" }, true},
+		{"guaranteed stop without stop", func(o *igmarkets.OTCOrderRequest) { o.GuaranteedStop = true }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := igmarkets.OTCOrderRequest{
+				Epic:         "EPIC",
+				Direction:    igmarkets.DirectionBuy,
+				OrderType:    igmarkets.OrderTypeMarket,
+				Size:         1,
+				CurrencyCode: "USD",
+				Expiry:       igmarkets.ExpiryNone,
+				ForceOpen:    true,
+			}
+			tt.set(&order)
+			checkValid(t, order.Validate(), tt.valid)
+		})
+	}
+}
+
+func TestOTCWorkingOrderRequestValidateEnums(t *testing.T) {
+	for _, d := range testDirections {
+		for _, wt := range testWorkingOrderTypes {
+			for _, tif := range testTimesInForce {
+				t.Run(fmt.Sprintf("%q/%q/%q", d, wt, tif), func(t *testing.T) {
+					order := igmarkets.OTCWorkingOrderRequest{
+						Epic:         "EPIC",
+						Direction:    d,
+						Type:         wt,
+						TimeInForce:  tif,
+						Size:         1,
+						Level:        1.1,
+						CurrencyCode: "USD",
+						Expiry:       igmarkets.ExpiryNone,
+					}
+					if tif == igmarkets.TimeInForceGoodTillDate {
+						order.GoodTillDate = "2030/01/02 15:04"
+					}
+					valid := d.Valid() && wt.Valid() &&
+						(tif == igmarkets.TimeInForceGoodTillCancelled || tif == igmarkets.TimeInForceGoodTillDate)
+					checkValid(t, order.Validate(), valid)
+				})
+			}
+		}
+	}
+}
+
+func TestOTCWorkingOrderRequestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(o *igmarkets.OTCWorkingOrderRequest)
+		valid bool
+	}{
+		{"limit order", func(o *igmarkets.OTCWorkingOrderRequest) {}, true},
+		{"invalid deal reference", func(o *igmarkets.OTCWorkingOrderRequest) { o.DealReference = "a b" }, false},
+		{"no epic", func(o *igmarkets.OTCWorkingOrderRequest) { o.Epic = "" }, false},
+		{"no expiry", func(o *igmarkets.OTCWorkingOrderRequest) { o.Expiry = "" }, false},
+		{"no currency", func(o *igmarkets.OTCWorkingOrderRequest) { o.CurrencyCode = "" }, false},
+		{"no size", func(o *igmarkets.OTCWorkingOrderRequest) { o.Size = 0 }, false},
+		{"no level", func(o *igmarkets.OTCWorkingOrderRequest) { o.Level = 0 }, false},
+		{"good till date without date", func(o *igmarkets.OTCWorkingOrderRequest) {
+			o.TimeInForce = igmarkets.TimeInForceGoodTillDate
+		}, false},
+		{"stop and limit without force open", func(o *igmarkets.OTCWorkingOrderRequest) {
+			o.StopDistance, o.LimitDistance = "10", "20"
+		}, true},
+		{"stop distance and level", func(o *igmarkets.OTCWorkingOrderRequest) { o.StopDistance, o.StopLevel = "10", "1" }, false},
+		{"limit distance and level", func(o *igmarkets.OTCWorkingOrderRequest) { o.LimitDistance, o.LimitLevel = "10", "1.2" }, false},
+		{"guaranteed stop without stop", func(o *igmarkets.OTCWorkingOrderRequest) { o.GuaranteedStop = true }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := igmarkets.OTCWorkingOrderRequest{
+				Epic:         "EPIC",
+				Direction:    igmarkets.DirectionBuy,
+				Type:         igmarkets.WorkingOrderTypeLimit,
+				TimeInForce:  igmarkets.TimeInForceGoodTillCancelled,
+				Size:         1,
+				Level:        1.1,
+				CurrencyCode: "USD",
+				Expiry:       igmarkets.ExpiryNone,
+			}
+			tt.set(&order)
+			checkValid(t, order.Validate(), tt.valid)
+		})
+	}
+}
+
+func TestOTCWorkingOrderUpdateRequestValidate(t *testing.T) {
+	for _, wt := range testWorkingOrderTypes {
+		for _, tif := range testTimesInForce {
+			t.Run(fmt.Sprintf("%q/%q", wt, tif), func(t *testing.T) {
+				update := igmarkets.OTCWorkingOrderUpdateRequest{Type: wt, TimeInForce: tif, Level: 1.1}
+				if tif == igmarkets.TimeInForceGoodTillDate {
+					update.GoodTillDate = "2030/01/02 15:04"
+				}
+				valid := wt.Valid() &&
+					(tif == igmarkets.TimeInForceGoodTillCancelled || tif == igmarkets.TimeInForceGoodTillDate)
+				checkValid(t, update.Validate(), valid)
+			})
+		}
+	}
+
+	tests := []struct {
+		name  string
+		set   func(u *igmarkets.OTCWorkingOrderUpdateRequest)
+		valid bool
+	}{
+		{"good till date without date", func(u *igmarkets.OTCWorkingOrderUpdateRequest) {
+			u.TimeInForce = igmarkets.TimeInForceGoodTillDate
+		}, false},
+		{"good till cancelled with a date", func(u *igmarkets.OTCWorkingOrderUpdateRequest) {
+			u.GoodTillDate = "2030/01/02 15:04"
+		}, false},
+		{"no level", func(u *igmarkets.OTCWorkingOrderUpdateRequest) { u.Level = 0 }, false},
+		{"stop distance and level", func(u *igmarkets.OTCWorkingOrderUpdateRequest) { u.StopDistance, u.StopLevel = "10", "1" }, false},
+		{"limit distance and level", func(u *igmarkets.OTCWorkingOrderUpdateRequest) { u.LimitDistance, u.LimitLevel = "10", "1.2" }, false},
+		{"guaranteed stop", func(u *igmarkets.OTCWorkingOrderUpdateRequest) { u.GuaranteedStop, u.StopDistance = true, "10" }, true},
+		{"guaranteed stop without stop", func(u *igmarkets.OTCWorkingOrderUpdateRequest) { u.GuaranteedStop = true }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := igmarkets.OTCWorkingOrderUpdateRequest{
+				Type:        igmarkets.WorkingOrderTypeStop,
+				TimeInForce: igmarkets.TimeInForceGoodTillCancelled,
+				Level:       1.1,
+			}
+			tt.set(&update)
+			checkValid(t, update.Validate(), tt.valid)
+		})
+	}
+}
+
+func TestOTCUpdateOrderRequestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		update igmarkets.OTCUpdateOrderRequest
+		valid  bool
+	}{
+		{"no change", igmarkets.OTCUpdateOrderRequest{}, true},
+		{"stop and limit levels", igmarkets.OTCUpdateOrderRequest{StopLevel: "1", LimitLevel: "1.2"}, true},
+		{"stop distance and level", igmarkets.OTCUpdateOrderRequest{StopDistance: "10", StopLevel: "1"}, false},
+		{"limit distance and level", igmarkets.OTCUpdateOrderRequest{LimitDistance: "10", LimitLevel: "1.2"}, false},
+		{"trailing stop", igmarkets.OTCUpdateOrderRequest{
+			TrailingStop: true, StopLevel: "1", TrailingStopDistance: "10", TrailingStopIncrement: "2",
+		}, true},
+		{"trailing stop without level", igmarkets.OTCUpdateOrderRequest{
+			TrailingStop: true, TrailingStopDistance: "10", TrailingStopIncrement: "2",
+		}, false},
+		{"trailing distance without trailing stop", igmarkets.OTCUpdateOrderRequest{StopLevel: "1", TrailingStopDistance: "10"}, false},
+		{"guaranteed trailing stop", igmarkets.OTCUpdateOrderRequest{
+			TrailingStop: true, GuaranteedStop: true, StopLevel: "1", TrailingStopDistance: "10", TrailingStopIncrement: "2",
+		}, false},
+		{"guaranteed stop", igmarkets.OTCUpdateOrderRequest{GuaranteedStop: true, StopLevel: "1"}, true},
+		{"guaranteed stop without stop", igmarkets.OTCUpdateOrderRequest{GuaranteedStop: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkValid(t, tt.update.Validate(), tt.valid)
+		})
+	}
+}
+
+func TestOTCPositionCloseRequestValidate(t *testing.T) {
+	for _, d := range testDirections {
+		for _, ot := range testOrderTypes {
+			for _, tif := range testTimesInForce {
+				t.Run(fmt.Sprintf("%q/%q/%q", d, ot, tif), func(t *testing.T) {
+					level, quoteID := orderLevel(ot)
+					close := igmarkets.OTCPositionCloseRequest{
+						DealID:      "DIAAA",
+						Direction:   d,
+						OrderType:   ot,
+						TimeInForce: tif,
+						Size:        1,
+						Level:       level,
+						QuoteID:     quoteID,
+					}
+					valid := d.Valid() && ot.Valid() &&
+						(tif == "" || tif == igmarkets.TimeInForceExecuteAndEliminate || tif == igmarkets.TimeInForceFillOrKill)
+					checkValid(t, close.Validate(), valid)
+				})
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		set   func(c *igmarkets.OTCPositionCloseRequest)
+		valid bool
+	}{
+		{"by epic", func(c *igmarkets.OTCPositionCloseRequest) { c.DealID, c.Epic, c.Expiry = "", "EPIC", "-" }, true},
+		{"no deal ID or epic", func(c *igmarkets.OTCPositionCloseRequest) { c.DealID = "" }, false},
+		{"deal ID and epic", func(c *igmarkets.OTCPositionCloseRequest) { c.Epic, c.Expiry = "EPIC", "-" }, false},
+		{"epic without expiry", func(c *igmarkets.OTCPositionCloseRequest) { c.DealID, c.Epic = "", "EPIC" }, false},
+		{"no size", func(c *igmarkets.OTCPositionCloseRequest) { c.Size = 0 }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			close := igmarkets.OTCPositionCloseRequest{
+				DealID:    "DIAAA",
+				Direction: igmarkets.DirectionSell,
+				OrderType: igmarkets.OrderTypeMarket,
+				Size:      1,
+			}
+			tt.set(&close)
+			checkValid(t, close.Validate(), tt.valid)
+		})
+	}
+}
+
+func TestEnumMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		valid bool
+	}{
+		{"direction", igmarkets.DirectionSell, true},
+		{"unknown direction", igmarkets.Direction("HOLD"), false},
+		{"empty direction", igmarkets.Direction(""), true},
+		{"order type", igmarkets.OrderTypeQuote, true},
+		{"unknown order type", igmarkets.OrderType("STOP"), false},
+		{"time in force", igmarkets.TimeInForceGoodTillDate, true},
+		{"unknown time in force", igmarkets.TimeInForce("NOW"), false},
+		{"working order type", igmarkets.WorkingOrderTypeStop, true},
+		{"unknown working order type", igmarkets.WorkingOrderType("MARKET"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := json.Marshal(tt.value)
+			checkValid(t, err, tt.valid)
+		})
+	}
+}
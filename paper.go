@@ -0,0 +1,1109 @@
+package igmarkets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultPaperQuoteTTL - age after which a paper broker fetches a quote again
+const DefaultPaperQuoteTTL = 5 * time.Second
+
+// Reasons of the deals rejected by the paper broker, as IG sends them
+const (
+	paperReasonSuccess      = "SUCCESS"
+	paperReasonMarketClosed = "MARKET_CLOSED_WITH_EDITS"
+	paperReasonLevel        = "LEVEL_TOLERANCE_ERROR"
+	paperReasonWrongSide    = "WRONG_SIDE_OF_MARKET"
+	paperReasonNotAvailable = "POSITION_NOT_AVAILABLE_TO_CLOSE"
+	paperReasonUnknown      = "UNKNOWN"
+)
+
+// Date layouts of the positions and working orders, as IG sends them
+const (
+	paperDateFormat          = "2006/01/02 15:04:05:000"
+	paperDateUTCFormat       = "2006-01-02T15:04:05"
+	paperGoodTillDateFormat  = "2006/01/02 15:04:05"
+	paperGoodTillDateMinutes = "2006/01/02 15:04"
+)
+
+// PaperBroker - simulated book serving the order, position, working order
+// and deal confirmation calls of an IGMarkets in paper trading mode, see
+// EnablePaperTrading. Deals are filled at the quotes given to SetQuote or
+// OnChartTick, fetched with GetMarkets when older than QuoteTTL. Every quote
+// triggers the stops, limits and working orders of its epic.
+type PaperBroker struct {
+	QuoteTTL time.Duration
+	// OnTradeUpdate - called with the confirmations, position and working
+	// order updates of the book, as the trade stream sends them. It is
+	// called by the order calls and must not place orders itself while a
+	// RiskGuard is enabled.
+	OnTradeUpdate func(TradeUpdate)
+	// StreamOptions - reconnection and stall settings of the quote stream
+	// opened by Watch
+	StreamOptions LightStreamOptions
+
+	ig        *IGMarkets
+	mu        sync.Mutex
+	seq       uint64
+	quotes    map[string]paperQuote
+	markets   map[string]*MarketsResponse
+	positions []Position
+	orders    []paperOrder
+	confirms  map[string]*OTCDealConfirmation
+	realised  map[string]float64
+	// transactions - closed deals, as GetTransactions returns them
+	transactions []Transaction
+
+	streamMu sync.Mutex
+	streams  map[*paperStream]struct{}
+}
+
+// paperStream - trade stream of the book, updates queue up until they are
+// sent so that the order calls never wait for the stream to be drained
+type paperStream struct {
+	mu    sync.Mutex
+	queue []TradeUpdate
+	ready chan struct{}
+}
+
+// push - queue updates and wake the stream
+func (s *paperStream) push(updates []TradeUpdate) {
+	s.mu.Lock()
+	s.queue = append(s.queue, updates...)
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop - queued updates
+func (s *paperStream) pop() []TradeUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := s.queue
+	s.queue = nil
+	return queue
+}
+
+type paperQuote struct {
+	bid, offer float64
+	time       time.Time
+}
+
+// price - price dealing in direction: the offer for BUY, the bid for SELL
+func (q paperQuote) price(d Direction) float64 {
+	if d == DirectionSell {
+		return q.bid
+	}
+	return q.offer
+}
+
+// paperOrder - working order of the book and its stop and limit as requested
+type paperOrder struct {
+	order   OTCWorkingOrder
+	request OTCWorkingOrderRequest
+}
+
+// NewPaperBroker - empty book fetching its quotes and markets from ig
+func NewPaperBroker(ig *IGMarkets) *PaperBroker {
+	return &PaperBroker{
+		QuoteTTL: DefaultPaperQuoteTTL,
+		StreamOptions: LightStreamOptions{
+			ReconnectionTime: DefaultStreamReconnectionTime,
+			MaxReconnection:  DefaultStreamMaxReconnection,
+		},
+		ig:       ig,
+		quotes:   make(map[string]paperQuote),
+		markets:  make(map[string]*MarketsResponse),
+		confirms: make(map[string]*OTCDealConfirmation),
+		realised: make(map[string]float64),
+		streams:  make(map[*paperStream]struct{}),
+	}
+}
+
+// EnablePaperTrading - serve the order calls, the trade stream and the
+// transaction history of ig with a new paper broker, market data calls still
+// go to IG
+func (ig *IGMarkets) EnablePaperTrading() *PaperBroker {
+	b := NewPaperBroker(ig)
+
+	ig.Lock()
+	ig.paper = b
+	ig.Unlock()
+
+	return b
+}
+
+// DisablePaperTrading - send the order calls to IG again
+func (ig *IGMarkets) DisablePaperTrading() {
+	ig.Lock()
+	ig.paper = nil
+	ig.Unlock()
+}
+
+// paperBroker - broker of the paper trading mode, nil when disabled
+func (ig *IGMarkets) paperBroker() *PaperBroker {
+	ig.RLock()
+	defer ig.RUnlock()
+	return ig.paper
+}
+
+// SetQuote - current bid and offer of epic
+func (b *PaperBroker) SetQuote(epic string, bid, offer float64) {
+	q := paperQuote{bid: bid, offer: offer, time: time.Now()}
+
+	b.mu.Lock()
+	b.quotes[epic] = q
+	updates := b.trigger(epic, q)
+	b.mu.Unlock()
+
+	b.emit(nil, updates)
+}
+
+// OnChartTick - SetQuote with the closing bid and offer of tick
+func (b *PaperBroker) OnChartTick(tick LightStreamChartTick) {
+	if tick.BID_CLOSE > 0 && tick.OFR_CLOSE > 0 {
+		b.SetQuote(tick.EPIC, tick.BID_CLOSE, tick.OFR_CLOSE)
+	}
+}
+
+// Watch - feed the broker with the streamed prices of epics until ctx is done
+func (b *PaperBroker) Watch(ctx context.Context, epics ...string) (<-chan error, error) {
+	o := b.StreamOptions
+	o.Epics = epics
+	o.Fields = []string{"UTM", "BID_CLOSE", "OFR_CLOSE"}
+	o.SubType = "CHART"
+	o.Interval = "SECOND"
+	o.Mode = "MERGE"
+
+	ticks, errs, err := b.ig.OpenLightStreamerSubscription(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for tick := range ticks {
+			b.OnChartTick(tick)
+		}
+	}()
+
+	return errs, nil
+}
+
+// RealisedProfit - profit of the closed deals by currency
+func (b *PaperBroker) RealisedProfit() map[string]float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	profit := make(map[string]float64, len(b.realised))
+	for c, p := range b.realised {
+		profit[c] = p
+	}
+	return profit
+}
+
+// quote - fresh quote and market of epic
+func (b *PaperBroker) quote(epic string) (paperQuote, *MarketsResponse, error) {
+	b.mu.Lock()
+	q, ok := b.quotes[epic]
+	market := b.markets[epic]
+	b.mu.Unlock()
+
+	if ok && market != nil && time.Since(q.time) < b.QuoteTTL {
+		return q, market, nil
+	}
+
+	market, err := b.ig.GetMarkets(epic)
+	if err != nil {
+		return paperQuote{}, nil, err
+	}
+	if !ok || time.Since(q.time) >= b.QuoteTTL {
+		q = paperQuote{bid: market.Snapshot.Bid, offer: market.Snapshot.Offer, time: time.Now()}
+	}
+	if q.bid <= 0 || q.offer <= 0 {
+		return paperQuote{}, nil, fmt.Errorf("igmarkets: no quote for %s", epic)
+	}
+
+	b.mu.Lock()
+	b.markets[epic] = market
+	b.quotes[epic] = q
+	updates := b.trigger(epic, q)
+	b.mu.Unlock()
+
+	b.emit(nil, updates)
+	return q, market, nil
+}
+
+// emit - publish confirm and updates like the trade stream
+func (b *PaperBroker) emit(confirm *OTCDealConfirmation, updates []TradeUpdate) {
+	if confirm != nil {
+		b.ig.confirmHub().publish(confirm)
+		updates = append([]TradeUpdate{{Confirm: confirm}}, updates...)
+	}
+	if len(updates) == 0 {
+		return
+	}
+
+	b.streamMu.Lock()
+	for s := range b.streams {
+		s.push(updates)
+	}
+	b.streamMu.Unlock()
+
+	if b.OnTradeUpdate != nil {
+		for _, u := range updates {
+			b.OnTradeUpdate(u)
+		}
+	}
+}
+
+// OpenTradeStream - confirmations, position and working order updates of the
+// book until ctx is done, as the trade stream of IG sends them. The updates
+// are queued until received. The error channel never sends and is closed
+// with the update one.
+func (b *PaperBroker) OpenTradeStream(ctx context.Context) (<-chan TradeUpdate, <-chan error) {
+	s := &paperStream{ready: make(chan struct{}, 1)}
+	b.streamMu.Lock()
+	b.streams[s] = struct{}{}
+	b.streamMu.Unlock()
+
+	updates := make(chan TradeUpdate)
+	errs := make(chan error)
+
+	go func() {
+		defer func() {
+			b.streamMu.Lock()
+			delete(b.streams, s)
+			b.streamMu.Unlock()
+			close(updates)
+			close(errs)
+		}()
+
+		for {
+			for _, u := range s.pop() {
+				select {
+				case updates <- u:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-s.ready:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return updates, errs
+}
+
+// nextDealID - deal ID of a new position or working order
+func (b *PaperBroker) nextDealID() string {
+	b.seq++
+	return "PAPER" + strconv.FormatUint(b.seq, 36)
+}
+
+// confirmation - accepted deal, stored for GetDealConfirmation
+func (b *PaperBroker) confirmation(ref, epic string, direction Direction, size float64) *OTCDealConfirmation {
+	c := &OTCDealConfirmation{
+		Epic:          epic,
+		Date:          Time(time.Now().UTC()),
+		DealStatus:    DealStatusAccepted,
+		Reason:        paperReasonSuccess,
+		Direction:     direction,
+		Size:          size,
+		DealReference: ref,
+	}
+	b.confirms[ref] = c
+	return c
+}
+
+// reject - c rejected for reason
+func reject(c *OTCDealConfirmation, reason string) *OTCDealConfirmation {
+	c.DealStatus = DealStatusRejected
+	c.Reason = reason
+	c.AffectedDeals = nil
+	return c
+}
+
+// tradeable - false when market is known to be closed
+func tradeable(market *MarketsResponse) bool {
+	status := market.Snapshot.MarketStatus
+	return status == "" || status == "TRADEABLE"
+}
+
+// PlaceOTCOrder - fill order at the current quote, positions in the opposite
+// direction are closed first unless ForceOpen is set
+func (b *PaperBroker) PlaceOTCOrder(order OTCOrderRequest) (*DealReference, error) {
+	q, market, err := b.quote(order.Epic)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	c := b.confirmation(order.DealReference, order.Epic, order.Direction, order.Size)
+	c.Expiry = order.Expiry
+	c.CurrencyCode = order.CurrencyCode
+	c.OrderType = order.OrderType
+	c.TimeInForce = order.TimeInForce
+	c.ForceOpen = order.ForceOpen
+	c.GuaranteedStop = order.GuaranteedStop
+	c.TrailingStop = order.TrailingStop
+
+	price := q.price(order.Direction)
+	level, _ := strconv.ParseFloat(order.Level, 64)
+
+	var updates []TradeUpdate
+	switch {
+	case !tradeable(market):
+		reject(c, paperReasonMarketClosed)
+	case order.OrderType == OrderTypeLimit && (price-level)*stopSign(order.Direction) > 0:
+		reject(c, paperReasonLevel)
+	default:
+		if order.OrderType == OrderTypeQuote {
+			price = level
+		}
+		c.Level = price
+
+		stop := paperStopLimit{
+			stopDistance:  order.StopDistance,
+			stopLevel:     order.StopLevel,
+			limitDistance: order.LimitDistance,
+			limitLevel:    order.LimitLevel,
+			trailing:      order.TrailingStop,
+			trailingStep:  order.TrailingStopIncrement,
+		}
+		updates = b.fill(c, market, order.Expiry, order.CurrencyCode, order.ForceOpen, order.GuaranteedStop, stop, "")
+	}
+	b.mu.Unlock()
+
+	b.emit(c, updates)
+	return &DealReference{DealReference: order.DealReference}, nil
+}
+
+// paperStopLimit - stop and limit of a deal as requested
+type paperStopLimit struct {
+	stopDistance, stopLevel   string
+	limitDistance, limitLevel string
+	trailing                  bool
+	trailingStep              string
+}
+
+// levels - stop and limit levels of a deal at price
+func (s paperStopLimit) levels(direction Direction, price float64) (stop, limit float64) {
+	sign := stopSign(direction)
+	if d, err := strconv.ParseFloat(s.stopDistance, 64); err == nil {
+		stop = price - d*sign
+	} else if l, err := strconv.ParseFloat(s.stopLevel, 64); err == nil {
+		stop = l
+	}
+	if d, err := strconv.ParseFloat(s.limitDistance, 64); err == nil {
+		limit = price + d*sign
+	} else if l, err := strconv.ParseFloat(s.limitLevel, 64); err == nil {
+		limit = l
+	}
+	return stop, limit
+}
+
+// fill - execute the accepted deal c at c.Level: net the opposite positions
+// unless forceOpen, then open the rest. origin is the deal ID of the filled
+// working order, if any.
+func (b *PaperBroker) fill(c *OTCDealConfirmation, market *MarketsResponse, expiry, currency string,
+	forceOpen, guaranteed bool, sl paperStopLimit, origin string) []TradeUpdate {
+	var updates []TradeUpdate
+	remaining := c.Size
+
+	if !forceOpen {
+		for i := 0; i < len(b.positions) && remaining > 0; {
+			p := b.positions[i]
+			if p.MarketData.Epic != c.Epic || p.MarketData.Expiry != expiry || p.Position.Direction != c.Direction.Opposite() {
+				i++
+				continue
+			}
+
+			size := p.Position.Size
+			if remaining < size {
+				size = remaining
+			}
+			remaining -= size
+
+			profit, affected, update := b.closePosition(i, size, c.Level, market)
+			c.Profit += profit
+			c.ProfitCurrency = p.Position.Currency
+			c.AffectedDeals = append(c.AffectedDeals, affected)
+			updates = append(updates, update)
+			c.DealID = p.Position.DealID
+			c.Status = "CLOSED"
+			if affected.Constant != "FULLY_CLOSED" {
+				i++
+			}
+		}
+	}
+
+	if remaining <= 0 {
+		return updates
+	}
+
+	if currency == "" {
+		if cur, err := dealCurrency(market, ""); err == nil {
+			currency = cur.Code
+		}
+	}
+
+	var p Position
+	p.MarketData = paperMarketData(c.Epic, expiry, market)
+	p.Position.ContractSize, _ = strconv.ParseFloat(market.Instrument.ContractSize, 64)
+	p.Position.ControlledRisk = guaranteed
+	now := time.Now()
+	p.Position.CreatedDate = now.Format(paperDateFormat)
+	p.Position.CreatedDateUTC = now.UTC().Format(paperDateUTCFormat)
+	p.Position.Created = now.UTC().Truncate(time.Second)
+	p.Position.Currency = currency
+	p.Position.Currencry = currency
+	p.Position.DealID = b.nextDealID()
+	p.Position.DealReference = c.DealReference
+	p.Position.Direction = c.Direction
+	p.Position.Level = c.Level
+	p.Position.Size = remaining
+	p.Position.StopLevel, p.Position.LimitLevel = sl.levels(c.Direction, c.Level)
+	if sl.trailing && p.Position.StopLevel != 0 {
+		p.Position.TrailingStopDistance = (c.Level - p.Position.StopLevel) * stopSign(c.Direction)
+		p.Position.TrailingStep, _ = strconv.ParseFloat(sl.trailingStep, 64)
+	}
+	b.positions = append(b.positions, p)
+
+	c.DealID = p.Position.DealID
+	c.Status = "OPEN"
+	c.StopLevel, c.LimitLevel = p.Position.StopLevel, p.Position.LimitLevel
+	c.AffectedDeals = append(c.AffectedDeals, AffectedDeal{DealID: p.Position.DealID, Constant: "OPENED"})
+
+	update := paperPositionUpdate(p, TradeStatusOpen)
+	update.DealIDOrigin = origin
+	return append(updates, TradeUpdate{Position: update})
+}
+
+// closePosition - close size of position i at level
+func (b *PaperBroker) closePosition(i int, size, level float64, market *MarketsResponse) (float64, AffectedDeal, TradeUpdate) {
+	p := &b.positions[i]
+
+	value, err := p.pointValue(market)
+	if err != nil {
+		value = 1
+	}
+	profit := (level - p.Position.Level) * stopSign(p.Position.Direction) * size * value
+	b.realised[p.Position.Currency] += profit
+	b.transactions = append(b.transactions, paperTransaction(*p, size, level, profit))
+
+	affected := AffectedDeal{DealID: p.Position.DealID, Constant: "PARTIALLY_CLOSED"}
+	if size >= p.Position.Size {
+		affected.Constant = "FULLY_CLOSED"
+		update := paperPositionUpdate(*p, TradeStatusDeleted)
+		update.Level = level
+		b.positions = append(b.positions[:i], b.positions[i+1:]...)
+		return profit, affected, TradeUpdate{Position: update}
+	}
+
+	p.Position.Size -= size
+	return profit, affected, TradeUpdate{Position: paperPositionUpdate(*p, TradeStatusUpdated)}
+}
+
+// paperTransaction - transaction of size of position p closed at level
+func paperTransaction(p Position, size, level, profit float64) Transaction {
+	now := time.Now()
+	return Transaction{
+		CloseLevel:      strconv.FormatFloat(level, 'f', -1, 64),
+		Currency:        p.Position.Currency,
+		Date:            now.Format(paperDateFormat),
+		DateUTC:         now.UTC().Format(paperDateUTCFormat),
+		InstrumentName:  p.MarketData.Epic,
+		OpenDateUtc:     p.Position.CreatedDateUTC,
+		OpenLevel:       strconv.FormatFloat(p.Position.Level, 'f', -1, 64),
+		Period:          p.MarketData.Expiry,
+		ProfitAndLoss:   p.Position.Currency + strconv.FormatFloat(profit, 'f', 2, 64),
+		Reference:       p.Position.DealID,
+		Size:            strconv.FormatFloat(size*stopSign(p.Position.Direction), 'f', -1, 64),
+		TransactionType: "DEAL",
+	}
+}
+
+// GetTransactions - deals closed since from, for the types ALL and ALL_DEAL
+func (b *PaperBroker) GetTransactions(transactionType string, from time.Time) (*HistoryTransactionResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	transactions := &HistoryTransactionResponse{Transactions: []Transaction{}}
+	if transactionType != "ALL" && transactionType != "ALL_DEAL" {
+		return transactions, nil
+	}
+	for _, t := range b.transactions {
+		date, err := time.ParseInLocation(paperDateUTCFormat, t.DateUTC, time.UTC)
+		if err == nil && !date.Before(from.UTC().Truncate(time.Second)) {
+			transactions.Transactions = append(transactions.Transactions, t)
+		}
+	}
+	return transactions, nil
+}
+
+// paperMarketData - market part of a position or working order
+func paperMarketData(epic, expiry string, market *MarketsResponse) MarketData {
+	return MarketData{
+		Bid:            market.Snapshot.Bid,
+		Epic:           epic,
+		Expiry:         expiry,
+		High:           market.Snapshot.High,
+		InstrumentType: market.Instrument.Type,
+		LotSize:        market.Instrument.LotSize,
+		Low:            market.Snapshot.Low,
+		MarketStatus:   market.Snapshot.MarketStatus,
+		Offer:          market.Snapshot.Offer,
+	}
+}
+
+func paperPositionUpdate(p Position, status string) *PositionUpdate {
+	return &PositionUpdate{
+		DealReference:  p.Position.DealReference,
+		DealID:         p.Position.DealID,
+		Direction:      p.Position.Direction,
+		Epic:           p.MarketData.Epic,
+		Status:         status,
+		DealStatus:     DealStatusAccepted,
+		Level:          p.Position.Level,
+		Size:           p.Position.Size,
+		Currency:       p.Position.Currency,
+		Expiry:         p.MarketData.Expiry,
+		Timestamp:      time.Now().UTC().Format(paperDateUTCFormat),
+		StopLevel:      p.Position.StopLevel,
+		LimitLevel:     p.Position.LimitLevel,
+		GuaranteedStop: p.Position.ControlledRisk,
+		Channel:        "PAPER",
+	}
+}
+
+func paperWorkingOrderUpdate(o OTCWorkingOrder, ref, status string) *WorkingOrderUpdate {
+	w := o.WorkingOrderData
+	return &WorkingOrderUpdate{
+		DealReference:  ref,
+		DealID:         w.DealID,
+		Direction:      w.Direction,
+		Epic:           w.Epic,
+		Status:         status,
+		DealStatus:     DealStatusAccepted,
+		Level:          w.OrderLevel,
+		Size:           w.OrderSize,
+		Currency:       w.CurrencyCode,
+		Expiry:         o.MarketData.Expiry,
+		Timestamp:      time.Now().UTC().Format(paperDateUTCFormat),
+		OrderType:      w.OrderType,
+		TimeInForce:    w.TimeInForce,
+		GoodTillDate:   w.GoodTillDate,
+		StopDistance:   w.StopDistance,
+		LimitDistance:  w.LimitDistance,
+		GuaranteedStop: w.GuaranteedStop,
+		Channel:        "PAPER",
+	}
+}
+
+// CloseOTCPosition - close the position of close.DealID, or the positions of
+// close.Epic in the opposite direction, oldest first
+func (b *PaperBroker) CloseOTCPosition(close OTCPositionCloseRequest) (*DealReference, error) {
+	ref := paperReference("CLOSE")
+
+	epic := close.Epic
+	if close.DealID != "" {
+		b.mu.Lock()
+		for _, p := range b.positions {
+			if p.Position.DealID == close.DealID {
+				epic = p.MarketData.Epic
+			}
+		}
+		b.mu.Unlock()
+	}
+
+	var q paperQuote
+	var market *MarketsResponse
+	if epic != "" {
+		var err error
+		if q, market, err = b.quote(epic); err != nil {
+			return nil, err
+		}
+	}
+
+	b.mu.Lock()
+	c := b.confirmation(ref, epic, close.Direction, close.Size)
+	c.OrderType = close.OrderType
+	c.TimeInForce = close.TimeInForce
+	c.Status = "CLOSED"
+
+	var updates []TradeUpdate
+	price := q.price(close.Direction)
+	level, _ := strconv.ParseFloat(close.Level, 64)
+
+	var matching []int
+	total := 0.0
+	for i, p := range b.positions {
+		if (close.DealID != "" && p.Position.DealID == close.DealID) ||
+			(close.DealID == "" && p.MarketData.Epic == close.Epic && p.MarketData.Expiry == close.Expiry) {
+			if p.Position.Direction == close.Direction.Opposite() {
+				matching = append(matching, i)
+				total += p.Position.Size
+			}
+		}
+	}
+
+	switch {
+	case len(matching) == 0 || (close.DealID != "" && close.Size > total):
+		reject(c, paperReasonNotAvailable)
+	case !tradeable(market):
+		reject(c, paperReasonMarketClosed)
+	case close.OrderType == OrderTypeLimit && (price-level)*stopSign(close.Direction) > 0:
+		reject(c, paperReasonLevel)
+	default:
+		if close.OrderType == OrderTypeQuote {
+			price = level
+		}
+		c.Level = price
+
+		remaining := close.Size
+		removed := 0
+		for _, i := range matching {
+			if remaining <= 0 {
+				break
+			}
+			i -= removed
+			p := b.positions[i]
+
+			size := p.Position.Size
+			if remaining < size {
+				size = remaining
+			}
+			remaining -= size
+
+			profit, affected, update := b.closePosition(i, size, price, market)
+			if affected.Constant == "FULLY_CLOSED" {
+				removed++
+			}
+			c.Profit += profit
+			c.ProfitCurrency = p.Position.Currency
+			c.CurrencyCode = p.Position.Currency
+			c.Expiry = p.MarketData.Expiry
+			c.DealID = p.Position.DealID
+			c.AffectedDeals = append(c.AffectedDeals, affected)
+			updates = append(updates, update)
+		}
+	}
+	b.mu.Unlock()
+
+	b.emit(c, updates)
+	return &DealReference{DealReference: ref}, nil
+}
+
+// paperReference - reference of a close or an amendment, IG makes its own
+// for those
+func paperReference(kind string) string {
+	return "PAPER" + kind + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// UpdateOTCOrder - replace the stop and limit of the position dealID
+func (b *PaperBroker) UpdateOTCOrder(dealID string, update OTCUpdateOrderRequest) (*DealReference, error) {
+	ref := paperReference("AMEND")
+
+	epic := ""
+	b.mu.Lock()
+	for _, p := range b.positions {
+		if p.Position.DealID == dealID {
+			epic = p.MarketData.Epic
+		}
+	}
+	b.mu.Unlock()
+
+	var q paperQuote
+	if epic != "" {
+		var err error
+		if q, _, err = b.quote(epic); err != nil {
+			return nil, err
+		}
+	}
+
+	b.mu.Lock()
+	var updates []TradeUpdate
+	c := b.confirmation(ref, epic, "", 0)
+	c.DealID = dealID
+	c.Status = "AMENDED"
+
+	i := b.position(dealID)
+	if i < 0 {
+		reject(c, paperReasonUnknown)
+	} else {
+		p := &b.positions[i].Position
+		price := q.price(p.Direction.Opposite())
+		sl := paperStopLimit{
+			stopDistance:  update.StopDistance,
+			stopLevel:     update.StopLevel,
+			limitDistance: update.LimitDistance,
+			limitLevel:    update.LimitLevel,
+		}
+		p.StopLevel, p.LimitLevel = sl.levels(p.Direction, price)
+		p.ControlledRisk = update.GuaranteedStop
+		p.TrailingStopDistance, p.TrailingStep = 0, 0
+		if update.TrailingStop {
+			p.TrailingStopDistance, _ = strconv.ParseFloat(update.TrailingStopDistance, 64)
+			p.TrailingStep, _ = strconv.ParseFloat(update.TrailingStopIncrement, 64)
+		}
+
+		c.Direction, c.Size, c.Level = p.Direction, p.Size, p.Level
+		c.StopLevel, c.LimitLevel = p.StopLevel, p.LimitLevel
+		c.GuaranteedStop, c.TrailingStop = p.ControlledRisk, update.TrailingStop
+		c.AffectedDeals = []AffectedDeal{{DealID: dealID, Constant: "AMENDED"}}
+		updates = append(updates, TradeUpdate{Position: paperPositionUpdate(b.positions[i], TradeStatusUpdated)})
+	}
+	b.mu.Unlock()
+
+	b.emit(c, updates)
+	return &DealReference{DealReference: ref}, nil
+}
+
+// position - index of the position dealID, -1 if not open
+func (b *PaperBroker) position(dealID string) int {
+	for i, p := range b.positions {
+		if p.Position.DealID == dealID {
+			return i
+		}
+	}
+	return -1
+}
+
+// workingOrder - index of the working order dealID, -1 if not in the book
+func (b *PaperBroker) workingOrder(dealID string) int {
+	for i, o := range b.orders {
+		if o.order.WorkingOrderData.DealID == dealID {
+			return i
+		}
+	}
+	return -1
+}
+
+// PlaceOTCWorkingOrder - add order to the book, it must not be fillable at
+// the current quote
+func (b *PaperBroker) PlaceOTCWorkingOrder(order OTCWorkingOrderRequest) (*DealReference, error) {
+	q, market, err := b.quote(order.Epic)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	c := b.confirmation(order.DealReference, order.Epic, order.Direction, order.Size)
+	c.Expiry = order.Expiry
+	c.CurrencyCode = order.CurrencyCode
+	c.TimeInForce = order.TimeInForce
+	c.ForceOpen = order.ForceOpen
+	c.GuaranteedStop = order.GuaranteedStop
+	c.Level = order.Level
+
+	var updates []TradeUpdate
+	if workingOrderTriggered(order.Direction, order.Type, order.Level, q) {
+		reject(c, paperReasonWrongSide)
+	} else {
+		o := paperOrder{request: order}
+		o.order.MarketData = paperMarketData(order.Epic, order.Expiry, market)
+		o.order.WorkingOrderData = WorkingOrderData{
+			CreatedDate:    time.Now().Format(paperDateFormat),
+			CreatedDateUTC: time.Now().UTC().Format(paperDateUTCFormat),
+			CurrencyCode:   order.CurrencyCode,
+			DealID:         b.nextDealID(),
+			Direction:      order.Direction,
+			Epic:           order.Epic,
+			GoodTillDate:   order.GoodTillDate,
+			GuaranteedStop: order.GuaranteedStop,
+			OrderLevel:     order.Level,
+			OrderSize:      order.Size,
+			OrderType:      order.Type,
+			TimeInForce:    order.TimeInForce,
+		}
+		setWorkingOrderDistances(&o)
+		b.orders = append(b.orders, o)
+
+		c.DealID = o.order.WorkingOrderData.DealID
+		c.Status = "OPEN"
+		c.AffectedDeals = []AffectedDeal{{DealID: c.DealID, Constant: "OPENED"}}
+		updates = append(updates, TradeUpdate{WorkingOrder: paperWorkingOrderUpdate(o.order, order.DealReference, TradeStatusOpen)})
+	}
+	b.mu.Unlock()
+
+	b.emit(c, updates)
+	return &DealReference{DealReference: order.DealReference}, nil
+}
+
+// setWorkingOrderDistances - stop and limit distances of o from its level
+func setWorkingOrderDistances(o *paperOrder) {
+	w := &o.order.WorkingOrderData
+	sl := paperStopLimit{
+		stopDistance:  o.request.StopDistance,
+		stopLevel:     o.request.StopLevel,
+		limitDistance: o.request.LimitDistance,
+		limitLevel:    o.request.LimitLevel,
+	}
+	stop, limit := sl.levels(w.Direction, w.OrderLevel)
+
+	sign := stopSign(w.Direction)
+	w.StopDistance, w.LimitDistance = 0, 0
+	if stop != 0 {
+		w.StopDistance = (w.OrderLevel - stop) * sign
+	}
+	if limit != 0 {
+		w.LimitDistance = (limit - w.OrderLevel) * sign
+	}
+}
+
+// workingOrderTriggered - true when a working order at level fills at q
+func workingOrderTriggered(direction Direction, orderType WorkingOrderType, level float64, q paperQuote) bool {
+	price := q.price(direction)
+	if (orderType == WorkingOrderTypeLimit) == (direction == DirectionBuy) {
+		// buy limit or sell stop: filled at or below level
+		return price <= level
+	}
+	return price >= level
+}
+
+// UpdateOTCWorkingOrder - amend the working order dealID
+func (b *PaperBroker) UpdateOTCWorkingOrder(dealID string, update OTCWorkingOrderUpdateRequest) (*DealReference, error) {
+	ref := paperReference("AMEND")
+
+	epic := ""
+	b.mu.Lock()
+	if i := b.workingOrder(dealID); i >= 0 {
+		epic = b.orders[i].order.WorkingOrderData.Epic
+	}
+	b.mu.Unlock()
+
+	var q paperQuote
+	if epic != "" {
+		var err error
+		if q, _, err = b.quote(epic); err != nil {
+			return nil, err
+		}
+	}
+
+	b.mu.Lock()
+	var updates []TradeUpdate
+	c := b.confirmation(ref, epic, "", 0)
+	c.DealID = dealID
+	c.Status = "AMENDED"
+
+	i := b.workingOrder(dealID)
+	switch {
+	case i < 0:
+		reject(c, paperReasonUnknown)
+	case workingOrderTriggered(b.orders[i].order.WorkingOrderData.Direction, update.Type, update.Level, q):
+		reject(c, paperReasonWrongSide)
+	default:
+		o := &b.orders[i]
+		o.request.Level = update.Level
+		o.request.Type = update.Type
+		o.request.TimeInForce = update.TimeInForce
+		o.request.GoodTillDate = update.GoodTillDate
+		o.request.GuaranteedStop = update.GuaranteedStop
+		o.request.StopDistance, o.request.StopLevel = update.StopDistance, update.StopLevel
+		o.request.LimitDistance, o.request.LimitLevel = update.LimitDistance, update.LimitLevel
+
+		w := &o.order.WorkingOrderData
+		w.OrderLevel, w.OrderType, w.TimeInForce = update.Level, update.Type, update.TimeInForce
+		w.GoodTillDate, w.GuaranteedStop = update.GoodTillDate, update.GuaranteedStop
+		setWorkingOrderDistances(o)
+
+		c.Direction, c.Size, c.Level = w.Direction, w.OrderSize, w.OrderLevel
+		c.TimeInForce, c.GuaranteedStop = w.TimeInForce, w.GuaranteedStop
+		c.AffectedDeals = []AffectedDeal{{DealID: dealID, Constant: "AMENDED"}}
+		updates = append(updates, TradeUpdate{WorkingOrder: paperWorkingOrderUpdate(o.order, o.request.DealReference, TradeStatusUpdated)})
+	}
+	b.mu.Unlock()
+
+	b.emit(c, updates)
+	return &DealReference{DealReference: ref}, nil
+}
+
+// DeleteOTCWorkingOrder - remove the working order dealID from the book
+func (b *PaperBroker) DeleteOTCWorkingOrder(dealID string) error {
+	b.mu.Lock()
+	i := b.workingOrder(dealID)
+	if i < 0 {
+		b.mu.Unlock()
+		return newAPIError(http.StatusNotFound, []byte(`{"errorCode":"error.service.workingorder.not.found"}`))
+	}
+	o := b.orders[i]
+	b.orders = append(b.orders[:i], b.orders[i+1:]...)
+	b.mu.Unlock()
+
+	b.emit(nil, []TradeUpdate{{WorkingOrder: paperWorkingOrderUpdate(o.order, o.request.DealReference, TradeStatusDeleted)}})
+	return nil
+}
+
+// GetOTCWorkingOrders - working orders of the book
+func (b *PaperBroker) GetOTCWorkingOrders() (*WorkingOrders, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	orders := &WorkingOrders{WorkingOrders: make([]OTCWorkingOrder, 0, len(b.orders))}
+	for _, o := range b.orders {
+		order := o.order
+		b.setMarketQuote(&order.MarketData)
+		orders.WorkingOrders = append(orders.WorkingOrders, order)
+	}
+	return orders, nil
+}
+
+// GetPositions - open positions of the book
+func (b *PaperBroker) GetPositions() (*PositionsResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	positions := &PositionsResponse{Positions: make([]Position, 0, len(b.positions))}
+	for _, p := range b.positions {
+		b.setMarketQuote(&p.MarketData)
+		positions.Positions = append(positions.Positions, p)
+	}
+	return positions, nil
+}
+
+// GetPosition - open position dealID of the book
+func (b *PaperBroker) GetPosition(dealID string) (*Position, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.position(dealID)
+	if i < 0 {
+		return nil, newAPIError(http.StatusNotFound, []byte(`{"errorCode":"error.position.notfound"}`))
+	}
+	p := b.positions[i]
+	b.setMarketQuote(&p.MarketData)
+	return &p, nil
+}
+
+// GetDealConfirmation - confirmation of a deal of the book
+func (b *PaperBroker) GetDealConfirmation(dealRef string) (*OTCDealConfirmation, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.confirms[dealRef]
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, []byte(`{"errorCode":"error.confirms.deal-not-found"}`))
+	}
+	confirmation := *c
+	return &confirmation, nil
+}
+
+// setMarketQuote - latest quote into m
+func (b *PaperBroker) setMarketQuote(m *MarketData) {
+	if q, ok := b.quotes[m.Epic]; ok {
+		m.Bid, m.Offer = q.bid, q.offer
+		m.UpdateTimeUTC = q.time.UTC().Format("15:04:05")
+	}
+}
+
+// trigger - move the trailing stops, close the positions at their stop or
+// limit and fill the working orders of epic at q
+func (b *PaperBroker) trigger(epic string, q paperQuote) []TradeUpdate {
+	var updates []TradeUpdate
+	market := b.markets[epic]
+	if market == nil {
+		market = &MarketsResponse{}
+	}
+
+	for i := 0; i < len(b.positions); {
+		p := &b.positions[i]
+		if p.MarketData.Epic != epic {
+			i++
+			continue
+		}
+
+		pos := &p.Position
+		sign := stopSign(pos.Direction)
+		price := q.price(pos.Direction.Opposite())
+
+		if pos.TrailingStopDistance > 0 {
+			step := pos.TrailingStep
+			if stop := price - pos.TrailingStopDistance*sign; (stop-pos.StopLevel)*sign >= step {
+				pos.StopLevel = stop
+				updates = append(updates, TradeUpdate{Position: paperPositionUpdate(*p, TradeStatusUpdated)})
+			}
+		}
+
+		level := 0.0
+		switch {
+		case pos.StopLevel != 0 && (price-pos.StopLevel)*sign <= 0:
+			level = price
+			if pos.ControlledRisk {
+				level = pos.StopLevel
+			}
+		case pos.LimitLevel != 0 && (price-pos.LimitLevel)*sign >= 0:
+			level = price
+		default:
+			i++
+			continue
+		}
+
+		_, _, update := b.closePosition(i, pos.Size, level, market)
+		updates = append(updates, update)
+	}
+
+	now := time.Now()
+	for i := 0; i < len(b.orders); {
+		o := b.orders[i]
+		w := o.order.WorkingOrderData
+		if w.Epic != epic {
+			i++
+			continue
+		}
+
+		if paperExpired(w, now) {
+			b.orders = append(b.orders[:i], b.orders[i+1:]...)
+			updates = append(updates, TradeUpdate{WorkingOrder: paperWorkingOrderUpdate(o.order, o.request.DealReference, TradeStatusDeleted)})
+			continue
+		}
+		if !workingOrderTriggered(w.Direction, w.OrderType, w.OrderLevel, q) {
+			i++
+			continue
+		}
+
+		b.orders = append(b.orders[:i], b.orders[i+1:]...)
+		updates = append(updates, TradeUpdate{WorkingOrder: paperWorkingOrderUpdate(o.order, o.request.DealReference, TradeStatusDeleted)})
+
+		c := &OTCDealConfirmation{
+			Epic:          epic,
+			Direction:     w.Direction,
+			Size:          w.OrderSize,
+			Level:         q.price(w.Direction),
+			DealReference: o.request.DealReference,
+		}
+		sl := paperStopLimit{}
+		if w.StopDistance != 0 {
+			sl.stopDistance = strconv.FormatFloat(w.StopDistance, 'f', -1, 64)
+		}
+		if w.LimitDistance != 0 {
+			sl.limitDistance = strconv.FormatFloat(w.LimitDistance, 'f', -1, 64)
+		}
+		updates = append(updates, b.fill(c, market, o.order.MarketData.Expiry, w.CurrencyCode,
+			o.request.ForceOpen, w.GuaranteedStop, sl, w.DealID)...)
+	}
+
+	return updates
+}
+
+// paperExpired - true once a GOOD_TILL_DATE order is past its date
+func paperExpired(w WorkingOrderData, now time.Time) bool {
+	if w.TimeInForce != TimeInForceGoodTillDate {
+		return false
+	}
+	for _, layout := range []string{paperGoodTillDateFormat, paperGoodTillDateMinutes} {
+		if t, err := time.Parse(layout, w.GoodTillDate); err == nil {
+			return now.After(t)
+		}
+	}
+	return false
+}
@@ -0,0 +1,394 @@
+package igmarkets_test
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+	"github.com/amaurybrisou/igmarkets/igmarketstest"
+)
+
+func TestPaperWatchReconnects(t *testing.T) {
+	r := newStreamRig(t)
+
+	paper := r.ig.EnablePaperTrading()
+	if paper.StreamOptions.ReconnectionTime <= 0 || paper.StreamOptions.MaxReconnection == 0 {
+		t.Fatalf("quote stream without reconnection %+v", paper.StreamOptions)
+	}
+	paper.StreamOptions.OnStateChange = func(e igmarkets.StreamStateEvent) { r.states <- e }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := paper.Watch(ctx, testEpic); err != nil {
+		t.Fatal(err)
+	}
+	r.waitForSubscription(t)
+
+	r.ls.Disconnect()
+	r.waitState(t, igmarkets.StreamReconnecting)
+	r.waitState(t, igmarkets.StreamSubscribed)
+	r.waitForSubscription(t)
+}
+
+const paperMarket = `{"instrument":{"epic":"FX","valueOfOnePip":"10.00","contractSize":"1",` +
+	`"marginFactor":5,"marginFactorUnit":"PERCENTAGE","currencies":[{"code":"USD","isDefault":true}]},` +
+	`"snapshot":{"marketStatus":"TRADEABLE","bid":100,"offer":101}}`
+
+// newPaperClient - client trading on paper the market FX quoted 100/101, one
+// point worth 10 USD
+func newPaperClient(t *testing.T) (*igmarketstest.Server, *igmarkets.IGMarkets, *igmarkets.PaperBroker) {
+	t.Helper()
+
+	srv := igmarketstest.NewServer("")
+	t.Cleanup(srv.Close)
+	srv.Mux.HandleFunc("/gateway/deal/markets/FX", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(paperMarket))
+	})
+	srv.Mux.HandleFunc("/gateway/deal/positions/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("paper order sent to IG: %s %s", r.Method, r.URL)
+	})
+	srv.Mux.HandleFunc("/gateway/deal/workingorders/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("paper working order sent to IG: %s %s", r.Method, r.URL)
+	})
+
+	ig := srv.NewClient(false)
+	paper := ig.EnablePaperTrading()
+	paper.SetQuote("FX", 100, 101)
+	return srv, ig, paper
+}
+
+func paperOrder(direction igmarkets.Direction, size float64, forceOpen bool) igmarkets.OTCOrderRequest {
+	return igmarkets.OTCOrderRequest{
+		Epic:         "FX",
+		Direction:    direction,
+		Size:         size,
+		OrderType:    igmarkets.OrderTypeMarket,
+		CurrencyCode: "USD",
+		Expiry:       "-",
+		ForceOpen:    forceOpen,
+	}
+}
+
+type paperPosition struct {
+	direction igmarkets.Direction
+	size      float64
+	level     float64
+}
+
+func paperPositions(t *testing.T, ig *igmarkets.IGMarkets) []paperPosition {
+	t.Helper()
+	positions, err := ig.GetPositions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []paperPosition
+	for _, p := range positions.Positions {
+		got = append(got, paperPosition{p.Position.Direction, p.Position.Size, p.Position.Level})
+	}
+	return got
+}
+
+func TestPaperOrderFill(t *testing.T) {
+	limitBuy := paperOrder(igmarkets.DirectionBuy, 1, true)
+	limitBuy.OrderType, limitBuy.Level = igmarkets.OrderTypeLimit, "99"
+
+	tests := []struct {
+		name      string
+		orders    []igmarkets.OTCOrderRequest
+		status    string // of the last order
+		positions []paperPosition
+		realised  float64
+	}{
+		{
+			name:      "buy at the offer",
+			orders:    []igmarkets.OTCOrderRequest{paperOrder(igmarkets.DirectionBuy, 2, true)},
+			status:    igmarkets.DealStatusAccepted,
+			positions: []paperPosition{{igmarkets.DirectionBuy, 2, 101}},
+		},
+		{
+			name:      "sell at the bid",
+			orders:    []igmarkets.OTCOrderRequest{paperOrder(igmarkets.DirectionSell, 1, true)},
+			status:    igmarkets.DealStatusAccepted,
+			positions: []paperPosition{{igmarkets.DirectionSell, 1, 100}},
+		},
+		{
+			name: "opposite order reduces the position",
+			orders: []igmarkets.OTCOrderRequest{
+				paperOrder(igmarkets.DirectionBuy, 2, true),
+				paperOrder(igmarkets.DirectionSell, 0.5, false),
+			},
+			status:    igmarkets.DealStatusAccepted,
+			positions: []paperPosition{{igmarkets.DirectionBuy, 1.5, 101}},
+			realised:  -5,
+		},
+		{
+			name: "opposite order reverses the position",
+			orders: []igmarkets.OTCOrderRequest{
+				paperOrder(igmarkets.DirectionBuy, 1, true),
+				paperOrder(igmarkets.DirectionSell, 3, false),
+			},
+			status:    igmarkets.DealStatusAccepted,
+			positions: []paperPosition{{igmarkets.DirectionSell, 2, 100}},
+			realised:  -10,
+		},
+		{
+			name: "force open keeps both positions",
+			orders: []igmarkets.OTCOrderRequest{
+				paperOrder(igmarkets.DirectionBuy, 1, true),
+				paperOrder(igmarkets.DirectionSell, 1, true),
+			},
+			status: igmarkets.DealStatusAccepted,
+			positions: []paperPosition{
+				{igmarkets.DirectionBuy, 1, 101},
+				{igmarkets.DirectionSell, 1, 100},
+			},
+		},
+		{
+			name:   "limit beyond the quote rejected",
+			orders: []igmarkets.OTCOrderRequest{limitBuy},
+			status: igmarkets.DealStatusRejected,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ig, paper := newPaperClient(t)
+
+			var ref *igmarkets.DealReference
+			for _, o := range tt.orders {
+				var err error
+				if ref, err = ig.PlaceOTCOrder(o); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c, err := ig.GetDealConfirmation(ref.DealReference)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.DealStatus != tt.status {
+				t.Errorf("deal status %s (%s), want %s", c.DealStatus, c.Reason, tt.status)
+			}
+			if got := paperPositions(t, ig); !reflect.DeepEqual(got, tt.positions) {
+				t.Errorf("positions %+v, want %+v", got, tt.positions)
+			}
+			if got := paper.RealisedProfit()["USD"]; math.Abs(got-tt.realised) > 1e-9 {
+				t.Errorf("realised %v, want %v", got, tt.realised)
+			}
+		})
+	}
+}
+
+func TestPaperStopAndLimit(t *testing.T) {
+	type quote struct{ bid, offer float64 }
+
+	tests := []struct {
+		name     string
+		order    func(o *igmarkets.OTCOrderRequest)
+		quotes   []quote
+		open     bool
+		realised float64
+	}{
+		{
+			name:   "stop not reached",
+			order:  func(o *igmarkets.OTCOrderRequest) { o.StopDistance = "5" },
+			quotes: []quote{{97, 98}},
+			open:   true,
+		},
+		{
+			name:     "stop",
+			order:    func(o *igmarkets.OTCOrderRequest) { o.StopDistance = "5" },
+			quotes:   []quote{{95, 96}},
+			realised: -60,
+		},
+		{
+			name:     "guaranteed stop closes at the stop level",
+			order:    func(o *igmarkets.OTCOrderRequest) { o.StopDistance, o.GuaranteedStop = "5", true },
+			quotes:   []quote{{90, 91}},
+			realised: -50,
+		},
+		{
+			name:     "limit",
+			order:    func(o *igmarkets.OTCOrderRequest) { o.LimitLevel = "111" },
+			quotes:   []quote{{112, 113}},
+			realised: 110,
+		},
+		{
+			name: "trailing stop follows the price",
+			order: func(o *igmarkets.OTCOrderRequest) {
+				o.StopDistance, o.TrailingStop, o.TrailingStopIncrement = "5", true, "1"
+			},
+			quotes:   []quote{{110, 111}, {104, 105}},
+			realised: 30,
+		},
+		{
+			name: "sell stop above the offer",
+			order: func(o *igmarkets.OTCOrderRequest) {
+				o.Direction, o.StopDistance = igmarkets.DirectionSell, "5"
+			},
+			quotes:   []quote{{104, 106}},
+			realised: -60,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ig, paper := newPaperClient(t)
+
+			o := paperOrder(igmarkets.DirectionBuy, 1, true)
+			tt.order(&o)
+			if _, err := ig.PlaceOTCOrderAndConfirm(context.Background(), o); err != nil {
+				t.Fatal(err)
+			}
+			for _, q := range tt.quotes {
+				paper.SetQuote("FX", q.bid, q.offer)
+			}
+
+			if open := len(paperPositions(t, ig)) > 0; open != tt.open {
+				t.Errorf("position open %v, want %v", open, tt.open)
+			}
+			if got := paper.RealisedProfit()["USD"]; math.Abs(got-tt.realised) > 1e-9 {
+				t.Errorf("realised %v, want %v", got, tt.realised)
+			}
+		})
+	}
+}
+
+func TestPaperWorkingOrder(t *testing.T) {
+	type quote struct{ bid, offer float64 }
+	order := func(direction igmarkets.Direction, orderType igmarkets.WorkingOrderType, level float64) igmarkets.OTCWorkingOrderRequest {
+		return igmarkets.OTCWorkingOrderRequest{
+			Epic:         "FX",
+			Direction:    direction,
+			Size:         1,
+			Level:        level,
+			Type:         orderType,
+			TimeInForce:  igmarkets.TimeInForceGoodTillCancelled,
+			CurrencyCode: "USD",
+			Expiry:       "-",
+			ForceOpen:    true,
+		}
+	}
+	expired := order(igmarkets.DirectionBuy, igmarkets.WorkingOrderTypeStop, 105)
+	expired.TimeInForce = igmarkets.TimeInForceGoodTillDate
+	expired.GoodTillDate = time.Now().UTC().Add(-time.Minute).Format("2006/01/02 15:04")
+	withStop := order(igmarkets.DirectionBuy, igmarkets.WorkingOrderTypeStop, 105)
+	withStop.StopDistance = "5"
+
+	tests := []struct {
+		name      string
+		order     igmarkets.OTCWorkingOrderRequest
+		status    string
+		quote     quote
+		orders    int
+		positions []paperPosition
+		stop      float64
+	}{
+		{
+			name:   "not reached",
+			order:  order(igmarkets.DirectionBuy, igmarkets.WorkingOrderTypeStop, 105),
+			status: igmarkets.DealStatusAccepted,
+			quote:  quote{102, 103},
+			orders: 1,
+		},
+		{
+			name:      "buy stop fills above",
+			order:     order(igmarkets.DirectionBuy, igmarkets.WorkingOrderTypeStop, 105),
+			status:    igmarkets.DealStatusAccepted,
+			quote:     quote{105, 106},
+			positions: []paperPosition{{igmarkets.DirectionBuy, 1, 106}},
+		},
+		{
+			name:      "buy limit fills below",
+			order:     order(igmarkets.DirectionBuy, igmarkets.WorkingOrderTypeLimit, 95),
+			status:    igmarkets.DealStatusAccepted,
+			quote:     quote{93, 94},
+			positions: []paperPosition{{igmarkets.DirectionBuy, 1, 94}},
+		},
+		{
+			name:      "sell stop fills below",
+			order:     order(igmarkets.DirectionSell, igmarkets.WorkingOrderTypeStop, 95),
+			status:    igmarkets.DealStatusAccepted,
+			quote:     quote{94, 95},
+			positions: []paperPosition{{igmarkets.DirectionSell, 1, 94}},
+		},
+		{
+			name:      "stop distance from the fill",
+			order:     withStop,
+			status:    igmarkets.DealStatusAccepted,
+			quote:     quote{105, 106},
+			positions: []paperPosition{{igmarkets.DirectionBuy, 1, 106}},
+			stop:      101,
+		},
+		{
+			name:   "wrong side of the market",
+			order:  order(igmarkets.DirectionBuy, igmarkets.WorkingOrderTypeStop, 100),
+			status: igmarkets.DealStatusRejected,
+			quote:  quote{100, 101},
+		},
+		{
+			name:   "expired",
+			order:  expired,
+			status: igmarkets.DealStatusAccepted,
+			quote:  quote{102, 103},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ig, paper := newPaperClient(t)
+
+			ref, err := ig.PlaceOTCWorkingOrder(tt.order)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := ig.GetDealConfirmation(ref.DealReference)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.DealStatus != tt.status {
+				t.Errorf("deal status %s (%s), want %s", c.DealStatus, c.Reason, tt.status)
+			}
+
+			paper.SetQuote("FX", tt.quote.bid, tt.quote.offer)
+
+			orders, err := ig.GetOTCWorkingOrders()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(orders.WorkingOrders) != tt.orders {
+				t.Errorf("%d working orders, want %d", len(orders.WorkingOrders), tt.orders)
+			}
+			if got := paperPositions(t, ig); !reflect.DeepEqual(got, tt.positions) {
+				t.Errorf("positions %+v, want %+v", got, tt.positions)
+			}
+			if tt.stop != 0 {
+				positions, _ := ig.GetPositions()
+				if stop := positions.Positions[0].Position.StopLevel; stop != tt.stop {
+					t.Errorf("stop %v, want %v", stop, tt.stop)
+				}
+			}
+		})
+	}
+}
+
+func TestPaperPositionCurrency(t *testing.T) {
+	_, ig, _ := newPaperClient(t)
+	if _, err := ig.PlaceOTCOrder(paperOrder(igmarkets.DirectionBuy, 1, true)); err != nil {
+		t.Fatal(err)
+	}
+
+	positions, _ := ig.GetPositions()
+	p := positions.Positions[0]
+	if p.Position.Currency != "USD" || p.Position.Currencry != "USD" {
+		t.Fatalf("currency %q, deprecated currency %q", p.Position.Currency, p.Position.Currencry)
+	}
+	position, err := ig.GetPosition(p.Position.DealID)
+	if err != nil || position.Position.Currencry != "USD" {
+		t.Fatalf("GetPosition: %+v %v", position, err)
+	}
+}
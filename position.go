@@ -0,0 +1,119 @@
+package igmarkets
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// UnmarshalJSON - decode p, setting the fields derived from IG's
+func (p *PositionData) UnmarshalJSON(data []byte) error {
+	type plain PositionData
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+
+	p.Currencry = p.Currency
+	p.Created = time.Time{}
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05", p.CreatedDateUTC, time.UTC); err == nil {
+		p.Created = t
+	}
+	return nil
+}
+
+// MarshalJSON - encode p, Currencry is sent when Currency is not set
+func (p PositionData) MarshalJSON() ([]byte, error) {
+	type plain PositionData
+	if p.Currency == "" {
+		p.Currency = p.Currencry
+	}
+	return json.Marshal(plain(p))
+}
+
+// UnmarshalJSON - decode m, setting the fields derived from IG's
+func (m *MarketData) UnmarshalJSON(data []byte) error {
+	type plain MarketData
+	if err := json.Unmarshal(data, (*plain)(m)); err != nil {
+		return err
+	}
+
+	m.MarektStatus = m.MarketStatus
+	return nil
+}
+
+// MarshalJSON - encode m, MarektStatus is sent when MarketStatus is not set
+func (m MarketData) MarshalJSON() ([]byte, error) {
+	type plain MarketData
+	if m.MarketStatus == "" {
+		m.MarketStatus = m.MarektStatus
+	}
+	return json.Marshal(plain(m))
+}
+
+// UpdatedAt - time of the last update of m as seen at now: UpdateTimeUTC on
+// the last day it was reached, give or take a minute, zero if it cannot be
+// parsed. IG sends no date, an update older than a day is dated within the
+// last one.
+func (m MarketData) UpdatedAt(now time.Time) time.Time {
+	c, err := time.Parse("15:04:05", m.UpdateTimeUTC)
+	if err != nil {
+		return time.Time{}
+	}
+
+	now = now.UTC()
+	t := time.Date(now.Year(), now.Month(), now.Day(), c.Hour(), c.Minute(), c.Second(), 0, time.UTC)
+	if t.After(now.Add(time.Minute)) {
+		t = t.AddDate(0, 0, -1)
+	}
+	return t
+}
+
+// UnrealisedPoints - points made by closing p at the bid for BUY and the offer
+// for SELL of its market data
+func (p Position) UnrealisedPoints() (float64, error) {
+	price := closePrice(&p, &MarketsResponse{})
+	if price == 0 {
+		return 0, fmt.Errorf("igmarkets: no price for position %s", p.Position.DealID)
+	}
+	return (price - p.Position.Level) * stopSign(p.Position.Direction), nil
+}
+
+// UnrealisedProfit - profit made by closing p, in the currency of the
+// position: UnrealisedPoints times the size and the value of one point, the
+// contract size divided by the scaling factor of the prices when set
+func (p Position) UnrealisedProfit() (float64, error) {
+	points, err := p.UnrealisedPoints()
+	if err != nil {
+		return 0, err
+	}
+	value, err := p.pointValue(nil)
+	if err != nil {
+		return 0, err
+	}
+	return points * p.Position.Size * value, nil
+}
+
+// pointValue - value of one point of size 1 of p in its currency, from the
+// instrument of market when given, from the contract size and the scaling
+// factor of p otherwise
+func (p Position) pointValue(market *MarketsResponse) (float64, error) {
+	var instrument Instrument
+	if market != nil {
+		instrument = market.Instrument
+	}
+	if instrument.ValueOfOnePip == "" && instrument.ContractSize == "" {
+		contractSize := p.Position.ContractSize
+		if contractSize == 0 {
+			contractSize = 1
+		}
+		instrument = Instrument{
+			Epic:         p.MarketData.Epic,
+			ContractSize: strconv.FormatFloat(contractSize, 'f', -1, 64),
+		}
+		if p.MarketData.ScalingFactor > 0 {
+			instrument.OnePipMeans = strconv.FormatFloat(1/float64(p.MarketData.ScalingFactor), 'f', -1, 64)
+		}
+	}
+	return valueOfOnePoint(instrument, p.Position.Currency, func(string, ...interface{}) {})
+}
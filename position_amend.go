@@ -0,0 +1,218 @@
+package igmarkets
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CheckPositionUpdate - violations of the dealing rules of market by update of
+// position. Stops and limits are checked from the price closing the position:
+// the bid for BUY positions and the offer for SELL ones.
+func CheckPositionUpdate(position *Position, update OTCUpdateOrderRequest, market *MarketsResponse) error {
+	e := &DealingRulesError{Epic: position.MarketData.Epic}
+
+	if err := update.Validate(); err != nil {
+		e.add("", "request", "%v", strings.TrimPrefix(err.Error(), "igmarkets: "))
+	}
+
+	if position.Position.ControlledRisk && !update.GuaranteedStop {
+		e.add("guaranteedStop", "controlledRisk", "the guaranteed stop of the position cannot be removed")
+	}
+
+	price := closePrice(position, market)
+	checkStopLimit(e, stopLimit{
+		direction:      position.Position.Direction,
+		price:          price,
+		stopDistance:   update.StopDistance,
+		stopLevel:      update.StopLevel,
+		limitDistance:  update.LimitDistance,
+		limitLevel:     update.LimitLevel,
+		guaranteedStop: update.GuaranteedStop,
+		trailingStop:   update.TrailingStop,
+		trailingStep:   update.TrailingStopIncrement,
+	}, market)
+
+	if update.TrailingStop && update.TrailingStopDistance != "" {
+		d, err := strconv.ParseFloat(update.TrailingStopDistance, 64)
+		if err != nil {
+			e.add("trailingStopDistance", "format", "invalid trailing stop distance %q", update.TrailingStopDistance)
+		} else {
+			rules, point := market.DealingRules, pointSize(market)
+			checkDistance(e, "trailingStopDistance", "minNormalStopOrLimitDistance", "trailing stop", d,
+				distancePoints(rules.MinNormalStopOrLimitDistance, price, point),
+				distancePoints(rules.MaxStopOrLimitDistance, price, point))
+		}
+	}
+
+	return e.err()
+}
+
+// closePrice - price closing position, from market or the position when the
+// market has no quote
+func closePrice(position *Position, market *MarketsResponse) float64 {
+	bid, offer := market.Snapshot.Bid, market.Snapshot.Offer
+	if bid == 0 || offer == 0 {
+		bid, offer = position.MarketData.Bid, position.MarketData.Offer
+	}
+	if position.Position.Direction == DirectionSell {
+		return offer
+	}
+	return bid
+}
+
+// PositionUpdateRequest - update keeping the stop and limit of position as
+// they are, the base of the amendments
+func PositionUpdateRequest(position *Position, market *MarketsResponse) OTCUpdateOrderRequest {
+	p := position.Position
+	decimals := market.Snapshot.DecimalPlacesFactor
+
+	update := OTCUpdateOrderRequest{GuaranteedStop: p.ControlledRisk}
+	if p.StopLevel != 0 {
+		update.StopLevel = formatLevel(p.StopLevel, decimals)
+	}
+	if p.LimitLevel != 0 {
+		update.LimitLevel = formatLevel(p.LimitLevel, decimals)
+	}
+	if p.TrailingStopDistance != 0 {
+		update.TrailingStop = true
+		update.TrailingStopDistance = formatDistance(p.TrailingStopDistance, market)
+		update.TrailingStopIncrement = formatDistance(p.TrailingStep, market)
+	}
+	return update
+}
+
+// formatLevel - v with decimals digits, as short as possible when negative
+func formatLevel(v float64, decimals float64) string {
+	if decimals < 0 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'f', int(decimals), 64)
+}
+
+// formatDistance - v points with the decimals of a point of market: those of
+// its prices less the digits of its scaling factor
+func formatDistance(v float64, market *MarketsResponse) string {
+	decimals := market.Snapshot.DecimalPlacesFactor - math.Round(math.Log10(1/pointSize(market)))
+	if decimals < 0 {
+		decimals = 0
+	}
+	return formatLevel(v, decimals)
+}
+
+// stopSign - 1 when the stop of a position of direction d is below its price
+func stopSign(d Direction) float64 {
+	if d == DirectionSell {
+		return -1
+	}
+	return 1
+}
+
+// AmendPosition - update the position dealID with the request returned by
+// amend, checked against the position and its market before it is sent
+func (ig *IGMarkets) AmendPosition(ctx context.Context, dealID string,
+	amend func(position *Position, market *MarketsResponse) (OTCUpdateOrderRequest, error)) (*OTCDealConfirmation, error) {
+	position, err := ig.GetPosition(dealID)
+	if err != nil {
+		return nil, err
+	}
+	market, err := ig.GetMarkets(position.MarketData.Epic)
+	if err != nil {
+		return nil, err
+	}
+
+	update, err := amend(position, market)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckPositionUpdate(position, update, market); err != nil {
+		return nil, err
+	}
+
+	return ig.UpdateOTCOrderAndConfirm(ctx, dealID, update)
+}
+
+// MoveStopToBreakeven - stop at the opening level of the position plus offset
+// points in its favour. A stop already beyond that level is not loosened.
+func (ig *IGMarkets) MoveStopToBreakeven(ctx context.Context, dealID string, offset float64) (*OTCDealConfirmation, error) {
+	return ig.AmendPosition(ctx, dealID, func(position *Position, market *MarketsResponse) (OTCUpdateOrderRequest, error) {
+		p := position.Position
+		sign := stopSign(p.Direction)
+		stop := p.Level + offset*pointSize(market)*sign
+
+		if p.StopLevel != 0 && (p.StopLevel-stop)*sign >= 0 {
+			return OTCUpdateOrderRequest{}, fmt.Errorf("igmarkets: stop %g of %s is already at or beyond %g", p.StopLevel, p.DealID, stop)
+		}
+
+		update := PositionUpdateRequest(position, market)
+		update.StopLevel = formatLevel(stop, market.Snapshot.DecimalPlacesFactor)
+		return update, nil
+	})
+}
+
+// SetTrailingStop - trailing stop distance points away from the current price,
+// moving by increment points
+func (ig *IGMarkets) SetTrailingStop(ctx context.Context, dealID string, distance, increment float64) (*OTCDealConfirmation, error) {
+	return ig.AmendPosition(ctx, dealID, func(position *Position, market *MarketsResponse) (OTCUpdateOrderRequest, error) {
+		stop := closePrice(position, market) - distance*pointSize(market)*stopSign(position.Position.Direction)
+
+		update := PositionUpdateRequest(position, market)
+		update.StopLevel = formatLevel(stop, market.Snapshot.DecimalPlacesFactor)
+		update.TrailingStop = true
+		update.TrailingStopDistance = formatDistance(distance, market)
+		update.TrailingStopIncrement = formatDistance(increment, market)
+		return update, nil
+	})
+}
+
+// SetStopATR - stop multiple times atr away from the current price, atr in
+// price as ATR returns it. A trailing stop keeps trailing at that distance.
+func (ig *IGMarkets) SetStopATR(ctx context.Context, dealID string, atr, multiple float64) (*OTCDealConfirmation, error) {
+	if atr <= 0 || multiple <= 0 {
+		return nil, fmt.Errorf("igmarkets: ATR and multiple must be positive")
+	}
+	distance := atr * multiple
+
+	return ig.AmendPosition(ctx, dealID, func(position *Position, market *MarketsResponse) (OTCUpdateOrderRequest, error) {
+		stop := closePrice(position, market) - distance*stopSign(position.Position.Direction)
+
+		update := PositionUpdateRequest(position, market)
+		update.StopLevel = formatLevel(stop, market.Snapshot.DecimalPlacesFactor)
+		if update.TrailingStop {
+			update.TrailingStopDistance = formatDistance(distance/pointSize(market), market)
+		}
+		return update, nil
+	})
+}
+
+// RemoveStop - remove the stop of the position, trailing or not
+func (ig *IGMarkets) RemoveStop(ctx context.Context, dealID string) (*OTCDealConfirmation, error) {
+	return ig.AmendPosition(ctx, dealID, func(position *Position, market *MarketsResponse) (OTCUpdateOrderRequest, error) {
+		if position.Position.StopLevel == 0 {
+			return OTCUpdateOrderRequest{}, fmt.Errorf("igmarkets: position %s has no stop", dealID)
+		}
+
+		update := PositionUpdateRequest(position, market)
+		update.StopLevel = ""
+		update.GuaranteedStop = false
+		update.TrailingStop = false
+		update.TrailingStopDistance = ""
+		update.TrailingStopIncrement = ""
+		return update, nil
+	})
+}
+
+// RemoveLimit - remove the limit of the position
+func (ig *IGMarkets) RemoveLimit(ctx context.Context, dealID string) (*OTCDealConfirmation, error) {
+	return ig.AmendPosition(ctx, dealID, func(position *Position, market *MarketsResponse) (OTCUpdateOrderRequest, error) {
+		if position.Position.LimitLevel == 0 {
+			return OTCUpdateOrderRequest{}, fmt.Errorf("igmarkets: position %s has no limit", dealID)
+		}
+
+		update := PositionUpdateRequest(position, market)
+		update.LimitLevel = ""
+		return update, nil
+	})
+}
@@ -0,0 +1,209 @@
+package igmarkets_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/amaurybrisou/igmarkets"
+	"github.com/amaurybrisou/igmarkets/igmarketstest"
+)
+
+func TestAmendPosition(t *testing.T) {
+	// EUR/USD quoted 1.10500/1.10520, 10000 points to a unit of price
+	market := igmarkets.MarketsResponse{
+		DealingRules: igmarkets.DealingRules{
+			TrailingStopsPreference:      "AVAILABLE",
+			MinNormalStopOrLimitDistance: igmarkets.UnitValueFloat{Unit: igmarkets.UnitPoints, Value: 5},
+			MinStepDistance:              igmarkets.UnitValueFloat{Unit: igmarkets.UnitPoints, Value: 1},
+		},
+		Instrument: igmarkets.Instrument{Epic: "FX"},
+		Snapshot: igmarkets.Snapshot{
+			MarketStatus: "TRADEABLE", Bid: 1.105, Offer: 1.1052, ScalingFactor: 10000, DecimalPlacesFactor: 5,
+		},
+	}
+	position := func(set func(p *igmarkets.PositionData)) igmarkets.Position {
+		p := igmarkets.Position{
+			MarketData: igmarkets.MarketData{Epic: "FX"},
+			Position: igmarkets.PositionData{
+				DealID: "DIAAA", Direction: igmarkets.DirectionBuy, Size: 1, Level: 1.1, Currency: "USD",
+			},
+		}
+		if set != nil {
+			set(&p.Position)
+		}
+		return p
+	}
+	trailing := func(p *igmarkets.PositionData) {
+		p.StopLevel, p.TrailingStopDistance, p.TrailingStep = 1.103, 20.000000001, 5
+	}
+
+	tests := []struct {
+		name     string
+		position igmarkets.Position
+		amend    func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error)
+		want     *igmarkets.OTCUpdateOrderRequest // nil when nothing is sent
+	}{
+		{
+			name:     "breakeven offset in points",
+			position: position(func(p *igmarkets.PositionData) { p.StopLevel, p.LimitLevel = 1.099, 1.12 }),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.MoveStopToBreakeven(ctx, "DIAAA", 2)
+			},
+			want: &igmarkets.OTCUpdateOrderRequest{StopLevel: "1.10020", LimitLevel: "1.12000"},
+		},
+		{
+			name:     "breakeven behind the stop",
+			position: position(func(p *igmarkets.PositionData) { p.StopLevel = 1.1003 }),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.MoveStopToBreakeven(ctx, "DIAAA", 2)
+			},
+		},
+		{
+			name:     "trailing stop in points",
+			position: position(nil),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.SetTrailingStop(ctx, "DIAAA", 20, 5)
+			},
+			want: &igmarkets.OTCUpdateOrderRequest{
+				StopLevel: "1.10300", TrailingStop: true, TrailingStopDistance: "20.0", TrailingStopIncrement: "5.0",
+			},
+		},
+		{
+			name:     "trailing stop too close",
+			position: position(nil),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.SetTrailingStop(ctx, "DIAAA", 3, 1)
+			},
+		},
+		{
+			name:     "ATR stop keeps trailing",
+			position: position(trailing),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.SetStopATR(ctx, "DIAAA", 0.001, 2)
+			},
+			want: &igmarkets.OTCUpdateOrderRequest{
+				StopLevel: "1.10300", TrailingStop: true, TrailingStopDistance: "20.0", TrailingStopIncrement: "5.0",
+			},
+		},
+		{
+			name:     "no ATR",
+			position: position(nil),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.SetStopATR(ctx, "DIAAA", 0, 2)
+			},
+		},
+		{
+			name:     "no limit to remove",
+			position: position(trailing),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.RemoveLimit(ctx, "DIAAA")
+			},
+		},
+		{
+			name:     "remove the limit",
+			position: position(func(p *igmarkets.PositionData) { trailing(p); p.LimitLevel = 1.12 }),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.RemoveLimit(ctx, "DIAAA")
+			},
+			want: &igmarkets.OTCUpdateOrderRequest{
+				StopLevel: "1.10300", TrailingStop: true, TrailingStopDistance: "20.0", TrailingStopIncrement: "5.0",
+			},
+		},
+		{
+			name:     "remove the stop",
+			position: position(trailing),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.RemoveStop(ctx, "DIAAA")
+			},
+			want: &igmarkets.OTCUpdateOrderRequest{},
+		},
+		{
+			name:     "no stop to remove",
+			position: position(nil),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.RemoveStop(ctx, "DIAAA")
+			},
+		},
+		{
+			name:     "unknown position",
+			position: position(func(p *igmarkets.PositionData) { p.DealID = "DIBBB" }),
+			amend: func(ctx context.Context, ig *igmarkets.IGMarkets) (*igmarkets.OTCDealConfirmation, error) {
+				return ig.RemoveLimit(ctx, "DIAAA")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := igmarketstest.NewServer("")
+			defer srv.Close()
+
+			srv.Mux.HandleFunc("/gateway/deal/positions/", func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/gateway/deal/positions/"+tt.position.Position.DealID {
+					http.Error(w, `{"errorCode":"error.position.notfound"}`, http.StatusNotFound)
+					return
+				}
+				json.NewEncoder(w).Encode(tt.position)
+			})
+			srv.Mux.HandleFunc("/gateway/deal/markets/FX", func(w http.ResponseWriter, req *http.Request) {
+				json.NewEncoder(w).Encode(market)
+			})
+			var sent *igmarkets.OTCUpdateOrderRequest
+			srv.Mux.HandleFunc("/gateway/deal/positions/otc/DIAAA", func(w http.ResponseWriter, req *http.Request) {
+				sent = &igmarkets.OTCUpdateOrderRequest{}
+				if err := json.NewDecoder(req.Body).Decode(sent); err != nil {
+					t.Error(err)
+				}
+				w.Write([]byte(`{"dealReference":"REF1"}`))
+			})
+			srv.Mux.HandleFunc("/gateway/deal/confirms/REF1", func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"dealReference":"REF1","dealId":"DIAAA","dealStatus":"ACCEPTED","status":"AMENDED"}`))
+			})
+
+			_, err := tt.amend(context.Background(), srv.NewClient(false))
+			if (err != nil) != (tt.want == nil) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(sent, tt.want) {
+				t.Fatalf("update %+v, want %+v", sent, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPositionUpdateTrailingDistance(t *testing.T) {
+	rules := igmarkets.DealingRules{
+		TrailingStopsPreference:      "AVAILABLE",
+		MinNormalStopOrLimitDistance: igmarkets.UnitValueFloat{Unit: igmarkets.UnitPoints, Value: 5},
+		MaxStopOrLimitDistance:       igmarkets.UnitValueFloat{Unit: igmarkets.UnitPercentage, Value: 1},
+	}
+	fx := rulesMarket(1.1, 1.1002, 10000, rules)
+	var position igmarkets.Position
+	position.MarketData.Epic = "EPIC"
+	position.Position.Direction = igmarkets.DirectionBuy
+
+	tests := []struct {
+		name     string
+		distance string
+		want     []string
+	}{
+		{"within the rules", "20", nil},
+		{"too close", "4", []string{"trailingStopDistance/minNormalStopOrLimitDistance"}},
+		{"over 1% in points", "111", []string{"trailingStopDistance/maxStopOrLimitDistance"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := igmarkets.OTCUpdateOrderRequest{
+				StopLevel: "1.098", TrailingStop: true, TrailingStopDistance: tt.distance, TrailingStopIncrement: "5",
+			}
+			got := violations(t, igmarkets.CheckPositionUpdate(&position, update, fx))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("violations %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package igmarkets
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// DefaultCloseConcurrency - closes in flight at once when not given
+const DefaultCloseConcurrency = 4
+
+// PositionClose - outcome of the close of one position
+type PositionClose struct {
+	DealID       string               `json:"dealId"`
+	Epic         string               `json:"epic"`
+	Direction    Direction            `json:"direction"` // direction of the position
+	Size         float64              `json:"size"`      // size closed
+	Confirmation *OTCDealConfirmation `json:"confirmation,omitempty"`
+	Err          error                `json:"-"`
+}
+
+// PositionCloseRequest - market order closing size of position, the whole
+// position when size is 0
+func PositionCloseRequest(position Position, size float64) (OTCPositionCloseRequest, error) {
+	p := position.Position
+	if size == 0 {
+		size = p.Size
+	}
+	if size <= 0 || size > p.Size {
+		return OTCPositionCloseRequest{}, fmt.Errorf("igmarkets: cannot close %g of position %s of size %g", size, p.DealID, p.Size)
+	}
+
+	return OTCPositionCloseRequest{
+		DealID:    p.DealID,
+		Direction: p.Direction.Opposite(),
+		OrderType: OrderTypeMarket,
+		Size:      size,
+	}, nil
+}
+
+// ClosePosition - close size of the position dealID at market, the whole
+// position when size is 0
+func (ig *IGMarkets) ClosePosition(ctx context.Context, dealID string, size float64) (*OTCDealConfirmation, error) {
+	positions, err := ig.GetPositions()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, position := range positions.Positions {
+		if position.Position.DealID != dealID {
+			continue
+		}
+		close, err := PositionCloseRequest(position, size)
+		if err != nil {
+			return nil, err
+		}
+		return ig.CloseOTCPositionAndConfirm(ctx, close)
+	}
+
+	return nil, fmt.Errorf("igmarkets: no open position %s", dealID)
+}
+
+// ClosePositions - close the positions on epic, of any expiry when expiry is
+// empty, long and short ones alike. See CloseAllPositions.
+func (ig *IGMarkets) ClosePositions(ctx context.Context, epic, expiry string, concurrency int) ([]PositionClose, error) {
+	return ig.closePositionsWhere(ctx, concurrency, func(p Position) bool {
+		return p.MarketData.Epic == epic && (expiry == "" || p.MarketData.Expiry == expiry)
+	})
+}
+
+// CloseAllPositions - flatten the account, closing every position at market
+// with at most concurrency closes in flight (DefaultCloseConcurrency when 0).
+// The outcome of each close is returned, the error tells how many failed.
+func (ig *IGMarkets) CloseAllPositions(ctx context.Context, concurrency int) ([]PositionClose, error) {
+	return ig.closePositionsWhere(ctx, concurrency, func(Position) bool { return true })
+}
+
+func (ig *IGMarkets) closePositionsWhere(ctx context.Context, concurrency int, match func(Position) bool) ([]PositionClose, error) {
+	positions, err := ig.GetPositions()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []Position
+	for _, p := range positions.Positions {
+		if match(p) {
+			selected = append(selected, p)
+		}
+	}
+
+	results := ig.closePositions(ctx, selected, concurrency)
+
+	failed := 0
+	var firstErr error
+	for _, r := range results {
+		if r.Err != nil {
+			if failed == 0 {
+				firstErr = r.Err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("igmarkets: %d of %d positions not closed: %v", failed, len(results), firstErr)
+	}
+	return results, nil
+}
+
+// closePositions - close positions, at most concurrency at once
+func (ig *IGMarkets) closePositions(ctx context.Context, positions []Position, concurrency int) []PositionClose {
+	if concurrency <= 0 {
+		concurrency = DefaultCloseConcurrency
+	}
+
+	results := make([]PositionClose, len(positions))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, position := range positions {
+		p := position.Position
+		results[i] = PositionClose{
+			DealID:    p.DealID,
+			Epic:      position.MarketData.Epic,
+			Direction: p.Direction,
+			Size:      p.Size,
+		}
+
+		// no close is sent once ctx is done, even with room in flight
+		if err := ctx.Err(); err != nil {
+			results[i].Err = err
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(r *PositionClose, position Position) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			close, err := PositionCloseRequest(position, 0)
+			if err != nil {
+				r.Err = err
+				return
+			}
+			r.Confirmation, r.Err = ig.CloseOTCPositionAndConfirm(ctx, close)
+		}(&results[i], position)
+	}
+
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,245 @@
+package igmarkets_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/amaurybrisou/igmarkets"
+	"github.com/amaurybrisou/igmarkets/igmarketstest"
+)
+
+// closeRig - IG stand-in with two positions on FX and one on INDEX
+type closeRig struct {
+	srv *igmarketstest.Server
+	ig  *igmarkets.IGMarkets
+
+	mu        sync.Mutex
+	closes    []igmarkets.OTCPositionCloseRequest
+	confirms  int
+	refused   string // deal ID whose close is refused
+	rejected  string // deal ID whose close is rejected
+	positions []igmarkets.Position
+}
+
+func newCloseRig(t *testing.T) *closeRig {
+	t.Helper()
+
+	r := &closeRig{srv: igmarketstest.NewServer("")}
+	t.Cleanup(r.srv.Close)
+	for i, p := range []struct {
+		epic      string
+		direction igmarkets.Direction
+		size      float64
+	}{
+		{"FX", igmarkets.DirectionBuy, 1},
+		{"FX", igmarkets.DirectionSell, 2},
+		{"INDEX", igmarkets.DirectionBuy, 3},
+	} {
+		var position igmarkets.Position
+		position.MarketData.Epic, position.MarketData.Expiry = p.epic, "-"
+		position.Position.DealID = fmt.Sprintf("DI%d", i)
+		position.Position.Direction, position.Position.Size = p.direction, p.size
+		r.positions = append(r.positions, position)
+	}
+
+	r.srv.Mux.HandleFunc("/gateway/deal/positions/", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(igmarkets.PositionsResponse{Positions: r.positions})
+	})
+	r.srv.Mux.HandleFunc("/gateway/deal/positions/otc", func(w http.ResponseWriter, req *http.Request) {
+		var close igmarkets.OTCPositionCloseRequest
+		if err := json.NewDecoder(req.Body).Decode(&close); err != nil {
+			t.Error(err)
+		}
+		if req.Header.Get("_method") != http.MethodDelete {
+			t.Errorf("close sent without the DELETE method override")
+		}
+		r.mu.Lock()
+		r.closes = append(r.closes, close)
+		refused := close.DealID == r.refused
+		r.mu.Unlock()
+		if refused {
+			http.Error(w, `{"errorCode":"error.service.marketdata.position.notional.details.null.error"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"dealReference":"REF-%s"}`, close.DealID)
+	})
+	r.srv.Mux.HandleFunc("/gateway/deal/confirms/", func(w http.ResponseWriter, req *http.Request) {
+		ref := req.URL.Path[len("/gateway/deal/confirms/"):]
+		dealID := ref[len("REF-"):]
+		r.mu.Lock()
+		r.confirms++
+		status := igmarkets.DealStatusAccepted
+		if dealID == r.rejected {
+			status = igmarkets.DealStatusRejected
+		}
+		r.mu.Unlock()
+		fmt.Fprintf(w, `{"dealReference":%q,"dealId":%q,"dealStatus":%q,"reason":"UNKNOWN"}`, ref, dealID, status)
+	})
+
+	r.ig = r.srv.NewClient(false)
+	return r
+}
+
+// closed - deal ID and size of the closes sent, by deal ID
+func (r *closeRig) closed() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var closed []string
+	for _, c := range r.closes {
+		closed = append(closed, fmt.Sprintf("%s %s %g", c.DealID, c.Direction, c.Size))
+	}
+	sort.Strings(closed)
+	return closed
+}
+
+func TestClosePosition(t *testing.T) {
+	tests := []struct {
+		name   string
+		dealID string
+		size   float64
+		closed []string
+		err    bool
+	}{
+		{"whole position", "DI1", 0, []string{"DI1 BUY 2"}, false},
+		{"partial close", "DI1", 0.5, []string{"DI1 BUY 0.5"}, false},
+		{"more than the position", "DI1", 3, nil, true},
+		{"unknown position", "DI9", 0, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCloseRig(t)
+			_, err := r.ig.ClosePosition(context.Background(), tt.dealID, tt.size)
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got := r.closed(); fmt.Sprint(got) != fmt.Sprint(tt.closed) {
+				t.Fatalf("closes %v, want %v", got, tt.closed)
+			}
+		})
+	}
+}
+
+func TestClosePositions(t *testing.T) {
+	all := []string{"DI0 SELL 1", "DI1 BUY 2", "DI2 SELL 3"}
+
+	tests := []struct {
+		name     string
+		close    func(ctx context.Context, ig *igmarkets.IGMarkets) ([]igmarkets.PositionClose, error)
+		refused  string
+		rejected string
+		cancel   bool
+		closed   []string
+		failed   []string
+	}{
+		{
+			name: "by epic",
+			close: func(ctx context.Context, ig *igmarkets.IGMarkets) ([]igmarkets.PositionClose, error) {
+				return ig.ClosePositions(ctx, "FX", "", 0)
+			},
+			closed: []string{"DI0 SELL 1", "DI1 BUY 2"},
+		},
+		{
+			name: "by epic and expiry",
+			close: func(ctx context.Context, ig *igmarkets.IGMarkets) ([]igmarkets.PositionClose, error) {
+				return ig.ClosePositions(ctx, "FX", "DEC-30", 0)
+			},
+		},
+		{
+			name: "all",
+			close: func(ctx context.Context, ig *igmarkets.IGMarkets) ([]igmarkets.PositionClose, error) {
+				return ig.CloseAllPositions(ctx, 1)
+			},
+			closed: all,
+		},
+		{
+			name: "refused close",
+			close: func(ctx context.Context, ig *igmarkets.IGMarkets) ([]igmarkets.PositionClose, error) {
+				return ig.CloseAllPositions(ctx, 0)
+			},
+			refused: "DI1",
+			closed:  all,
+			failed:  []string{"DI1"},
+		},
+		{
+			name: "rejected close",
+			close: func(ctx context.Context, ig *igmarkets.IGMarkets) ([]igmarkets.PositionClose, error) {
+				return ig.CloseAllPositions(ctx, 0)
+			},
+			rejected: "DI2",
+			closed:   all,
+			failed:   []string{"DI2"},
+		},
+		{
+			name: "cancelled",
+			close: func(ctx context.Context, ig *igmarkets.IGMarkets) ([]igmarkets.PositionClose, error) {
+				return ig.CloseAllPositions(ctx, 1)
+			},
+			cancel: true,
+			failed: []string{"DI0", "DI1", "DI2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCloseRig(t)
+			r.refused, r.rejected = tt.refused, tt.rejected
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			results, err := tt.close(ctx, r.ig)
+			if (err != nil) != (len(tt.failed) > 0) {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			var failed []string
+			for _, res := range results {
+				if res.Err != nil {
+					failed = append(failed, res.DealID)
+				}
+			}
+			if fmt.Sprint(failed) != fmt.Sprint(tt.failed) {
+				t.Fatalf("failed closes %v, want %v", failed, tt.failed)
+			}
+			if got := r.closed(); fmt.Sprint(got) != fmt.Sprint(tt.closed) {
+				t.Fatalf("closes %v, want %v", got, tt.closed)
+			}
+		})
+	}
+}
+
+func TestDeletePositionsOTC(t *testing.T) {
+	tests := []struct {
+		name    string
+		refused string
+		err     bool
+	}{
+		{"all sent", "", false},
+		{"one refused", "DI0", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCloseRig(t)
+			r.refused = tt.refused
+
+			if err := r.ig.DeletePositionsOTC(); (err != nil) != tt.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got := r.closed(); len(got) != 3 {
+				t.Fatalf("closes %v, want the 3 positions", got)
+			}
+			if r.confirms != 0 {
+				t.Fatalf("%d confirmations awaited", r.confirms)
+			}
+		})
+	}
+}
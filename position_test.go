@@ -0,0 +1,105 @@
+package igmarkets
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestUnrealisedProfit(t *testing.T) {
+	position := func(direction Direction, level, contractSize float64, scalingFactor int) Position {
+		var p Position
+		p.MarketData.Epic = "CS.D.EURUSD.CFD.IP"
+		p.MarketData.Bid, p.MarketData.Offer = 11010, 11011
+		p.MarketData.ScalingFactor = scalingFactor
+		p.Position.Currency = "USD"
+		p.Position.Direction = direction
+		p.Position.Level = level
+		p.Position.Size = 2
+		p.Position.ContractSize = contractSize
+		return p
+	}
+
+	tests := []struct {
+		name     string
+		position Position
+		want     float64
+	}{
+		{"contract size over scaling factor", position(DirectionBuy, 11000, 100000, 10000), 200},
+		{"sell at the offer", position(DirectionSell, 11000, 100000, 10000), -220},
+		{"contract size alone", position(DirectionBuy, 11000, 1, 0), 20},
+		{"no contract size", position(DirectionBuy, 11005, 0, 0), 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.position.UnrealisedProfit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// the position, the risk guard and the paper broker value a point alike
+func TestProfitValuesOnePointAlike(t *testing.T) {
+	var p Position
+	p.MarketData.Epic = "CS.D.EURUSD.CFD.IP"
+	p.MarketData.Bid, p.MarketData.Offer = 11010, 11011
+	p.MarketData.ScalingFactor = 10000
+	p.Position.Currency = "USD"
+	p.Position.Direction = DirectionBuy
+	p.Position.Level = 11000
+	p.Position.Size = 2
+	p.Position.ContractSize = 100000
+
+	market := &MarketsResponse{}
+	market.Instrument.Epic = p.MarketData.Epic
+	market.Instrument.ContractSize = "100000"
+	market.Instrument.OnePipMeans = "0.0001 USD/EUR"
+	market.Instrument.Currencies = []Currency{{Code: "USD", IsDefault: true}}
+
+	position, err := p.UnrealisedProfit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard, err := positionProfit(market, p, "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &PaperBroker{positions: []Position{p}, realised: make(map[string]float64)}
+	paper, _, _ := b.closePosition(0, p.Position.Size, p.MarketData.Bid, market)
+
+	if math.Abs(position-200) > 1e-9 || math.Abs(guard-200) > 1e-9 || math.Abs(paper-200) > 1e-9 {
+		t.Fatalf("position %v, risk guard %v, paper %v, want 200", position, guard, paper)
+	}
+}
+
+func TestMarketDataUpdatedAt(t *testing.T) {
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		clock string
+		now   time.Time
+		want  time.Time
+	}{
+		{"earlier today", "09:30:15", now, time.Date(2026, 3, 2, 9, 30, 15, 0, time.UTC)},
+		{"clock ahead of now", "10:00:30", now, time.Date(2026, 3, 2, 10, 0, 30, 0, time.UTC)},
+		{"yesterday", "23:59:00", now, time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC)},
+		{"now outside UTC", "01:30:00", now.Add(-8 * time.Hour).In(time.FixedZone("EST", -5*3600)), time.Date(2026, 3, 2, 1, 30, 0, 0, time.UTC)},
+		{"not a clock", "", now, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := MarketData{UpdateTimeUTC: tt.clock}
+			if got := m.UpdatedAt(tt.now); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
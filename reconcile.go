@@ -0,0 +1,492 @@
+package igmarkets
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultReconcileInterval - period of Reconciler.Run when not set
+const DefaultReconcileInterval = time.Minute
+
+// ReconcilePolicy - what a Reconciler does about the discrepancies it finds
+type ReconcilePolicy string
+
+const (
+	// ReconcileReportOnly - only report the discrepancies
+	ReconcileReportOnly ReconcilePolicy = "REPORT"
+	// ReconcileAdopt - take the state of IG as the expected one
+	ReconcileAdopt ReconcilePolicy = "ADOPT"
+	// ReconcileCloseUnexpected - close the unexpected positions of Tag,
+	// report the other discrepancies. Positions opened less than an Interval
+	// ago or with the reference of an expected deal, e.g. a working order
+	// just filled, are kept until the next reconciliation. Tag is required.
+	ReconcileCloseUnexpected ReconcilePolicy = "CLOSE_UNEXPECTED"
+)
+
+// DiscrepancyKind - how a position or working order differs from the
+// expected one
+type DiscrepancyKind string
+
+const (
+	// DiscrepancyMissing - expected but not on IG
+	DiscrepancyMissing DiscrepancyKind = "MISSING"
+	// DiscrepancyUnexpected - on IG but not expected
+	DiscrepancyUnexpected DiscrepancyKind = "UNEXPECTED"
+	// DiscrepancySize - of another size or direction
+	DiscrepancySize DiscrepancyKind = "SIZE_MISMATCH"
+	// DiscrepancyStopLimit - with another stop or limit
+	DiscrepancyStopLimit DiscrepancyKind = "STOP_LIMIT_MISMATCH"
+)
+
+// ExpectedPosition - position or working order a bot believes it holds,
+// identified by its deal ID or, until it is known, by its deal reference
+type ExpectedPosition struct {
+	DealID        string    `json:"dealId,omitempty"`
+	DealReference string    `json:"dealReference,omitempty"`
+	Epic          string    `json:"epic"`
+	Direction     Direction `json:"direction"`
+	Size          float64   `json:"size"`
+	// StopLevel, LimitLevel - 0 for none
+	StopLevel  float64 `json:"stopLevel"`
+	LimitLevel float64 `json:"limitLevel"`
+
+	// WorkingOrder - a working order at Level, matched by DealID only as IG
+	// does not return the reference of working orders
+	WorkingOrder bool    `json:"workingOrder,omitempty"`
+	Level        float64 `json:"level,omitempty"`
+}
+
+// Discrepancy - difference between the expected state and IG
+type Discrepancy struct {
+	Kind         DiscrepancyKind   `json:"kind"`
+	Expected     *ExpectedPosition `json:"expected,omitempty"`
+	Position     *Position         `json:"position,omitempty"`
+	WorkingOrder *OTCWorkingOrder  `json:"workingOrder,omitempty"`
+	Detail       string            `json:"detail"`
+
+	// Action - what the policy did: "ADOPTED" or "CLOSED", empty when only
+	// reported
+	Action string `json:"action,omitempty"`
+	Err    error  `json:"-"`
+}
+
+// ReconcileReport - outcome of a reconciliation
+type ReconcileReport struct {
+	Time          time.Time     `json:"time"`
+	Positions     int           `json:"positions"`     // on IG
+	WorkingOrders int           `json:"workingOrders"` // on IG
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+// Reconciler - compares the positions and working orders a bot expects with
+// GetPositions and GetOTCWorkingOrders and applies Policy to the differences
+type Reconciler struct {
+	Policy   ReconcilePolicy
+	Interval time.Duration
+	// Tag - deal reference prefix of the deals of the bot, the positions of
+	// other deals are not reported as unexpected. Working orders have no
+	// reference, with a tag unexpected ones are only reported on the epics of
+	// the expected state.
+	Tag string
+	// LevelTolerance - largest difference of stop and limit levels ignored
+	LevelTolerance float64
+
+	// OnDiscrepancy - called for each discrepancy once Policy is applied
+	OnDiscrepancy func(Discrepancy)
+	// OnReconcile - called with the report of each reconciliation of Run
+	OnReconcile func(ReconcileReport)
+
+	ig       *IGMarkets
+	mu       sync.Mutex
+	expected []*ExpectedPosition
+}
+
+// NewReconciler - reconciler of the positions of ig, reporting only
+func NewReconciler(ig *IGMarkets) *Reconciler {
+	return &Reconciler{
+		Policy:   ReconcileReportOnly,
+		Interval: DefaultReconcileInterval,
+		ig:       ig,
+	}
+}
+
+// Expect - add p to the expected state, replacing the position of the same
+// deal ID or deal reference
+func (r *Reconciler) Expect(p ExpectedPosition) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if i := r.find(p.DealID, p.DealReference); i >= 0 {
+		r.expected[i] = &p
+		return
+	}
+	r.expected = append(r.expected, &p)
+}
+
+// Forget - remove the position of deal ID or deal reference id from the
+// expected state
+func (r *Reconciler) Forget(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if i := r.find(id, id); i >= 0 {
+		r.expected = append(r.expected[:i], r.expected[i+1:]...)
+	}
+}
+
+// Expected - the expected state
+func (r *Reconciler) Expected() []ExpectedPosition {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expected := make([]ExpectedPosition, len(r.expected))
+	for i, p := range r.expected {
+		expected[i] = *p
+	}
+	return expected
+}
+
+// find - index of the expected position of dealID or dealRef, -1 if none
+func (r *Reconciler) find(dealID, dealRef string) int {
+	for i, p := range r.expected {
+		if (dealID != "" && p.DealID == dealID) || (dealRef != "" && p.DealReference == dealRef) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Run - reconcile every Interval until ctx is done
+func (r *Reconciler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+
+	for {
+		report, err := r.Reconcile(ctx)
+		if err != nil {
+			log.WithError(err).Warn("igmarkets : reconciliation failed")
+		} else if r.OnReconcile != nil {
+			r.OnReconcile(*report)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reconciler) interval() time.Duration {
+	if r.Interval > 0 {
+		return r.Interval
+	}
+	return DefaultReconcileInterval
+}
+
+// Reconcile - compare the expected state with IG once and apply Policy
+func (r *Reconciler) Reconcile(ctx context.Context) (*ReconcileReport, error) {
+	if r.Policy == ReconcileCloseUnexpected && r.Tag == "" {
+		return nil, fmt.Errorf("igmarkets: reconciler tag is required to close unexpected positions")
+	}
+
+	positions, err := r.ig.GetPositions()
+	if err != nil {
+		return nil, err
+	}
+	orders, err := r.ig.GetOTCWorkingOrders()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{
+		Time:          time.Now(),
+		Positions:     len(positions.Positions),
+		WorkingOrders: len(orders.WorkingOrders),
+	}
+
+	r.mu.Lock()
+	report.Discrepancies = r.compare(positions.Positions, orders.WorkingOrders)
+	r.mu.Unlock()
+
+	for i := range report.Discrepancies {
+		d := &report.Discrepancies[i]
+		r.apply(ctx, d)
+		if d.Err != nil {
+			log.WithError(d.Err).Warnf("igmarkets : cannot reconcile %s discrepancy", d.Kind)
+		}
+		if r.OnDiscrepancy != nil {
+			r.OnDiscrepancy(*d)
+		}
+	}
+
+	return report, nil
+}
+
+// compare - discrepancies between the expected state and IG, the deal IDs
+// of the positions found by reference are learnt
+func (r *Reconciler) compare(positions []Position, orders []OTCWorkingOrder) []Discrepancy {
+	var discrepancies []Discrepancy
+	matchedPositions := make([]bool, len(positions))
+	matchedOrders := make([]bool, len(orders))
+
+	for _, e := range r.expected {
+		expected := *e
+
+		if e.WorkingOrder {
+			i := -1
+			for j, o := range orders {
+				if !matchedOrders[j] && e.DealID != "" && o.WorkingOrderData.DealID == e.DealID {
+					i = j
+					break
+				}
+			}
+			if i < 0 {
+				discrepancies = append(discrepancies, Discrepancy{
+					Kind:     DiscrepancyMissing,
+					Expected: &expected,
+					Detail:   fmt.Sprintf("working order %s not found", e.DealID),
+				})
+				continue
+			}
+			matchedOrders[i] = true
+			o := orders[i]
+			discrepancies = append(discrepancies, r.compareWorkingOrder(expected, o)...)
+			continue
+		}
+
+		i := -1
+		for j, p := range positions {
+			if matchedPositions[j] {
+				continue
+			}
+			if (e.DealID != "" && p.Position.DealID == e.DealID) ||
+				(e.DealID == "" && e.DealReference != "" && p.Position.DealReference == e.DealReference) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			id := e.DealID
+			if id == "" {
+				id = e.DealReference
+			}
+			discrepancies = append(discrepancies, Discrepancy{
+				Kind:     DiscrepancyMissing,
+				Expected: &expected,
+				Detail:   fmt.Sprintf("position %s not found", id),
+			})
+			continue
+		}
+		matchedPositions[i] = true
+		if e.DealID == "" {
+			e.DealID = positions[i].Position.DealID
+			expected.DealID = e.DealID
+		}
+		discrepancies = append(discrepancies, r.comparePosition(expected, positions[i])...)
+	}
+
+	for i, p := range positions {
+		if matchedPositions[i] || (r.Tag != "" && !strings.HasPrefix(p.Position.DealReference, r.Tag)) {
+			continue
+		}
+		position := p
+		discrepancies = append(discrepancies, Discrepancy{
+			Kind:     DiscrepancyUnexpected,
+			Position: &position,
+			Detail: fmt.Sprintf("position %s %s %g on %s not expected",
+				p.Position.DealID, p.Position.Direction, p.Position.Size, p.MarketData.Epic),
+		})
+	}
+
+	// the working orders of other deals are left out with a tag, as far as
+	// their epic tells
+	epics := make(map[string]bool)
+	for _, e := range r.expected {
+		epics[e.Epic] = true
+	}
+	for i, o := range orders {
+		if matchedOrders[i] || (r.Tag != "" && !epics[o.WorkingOrderData.Epic]) {
+			continue
+		}
+		order := o
+		w := o.WorkingOrderData
+		discrepancies = append(discrepancies, Discrepancy{
+			Kind:         DiscrepancyUnexpected,
+			WorkingOrder: &order,
+			Detail: fmt.Sprintf("working order %s %s %g on %s at %g not expected",
+				w.DealID, w.Direction, w.OrderSize, w.Epic, w.OrderLevel),
+		})
+	}
+
+	return discrepancies
+}
+
+func (r *Reconciler) comparePosition(e ExpectedPosition, p Position) []Discrepancy {
+	var discrepancies []Discrepancy
+	position := p.Position
+
+	if position.Direction != e.Direction || !r.equal(position.Size, e.Size) {
+		discrepancies = append(discrepancies, Discrepancy{
+			Kind:     DiscrepancySize,
+			Expected: &e,
+			Position: &p,
+			Detail: fmt.Sprintf("position %s is %s %g, expected %s %g",
+				position.DealID, position.Direction, position.Size, e.Direction, e.Size),
+		})
+	}
+	if !r.equal(position.StopLevel, e.StopLevel) || !r.equal(position.LimitLevel, e.LimitLevel) {
+		discrepancies = append(discrepancies, Discrepancy{
+			Kind:     DiscrepancyStopLimit,
+			Expected: &e,
+			Position: &p,
+			Detail: fmt.Sprintf("position %s has stop %g and limit %g, expected %g and %g",
+				position.DealID, position.StopLevel, position.LimitLevel, e.StopLevel, e.LimitLevel),
+		})
+	}
+	return discrepancies
+}
+
+func (r *Reconciler) compareWorkingOrder(e ExpectedPosition, o OTCWorkingOrder) []Discrepancy {
+	var discrepancies []Discrepancy
+	w := o.WorkingOrderData
+
+	if w.Direction != e.Direction || !r.equal(w.OrderSize, e.Size) || !r.equal(w.OrderLevel, e.Level) {
+		discrepancies = append(discrepancies, Discrepancy{
+			Kind:         DiscrepancySize,
+			Expected:     &e,
+			WorkingOrder: &o,
+			Detail: fmt.Sprintf("working order %s is %s %g at %g, expected %s %g at %g",
+				w.DealID, w.Direction, w.OrderSize, w.OrderLevel, e.Direction, e.Size, e.Level),
+		})
+	}
+
+	stop, limit := 0.0, 0.0
+	if e.StopLevel != 0 {
+		stop = math.Abs(e.Level - e.StopLevel)
+	}
+	if e.LimitLevel != 0 {
+		limit = math.Abs(e.LimitLevel - e.Level)
+	}
+	if !r.equal(w.StopDistance, stop) || !r.equal(w.LimitDistance, limit) {
+		discrepancies = append(discrepancies, Discrepancy{
+			Kind:         DiscrepancyStopLimit,
+			Expected:     &e,
+			WorkingOrder: &o,
+			Detail: fmt.Sprintf("working order %s has stop distance %g and limit distance %g, expected %g and %g",
+				w.DealID, w.StopDistance, w.LimitDistance, stop, limit),
+		})
+	}
+	return discrepancies
+}
+
+// equal - true if a and b differ by at most LevelTolerance
+func (r *Reconciler) equal(a, b float64) bool {
+	return math.Abs(a-b) <= r.LevelTolerance+1e-9
+}
+
+// apply - carry out Policy for d
+func (r *Reconciler) apply(ctx context.Context, d *Discrepancy) {
+	switch r.Policy {
+	case ReconcileAdopt:
+		r.adopt(d)
+		d.Action = "ADOPTED"
+	case ReconcileCloseUnexpected:
+		if d.Kind != DiscrepancyUnexpected || d.Position == nil {
+			return
+		}
+		if reason := r.pending(*d.Position, time.Now()); reason != "" {
+			d.Detail += ", kept as " + reason
+			return
+		}
+		close, err := PositionCloseRequest(*d.Position, 0)
+		if err == nil {
+			_, err = r.ig.CloseOTCPositionAndConfirm(ctx, close)
+		}
+		d.Action, d.Err = "CLOSED", err
+	}
+}
+
+// pending - why p may be a deal of the bot the expected state does not know
+// yet, empty if it can be closed
+func (r *Reconciler) pending(p Position, now time.Time) string {
+	created := p.Position.Created
+	if created.IsZero() {
+		return "its creation time is unknown"
+	}
+	if now.Sub(created) < r.interval() {
+		return "it was opened less than an interval ago"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.expected {
+		if e.DealReference != "" && e.DealReference == p.Position.DealReference {
+			return "its reference " + e.DealReference + " is expected"
+		}
+	}
+	return ""
+}
+
+// adopt - make the expected state agree with IG for d
+func (r *Reconciler) adopt(d *Discrepancy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if d.Kind == DiscrepancyMissing {
+		if i := r.find(d.Expected.DealID, d.Expected.DealReference); i >= 0 {
+			r.expected = append(r.expected[:i], r.expected[i+1:]...)
+		}
+		return
+	}
+
+	var actual ExpectedPosition
+	switch {
+	case d.Position != nil:
+		p := d.Position.Position
+		actual = ExpectedPosition{
+			DealID:        p.DealID,
+			DealReference: p.DealReference,
+			Epic:          d.Position.MarketData.Epic,
+			Direction:     p.Direction,
+			Size:          p.Size,
+			StopLevel:     p.StopLevel,
+			LimitLevel:    p.LimitLevel,
+		}
+	case d.WorkingOrder != nil:
+		w := d.WorkingOrder.WorkingOrderData
+		actual = ExpectedPosition{
+			DealID:       w.DealID,
+			Epic:         w.Epic,
+			Direction:    w.Direction,
+			Size:         w.OrderSize,
+			WorkingOrder: true,
+			Level:        w.OrderLevel,
+		}
+		sign := stopSign(w.Direction)
+		if w.StopDistance != 0 {
+			actual.StopLevel = w.OrderLevel - w.StopDistance*sign
+		}
+		if w.LimitDistance != 0 {
+			actual.LimitLevel = w.OrderLevel + w.LimitDistance*sign
+		}
+	default:
+		return
+	}
+
+	i := r.find(actual.DealID, "")
+	if i < 0 {
+		r.expected = append(r.expected, &actual)
+		return
+	}
+	if actual.DealReference == "" {
+		actual.DealReference = r.expected[i].DealReference
+	}
+	r.expected[i] = &actual
+}
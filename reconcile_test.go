@@ -0,0 +1,154 @@
+package igmarkets_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+)
+
+func TestReconcileCloseUnexpected(t *testing.T) {
+	tests := []struct {
+		name     string
+		ref      string // of the position on IG
+		interval time.Duration
+		expect   *igmarkets.ExpectedPosition
+		action   string
+		open     bool
+	}{
+		{
+			name:     "old position of the tag closed",
+			ref:      "BOT-1",
+			interval: time.Nanosecond,
+			action:   "CLOSED",
+		},
+		{
+			name:     "position opened within the interval kept",
+			ref:      "BOT-1",
+			interval: time.Hour,
+			open:     true,
+		},
+		{
+			name:     "position of an expected reference kept",
+			ref:      "BOT-1",
+			interval: time.Nanosecond,
+			expect: &igmarkets.ExpectedPosition{
+				DealID: "WO1", DealReference: "BOT-1", Epic: "FX", Direction: igmarkets.DirectionBuy,
+				Size: 1, WorkingOrder: true, Level: 100,
+			},
+			open: true,
+		},
+		{
+			name:     "position of another tag ignored",
+			ref:      "MANUAL-1",
+			interval: time.Nanosecond,
+			open:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ig, _ := newPaperClient(t)
+			order := paperOrder(igmarkets.DirectionBuy, 1, true)
+			order.DealReference = tt.ref
+			if _, err := ig.PlaceOTCOrder(order); err != nil {
+				t.Fatal(err)
+			}
+
+			r := igmarkets.NewReconciler(ig)
+			r.Policy = igmarkets.ReconcileCloseUnexpected
+			r.Tag = "BOT-"
+			r.Interval = tt.interval
+			if tt.expect != nil {
+				r.Expect(*tt.expect)
+			}
+
+			report, err := r.Reconcile(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range report.Discrepancies {
+				if d.Kind == igmarkets.DiscrepancyUnexpected && d.Action != tt.action {
+					t.Errorf("action %q on %s, want %q", d.Action, d.Detail, tt.action)
+				}
+			}
+
+			positions, _ := ig.GetPositions()
+			if open := len(positions.Positions) > 0; open != tt.open {
+				t.Errorf("position open %v, want %v", open, tt.open)
+			}
+		})
+	}
+}
+
+func TestReconcileCloseUnexpectedRequiresTag(t *testing.T) {
+	_, ig, _ := newPaperClient(t)
+	if _, err := ig.PlaceOTCOrder(paperOrder(igmarkets.DirectionBuy, 1, true)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := igmarkets.NewReconciler(ig)
+	r.Policy = igmarkets.ReconcileCloseUnexpected
+	r.Interval = time.Nanosecond
+	if _, err := r.Reconcile(context.Background()); err == nil {
+		t.Fatal("reconciled without a tag")
+	}
+
+	positions, _ := ig.GetPositions()
+	if len(positions.Positions) != 1 {
+		t.Fatal("position closed without a tag")
+	}
+}
+
+func TestReconcileUnexpectedWorkingOrdersWithTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		tag      string
+		epic     string // of the expected position
+		reported bool
+	}{
+		{"no tag", "", "OTHER", true},
+		{"epic of the bot", "BOT-", "FX", true},
+		{"other epic", "BOT-", "OTHER", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ig, _ := newPaperClient(t)
+			if _, err := ig.PlaceOTCWorkingOrder(igmarkets.OTCWorkingOrderRequest{
+				Epic:         "FX",
+				Direction:    igmarkets.DirectionBuy,
+				Type:         igmarkets.WorkingOrderTypeLimit,
+				Level:        90,
+				Size:         1,
+				TimeInForce:  igmarkets.TimeInForceGoodTillCancelled,
+				CurrencyCode: "USD",
+				Expiry:       "-",
+				ForceOpen:    true,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			r := igmarkets.NewReconciler(ig)
+			r.Tag = tt.tag
+			r.Expect(igmarkets.ExpectedPosition{
+				DealReference: "BOT-1", Epic: tt.epic, Direction: igmarkets.DirectionBuy, Size: 1,
+			})
+
+			report, err := r.Reconcile(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			reported := false
+			for _, d := range report.Discrepancies {
+				if d.Kind == igmarkets.DiscrepancyUnexpected && d.WorkingOrder != nil {
+					reported = true
+				}
+			}
+			if reported != tt.reported {
+				t.Fatalf("working order reported %v, want %v in %+v", reported, tt.reported, report.Discrepancies)
+			}
+		})
+	}
+}
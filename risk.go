@@ -0,0 +1,852 @@
+package igmarkets
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRiskCheckInterval - age after which the daily loss and the kill file
+// of a RiskGuard are checked again when not set
+const DefaultRiskCheckInterval = 30 * time.Second
+
+// RiskLimits - limits of a RiskGuard, zero values disable a limit
+type RiskLimits struct {
+	// MaxSizePerEpic - largest net size held on an epic, positions and the
+	// order included
+	MaxSizePerEpic float64
+	// MaxExposure - largest gross notional of the positions and the order in
+	// the account currency, see GetExposure
+	MaxExposure      float64
+	MaxOpenPositions int
+	// MaxOrdersPerMinute - orders and working orders placed in the last minute
+	MaxOrdersPerMinute int
+	// MaxDailyLoss - realised loss of the day plus the unrealised loss of the
+	// open positions, in the account currency, that trips the guard
+	MaxDailyLoss float64
+	// AllowedEpics - epics new risk may be taken on, any epic when empty
+	AllowedEpics []string
+
+	// KillFile - the guard trips while this file exists
+	KillFile string
+	// FlattenOnTrip - close the positions and delete the working orders when
+	// the guard trips
+	FlattenOnTrip bool
+
+	// CheckInterval - DefaultRiskCheckInterval when 0
+	CheckInterval time.Duration
+	// Location - the day of MaxDailyLoss starts at midnight there, local time
+	// when nil
+	Location *time.Location
+}
+
+// RiskError - an order was blocked by the RiskGuard
+type RiskError struct {
+	Rule   string // e.g. "maxOpenPositions" or "tripped"
+	Reason string
+}
+
+func (e *RiskError) Error() string {
+	return fmt.Sprintf("igmarkets: order blocked by risk guard (%s): %s", e.Rule, e.Reason)
+}
+
+// IsRiskBlocked - true if err is a RiskError
+func IsRiskBlocked(err error) bool {
+	_, ok := err.(*RiskError)
+	return ok
+}
+
+// RiskStatus - state of a RiskGuard
+type RiskStatus struct {
+	Tripped   bool      `json:"tripped"`
+	Reason    string    `json:"reason,omitempty"`
+	TrippedAt time.Time `json:"trippedAt,omitempty"`
+
+	// RealisedProfit, UnrealisedProfit - of the day, in the account
+	// currency, as of CheckedAt when MaxDailyLoss is set
+	RealisedProfit   float64   `json:"realisedProfit"`
+	UnrealisedProfit float64   `json:"unrealisedProfit"`
+	CheckedAt        time.Time `json:"checkedAt,omitempty"`
+
+	OrdersLastMinute int `json:"ordersLastMinute"`
+
+	// Flatten - closes made when the guard tripped
+	Flatten []PositionClose `json:"flatten,omitempty"`
+}
+
+// RiskGuard - limits enforced on every order sent by an IGMarkets, see
+// EnableRiskGuard. Orders taking new risk are checked against the limits,
+// closes and orders reducing a position always go through. Once tripped by
+// Trip, the kill file or the daily loss, no new risk is taken until Reset.
+type RiskGuard struct {
+	Limits RiskLimits
+	// OnTrip - called once each time the guard trips
+	OnTrip func(RiskStatus)
+
+	ig         *IGMarkets
+	orderMu    sync.Mutex // held from the check of an order to its submission
+	mu         sync.Mutex
+	status     RiskStatus
+	orders     []time.Time
+	pending    []reservation
+	currencies map[string]Currency // last rates seen, by code
+}
+
+// NewRiskGuard - guard of the orders of ig
+func NewRiskGuard(ig *IGMarkets, limits RiskLimits) *RiskGuard {
+	return &RiskGuard{Limits: limits, ig: ig}
+}
+
+// EnableRiskGuard - check every order of ig against limits
+func (ig *IGMarkets) EnableRiskGuard(limits RiskLimits) *RiskGuard {
+	g := NewRiskGuard(ig, limits)
+
+	ig.Lock()
+	ig.guard = g
+	ig.Unlock()
+
+	return g
+}
+
+// DisableRiskGuard - send the orders of ig unchecked
+func (ig *IGMarkets) DisableRiskGuard() {
+	ig.Lock()
+	ig.guard = nil
+	ig.Unlock()
+}
+
+// riskGuard - guard of the orders, nil when disabled
+func (ig *IGMarkets) riskGuard() *RiskGuard {
+	ig.RLock()
+	defer ig.RUnlock()
+	return ig.guard
+}
+
+// Status - current state of the guard
+func (g *RiskGuard) Status() RiskStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s := g.status
+	s.OrdersLastMinute = g.recentOrders(time.Now())
+	return s
+}
+
+// Trip - block new risk for reason, flattening the account when
+// Limits.FlattenOnTrip is set. A tripped guard keeps its first reason.
+func (g *RiskGuard) Trip(reason string) error {
+	g.mu.Lock()
+	if g.status.Tripped {
+		g.mu.Unlock()
+		return nil
+	}
+	g.status.Tripped = true
+	g.status.Reason = reason
+	g.status.TrippedAt = time.Now()
+	g.status.Flatten = nil
+	flatten := g.Limits.FlattenOnTrip
+	g.mu.Unlock()
+
+	log.WithField("reason", reason).Warn("igmarkets : risk guard tripped")
+
+	var err error
+	if flatten {
+		err = g.flatten()
+	}
+
+	if g.OnTrip != nil {
+		g.OnTrip(g.Status())
+	}
+	return err
+}
+
+// Reset - take new risk again, the kill file must be removed first
+func (g *RiskGuard) Reset() error {
+	if g.killFilePresent() {
+		return fmt.Errorf("igmarkets: kill file %s still present", g.Limits.KillFile)
+	}
+
+	g.mu.Lock()
+	g.status.Tripped = false
+	g.status.Reason = ""
+	g.status.TrippedAt = time.Time{}
+	g.status.Flatten = nil
+	g.mu.Unlock()
+	return nil
+}
+
+// Run - check the kill file and the daily loss every CheckInterval until ctx
+// is done, so the guard trips without waiting for the next order
+func (g *RiskGuard) Run(ctx context.Context) error {
+	ticker := time.NewTicker(g.interval())
+	defer ticker.Stop()
+
+	for {
+		if err := g.Check(); err != nil && !IsRiskBlocked(err) {
+			log.WithError(err).Warn("igmarkets : risk guard check failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check - trip the guard if the kill file exists or the daily loss is over
+// MaxDailyLoss, a RiskError is returned when the guard is tripped
+func (g *RiskGuard) Check() error {
+	if g.killFilePresent() {
+		if err := g.Trip("kill file " + g.Limits.KillFile + " present"); err != nil {
+			log.WithError(err).Error("igmarkets : risk guard cannot flatten")
+		}
+	}
+
+	if g.Limits.MaxDailyLoss > 0 {
+		realised, unrealised, err := g.dailyProfit()
+		if err != nil {
+			return err
+		}
+
+		g.mu.Lock()
+		g.status.RealisedProfit = realised
+		g.status.UnrealisedProfit = unrealised
+		g.mu.Unlock()
+
+		if loss := -(realised + unrealised); loss >= g.Limits.MaxDailyLoss {
+			reason := fmt.Sprintf("daily loss %.2f over %.2f (realised %.2f, unrealised %.2f)",
+				loss, g.Limits.MaxDailyLoss, realised, unrealised)
+			if err := g.Trip(reason); err != nil {
+				log.WithError(err).Error("igmarkets : risk guard cannot flatten")
+			}
+		}
+	}
+
+	g.mu.Lock()
+	g.status.CheckedAt = time.Now()
+	g.mu.Unlock()
+
+	return g.tripped()
+}
+
+// tripped - RiskError of a tripped guard, nil otherwise
+func (g *RiskGuard) tripped() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.status.Tripped {
+		return &RiskError{Rule: "tripped", Reason: g.status.Reason}
+	}
+	return nil
+}
+
+// checkStale - Check when the last one is older than CheckInterval, the
+// tripped state otherwise
+func (g *RiskGuard) checkStale() error {
+	g.mu.Lock()
+	stale := time.Since(g.status.CheckedAt) >= g.interval()
+	g.mu.Unlock()
+
+	if stale || g.killFilePresent() {
+		return g.Check()
+	}
+	return g.tripped()
+}
+
+func (g *RiskGuard) interval() time.Duration {
+	if g.Limits.CheckInterval > 0 {
+		return g.Limits.CheckInterval
+	}
+	return DefaultRiskCheckInterval
+}
+
+func (g *RiskGuard) killFilePresent() bool {
+	if g.Limits.KillFile == "" {
+		return false
+	}
+	_, err := os.Stat(g.Limits.KillFile)
+	return err == nil
+}
+
+// recentOrders - orders placed in the minute before now
+func (g *RiskGuard) recentOrders(now time.Time) int {
+	i := 0
+	for i < len(g.orders) && now.Sub(g.orders[i]) >= time.Minute {
+		i++
+	}
+	g.orders = g.orders[i:]
+	return len(g.orders)
+}
+
+// riskReservationTTL - time an order let through by the guard is counted
+// against the limits when it neither shows in the positions nor is confirmed
+const riskReservationTTL = time.Minute
+
+// reservation - order of new risk let through by the guard, counted against
+// the limits until it shows in the positions, is confirmed or expires
+type reservation struct {
+	ref      string
+	epic     string
+	size     float64 // positive to buy
+	notional float64
+	expires  time.Time
+}
+
+// admit - check an order of new risk and hold the other orders until done is
+// called with the outcome of its submission. An order sent, or that may have
+// reached IG, is reserved under ref.
+func (g *RiskGuard) admit(ref, epic string, direction Direction, size float64, forceOpen bool, currency string, notional func(accountCurrency string) (float64, error)) (done func(err error), err error) {
+	g.orderMu.Lock()
+	r, err := g.checkOrder(epic, direction, size, forceOpen, currency, notional)
+	if err != nil {
+		g.orderMu.Unlock()
+		return nil, err
+	}
+
+	return func(err error) {
+		defer g.orderMu.Unlock()
+		if r == nil || (err != nil && !ambiguousSubmission(err)) {
+			return
+		}
+		r.ref = ref
+		r.expires = time.Now().Add(riskReservationTTL)
+
+		g.mu.Lock()
+		g.pending = append(g.pending, *r)
+		g.mu.Unlock()
+	}, nil
+}
+
+// settle - stop counting the order ref, it is confirmed
+func (g *RiskGuard) settle(ref string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, r := range g.pending {
+		if r.ref == ref {
+			g.pending = append(g.pending[:i], g.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// reservations - orders still in flight, the ones showing in positions or
+// expired are dropped
+func (g *RiskGuard) reservations(positions *PositionsResponse, now time.Time) []reservation {
+	open := make(map[string]bool)
+	for _, p := range positions.Positions {
+		open[p.Position.DealReference] = true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	pending := g.pending[:0]
+	for _, r := range g.pending {
+		if !open[r.ref] && now.Before(r.expires) {
+			pending = append(pending, r)
+		}
+	}
+	g.pending = pending
+	return append([]reservation(nil), pending...)
+}
+
+// checkOrder - error if an order of size on epic in currency breaks a limit,
+// counting the orders in flight. reducing orders only close positions, are
+// not checked and get no reservation.
+func (g *RiskGuard) checkOrder(epic string, direction Direction, size float64, forceOpen bool, currency string, notional func(accountCurrency string) (float64, error)) (*reservation, error) {
+	positions, err := g.ig.GetPositions()
+	if err != nil {
+		return nil, fmt.Errorf("igmarkets: risk guard cannot get positions: %v", err)
+	}
+
+	if !forceOpen {
+		opposite := 0.0
+		for _, p := range positions.Positions {
+			if p.MarketData.Epic == epic && p.Position.Direction == direction.Opposite() {
+				opposite += p.Position.Size
+			}
+		}
+		if size <= opposite {
+			return nil, nil
+		}
+	}
+
+	if err := g.checkStale(); err != nil {
+		return nil, err
+	}
+
+	if len(g.Limits.AllowedEpics) > 0 {
+		allowed := false
+		for _, e := range g.Limits.AllowedEpics {
+			allowed = allowed || e == epic
+		}
+		if !allowed {
+			return nil, &RiskError{Rule: "allowedEpics", Reason: epic + " is not allowed"}
+		}
+	}
+
+	pending := g.reservations(positions, time.Now())
+	r := &reservation{epic: epic, size: size * stopSign(direction)}
+
+	if max := g.Limits.MaxOpenPositions; max > 0 && len(positions.Positions)+len(pending)+1 > max {
+		return nil, &RiskError{Rule: "maxOpenPositions", Reason: fmt.Sprintf("%d positions open and %d in flight, at most %d", len(positions.Positions), len(pending), max)}
+	}
+
+	if max := g.Limits.MaxSizePerEpic; max > 0 {
+		net := r.size
+		for _, p := range positions.Positions {
+			if p.MarketData.Epic == epic {
+				net += p.Position.Size * stopSign(p.Position.Direction)
+			}
+		}
+		for _, p := range pending {
+			if p.epic == epic {
+				net += p.size
+			}
+		}
+		if math.Abs(net) > max {
+			return nil, &RiskError{Rule: "maxSizePerEpic", Reason: fmt.Sprintf("net size %g on %s, at most %g", net, epic, max)}
+		}
+	}
+
+	if max := g.Limits.MaxExposure; max > 0 {
+		account, err := g.ig.currentAccount()
+		if err != nil {
+			return nil, fmt.Errorf("igmarkets: risk guard cannot get the account: %v", err)
+		}
+		exposure, err := g.ig.GetExposure()
+		if err != nil {
+			return nil, fmt.Errorf("igmarkets: risk guard cannot get exposure: %v", err)
+		}
+		if r.notional, err = notional(account.Currency); err != nil {
+			return nil, fmt.Errorf("igmarkets: risk guard cannot value the order: %v", err)
+		}
+		total := exposure.GrossNotional + r.notional
+		for _, p := range pending {
+			total += p.notional
+		}
+		if total > max {
+			return nil, &RiskError{Rule: "maxExposure", Reason: fmt.Sprintf("exposure %.2f %s, at most %.2f", total, account.Currency, max)}
+		}
+	}
+
+	// the rate of the deal is needed once it is closed
+	if g.Limits.MaxDailyLoss > 0 && !g.seenCurrency(currency) {
+		if _, err := g.market(epic); err != nil {
+			return nil, fmt.Errorf("igmarkets: risk guard cannot get market %s: %v", epic, err)
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if max := g.Limits.MaxOrdersPerMinute; max > 0 && g.recentOrders(now) >= max {
+		return nil, &RiskError{Rule: "maxOrdersPerMinute", Reason: fmt.Sprintf("%d orders in the last minute, at most %d", len(g.orders), max)}
+	}
+	g.orders = append(g.orders, now)
+
+	return r, nil
+}
+
+// orderNotional - notional of order, in accountCurrency
+func (g *RiskGuard) orderNotional(order OTCOrderRequest) func(accountCurrency string) (float64, error) {
+	return func(accountCurrency string) (float64, error) {
+		market, err := g.market(order.Epic)
+		if err != nil {
+			return 0, err
+		}
+		e, err := EstimateOrderMargin(market, order, accountCurrency)
+		if err != nil {
+			return 0, err
+		}
+		return e.Notional, nil
+	}
+}
+
+// workingOrderNotional - notional of order, in accountCurrency
+func (g *RiskGuard) workingOrderNotional(order OTCWorkingOrderRequest) func(accountCurrency string) (float64, error) {
+	return func(accountCurrency string) (float64, error) {
+		market, err := g.market(order.Epic)
+		if err != nil {
+			return 0, err
+		}
+		e, err := EstimateWorkingOrderMargin(market, order, accountCurrency)
+		if err != nil {
+			return 0, err
+		}
+		return e.Notional, nil
+	}
+}
+
+// CheckOrder - error if order takes new risk the guard does not allow
+func (g *RiskGuard) CheckOrder(order OTCOrderRequest) error {
+	g.orderMu.Lock()
+	defer g.orderMu.Unlock()
+
+	_, err := g.checkOrder(order.Epic, order.Direction, order.Size, order.ForceOpen, order.CurrencyCode, g.orderNotional(order))
+	return err
+}
+
+// CheckWorkingOrder - error if order takes new risk the guard does not allow,
+// working orders are always new risk
+func (g *RiskGuard) CheckWorkingOrder(order OTCWorkingOrderRequest) error {
+	g.orderMu.Lock()
+	defer g.orderMu.Unlock()
+
+	_, err := g.checkOrder(order.Epic, order.Direction, order.Size, true, order.CurrencyCode, g.workingOrderNotional(order))
+	return err
+}
+
+// admitOrder - admit for order, see admit
+func (g *RiskGuard) admitOrder(order OTCOrderRequest) (func(err error), error) {
+	return g.admit(order.DealReference, order.Epic, order.Direction, order.Size, order.ForceOpen, order.CurrencyCode, g.orderNotional(order))
+}
+
+// admitWorkingOrder - admit for order, see admit
+func (g *RiskGuard) admitWorkingOrder(order OTCWorkingOrderRequest) (func(err error), error) {
+	return g.admit(order.DealReference, order.Epic, order.Direction, order.Size, true, order.CurrencyCode, g.workingOrderNotional(order))
+}
+
+// CheckUpdate - error if update of the position dealID adds risk while the
+// guard is tripped. A tripped guard lets through the updates tightening the
+// stop and any change of the limit, not the ones removing or loosening the
+// stop or its guarantee.
+func (g *RiskGuard) CheckUpdate(dealID string, update OTCUpdateOrderRequest) error {
+	tripped := g.tripped()
+	if tripped == nil {
+		return nil
+	}
+
+	position, err := g.ig.GetPosition(dealID)
+	if err != nil {
+		return fmt.Errorf("igmarkets: risk guard cannot get position %s: %v", dealID, err)
+	}
+	market, err := g.market(position.MarketData.Epic)
+	if err != nil {
+		return fmt.Errorf("igmarkets: risk guard cannot get market %s: %v", position.MarketData.Epic, err)
+	}
+
+	return blockedUpdate(tripped, loosenedStop(position, update, market))
+}
+
+// CheckWorkingOrderUpdate - error if update of the working order dealID adds
+// risk while the guard is tripped. A tripped guard lets through the updates
+// keeping the level and type of the order and not loosening its stop.
+func (g *RiskGuard) CheckWorkingOrderUpdate(dealID string, update OTCWorkingOrderUpdateRequest) error {
+	tripped := g.tripped()
+	if tripped == nil {
+		return nil
+	}
+
+	orders, err := g.ig.GetOTCWorkingOrders()
+	if err != nil {
+		return fmt.Errorf("igmarkets: risk guard cannot get working orders: %v", err)
+	}
+	for _, o := range orders.WorkingOrders {
+		if o.WorkingOrderData.DealID != dealID {
+			continue
+		}
+		market, err := g.market(o.WorkingOrderData.Epic)
+		if err != nil {
+			return fmt.Errorf("igmarkets: risk guard cannot get market %s: %v", o.WorkingOrderData.Epic, err)
+		}
+		return blockedUpdate(tripped, loosenedWorkingOrder(o.WorkingOrderData, update, market))
+	}
+	return blockedUpdate(tripped, "working order "+dealID+" not found")
+}
+
+// blockedUpdate - tripped with the reason an update adds risk, nil without
+// reason
+func blockedUpdate(tripped error, reason string) error {
+	if reason == "" {
+		return nil
+	}
+	e := *tripped.(*RiskError)
+	e.Reason += ", " + reason
+	return &e
+}
+
+// loosenedStop - why update adds risk to position, "" if it does not
+func loosenedStop(position *Position, update OTCUpdateOrderRequest, market *MarketsResponse) string {
+	p := position.Position
+	sign := stopSign(p.Direction)
+
+	if p.ControlledRisk && !update.GuaranteedStop {
+		return "the stop cannot lose its guarantee"
+	}
+
+	var stop float64
+	switch {
+	case update.StopLevel != "":
+		l, err := strconv.ParseFloat(update.StopLevel, 64)
+		if err != nil {
+			return fmt.Sprintf("invalid stop level %q", update.StopLevel)
+		}
+		stop = l
+	case update.StopDistance != "" || (update.TrailingStop && update.TrailingStopDistance != ""):
+		dist := update.StopDistance
+		if dist == "" {
+			dist = update.TrailingStopDistance
+		}
+		d, err := strconv.ParseFloat(dist, 64)
+		if err != nil {
+			return fmt.Sprintf("invalid stop distance %q", dist)
+		}
+		stop = closePrice(position, market) - d*sign*pointSize(market)
+	}
+
+	switch {
+	case stop == 0 && p.StopLevel != 0:
+		return "the stop cannot be removed"
+	case stop != 0 && p.StopLevel != 0 && (stop-p.StopLevel)*sign < 0:
+		return fmt.Sprintf("the stop cannot move away from %g to %g", p.StopLevel, stop)
+	}
+
+	if update.TrailingStop && p.TrailingStopDistance > 0 {
+		d, err := strconv.ParseFloat(update.TrailingStopDistance, 64)
+		if err != nil || d > p.TrailingStopDistance {
+			return fmt.Sprintf("the trailing stop distance cannot grow from %g to %q", p.TrailingStopDistance, update.TrailingStopDistance)
+		}
+	}
+	return ""
+}
+
+// loosenedWorkingOrder - why update adds risk to the working order o, "" if
+// it does not
+func loosenedWorkingOrder(o WorkingOrderData, update OTCWorkingOrderUpdateRequest, market *MarketsResponse) string {
+	if update.Level != o.OrderLevel || update.Type != o.OrderType {
+		return "the level and type of a working order cannot change"
+	}
+	if o.GuaranteedStop && !update.GuaranteedStop {
+		return "the stop cannot lose its guarantee"
+	}
+
+	var stop float64
+	switch {
+	case update.StopDistance != "":
+		d, err := strconv.ParseFloat(update.StopDistance, 64)
+		if err != nil {
+			return fmt.Sprintf("invalid stop distance %q", update.StopDistance)
+		}
+		stop = d
+	case update.StopLevel != "":
+		l, err := strconv.ParseFloat(update.StopLevel, 64)
+		if err != nil {
+			return fmt.Sprintf("invalid stop level %q", update.StopLevel)
+		}
+		stop = math.Round((o.OrderLevel-l)*stopSign(o.Direction)/pointSize(market)*1e6) / 1e6
+	}
+
+	switch {
+	case stop == 0 && o.StopDistance != 0:
+		return "the stop cannot be removed"
+	case o.StopDistance != 0 && stop > o.StopDistance:
+		return fmt.Sprintf("the stop distance cannot grow from %g to %g", o.StopDistance, stop)
+	}
+	return ""
+}
+
+// dailyProfit - profit of the deals closed since midnight and of the open
+// positions at the current prices, in the account currency. Deals closed in
+// another currency are converted with the last rates of the markets the guard
+// got, an error is returned when none gives the rate.
+func (g *RiskGuard) dailyProfit() (realised, unrealised float64, err error) {
+	loc := g.Limits.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	now := time.Now().In(loc)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	account, err := g.ig.currentAccount()
+	if err != nil {
+		return 0, 0, fmt.Errorf("igmarkets: risk guard cannot get the account: %v", err)
+	}
+	positions, err := g.ig.GetPositions()
+	if err != nil {
+		return 0, 0, fmt.Errorf("igmarkets: risk guard cannot get positions: %v", err)
+	}
+
+	markets := make(map[string]*MarketsResponse)
+	for _, position := range positions.Positions {
+		epic := position.MarketData.Epic
+		market, ok := markets[epic]
+		if !ok {
+			if market, err = g.market(epic); err != nil {
+				return 0, 0, fmt.Errorf("igmarkets: risk guard cannot get market %s: %v", epic, err)
+			}
+			markets[epic] = market
+		}
+
+		p, err := positionProfit(market, position, account.Currency)
+		if err != nil {
+			return 0, 0, err
+		}
+		unrealised += p
+	}
+
+	transactions, err := g.ig.GetTransactions("ALL_DEAL", midnight.UTC())
+	if err != nil {
+		return 0, 0, fmt.Errorf("igmarkets: risk guard cannot get transactions: %v", err)
+	}
+	for _, t := range transactions.Transactions {
+		p, err := parseProfitAndLoss(t.ProfitAndLoss)
+		if err != nil {
+			return 0, 0, err
+		}
+		rate, err := transactionExchangeRate(t, account.Currency, g.seenCurrencies())
+		if err != nil {
+			return 0, 0, err
+		}
+		realised += p * rate
+	}
+
+	return realised, unrealised, nil
+}
+
+// market - market of epic, its currency rates are kept for the deals closed
+// later
+func (g *RiskGuard) market(epic string) (*MarketsResponse, error) {
+	market, err := g.ig.GetMarkets(epic)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.currencies == nil {
+		g.currencies = make(map[string]Currency)
+	}
+	for _, c := range market.Instrument.Currencies {
+		g.currencies[c.Code] = c
+	}
+	return market, nil
+}
+
+// seenCurrency - true if the rate of the currency code was seen
+func (g *RiskGuard) seenCurrency(code string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.currencies[code]
+	return ok
+}
+
+// seenCurrencies - currencies of the markets the guard got so far
+func (g *RiskGuard) seenCurrencies() []Currency {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	currencies := make([]Currency, 0, len(g.currencies))
+	for _, c := range g.currencies {
+		currencies = append(currencies, c)
+	}
+	return currencies
+}
+
+// currencySymbols - codes of the currency symbols IG may use in transactions
+var currencySymbols = map[string]string{
+	"£": "GBP",
+	"$": "USD",
+	"€": "EUR",
+	"E": "EUR",
+	"¥": "JPY",
+}
+
+// transactionExchangeRate - rate of the profit of t to accountCurrency, from
+// the rates of currencies. t is in the account currency when its currency is
+// not given.
+func transactionExchangeRate(t Transaction, accountCurrency string, currencies []Currency) (float64, error) {
+	code := strings.TrimSpace(t.Currency)
+	if c, ok := currencySymbols[code]; ok {
+		code = c
+	}
+	if code == "" || code == accountCurrency {
+		return 1, nil
+	}
+
+	for _, c := range currencies {
+		if c.Code == code || (c.Symbol != "" && c.Symbol == t.Currency) {
+			return accountExchangeRate(c, accountCurrency)
+		}
+	}
+	return 0, fmt.Errorf("igmarkets: risk guard has no rate from %s to %s for deal %s", t.Currency, accountCurrency, t.Reference)
+}
+
+// positionProfit - profit of position closed at the current price, in
+// accountCurrency
+func positionProfit(market *MarketsResponse, position Position, accountCurrency string) (float64, error) {
+	p := position.Position
+
+	currency, err := dealCurrency(market, p.Currency)
+	if err != nil {
+		return 0, err
+	}
+	rate, err := accountExchangeRate(currency, accountCurrency)
+	if err != nil {
+		return 0, err
+	}
+	value, err := position.pointValue(market)
+	if err != nil {
+		return 0, err
+	}
+
+	level := closePrice(&position, market)
+	if level == 0 {
+		return 0, fmt.Errorf("igmarkets: no price to value %s at", position.MarketData.Epic)
+	}
+	return (level - p.Level) * stopSign(p.Direction) * p.Size * value * rate, nil
+}
+
+// parseProfitAndLoss - amount of a transaction profitAndLoss, e.g. "E-12.50"
+// or "£1,204.10", the currency prefix is dropped
+func parseProfitAndLoss(s string) (float64, error) {
+	amount := strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return -1
+	}, s)
+	if amount == "" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return 0, fmt.Errorf("igmarkets: invalid profit and loss %q", s)
+	}
+	return v, nil
+}
+
+// flatten - close every position and delete every working order
+func (g *RiskGuard) flatten() error {
+	closes, err := g.ig.CloseAllPositions(context.Background(), 0)
+
+	g.mu.Lock()
+	g.status.Flatten = closes
+	g.mu.Unlock()
+
+	orders, werr := g.ig.GetOTCWorkingOrders()
+	if werr != nil {
+		if err == nil {
+			err = werr
+		}
+		return err
+	}
+	for _, o := range orders.WorkingOrders {
+		if werr := g.ig.DeleteOTCWorkingOrder(o.WorkingOrderData.DealID); werr != nil && !IsNotFound(werr) && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
@@ -0,0 +1,528 @@
+package igmarkets_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+	"github.com/amaurybrisou/igmarkets/igmarketstest"
+)
+
+// newRiskClient - paper client of a USD account
+func newRiskClient(t *testing.T) (*igmarkets.IGMarkets, *igmarkets.PaperBroker) {
+	t.Helper()
+
+	srv, ig, paper := newPaperClient(t)
+	srv.Mux.HandleFunc("/gateway/deal/accounts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"accounts":[{"accountId":"ABC123","currency":"USD","balance":{"available":5000,"balance":6000}}]}`))
+	})
+	srv.Mux.HandleFunc("/gateway/deal/history/transactions", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("paper transactions asked to IG")
+	})
+	return ig, paper
+}
+
+func TestRiskGuardCheckOrder(t *testing.T) {
+	buy := paperOrder(igmarkets.DirectionBuy, 1, true)
+	buy2 := paperOrder(igmarkets.DirectionBuy, 2, true)
+	sell := paperOrder(igmarkets.DirectionSell, 1, false)
+	forcedSell := paperOrder(igmarkets.DirectionSell, 1, true)
+	other := paperOrder(igmarkets.DirectionBuy, 1, true)
+	other.Epic = "OTHER"
+
+	tests := []struct {
+		name   string
+		open   []igmarkets.OTCOrderRequest // before the guard
+		limits igmarkets.RiskLimits
+		trip   bool
+		orders []igmarkets.OTCOrderRequest
+		rule   string // blocking the last order, "" if placed
+	}{
+		{
+			name:   "no limit",
+			orders: []igmarkets.OTCOrderRequest{buy},
+		},
+		{
+			name:   "epic not allowed",
+			limits: igmarkets.RiskLimits{AllowedEpics: []string{"FX"}},
+			orders: []igmarkets.OTCOrderRequest{other},
+			rule:   "allowedEpics",
+		},
+		{
+			name:   "epic allowed",
+			limits: igmarkets.RiskLimits{AllowedEpics: []string{"FX"}},
+			orders: []igmarkets.OTCOrderRequest{buy},
+		},
+		{
+			name:   "open positions",
+			open:   []igmarkets.OTCOrderRequest{buy},
+			limits: igmarkets.RiskLimits{MaxOpenPositions: 1},
+			orders: []igmarkets.OTCOrderRequest{buy},
+			rule:   "maxOpenPositions",
+		},
+		{
+			name:   "size per epic",
+			open:   []igmarkets.OTCOrderRequest{buy2},
+			limits: igmarkets.RiskLimits{MaxSizePerEpic: 3},
+			orders: []igmarkets.OTCOrderRequest{buy2},
+			rule:   "maxSizePerEpic",
+		},
+		{
+			name:   "size per epic netted",
+			open:   []igmarkets.OTCOrderRequest{buy2},
+			limits: igmarkets.RiskLimits{MaxSizePerEpic: 3},
+			orders: []igmarkets.OTCOrderRequest{paperOrder(igmarkets.DirectionSell, 4, true)},
+		},
+		{
+			name:   "exposure",
+			limits: igmarkets.RiskLimits{MaxExposure: 10000},
+			orders: []igmarkets.OTCOrderRequest{paperOrder(igmarkets.DirectionBuy, 100, true)},
+			rule:   "maxExposure",
+		},
+		{
+			name:   "orders per minute",
+			limits: igmarkets.RiskLimits{MaxOrdersPerMinute: 2},
+			orders: []igmarkets.OTCOrderRequest{buy, buy, buy},
+			rule:   "maxOrdersPerMinute",
+		},
+		{
+			name:   "tripped",
+			trip:   true,
+			orders: []igmarkets.OTCOrderRequest{buy},
+			rule:   "tripped",
+		},
+		{
+			name:   "reducing order bypasses the limits",
+			open:   []igmarkets.OTCOrderRequest{buy2},
+			limits: igmarkets.RiskLimits{AllowedEpics: []string{"OTHER"}, MaxOpenPositions: 1, MaxOrdersPerMinute: 1},
+			trip:   true,
+			orders: []igmarkets.OTCOrderRequest{sell, sell},
+		},
+		{
+			name:   "forced open is new risk",
+			open:   []igmarkets.OTCOrderRequest{buy2},
+			limits: igmarkets.RiskLimits{MaxOpenPositions: 1},
+			orders: []igmarkets.OTCOrderRequest{forcedSell},
+			rule:   "maxOpenPositions",
+		},
+		{
+			name:   "order larger than the position is new risk",
+			open:   []igmarkets.OTCOrderRequest{buy},
+			limits: igmarkets.RiskLimits{MaxSizePerEpic: 1.5},
+			orders: []igmarkets.OTCOrderRequest{paperOrder(igmarkets.DirectionSell, 3, false)},
+			rule:   "maxSizePerEpic",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ig, _ := newRiskClient(t)
+			for _, o := range tt.open {
+				if _, err := ig.PlaceOTCOrder(o); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			guard := ig.EnableRiskGuard(tt.limits)
+			if tt.trip {
+				if err := guard.Trip("test"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var err error
+			for i, o := range tt.orders {
+				_, err = ig.PlaceOTCOrder(o)
+				if i < len(tt.orders)-1 && err != nil {
+					t.Fatalf("order %d: %v", i, err)
+				}
+			}
+
+			switch riskErr, _ := err.(*igmarkets.RiskError); {
+			case tt.rule == "" && err != nil:
+				t.Fatalf("order blocked: %v", err)
+			case tt.rule != "" && riskErr == nil:
+				t.Fatalf("got %v, want a RiskError %s", err, tt.rule)
+			case tt.rule != "" && riskErr.Rule != tt.rule:
+				t.Fatalf("blocked by %s, want %s", riskErr.Rule, tt.rule)
+			}
+		})
+	}
+}
+
+func TestRiskGuardWorkingOrderIsNewRisk(t *testing.T) {
+	ig, _ := newRiskClient(t)
+	if _, err := ig.PlaceOTCOrder(paperOrder(igmarkets.DirectionBuy, 1, true)); err != nil {
+		t.Fatal(err)
+	}
+	ig.EnableRiskGuard(igmarkets.RiskLimits{MaxOpenPositions: 1})
+
+	_, err := ig.PlaceOTCWorkingOrder(igmarkets.OTCWorkingOrderRequest{
+		Epic:         "FX",
+		Direction:    igmarkets.DirectionSell,
+		Size:         1,
+		Level:        95,
+		Type:         igmarkets.WorkingOrderTypeStop,
+		TimeInForce:  igmarkets.TimeInForceGoodTillCancelled,
+		CurrencyCode: "USD",
+		Expiry:       "-",
+	})
+	if !igmarkets.IsRiskBlocked(err) {
+		t.Fatalf("got %v, want a RiskError", err)
+	}
+}
+
+func TestRiskGuardKillFile(t *testing.T) {
+	ig, _ := newRiskClient(t)
+	kill := filepath.Join(t.TempDir(), "kill")
+	guard := ig.EnableRiskGuard(igmarkets.RiskLimits{KillFile: kill})
+
+	buy := paperOrder(igmarkets.DirectionBuy, 1, true)
+	if _, err := ig.PlaceOTCOrder(buy); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(kill, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ig.PlaceOTCOrder(buy)
+	if riskErr, ok := err.(*igmarkets.RiskError); !ok || riskErr.Rule != "tripped" || !strings.Contains(riskErr.Reason, kill) {
+		t.Fatalf("got %v, want the kill file to trip the guard", err)
+	}
+	if err := guard.Reset(); err == nil {
+		t.Fatal("reset with the kill file present")
+	}
+
+	if err := os.Remove(kill); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ig.PlaceOTCOrder(buy); err != nil {
+		t.Fatalf("order after reset: %v", err)
+	}
+}
+
+func TestRiskGuardTrippedUpdates(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  *igmarkets.OTCUpdateOrderRequest
+		working *igmarkets.OTCWorkingOrderUpdateRequest
+		blocked bool
+	}{
+		// BUY at 101, stop 90 and limit 120
+		{name: "stop tightened", update: &igmarkets.OTCUpdateOrderRequest{StopLevel: "95", LimitLevel: "120"}},
+		{name: "stop distance tightened", update: &igmarkets.OTCUpdateOrderRequest{StopDistance: "5", LimitLevel: "120"}},
+		{name: "limit removed", update: &igmarkets.OTCUpdateOrderRequest{StopLevel: "90"}},
+		{name: "limit moved", update: &igmarkets.OTCUpdateOrderRequest{StopLevel: "90", LimitLevel: "130"}},
+		{name: "stop loosened", update: &igmarkets.OTCUpdateOrderRequest{StopLevel: "85", LimitLevel: "120"}, blocked: true},
+		{name: "stop distance loosened", update: &igmarkets.OTCUpdateOrderRequest{StopDistance: "15", LimitLevel: "120"}, blocked: true},
+		{name: "stop removed", update: &igmarkets.OTCUpdateOrderRequest{LimitLevel: "120"}, blocked: true},
+
+		// BUY STOP at 110, stop 10 points below
+		{name: "working order stop tightened", working: &igmarkets.OTCWorkingOrderUpdateRequest{StopDistance: "5"}},
+		{name: "working order stop level tightened", working: &igmarkets.OTCWorkingOrderUpdateRequest{StopLevel: "102"}},
+		{name: "working order stop loosened", working: &igmarkets.OTCWorkingOrderUpdateRequest{StopLevel: "95"}, blocked: true},
+		{name: "working order stop removed", working: &igmarkets.OTCWorkingOrderUpdateRequest{}, blocked: true},
+		{name: "working order level moved", working: &igmarkets.OTCWorkingOrderUpdateRequest{Level: 111, StopDistance: "10"}, blocked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ig, _ := newRiskClient(t)
+
+			order := paperOrder(igmarkets.DirectionBuy, 1, true)
+			order.StopLevel, order.LimitLevel = "90", "120"
+			if _, err := ig.PlaceOTCOrder(order); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ig.PlaceOTCWorkingOrder(igmarkets.OTCWorkingOrderRequest{
+				Epic:         "FX",
+				Direction:    igmarkets.DirectionBuy,
+				Size:         1,
+				Level:        110,
+				Type:         igmarkets.WorkingOrderTypeStop,
+				TimeInForce:  igmarkets.TimeInForceGoodTillCancelled,
+				CurrencyCode: "USD",
+				Expiry:       "-",
+				StopDistance: "10",
+			}); err != nil {
+				t.Fatal(err)
+			}
+			positions, _ := ig.GetPositions()
+			orders, _ := ig.GetOTCWorkingOrders()
+
+			guard := ig.EnableRiskGuard(igmarkets.RiskLimits{})
+			if err := guard.Trip("test"); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			if tt.update != nil {
+				_, err = ig.UpdateOTCOrder(positions.Positions[0].Position.DealID, *tt.update)
+			} else {
+				update := *tt.working
+				if update.Level == 0 {
+					update.Level = 110
+				}
+				update.Type = igmarkets.WorkingOrderTypeStop
+				update.TimeInForce = igmarkets.TimeInForceGoodTillCancelled
+				_, err = ig.UpdateOTCWorkingOrder(orders.WorkingOrders[0].WorkingOrderData.DealID, update)
+			}
+
+			if blocked := igmarkets.IsRiskBlocked(err); blocked != tt.blocked {
+				t.Fatalf("blocked %v, want %v: %v", blocked, tt.blocked, err)
+			}
+			if err != nil && !tt.blocked {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRiskGuardDailyLoss(t *testing.T) {
+	ig, paper := newRiskClient(t)
+	if _, err := ig.PlaceOTCOrder(paperOrder(igmarkets.DirectionBuy, 2, true)); err != nil {
+		t.Fatal(err)
+	}
+	guard := ig.EnableRiskGuard(igmarkets.RiskLimits{MaxDailyLoss: 100})
+
+	// unrealised -20 at the bid of 100
+	if err := guard.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if s := guard.Status(); s.RealisedProfit != 0 || s.UnrealisedProfit != -20 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+
+	// a loss realised on paper only
+	paper.SetQuote("FX", 90, 91)
+	positions, _ := ig.GetPositions()
+	if _, err := ig.CloseOTCPosition(igmarkets.OTCPositionCloseRequest{
+		DealID:    positions.Positions[0].Position.DealID,
+		Direction: igmarkets.DirectionSell,
+		Size:      2,
+		OrderType: igmarkets.OrderTypeMarket,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := guard.Check(); !igmarkets.IsRiskBlocked(err) {
+		t.Fatalf("paper loss of 220 did not trip the guard: %v", err)
+	}
+	if s := guard.Status(); s.RealisedProfit != -220 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+}
+
+func TestRiskGuardCountsOrdersInFlight(t *testing.T) {
+	// IG accepts the orders but the positions do not show yet
+	srv := igmarketstest.NewServer("")
+	t.Cleanup(srv.Close)
+	srv.Mux.HandleFunc("/gateway/deal/positions/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"positions":[]}`))
+	})
+	var mu sync.Mutex
+	sent := 0
+	srv.Mux.HandleFunc("/gateway/deal/positions/otc", func(w http.ResponseWriter, r *http.Request) {
+		var order igmarkets.OTCOrderRequest
+		json.NewDecoder(r.Body).Decode(&order)
+		mu.Lock()
+		sent++
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintf(w, `{"dealReference":%q}`, order.DealReference)
+	})
+	srv.Mux.HandleFunc("/gateway/deal/confirms/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"dealReference":%q,"dealStatus":"REJECTED","reason":"INSUFFICIENT_FUNDS"}`, path.Base(r.URL.Path))
+	})
+
+	ig := srv.NewClient(false)
+	ig.EnableRiskGuard(igmarkets.RiskLimits{MaxOpenPositions: 1, MaxSizePerEpic: 1})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	refs := make(chan string, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ref, err := ig.PlaceOTCOrder(paperOrder(igmarkets.DirectionBuy, 1, true))
+			if err != nil {
+				errs <- err
+				return
+			}
+			refs <- ref.DealReference
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(refs)
+
+	for err := range errs {
+		if !igmarkets.IsRiskBlocked(err) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if len(refs) != 1 || sent != 1 {
+		t.Fatalf("%d orders placed, %d sent, want 1", len(refs), sent)
+	}
+
+	// a rejected order is no longer counted
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := ig.WaitForDealConfirmation(ctx, <-refs); err == nil {
+		t.Fatal("rejection not returned")
+	}
+	if _, err := ig.PlaceOTCOrder(paperOrder(igmarkets.DirectionBuy, 1, true)); err != nil {
+		t.Fatalf("order blocked by a rejected one: %v", err)
+	}
+}
+
+func TestRiskGuardConcurrentPaperOrders(t *testing.T) {
+	ig, _ := newRiskClient(t)
+	ig.EnableRiskGuard(igmarkets.RiskLimits{MaxSizePerEpic: 3})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ig.PlaceOTCOrder(paperOrder(igmarkets.DirectionBuy, 1, true))
+			if err != nil && !igmarkets.IsRiskBlocked(err) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := paperPositions(t, ig); len(got) != 3 {
+		t.Fatalf("%d positions open, at most 3: %+v", len(got), got)
+	}
+}
+
+func TestRiskGuardDailyLossCurrency(t *testing.T) {
+	tests := []struct {
+		name       string
+		currencies string // of the market
+		realised   float64
+		err        bool
+	}{
+		{
+			name:       "converted with the base rate",
+			currencies: `[{"code":"USD","baseExchangeRate":1.25,"isDefault":true}]`,
+			realised:   -176, // -220 USD at 1.25 USD per EUR
+		},
+		{
+			name:       "no rate",
+			currencies: `[{"code":"USD","isDefault":true}]`,
+			err:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := igmarketstest.NewServer("")
+			t.Cleanup(srv.Close)
+			srv.Mux.HandleFunc("/gateway/deal/accounts", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"accounts":[{"accountId":"ABC123","currency":"EUR","balance":{"available":5000,"balance":6000}}]}`))
+			})
+			srv.Mux.HandleFunc("/gateway/deal/markets/FX", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"instrument":{"epic":"FX","valueOfOnePip":"10.00","contractSize":"1",` +
+					`"marginFactor":5,"marginFactorUnit":"PERCENTAGE","currencies":` + tt.currencies + `},` +
+					`"snapshot":{"marketStatus":"TRADEABLE","bid":100,"offer":101}}`))
+			})
+
+			ig := srv.NewClient(false)
+			paper := ig.EnablePaperTrading()
+			paper.SetQuote("FX", 100, 101)
+			guard := ig.EnableRiskGuard(igmarkets.RiskLimits{MaxDailyLoss: 1000})
+
+			// the guard sees the rates of FX on the order, the deal is closed
+			// before the next check
+			if _, err := ig.PlaceOTCOrder(paperOrder(igmarkets.DirectionBuy, 2, true)); err != nil {
+				t.Fatal(err)
+			}
+			paper.SetQuote("FX", 90, 91)
+			positions, _ := ig.GetPositions()
+			if _, err := ig.CloseOTCPosition(igmarkets.OTCPositionCloseRequest{
+				DealID:    positions.Positions[0].Position.DealID,
+				Direction: igmarkets.DirectionSell,
+				Size:      2,
+				OrderType: igmarkets.OrderTypeMarket,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := guard.Check()
+			if tt.err {
+				if err == nil {
+					t.Fatal("USD deal summed into a EUR account without a rate")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := guard.Status(); math.Abs(s.RealisedProfit-tt.realised) > 1e-9 {
+				t.Fatalf("realised %g, want %g", s.RealisedProfit, tt.realised)
+			}
+		})
+	}
+}
+
+func TestRiskGuardFlattenOnTrip(t *testing.T) {
+	ig, _ := newRiskClient(t)
+	for _, o := range []igmarkets.OTCOrderRequest{
+		paperOrder(igmarkets.DirectionBuy, 1, true),
+		paperOrder(igmarkets.DirectionSell, 2, true),
+	} {
+		if _, err := ig.PlaceOTCOrderAndConfirm(context.Background(), o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ig.PlaceOTCWorkingOrder(igmarkets.OTCWorkingOrderRequest{
+		Epic:         "FX",
+		Direction:    igmarkets.DirectionBuy,
+		Size:         1,
+		Level:        110,
+		Type:         igmarkets.WorkingOrderTypeStop,
+		TimeInForce:  igmarkets.TimeInForceGoodTillCancelled,
+		CurrencyCode: "USD",
+		Expiry:       "-",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	guard := ig.EnableRiskGuard(igmarkets.RiskLimits{FlattenOnTrip: true})
+	var trips []igmarkets.RiskStatus
+	guard.OnTrip = func(s igmarkets.RiskStatus) { trips = append(trips, s) }
+
+	if err := guard.Trip("test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.Trip("again"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(trips) != 1 || trips[0].Reason != "test" || len(trips[0].Flatten) != 2 {
+		t.Fatalf("unexpected trips %+v", trips)
+	}
+	positions, _ := ig.GetPositions()
+	orders, _ := ig.GetOTCWorkingOrders()
+	if len(positions.Positions) != 0 || len(orders.WorkingOrders) != 0 {
+		t.Fatalf("%d positions and %d working orders left", len(positions.Positions), len(orders.WorkingOrders))
+	}
+}
@@ -0,0 +1,227 @@
+package igmarkets
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SizingRequest - risk to take on a market, the stop is set either as a
+// distance in points or as a level
+type SizingRequest struct {
+	Direction       Direction
+	AccountCurrency string
+	// Currency - currency of the deal, the default one of the market when empty
+	Currency string
+
+	// RiskAmount - loss at the stop in the account currency, RiskPercent of
+	// Equity when 0
+	RiskAmount  float64
+	RiskPercent float64
+	Equity      float64
+
+	StopDistance float64 // points
+	StopLevel    float64 // used when StopDistance is 0
+	// EntryLevel - level of a working order, the offer for BUY and the bid
+	// for SELL when 0
+	EntryLevel float64
+
+	// SizeStep - increment of the deal size, the precision of the minimum
+	// deal size when 0
+	SizeStep float64
+}
+
+// Sizing - deal size for a SizingRequest and the figures it was computed with
+type Sizing struct {
+	Size    float64 `json:"size"`    // rounded down to SizeStep
+	RawSize float64 `json:"rawSize"` // before rounding
+
+	RiskAmount float64 `json:"riskAmount"` // requested, in the account currency
+	Risk       float64 `json:"risk"`       // taken with Size, in the account currency
+
+	EntryLevel   float64 `json:"entryLevel"`
+	StopDistance float64 `json:"stopDistance"`
+
+	Currency        string  `json:"currency"`
+	AccountCurrency string  `json:"accountCurrency"`
+	ExchangeRate    float64 `json:"exchangeRate"`    // account currency for one unit of Currency
+	ValueOfOnePoint float64 `json:"valueOfOnePoint"` // per unit of size, in Currency
+	ValuePerPoint   float64 `json:"valuePerPoint"`   // of Size, in the account currency
+
+	SizeStep    float64 `json:"sizeStep"`
+	MinDealSize float64 `json:"minDealSize"`
+
+	// Assumptions - how the market details were read
+	Assumptions []string `json:"assumptions"`
+}
+
+func (s *Sizing) assume(format string, args ...interface{}) {
+	s.Assumptions = append(s.Assumptions, fmt.Sprintf(format, args...))
+}
+
+// SizePosition - size losing RiskAmount in the account currency if the stop
+// is hit. The size is rounded down to the size step, an error is returned
+// with the sizing when it is below the minimum deal size.
+func SizePosition(market *MarketsResponse, r SizingRequest) (*Sizing, error) {
+	s := &Sizing{AccountCurrency: r.AccountCurrency, RiskAmount: r.RiskAmount}
+
+	if !r.Direction.Valid() {
+		return nil, fmt.Errorf("igmarkets: invalid direction %q", r.Direction)
+	}
+
+	if s.RiskAmount == 0 {
+		if r.RiskPercent <= 0 || r.Equity <= 0 {
+			return nil, fmt.Errorf("igmarkets: risk amount, or risk percent and equity, are required")
+		}
+		s.RiskAmount = r.Equity * r.RiskPercent / 100
+		s.assume("risk %g%% of equity %g", r.RiskPercent, r.Equity)
+	}
+	if s.RiskAmount <= 0 {
+		return nil, fmt.Errorf("igmarkets: risk amount must be positive")
+	}
+
+	s.EntryLevel = r.EntryLevel
+	if s.EntryLevel == 0 {
+		s.EntryLevel = market.Snapshot.Offer
+		if r.Direction == DirectionSell {
+			s.EntryLevel = market.Snapshot.Bid
+		}
+		s.assume("entry at the current %s price %g", r.Direction, s.EntryLevel)
+	}
+
+	s.StopDistance = r.StopDistance
+	if s.StopDistance == 0 && r.StopLevel != 0 {
+		d := (s.EntryLevel - r.StopLevel) * stopSign(r.Direction)
+		if d <= 0 {
+			return nil, fmt.Errorf("igmarkets: stop level %g is on the wrong side of %g", r.StopLevel, s.EntryLevel)
+		}
+		point := pointSize(market)
+		s.StopDistance = math.Round(d/point*1e6) / 1e6
+		if point != 1 {
+			s.assume("stop level %g is %g points away, %g price per point", r.StopLevel, s.StopDistance, point)
+		}
+	}
+	if s.StopDistance <= 0 {
+		return nil, fmt.Errorf("igmarkets: stop distance or stop level is required")
+	}
+
+	currency, err := dealCurrency(market, r.Currency)
+	if err != nil {
+		return nil, err
+	}
+	s.Currency = currency.Code
+
+	s.ExchangeRate, err = accountExchangeRate(currency, r.AccountCurrency)
+	if err != nil {
+		return nil, err
+	}
+	if s.Currency != r.AccountCurrency {
+		s.assume("1 %s = %g %s", s.Currency, s.ExchangeRate, r.AccountCurrency)
+	}
+
+	s.ValueOfOnePoint, err = valueOfOnePoint(market.Instrument, s.Currency, s.assume)
+	if err != nil {
+		return nil, err
+	}
+
+	riskPerSize := s.StopDistance * s.ValueOfOnePoint * s.ExchangeRate
+	s.RawSize = s.RiskAmount / riskPerSize
+
+	s.MinDealSize = market.DealingRules.MinDealSize.Points(s.EntryLevel)
+	s.SizeStep = r.SizeStep
+	if s.SizeStep <= 0 {
+		s.SizeStep = sizeStep(s.MinDealSize)
+		s.assume("size step %g from the minimum deal size %g", s.SizeStep, s.MinDealSize)
+	}
+
+	// the epsilon keeps sizes like 0.3/0.1 from being rounded down a step
+	s.Size = math.Floor(s.RawSize/s.SizeStep+1e-9) * s.SizeStep
+	s.Size, _ = strconv.ParseFloat(strconv.FormatFloat(s.Size, 'f', stepDecimals(s.SizeStep), 64), 64)
+	s.ValuePerPoint = s.Size * s.ValueOfOnePoint * s.ExchangeRate
+	s.Risk = s.StopDistance * s.ValuePerPoint
+
+	if s.Size < s.MinDealSize {
+		return s, fmt.Errorf("igmarkets: risking %g %s over %g points needs a size of %g, below the minimum deal size %g",
+			s.RiskAmount, r.AccountCurrency, s.StopDistance, s.RawSize, s.MinDealSize)
+	}
+
+	return s, nil
+}
+
+// dealCurrency - currency code of market, the default one when code is empty
+func dealCurrency(market *MarketsResponse, code string) (Currency, error) {
+	currencies := market.Instrument.Currencies
+	for _, c := range currencies {
+		if (code == "" && c.IsDefault) || (code != "" && c.Code == code) {
+			return c, nil
+		}
+	}
+	if code == "" && len(currencies) > 0 {
+		return currencies[0], nil
+	}
+	return Currency{}, fmt.Errorf("igmarkets: currency %q not available on %s", code, market.Instrument.Epic)
+}
+
+// accountExchangeRate - amount in accountCurrency for one unit of c
+// IG gives the rate of a market currency against the account currency both
+// ways: exchangeRate in the account currency for one unit of c, and its
+// inverse baseExchangeRate in c for one unit of the account currency.
+func accountExchangeRate(c Currency, accountCurrency string) (float64, error) {
+	switch {
+	case c.Code == accountCurrency:
+		return 1, nil
+	case c.ExchangeRate > 0:
+		return c.ExchangeRate, nil
+	case c.BaseExchangeRate > 0:
+		return 1 / c.BaseExchangeRate, nil
+	}
+	return 0, fmt.Errorf("igmarkets: no exchange rate from %s to %s", c.Code, accountCurrency)
+}
+
+// valueOfOnePoint - value of a move of one point for a size of 1, in the
+// currency of the deal, how it was found is noted with assume
+func valueOfOnePoint(instrument Instrument, currency string, assume func(format string, args ...interface{})) (float64, error) {
+	if v, err := strconv.ParseFloat(strings.TrimSpace(instrument.ValueOfOnePip), 64); err == nil && v > 0 {
+		assume("one point is worth %g %s per unit of size (%s)", v, currency, instrument.OnePipMeans)
+		return v, nil
+	}
+
+	// contract size times the price move of one pip, e.g. "0.0001 USD/EUR"
+	contractSize, err := strconv.ParseFloat(strings.TrimSpace(instrument.ContractSize), 64)
+	if err != nil || contractSize <= 0 {
+		return 0, fmt.Errorf("igmarkets: no value of one pip nor contract size for %s", instrument.Epic)
+	}
+	pip := 1.0
+	if fields := strings.Fields(instrument.OnePipMeans); len(fields) > 0 {
+		if p, err := strconv.ParseFloat(fields[0], 64); err == nil && p > 0 {
+			pip = p
+		}
+	}
+	v := contractSize * pip
+	if instrument.LotSize > 0 {
+		v *= instrument.LotSize
+		assume("one point is worth contract size %s x lot size %g x pip %g = %g %s", instrument.ContractSize, instrument.LotSize, pip, v, currency)
+	} else {
+		assume("one point is worth contract size %s x pip %g = %g %s", instrument.ContractSize, pip, v, currency)
+	}
+	return v, nil
+}
+
+// sizeStep - smallest power of ten dividing min, 1 for whole sizes
+func sizeStep(min float64) float64 {
+	step := 1.0
+	for i := 0; i < 8 && min > 0 && math.Abs(min/step-math.Round(min/step)) > 1e-9; i++ {
+		step /= 10
+	}
+	return step
+}
+
+// stepDecimals - decimals of a size step
+func stepDecimals(step float64) int {
+	d := 0
+	for ; d < 8 && math.Abs(step-math.Round(step)) > 1e-9; d++ {
+		step *= 10
+	}
+	return d
+}
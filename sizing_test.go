@@ -0,0 +1,143 @@
+package igmarkets
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAccountExchangeRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		currency Currency
+		rate     float64
+		err      bool
+	}{
+		{"account currency", Currency{Code: "GBP", BaseExchangeRate: 2}, 1, false},
+		{"exchange rate", Currency{Code: "USD", ExchangeRate: 0.8}, 0.8, false},
+		{"inverse of the base rate", Currency{Code: "USD", BaseExchangeRate: 1.25}, 0.8, false},
+		{"both rates", Currency{Code: "USD", ExchangeRate: 0.8, BaseExchangeRate: 1.25}, 0.8, false},
+		{"no rate", Currency{Code: "USD"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rate, err := accountExchangeRate(tt.currency, "GBP")
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if math.Abs(rate-tt.rate) > 1e-12 {
+				t.Fatalf("rate %g, want %g", rate, tt.rate)
+			}
+		})
+	}
+}
+
+func TestSizePosition(t *testing.T) {
+	// EUR/USD, 10 USD a point for a size of 1
+	market := func(minDealSize float64) *MarketsResponse {
+		return &MarketsResponse{
+			DealingRules: DealingRules{MinDealSize: UnitValueFloat{Unit: UnitPoints, Value: minDealSize}},
+			Instrument: Instrument{
+				Epic:          "CS.D.EURUSD.CFD.IP",
+				ValueOfOnePip: "10",
+				Currencies:    []Currency{{Code: "USD", IsDefault: true, BaseExchangeRate: 1.25}},
+			},
+			Snapshot: Snapshot{Bid: 1.1, Offer: 1.1002, ScalingFactor: 10000},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		minDealSize float64
+		request     SizingRequest
+		size        float64
+		stop        float64 // points
+		risk        float64
+		err         bool
+	}{
+		{
+			name:        "rounded down to the step of the minimum size",
+			minDealSize: 0.1,
+			request:     SizingRequest{Direction: DirectionBuy, AccountCurrency: "USD", RiskAmount: 100, StopDistance: 15},
+			size:        0.6, // 100 / (15 x 10) = 0.666
+			stop:        15,
+			risk:        90,
+		},
+		{
+			name:        "whole sizes",
+			minDealSize: 1,
+			request:     SizingRequest{Direction: DirectionBuy, AccountCurrency: "USD", RiskAmount: 100, StopDistance: 4},
+			size:        2, // 2.5
+			stop:        4,
+			risk:        80,
+		},
+		{
+			name:        "exact multiple of the step",
+			minDealSize: 0.1,
+			request:     SizingRequest{Direction: DirectionBuy, AccountCurrency: "USD", RiskAmount: 30, StopDistance: 10},
+			size:        0.3, // 0.3/0.1 is below 3 in floating point
+			stop:        10,
+			risk:        30,
+		},
+		{
+			name:        "explicit step",
+			minDealSize: 0.1,
+			request:     SizingRequest{Direction: DirectionBuy, AccountCurrency: "USD", RiskAmount: 100, StopDistance: 15, SizeStep: 0.5},
+			size:        0.5,
+			stop:        15,
+			risk:        75,
+		},
+		{
+			name:        "stop level in points from the offer",
+			minDealSize: 0.1,
+			request:     SizingRequest{Direction: DirectionBuy, AccountCurrency: "USD", RiskAmount: 100, StopLevel: 1.0982},
+			size:        0.5,
+			stop:        20,
+			risk:        100,
+		},
+		{
+			name:        "sell stop level in points from the bid",
+			minDealSize: 0.1,
+			request:     SizingRequest{Direction: DirectionSell, AccountCurrency: "USD", RiskAmount: 100, StopLevel: 1.1025},
+			size:        0.4, // 100 / (25 x 10)
+			stop:        25,
+			risk:        100,
+		},
+		{
+			name:        "risk in another account currency",
+			minDealSize: 0.1,
+			request:     SizingRequest{Direction: DirectionBuy, AccountCurrency: "GBP", RiskAmount: 100, StopDistance: 20},
+			size:        0.6, // 100 / (20 x 10 x 0.8) = 0.625
+			stop:        20,
+			risk:        96,
+		},
+		{
+			name:        "below the minimum size",
+			minDealSize: 1,
+			request:     SizingRequest{Direction: DirectionBuy, AccountCurrency: "USD", RiskAmount: 10, StopDistance: 20},
+			stop:        20,
+			err:         true,
+		},
+		{
+			name:        "stop level on the wrong side",
+			minDealSize: 0.1,
+			request:     SizingRequest{Direction: DirectionSell, AccountCurrency: "USD", RiskAmount: 100, StopLevel: 1.09},
+			err:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := SizePosition(market(tt.minDealSize), tt.request)
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if s == nil {
+				return
+			}
+			if s.Size != tt.size || math.Abs(s.StopDistance-tt.stop) > 1e-9 || (!tt.err && math.Abs(s.Risk-tt.risk) > 1e-9) {
+				t.Fatalf("size %g, stop %g, risk %g, want %g, %g, %g", s.Size, s.StopDistance, s.Risk, tt.size, tt.stop, tt.risk)
+			}
+		})
+	}
+}
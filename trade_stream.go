@@ -0,0 +1,255 @@
+package igmarkets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets/lightstreamer"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// TradeStatusOpen - position or working order opened
+	TradeStatusOpen = "OPEN"
+	// TradeStatusUpdated - position or working order amended
+	TradeStatusUpdated = "UPDATED"
+	// TradeStatusDeleted - position closed or working order deleted
+	TradeStatusDeleted = "DELETED"
+)
+
+// PositionUpdate - OPU field of the trade stream
+type PositionUpdate struct {
+	DealReference  string    `json:"dealReference"`
+	DealID         string    `json:"dealId"`
+	DealIDOrigin   string    `json:"dealIdOrigin,omitempty"`
+	Direction      Direction `json:"direction"`
+	Epic           string    `json:"epic"`
+	Status         string    `json:"status"` // OPEN, UPDATED or DELETED
+	DealStatus     string    `json:"dealStatus"`
+	Level          float64   `json:"level"`
+	Size           float64   `json:"size"`
+	Currency       string    `json:"currency"`
+	Expiry         string    `json:"expiry"`
+	Timestamp      string    `json:"timestamp"`
+	StopLevel      float64   `json:"stopLevel,omitempty"`
+	LimitLevel     float64   `json:"limitLevel,omitempty"`
+	GuaranteedStop bool      `json:"guaranteedStop"`
+	Channel        string    `json:"channel"`
+}
+
+// WorkingOrderUpdate - WOU field of the trade stream
+type WorkingOrderUpdate struct {
+	DealReference  string           `json:"dealReference"`
+	DealID         string           `json:"dealId"`
+	Direction      Direction        `json:"direction"`
+	Epic           string           `json:"epic"`
+	Status         string           `json:"status"` // OPEN, UPDATED or DELETED
+	DealStatus     string           `json:"dealStatus"`
+	Level          float64          `json:"level"`
+	Size           float64          `json:"size"`
+	Currency       string           `json:"currency"`
+	Expiry         string           `json:"expiry"`
+	Timestamp      string           `json:"timestamp"`
+	OrderType      WorkingOrderType `json:"orderType"`
+	TimeInForce    TimeInForce      `json:"timeInForce"`
+	GoodTillDate   string           `json:"goodTillDate,omitempty"`
+	StopDistance   float64          `json:"stopDistance,omitempty"`
+	LimitDistance  float64          `json:"limitDistance,omitempty"`
+	GuaranteedStop bool             `json:"guaranteedStop"`
+	Channel        string           `json:"channel"`
+}
+
+// TradeUpdate - one of the fields of a trade stream update
+type TradeUpdate struct {
+	Confirm      *OTCDealConfirmation `json:"confirm,omitempty"`
+	Position     *PositionUpdate      `json:"position,omitempty"`
+	WorkingOrder *WorkingOrderUpdate  `json:"workingOrder,omitempty"`
+}
+
+// tradeFields - fields of the TRADE item, in TradeUpdate order
+var tradeFields = []string{"CONFIRMS", "OPU", "WOU"}
+
+// OpenTradeStream - deal confirmations, position and working order updates of
+// the account. Only the reconnection and state options of o are used.
+// While a trade stream is open, confirmations are also delivered to the
+// WaitForDealConfirmation calls. The update channel must be drained.
+// In paper trading mode the updates are the ones of the paper broker.
+func (ig *IGMarkets) OpenTradeStream(ctx context.Context, o LightStreamOptions) (<-chan TradeUpdate, <-chan error, error) {
+	if b := ig.paperBroker(); b != nil {
+		updates, errs := b.OpenTradeStream(ctx)
+		return updates, errs, nil
+	}
+
+	ig.RLock()
+	accountID := ig.AccountID
+	ig.RUnlock()
+
+	if accountID == "" {
+		return nil, nil, fmt.Errorf("igmarkets: account ID is required for the trade stream")
+	}
+
+	updates := make(chan TradeUpdate)
+	hub := ig.confirmHub()
+	hub.addStream()
+
+	sub := &lightstreamer.Subscription{
+		Items:  []string{LightStreamItem("TRADE", accountID, "")},
+		Fields: tradeFields,
+		Mode:   lightstreamer.ModeDistinct,
+	}
+
+	errChan := ig.startLightStream(ctx, o, sub, func(ctx context.Context) lightstreamer.Listener {
+		return &tradeListener{ctx: ctx, hub: hub, updates: updates}
+	}, func() {
+		hub.removeStream()
+		close(updates)
+	})
+
+	return updates, errChan, nil
+}
+
+// tradeListener - decodes the JSON fields of TRADE updates
+type tradeListener struct {
+	ctx     context.Context
+	hub     *confirmHub
+	updates chan<- TradeUpdate
+}
+
+func (l *tradeListener) OnUpdate(_ *lightstreamer.Subscription, u lightstreamer.Update) {
+	for i, value := range u.Values {
+		if !u.Changed[i] || value == "" {
+			continue
+		}
+
+		var update TradeUpdate
+		var err error
+
+		switch u.Fields[i] {
+		case "CONFIRMS":
+			update.Confirm = &OTCDealConfirmation{}
+			err = json.Unmarshal([]byte(value), update.Confirm)
+		case "OPU":
+			update.Position = &PositionUpdate{}
+			err = json.Unmarshal([]byte(value), update.Position)
+		case "WOU":
+			update.WorkingOrder = &WorkingOrderUpdate{}
+			err = json.Unmarshal([]byte(value), update.WorkingOrder)
+		default:
+			continue
+		}
+
+		if err != nil {
+			log.WithError(err).Errorf("igmarkets : unable to decode %s", u.Fields[i])
+			continue
+		}
+
+		if update.Confirm != nil {
+			l.hub.publish(update.Confirm)
+		}
+
+		select {
+		case l.updates <- update:
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
+
+// confirmHubRetention - how long stream confirmations are kept for the
+// WaitForDealConfirmation calls made after they arrived
+const confirmHubRetention = time.Minute
+
+// confirmHub - dispatches the confirmations of the trade streams by deal reference
+type confirmHub struct {
+	mu      sync.Mutex
+	streams int
+	waiters map[string][]chan *OTCDealConfirmation
+	recent  map[string]recentConfirm
+}
+
+type recentConfirm struct {
+	confirm *OTCDealConfirmation
+	time    time.Time
+}
+
+// confirmHub - created on first use
+func (ig *IGMarkets) confirmHub() *confirmHub {
+	ig.Lock()
+	defer ig.Unlock()
+
+	if ig.confirms == nil {
+		ig.confirms = &confirmHub{
+			waiters: make(map[string][]chan *OTCDealConfirmation),
+			recent:  make(map[string]recentConfirm),
+		}
+	}
+	return ig.confirms
+}
+
+func (h *confirmHub) addStream() {
+	h.mu.Lock()
+	h.streams++
+	h.mu.Unlock()
+}
+
+func (h *confirmHub) removeStream() {
+	h.mu.Lock()
+	h.streams--
+	h.mu.Unlock()
+}
+
+// publish - deliver c to its waiters and keep it for the late ones
+func (h *confirmHub) publish(c *OTCDealConfirmation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for ref, r := range h.recent {
+		if now.Sub(r.time) > confirmHubRetention {
+			delete(h.recent, ref)
+		}
+	}
+	h.recent[c.DealReference] = recentConfirm{confirm: c, time: now}
+
+	for _, w := range h.waiters[c.DealReference] {
+		w <- c
+	}
+	delete(h.waiters, c.DealReference)
+}
+
+// wait - channel receiving the confirmation of ref, nil without trade stream
+// cancel must be called once the confirmation is no longer awaited
+func (h *confirmHub) wait(ref string) (<-chan *OTCDealConfirmation, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.streams == 0 {
+		return nil, func() {}
+	}
+
+	w := make(chan *OTCDealConfirmation, 1)
+	if r, ok := h.recent[ref]; ok {
+		w <- r.confirm
+		return w, func() {}
+	}
+	h.waiters[ref] = append(h.waiters[ref], w)
+
+	return w, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		waiters := h.waiters[ref]
+		for i := range waiters {
+			if waiters[i] == w {
+				h.waiters[ref] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(h.waiters[ref]) == 0 {
+			delete(h.waiters, ref)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package igmarkets_test
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amaurybrisou/igmarkets"
+)
+
+func TestOpenTradeStream(t *testing.T) {
+	r := newStreamRig(t)
+	r.srv.Mux.HandleFunc("/gateway/deal/confirms/", func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, `{"errorCode":"error.confirms.deal-not-found"}`, http.StatusNotFound)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, _, err := r.ig.OpenTradeStream(ctx, r.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := "TRADE:" + r.srv.AccountID
+	wait, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if err := r.ls.WaitForSubscription(wait, item); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		values map[string]string
+		want   []igmarkets.TradeUpdate
+	}{
+		{
+			name:   "confirmation",
+			values: map[string]string{"CONFIRMS": `{"dealReference":"REF1","dealId":"DIAAA","dealStatus":"ACCEPTED"}`},
+			want: []igmarkets.TradeUpdate{{Confirm: &igmarkets.OTCDealConfirmation{
+				DealReference: "REF1", DealID: "DIAAA", DealStatus: igmarkets.DealStatusAccepted,
+			}}},
+		},
+		{
+			name:   "position",
+			values: map[string]string{"OPU": `{"dealReference":"REF2","dealId":"DIBBB","status":"OPEN","level":1.1,"size":2}`},
+			want: []igmarkets.TradeUpdate{{Position: &igmarkets.PositionUpdate{
+				DealReference: "REF2", DealID: "DIBBB", Status: igmarkets.TradeStatusOpen, Level: 1.1, Size: 2,
+			}}},
+		},
+		{
+			name:   "working order",
+			values: map[string]string{"WOU": `{"dealReference":"REF3","dealId":"DICCC","status":"DELETED","orderType":"STOP"}`},
+			want: []igmarkets.TradeUpdate{{WorkingOrder: &igmarkets.WorkingOrderUpdate{
+				DealReference: "REF3", DealID: "DICCC", Status: igmarkets.TradeStatusDeleted, OrderType: igmarkets.WorkingOrderTypeStop,
+			}}},
+		},
+		{
+			name: "undecodable field skipped",
+			values: map[string]string{
+				"CONFIRMS": `{"dealReference":`,
+				"WOU":      `{"dealReference":"REF4","dealId":"DIDDD","status":"UPDATED"}`,
+			},
+			want: []igmarkets.TradeUpdate{{WorkingOrder: &igmarkets.WorkingOrderUpdate{
+				DealReference: "REF4", DealID: "DIDDD", Status: igmarkets.TradeStatusUpdated,
+			}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.ls.Push(item, tt.values)
+			for _, want := range tt.want {
+				select {
+				case u := <-updates:
+					if !reflect.DeepEqual(u, want) {
+						t.Fatalf("update %+v, want %+v", u, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("no update")
+				}
+			}
+		})
+	}
+
+	// confirmations streamed before the wait are not polled for
+	confirmation, err := r.ig.WaitForDealConfirmation(ctx, "REF1")
+	if err != nil || confirmation.DealID != "DIAAA" {
+		t.Fatalf("confirmation %+v, error %v", confirmation, err)
+	}
+}
+
+func TestOpenTradeStreamWithoutAccount(t *testing.T) {
+	r := newStreamRig(t)
+	r.ig.AccountID = ""
+	if _, _, err := r.ig.OpenTradeStream(context.Background(), r.options()); err == nil {
+		t.Fatal("trade stream opened without account ID")
+	}
+}